@@ -0,0 +1,148 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// AlarmState is the persisted state of the leader's alarm
+type AlarmState struct {
+	State string
+	// Target is the armed state being armed into, or the armed state an entry delay or trigger interrupted
+	Target    string
+	ChangedAt time.Time
+	// Deadline is when an exit or entry delay ends, zero if no delay is running
+	Deadline time.Time
+}
+
+// AlarmTransition is an audit log entry for a change of alarm state
+type AlarmTransition struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+	// Source is who or what made the change, such as the API client's address
+	Source   string `json:"source"`
+	Zone     string `json:"zone,omitempty"`
+	DeviceID uint8  `json:"deviceID,omitempty"`
+	Sensor   string `json:"sensor,omitempty"`
+}
+
+// AlarmTransitionsFilter selects audit log entries in [From, To), newest first. A zero From or To leaves that end
+// of the range open. Before pages through results by returning only entries with a lower ID, and a Limit of 0
+// returns every match.
+type AlarmTransitionsFilter struct {
+	From   time.Time
+	To     time.Time
+	Before int64
+	Limit  int
+}
+
+// AlarmState returns the persisted alarm state, or false if the alarm has never changed state
+func (d *DB) AlarmState() (AlarmState, bool, error) {
+	log.Debug().Msg("db: AlarmState")
+	var (
+		st                    AlarmState
+		changedMs, deadlineMs int64
+	)
+	err := d.db.QueryRow(`select state, target, changed_ms, deadline_ms from alarm_state where id = 1`).
+		Scan(&st.State, &st.Target, &changedMs, &deadlineMs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AlarmState{}, false, nil
+	} else if err != nil {
+		return AlarmState{}, false, fmt.Errorf("AlarmState: %w", err)
+	}
+	st.ChangedAt = time.UnixMilli(changedMs)
+	if deadlineMs > 0 {
+		st.Deadline = time.UnixMilli(deadlineMs)
+	}
+
+	return st, true, nil
+}
+
+// SaveAlarmTransition stores the new alarm state together with its audit log entry
+func (d *DB) SaveAlarmTransition(st AlarmState, t AlarmTransition) error {
+	log.Debug().Str("from", t.From).Str("to", t.To).Msg("db: SaveAlarmTransition")
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("SaveAlarmTransition: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	var deadlineMs int64
+	if !st.Deadline.IsZero() {
+		deadlineMs = st.Deadline.UnixMilli()
+	}
+	if _, err := tx.Exec(`
+	insert into alarm_state(id, state, target, changed_ms, deadline_ms) values (1, ?, ?, ?, ?)
+	on conflict(id) do update set state = excluded.state, target = excluded.target,
+	    changed_ms = excluded.changed_ms, deadline_ms = excluded.deadline_ms`,
+		st.State, st.Target, st.ChangedAt.UnixMilli(), deadlineMs); err != nil {
+		return fmt.Errorf("SaveAlarmTransition: failed to save state: %w", err)
+	}
+	if _, err := tx.Exec(`
+	insert into alarm_audit(ts_ms, from_state, to_state, reason, source, zone, device_id, sensor)
+	values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Timestamp.UnixMilli(), t.From, t.To, t.Reason, t.Source, t.Zone, t.DeviceID, t.Sensor); err != nil {
+		return fmt.Errorf("SaveAlarmTransition: failed to write audit log: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// AlarmTransitions returns audit log entries matching f, newest first
+func (d *DB) AlarmTransitions(f AlarmTransitionsFilter) ([]AlarmTransition, error) {
+	log.Debug().Interface("filter", f).Msg("db: AlarmTransitions")
+	var (
+		where []string
+		args  []any
+	)
+	if !f.From.IsZero() {
+		where = append(where, "ts_ms >= ?")
+		args = append(args, f.From.UnixMilli())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "ts_ms < ?")
+		args = append(args, f.To.UnixMilli())
+	}
+	if f.Before > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.Before)
+	}
+
+	q := `select id, ts_ms, from_state, to_state, reason, source, zone, device_id, sensor from alarm_audit`
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	q += " order by id desc"
+	if f.Limit > 0 {
+		q += " limit ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := d.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("AlarmTransitions: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []AlarmTransition{}
+	for rows.Next() {
+		var (
+			t    AlarmTransition
+			tsMs int64
+		)
+		if err := rows.Scan(&t.ID, &tsMs, &t.From, &t.To, &t.Reason, &t.Source, &t.Zone, &t.DeviceID, &t.Sensor); err != nil {
+			return nil, fmt.Errorf("AlarmTransitions: failed to scan: %w", err)
+		}
+		t.Timestamp = time.UnixMilli(tsMs)
+		out = append(out, t)
+	}
+
+	return out, rows.Err()
+}
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a row to update or delete does not exist
+var ErrNotFound = errors.New("not found")
+
+// AlertRule is a condition on a metric which opens an alert while it holds
+type AlertRule struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// DeviceID limits the rule to one device. Nil applies it to every device reporting the metric.
+	DeviceID  *uint8 `json:"deviceID"`
+	Metric    string `json:"metric"`
+	Condition string `json:"condition"`
+	// Threshold is the value for above and below conditions, and the change within WindowSecs for rise and fall
+	Threshold float64 `json:"threshold"`
+	// Hysteresis is how far back past the threshold the value must go before an open alert resolves
+	Hysteresis float64 `json:"hysteresis"`
+	WindowSecs int     `json:"windowSecs"`
+	// ForSecs is how long the condition must hold before an alert opens
+	ForSecs int `json:"forSecs"`
+	// CooldownSecs is how long after an alert resolves before the rule may open another for the same device
+	CooldownSecs int `json:"cooldownSecs"`
+	// Disabled rules are kept but not evaluated
+	Disabled bool `json:"disabled"`
+	// Notifiers are the names of the notifiers the rule's alerts are sent to. Empty sends them to every notifier.
+	Notifiers []string `json:"notifiers"`
+}
+
+// Alert is an occurrence of an alert rule's condition on a device
+type Alert struct {
+	ID       int64  `json:"id"`
+	RuleID   int64  `json:"ruleID"`
+	RuleName string `json:"ruleName"`
+	DeviceID uint8  `json:"deviceID"`
+	Metric   string `json:"metric"`
+	State    string `json:"state"`
+	// Severity is warning or critical
+	Severity string `json:"severity"`
+	// Value is the value of the metric which opened the alert
+	Value float64 `json:"value"`
+	// Threshold is the rule's threshold when the alert opened, a change in value for rise and fall rules
+	Threshold float64 `json:"threshold"`
+	// Unit is the unit of Value and Threshold
+	Unit string `json:"unit"`
+	// Condition and WindowSecs are the rule's when the alert opened, and are blank for node offline alerts
+	Condition      string     `json:"condition,omitempty"`
+	WindowSecs     int        `json:"windowSecs,omitempty"`
+	Message        string     `json:"message"`
+	OpenedAt       time.Time  `json:"openedAt"`
+	AcknowledgedAt *time.Time `json:"acknowledgedAt,omitempty"`
+	ResolvedAt     *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// AlertsFilter selects alerts opened in [From, To), newest first. A zero From or To leaves that end of the range
+// open, and an empty States or DeviceIDs selects all of them. Before pages through results by returning only
+// alerts with a lower ID, and a Limit of 0 returns every match.
+type AlertsFilter struct {
+	From      time.Time
+	To        time.Time
+	States    []string
+	DeviceIDs []uint8
+	Before    int64
+	Limit     int
+}
+
+// AlertRules returns every alert rule
+func (d *DB) AlertRules() ([]AlertRule, error) {
+	log.Debug().Msg("db: AlertRules")
+	rows, err := d.db.Query(`
+	select id, name, device_id, metric, condition, threshold, hysteresis, window_secs, for_secs, cooldown_secs, disabled, notifiers
+	from alert_rules order by id`)
+	if err != nil {
+		return nil, fmt.Errorf("AlertRules: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []AlertRule{}
+	for rows.Next() {
+		var (
+			r         AlertRule
+			deviceID  sql.NullInt64
+			notifiers string
+		)
+		if err := rows.Scan(&r.ID, &r.Name, &deviceID, &r.Metric, &r.Condition, &r.Threshold, &r.Hysteresis,
+			&r.WindowSecs, &r.ForSecs, &r.CooldownSecs, &r.Disabled, &notifiers); err != nil {
+			return nil, fmt.Errorf("AlertRules: failed to scan: %w", err)
+		}
+		r.Notifiers = []string{}
+		if notifiers != "" {
+			r.Notifiers = strings.Split(notifiers, ",")
+		}
+		if deviceID.Valid {
+			id := uint8(deviceID.Int64)
+			r.DeviceID = &id
+		}
+		out = append(out, r)
+	}
+
+	return out, rows.Err()
+}
+
+// CreateAlertRule stores a new rule, returning it with its ID set
+func (d *DB) CreateAlertRule(r AlertRule) (AlertRule, error) {
+	log.Debug().Str("name", r.Name).Msg("db: CreateAlertRule")
+	res, err := d.db.Exec(`
+	insert into alert_rules(name, device_id, metric, condition, threshold, hysteresis, window_secs, for_secs, cooldown_secs, disabled, notifiers)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Name, r.DeviceID, r.Metric, r.Condition, r.Threshold, r.Hysteresis, r.WindowSecs, r.ForSecs, r.CooldownSecs, r.Disabled,
+		strings.Join(r.Notifiers, ","))
+	if err != nil {
+		return AlertRule{}, fmt.Errorf("CreateAlertRule: %w", err)
+	}
+	if r.ID, err = res.LastInsertId(); err != nil {
+		return AlertRule{}, fmt.Errorf("CreateAlertRule: %w", err)
+	}
+
+	return r, nil
+}
+
+// UpdateAlertRule replaces the rule with r.ID, returning ErrNotFound if there is none
+func (d *DB) UpdateAlertRule(r AlertRule) error {
+	log.Debug().Int64("id", r.ID).Msg("db: UpdateAlertRule")
+	res, err := d.db.Exec(`
+	update alert_rules set name = ?, device_id = ?, metric = ?, condition = ?, threshold = ?, hysteresis = ?,
+	    window_secs = ?, for_secs = ?, cooldown_secs = ?, disabled = ?, notifiers = ?
+	where id = ?`,
+		r.Name, r.DeviceID, r.Metric, r.Condition, r.Threshold, r.Hysteresis, r.WindowSecs, r.ForSecs, r.CooldownSecs, r.Disabled,
+		strings.Join(r.Notifiers, ","), r.ID)
+	if err != nil {
+		return fmt.Errorf("UpdateAlertRule: %w", err)
+	}
+
+	return requireRowAffected(res, "UpdateAlertRule")
+}
+
+// DeleteAlertRule deletes the rule with id, returning ErrNotFound if there is none. Its alerts are kept.
+func (d *DB) DeleteAlertRule(id int64) error {
+	log.Debug().Int64("id", id).Msg("db: DeleteAlertRule")
+	res, err := d.db.Exec(`delete from alert_rules where id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("DeleteAlertRule: %w", err)
+	}
+
+	return requireRowAffected(res, "DeleteAlertRule")
+}
+
+func requireRowAffected(res sql.Result, op string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrNotFound)
+	}
+
+	return nil
+}
+
+// OpenAlert stores a new alert, returning it with its ID set
+func (d *DB) OpenAlert(a Alert) (Alert, error) {
+	log.Debug().Int64("ruleID", a.RuleID).Uint8("deviceID", a.DeviceID).Msg("db: OpenAlert")
+	res, err := d.db.Exec(`
+	insert into alerts(rule_id, rule_name, device_id, metric, state, severity, value, threshold, unit, condition, window_secs,
+	                   message, opened_ms)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.RuleID, a.RuleName, a.DeviceID, a.Metric, a.State, a.Severity, a.Value, a.Threshold, a.Unit, a.Condition,
+		a.WindowSecs, a.Message, a.OpenedAt.UnixMilli())
+	if err != nil {
+		return Alert{}, fmt.Errorf("OpenAlert: %w", err)
+	}
+	if a.ID, err = res.LastInsertId(); err != nil {
+		return Alert{}, fmt.Errorf("OpenAlert: %w", err)
+	}
+
+	return a, nil
+}
+
+// EscalateAlert raises the severity of an active alert, replacing its value and message
+func (d *DB) EscalateAlert(id int64, severity string, value float64, message string) error {
+	log.Debug().Int64("id", id).Str("severity", severity).Msg("db: EscalateAlert")
+	res, err := d.db.Exec(`update alerts set severity = ?, value = ?, message = ? where id = ?`, severity, value, message, id)
+	if err != nil {
+		return fmt.Errorf("EscalateAlert: %w", err)
+	}
+
+	return requireRowAffected(res, "EscalateAlert")
+}
+
+// ResolveAlert sets the alert with id to state as of at
+func (d *DB) ResolveAlert(id int64, state string, at time.Time) error {
+	log.Debug().Int64("id", id).Msg("db: ResolveAlert")
+	res, err := d.db.Exec(`update alerts set state = ?, resolved_ms = ? where id = ?`, state, at.UnixMilli(), id)
+	if err != nil {
+		return fmt.Errorf("ResolveAlert: %w", err)
+	}
+
+	return requireRowAffected(res, "ResolveAlert")
+}
+
+// AcknowledgeAlert sets the alert with id to state as of at, if it is currently in one of from
+func (d *DB) AcknowledgeAlert(id int64, state string, from []string, at time.Time) error {
+	log.Debug().Int64("id", id).Msg("db: AcknowledgeAlert")
+	args := []any{state, at.UnixMilli(), id}
+	for _, s := range from {
+		args = append(args, s)
+	}
+	res, err := d.db.Exec(`update alerts set state = ?, acknowledged_ms = ? where id = ? and state in (`+placeholders(len(from))+`)`, args...)
+	if err != nil {
+		return fmt.Errorf("AcknowledgeAlert: %w", err)
+	}
+
+	return requireRowAffected(res, "AcknowledgeAlert")
+}
+
+// Alert returns the alert with id, or ErrNotFound
+func (d *DB) Alert(id int64) (Alert, error) {
+	log.Debug().Int64("id", id).Msg("db: Alert")
+	rows, err := d.db.Query(alertsQuery+` where id = ?`, id)
+	if err != nil {
+		return Alert{}, fmt.Errorf("Alert: failed to get rows: %w", err)
+	}
+	alerts, err := scanAlerts(rows)
+	if err != nil {
+		return Alert{}, fmt.Errorf("Alert: %w", err)
+	}
+	if len(alerts) == 0 {
+		return Alert{}, fmt.Errorf("Alert: %w", ErrNotFound)
+	}
+
+	return alerts[0], nil
+}
+
+const alertsQuery = `
+	select id, rule_id, rule_name, device_id, metric, state, severity, value, threshold, unit, condition, window_secs, message,
+	       opened_ms, acknowledged_ms, resolved_ms
+	from alerts`
+
+// Alerts returns stored alerts matching f, newest first
+func (d *DB) Alerts(f AlertsFilter) ([]Alert, error) {
+	log.Debug().Interface("filter", f).Msg("db: Alerts")
+	var (
+		where []string
+		args  []any
+	)
+	if !f.From.IsZero() {
+		where = append(where, "opened_ms >= ?")
+		args = append(args, f.From.UnixMilli())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "opened_ms < ?")
+		args = append(args, f.To.UnixMilli())
+	}
+	if len(f.States) > 0 {
+		where = append(where, "state in ("+placeholders(len(f.States))+")")
+		for _, s := range f.States {
+			args = append(args, s)
+		}
+	}
+	if len(f.DeviceIDs) > 0 {
+		where = append(where, "device_id in ("+placeholders(len(f.DeviceIDs))+")")
+		for _, id := range f.DeviceIDs {
+			args = append(args, id)
+		}
+	}
+	if f.Before > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.Before)
+	}
+
+	q := alertsQuery
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	q += " order by id desc"
+	if f.Limit > 0 {
+		q += " limit ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := d.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Alerts: failed to get rows: %w", err)
+	}
+	alerts, err := scanAlerts(rows)
+	if err != nil {
+		return nil, fmt.Errorf("Alerts: %w", err)
+	}
+
+	return alerts, nil
+}
+
+func scanAlerts(rows *sql.Rows) ([]Alert, error) {
+	defer rows.Close()
+
+	out := []Alert{}
+	for rows.Next() {
+		var (
+			a                   Alert
+			openedMs            int64
+			ackedMs, resolvedMs sql.NullInt64
+		)
+		if err := rows.Scan(&a.ID, &a.RuleID, &a.RuleName, &a.DeviceID, &a.Metric, &a.State, &a.Severity, &a.Value, &a.Threshold,
+			&a.Unit, &a.Condition, &a.WindowSecs, &a.Message, &openedMs, &ackedMs, &resolvedMs); err != nil {
+			return nil, fmt.Errorf("failed to scan: %w", err)
+		}
+		a.OpenedAt = time.UnixMilli(openedMs)
+		if ackedMs.Valid {
+			t := time.UnixMilli(ackedMs.Int64)
+			a.AcknowledgedAt = &t
+		}
+		if resolvedMs.Valid {
+			t := time.UnixMilli(resolvedMs.Int64)
+			a.ResolvedAt = &t
+		}
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
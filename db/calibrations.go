@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// Calibration corrects the values of one metric reported by one device
+type Calibration struct {
+	ID       int64  `json:"id"`
+	DeviceID uint8  `json:"deviceID"`
+	Metric   string `json:"metric"`
+	// Kind is offset, linear or two_point
+	Kind string `json:"kind"`
+	// Scale and Offset correct a raw value as raw*Scale + Offset. They are computed from the points of a two_point calibration.
+	Scale  float64 `json:"scale"`
+	Offset float64 `json:"offset"`
+	// RawLow, ActualLow, RawHigh and ActualHigh are the reference points of a two_point calibration
+	RawLow     float64   `json:"rawLow,omitempty"`
+	ActualLow  float64   `json:"actualLow,omitempty"`
+	RawHigh    float64   `json:"rawHigh,omitempty"`
+	ActualHigh float64   `json:"actualHigh,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Calibrations returns every calibration, ordered by device and metric
+func (d *DB) Calibrations() ([]Calibration, error) {
+	log.Debug().Msg("db: Calibrations")
+	rows, err := d.db.Query(`
+	select id, device_id, metric, kind, scale, offset_value, raw_low, actual_low, raw_high, actual_high, updated_ms
+	from calibrations order by device_id, metric`)
+	if err != nil {
+		return nil, fmt.Errorf("Calibrations: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []Calibration{}
+	for rows.Next() {
+		var (
+			c         Calibration
+			updatedMs int64
+		)
+		if err := rows.Scan(&c.ID, &c.DeviceID, &c.Metric, &c.Kind, &c.Scale, &c.Offset,
+			&c.RawLow, &c.ActualLow, &c.RawHigh, &c.ActualHigh, &updatedMs); err != nil {
+			return nil, fmt.Errorf("Calibrations: failed to scan: %w", err)
+		}
+		c.UpdatedAt = time.UnixMilli(updatedMs)
+		out = append(out, c)
+	}
+
+	return out, rows.Err()
+}
+
+// SetCalibration stores c as the calibration of its device and metric, replacing any existing one,
+// and returns it with its ID set
+func (d *DB) SetCalibration(c Calibration) (Calibration, error) {
+	log.Debug().Uint8("deviceID", c.DeviceID).Str("metric", c.Metric).Msg("db: SetCalibration")
+	if err := d.db.QueryRow(`
+	insert into calibrations(device_id, metric, kind, scale, offset_value, raw_low, actual_low, raw_high, actual_high, updated_ms)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	on conflict(device_id, metric) do update set kind = excluded.kind, scale = excluded.scale,
+	    offset_value = excluded.offset_value, raw_low = excluded.raw_low, actual_low = excluded.actual_low,
+	    raw_high = excluded.raw_high, actual_high = excluded.actual_high, updated_ms = excluded.updated_ms
+	returning id`,
+		c.DeviceID, c.Metric, c.Kind, c.Scale, c.Offset, c.RawLow, c.ActualLow, c.RawHigh, c.ActualHigh,
+		c.UpdatedAt.UnixMilli()).Scan(&c.ID); err != nil {
+		return Calibration{}, fmt.Errorf("SetCalibration: %w", err)
+	}
+
+	return c, nil
+}
+
+// DeleteCalibration deletes the calibration with id, returning ErrNotFound if there is none.
+// Stored values keep their correction until they are recalibrated.
+func (d *DB) DeleteCalibration(id int64) error {
+	log.Debug().Int64("id", id).Msg("db: DeleteCalibration")
+	res, err := d.db.Exec(`delete from calibrations where id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("DeleteCalibration: %w", err)
+	}
+
+	return requireRowAffected(res, "DeleteCalibration")
+}
+
+// Recalibrate rewrites the stored values of metric on deviceID in [from, to) as raw*scale + offset, returning
+// the number of values rewritten. A zero from or to leaves that end of the range open. Values stored before the
+// metric was ever calibrated are their own raw values, so they are kept as raw values first. Calibrated values
+// always have a raw value, as RecordCalibratedMeasurements stores both in one transaction.
+func (d *DB) Recalibrate(deviceID uint8, metric string, scale, offset float64, from, to time.Time) (int64, error) {
+	log.Debug().Uint8("deviceID", deviceID).Str("metric", metric).Msg("db: Recalibrate")
+	metricID, err := d.metricID(metric)
+	if err != nil {
+		return 0, fmt.Errorf("Recalibrate: %w", err)
+	}
+
+	where := []string{"device_id = ?", "metric_id = ?"}
+	args := []any{deviceID, metricID}
+	if !from.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, from.Unix())
+	}
+	if !to.IsZero() {
+		where = append(where, "ts < ?")
+		args = append(args, to.Unix())
+	}
+	clause := " where " + strings.Join(where, " and ")
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("Recalibrate: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+	insert or ignore into raw_measurements(device_id, metric_id, ts, value)
+	select device_id, metric_id, ts, value from measurements`+clause, args...); err != nil {
+		return 0, fmt.Errorf("Recalibrate: failed to keep raw values: %w", err)
+	}
+	res, err := tx.Exec(`
+	update measurements set value = (
+	    select r.value * ? + ? from raw_measurements r
+	    where r.device_id = measurements.device_id and r.metric_id = measurements.metric_id and r.ts = measurements.ts
+	)`+clause, append([]any{scale, offset}, args...)...)
+	if err != nil {
+		return 0, fmt.Errorf("Recalibrate: failed to update: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Recalibrate: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("Recalibrate: failed to commit: %w", err)
+	}
+
+	return n, nil
+}
@@ -7,11 +7,169 @@ import (
 	"github.com/Heanthor/quill-secure/node/sensor"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog/log"
-	"time"
+	"strings"
+	"sync"
 )
 
 type DB struct {
 	db *sql.DB
+
+	metricLock sync.Mutex
+	// metricIDs caches metric name to row ID
+	metricIDs map[string]int64
+}
+
+// schema is applied in order every time the database is opened, so each statement must be idempotent
+var schema = []string{`
+	create table if not exists metrics(
+	    id integer not null primary key,
+	    name text not null unique,
+	    unit text not null default '',
+	    sensor_type integer not null default 0
+	);`, `
+	create table if not exists measurements(
+	    device_id integer not null,
+	    metric_id integer not null references metrics(id),
+	    ts integer not null,
+	    value real not null,
+	    primary key (device_id, metric_id, ts)
+	) without rowid;`, `
+	create index if not exists idx_measurements_metric_timestamp on measurements(metric_id, ts);`, `
+	create index if not exists idx_measurements_timestamp on measurements(ts);`, `
+	create table if not exists sensor_errors(
+	    id integer not null primary key,
+	    device_id integer not null,
+	    sensor_type integer not null,
+	    sensor_name text not null,
+	    ts integer not null,
+	    message text not null,
+	    restarted integer not null default 0
+	);`, `
+	create index if not exists idx_sensor_errors_timestamp on sensor_errors(ts);`, `
+	create table if not exists events(
+	    id integer not null primary key,
+	    device_id integer not null,
+	    sensor text not null,
+	    kind text not null,
+	    state text not null,
+	    ts_ms integer not null,
+	    attributes text not null default '{}'
+	);`, `
+	create index if not exists idx_events_timestamp on events(ts_ms);`, `
+	create index if not exists idx_events_device_sensor on events(device_id, sensor);`, `
+	create table if not exists alarm_state(
+	    id integer not null primary key check (id = 1),
+	    state text not null,
+	    target text not null default '',
+	    changed_ms integer not null,
+	    deadline_ms integer not null default 0
+	);`, `
+	create table if not exists alarm_audit(
+	    id integer not null primary key,
+	    ts_ms integer not null,
+	    from_state text not null,
+	    to_state text not null,
+	    reason text not null,
+	    source text not null default '',
+	    zone text not null default '',
+	    device_id integer not null default 0,
+	    sensor text not null default ''
+	);`, `
+	create index if not exists idx_alarm_audit_timestamp on alarm_audit(ts_ms);`, `
+	create table if not exists alert_rules(
+	    id integer not null primary key,
+	    name text not null,
+	    device_id integer,
+	    metric text not null,
+	    condition text not null,
+	    threshold real not null,
+	    hysteresis real not null default 0,
+	    window_secs integer not null default 0,
+	    for_secs integer not null default 0,
+	    cooldown_secs integer not null default 0,
+	    disabled integer not null default 0
+	);`, `
+	create table if not exists alerts(
+	    id integer not null primary key,
+	    rule_id integer not null,
+	    rule_name text not null,
+	    device_id integer not null,
+	    metric text not null,
+	    state text not null,
+	    value real not null,
+	    message text not null,
+	    opened_ms integer not null,
+	    acknowledged_ms integer,
+	    resolved_ms integer
+	);`, `
+	create index if not exists idx_alerts_state on alerts(state);`, `
+	create table if not exists notification_deliveries(
+	    id integer not null primary key,
+	    alert_id integer not null,
+	    event text not null,
+	    notifier text not null,
+	    status text not null,
+	    attempts integer not null,
+	    error text not null default '',
+	    ts_ms integer not null
+	);`, `
+	create index if not exists idx_notification_deliveries_alert on notification_deliveries(alert_id);`, `
+	create table if not exists maintenance_windows(
+	    id integer not null primary key,
+	    device_id integer,
+	    start_ms integer not null,
+	    end_ms integer not null,
+	    reason text not null default ''
+	);`, `
+	create table if not exists calibrations(
+	    id integer not null primary key,
+	    device_id integer not null,
+	    metric text not null,
+	    kind text not null,
+	    scale real not null default 1,
+	    offset_value real not null default 0,
+	    raw_low real not null default 0,
+	    actual_low real not null default 0,
+	    raw_high real not null default 0,
+	    actual_high real not null default 0,
+	    updated_ms integer not null,
+	    unique (device_id, metric)
+	);`, `
+	create table if not exists raw_measurements(
+	    device_id integer not null,
+	    metric_id integer not null references metrics(id),
+	    ts integer not null,
+	    value real not null,
+	    primary key (device_id, metric_id, ts)
+	) without rowid;`, `
+	create table if not exists locations(
+	    id integer not null primary key,
+	    name text not null,
+	    kind text not null,
+	    parent_id integer references locations(id)
+	);`, `
+	create table if not exists assignments(
+	    device_id integer not null,
+	    sensor text not null default '',
+	    location_id integer references locations(id),
+	    labels text not null default '',
+	    primary key (device_id, sensor)
+	);`,
+}
+
+// column is a column added to a table after the table was first released
+type column struct {
+	table, name, definition string
+}
+
+// addedColumns are added to existing tables which lack them, after schema is applied
+var addedColumns = []column{
+	{"alert_rules", "notifiers", "text not null default ''"},
+	{"alerts", "severity", "text not null default 'warning'"},
+	{"alerts", "threshold", "real not null default 0"},
+	{"alerts", "unit", "text not null default ''"},
+	{"alerts", "condition", "text not null default ''"},
+	{"alerts", "window_secs", "integer not null default 0"},
 }
 
 func NewDB(file string) (*DB, error) {
@@ -24,99 +182,149 @@ func NewDB(file string) (*DB, error) {
 		return nil, err
 	}
 
-	if _, err = db.Exec(`
-	create table if not exists readings(
-	    id integer not null primary key,
-	    device_id integer not null,
-	    ts integer not null,
-	    temperature real,
-	    humidity real,
-	    pressure real,
-	    altitude real,
-	    voc_index real 
-	);
-	create index if not exists idx_readings_timestamp on readings(ts);
-	`); err != nil {
+	for _, stmt := range schema {
+		if _, err = db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range addedColumns {
+		if err := addColumn(db, c); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &DB{db: db, metricIDs: make(map[string]int64)}
+	for _, m := range sensor.Metrics() {
+		if _, err := d.RegisterMetric(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.migrateReadings(); err != nil {
 		return nil, err
 	}
 
-	return &DB{db: db}, nil
+	return d, nil
+}
+
+// addColumn adds c to its table unless the table already has it
+func addColumn(db *sql.DB, c column) error {
+	rows, err := db.Query(`select name from pragma_table_info(?)`, c.table)
+	if err != nil {
+		return fmt.Errorf("addColumn: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("addColumn: %w", err)
+		}
+		if name == c.name {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("addColumn: %w", err)
+	}
+
+	// table and column names come from addedColumns, never from input
+	if _, err := db.Exec(`alter table ` + c.table + ` add column ` + c.name + ` ` + c.definition); err != nil {
+		return fmt.Errorf("addColumn: failed to add %s.%s: %w", c.table, c.name, err)
+	}
+
+	return nil
 }
 
 func (d *DB) Close() {
 	d.db.Close()
 }
 
-func (d *DB) RecordAtmosphericMeasurement(mes sensor.AtmosphericDataLine, deviceID uint8) error {
-	log.Debug().Interface("data", mes).Msg("db: RecordAtmosphericMeasurement")
-	if _, err := d.db.Exec(`
-	insert into readings(
-	 ts,
-	 device_id,
-	 temperature,
-	 humidity,
-	 pressure,
-	 altitude,
-	 voc_index) values (
-	?, ?, ?, ?, ?, ?, ?
-	)`, mes.Timestamp.Unix(),
-		deviceID,
-		mes.Temperature,
-		mes.Humidity,
-		mes.Pressure,
-		mes.Altitude,
-		mes.VOCIndex); err != nil {
-		return err
+// BackupTo writes a consistent copy of the live database to path, which must not already exist.
+func (d *DB) BackupTo(path string) error {
+	log.Debug().Str("path", path).Msg("db: BackupTo")
+	if _, err := d.db.Exec(`vacuum into ?`, path); err != nil {
+		return fmt.Errorf("BackupTo: %w", err)
 	}
 
 	return nil
 }
 
-// GetRecentStats retrieves stats in reverse chronological order.
-func (d *DB) GetRecentStats(days int) ([]sensor.AtmosphericDataLine, error) {
-	log.Debug().Msg("db: GetRecentStats")
-	var a []sensor.AtmosphericDataLine
-
-	from := time.Now().Add(-time.Hour * time.Duration(24*days)).Unix()
-	rows, err := d.db.Query(`
-	select
-		 ts,
-		 temperature,
-		 humidity,
-		 pressure,
-		 altitude,
-		 voc_index
-	 from readings
-	 where ts >= ?
-	 order by ts desc
-	 `, from)
+// IntegrityCheck opens the database file read-only and runs sqlite's integrity check on it.
+func IntegrityCheck(file string) error {
+	db, err := sql.Open("sqlite3", "file:"+file+"?mode=ro")
 	if err != nil {
-		return nil, fmt.Errorf("GetRecentStats: failed to get rows: %w", err)
+		return err
 	}
-	for rows.Next() {
-		var (
-			adl   sensor.AtmosphericDataLine
-			tsInt int64
-		)
-
-		if err := rows.Scan(
-			&tsInt,
-			&adl.Temperature,
-			&adl.Humidity,
-			&adl.Pressure,
-			&adl.Altitude,
-			&adl.VOCIndex,
-		); err != nil {
-			return nil, fmt.Errorf("GetRecentStats: failed to scan: %w", err)
-		}
+	defer db.Close()
 
-		adl.Timestamp = time.Unix(tsInt, 0)
+	var result string
+	if err := db.QueryRow(`pragma integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("IntegrityCheck: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("IntegrityCheck: %s", result)
+	}
 
-		a = append(a, adl)
+	return nil
+}
+
+// migrateReadings copies rows from the original wide readings table into measurements,
+// then renames it to readings_legacy so the copy only ever happens once. Values whose device, metric and
+// timestamp are already stored, such as those of duplicate legacy rows, are skipped and counted in the log.
+func (d *DB) migrateReadings() error {
+	var n int
+	if err := d.db.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = 'readings'`).Scan(&n); err != nil {
+		return fmt.Errorf("migrateReadings: %w", err)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("GetRecentStats: error in iteration: %w", err)
+	if n == 0 {
+		return nil
+	}
+
+	log.Info().Msg("Migrating readings table to measurements")
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("migrateReadings: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, column := range []string{
+		sensor.MetricTemperature,
+		sensor.MetricHumidity,
+		sensor.MetricPressure,
+		sensor.MetricAltitude,
+		sensor.MetricVOCIndex,
+	} {
+		metricID, err := d.metricID(column)
+		if err != nil {
+			return err
+		}
+		// column names come from the fixed list above, never from input
+		var values int64
+		if err := tx.QueryRow(`select count(*) from readings where ` + column + ` is not null`).Scan(&values); err != nil {
+			return fmt.Errorf("migrateReadings: failed to count %s: %w", column, err)
+		}
+		res, err := tx.Exec(`
+		insert or ignore into measurements(device_id, metric_id, ts, value)
+		select device_id, ?, ts, `+column+` from readings where `+column+` is not null`, metricID)
+		if err != nil {
+			return fmt.Errorf("migrateReadings: failed to copy %s: %w", column, err)
+		}
+		copied, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("migrateReadings: %w", err)
+		}
+		if skipped := values - copied; skipped > 0 {
+			log.Warn().Str("metric", column).Int64("copied", copied).Int64("skipped", skipped).
+				Msg("Skipped legacy readings already stored for the same device and timestamp")
+		}
+	}
+	if _, err := tx.Exec(`alter table readings rename to readings_legacy`); err != nil {
+		return fmt.Errorf("migrateReadings: failed to rename: %w", err)
 	}
 
-	return a, nil
+	return tx.Commit()
+}
+
+// placeholders returns n comma separated query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
 }
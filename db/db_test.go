@@ -0,0 +1,332 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDB_migratesReadings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leader.db")
+	legacy, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := legacy.Exec(`
+	create table readings(
+	    id integer not null primary key,
+	    device_id integer not null,
+	    ts integer not null,
+	    temperature real,
+	    humidity real,
+	    pressure real,
+	    altitude real,
+	    voc_index real
+	);
+	insert into readings(device_id, ts, temperature, humidity, pressure, altitude, voc_index)
+	values (1, 100, 20.5, 40, 1000, 10, 0), (2, 100, 19, null, 1001, 11, 3), (2, 100, 19.5, null, null, null, null);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Close()
+
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	d, err := NewDB(file)
+	log.Logger = logger
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer d.Close()
+	// the duplicate row's temperature is skipped, keeping the first
+	if !strings.Contains(logs.String(), `"metric":"temperature","copied":2,"skipped":1`) {
+		t.Errorf("migration log does not count the skipped temperature: %s", logs.String())
+	}
+
+	samples, err := d.Samples(ReadingsFilter{})
+	if err != nil {
+		t.Fatalf("Samples() error = %v", err)
+	}
+	if len(samples) != 9 {
+		t.Errorf("Samples() got %d samples, want 9", len(samples))
+	}
+
+	// opening again must not migrate twice
+	d.Close()
+	d, err = NewDB(file)
+	if err != nil {
+		t.Fatalf("NewDB() reopen error = %v", err)
+	}
+	samples, _ = d.Samples(ReadingsFilter{})
+	if len(samples) != 9 {
+		t.Errorf("Samples() after reopen got %d samples, want 9", len(samples))
+	}
+}
+
+func TestReadingRows(t *testing.T) {
+	d, err := NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer d.Close()
+
+	record := func(deviceID uint8, ts int64, ms ...sensor.Measurement) {
+		t.Helper()
+		if err := d.RecordMeasurements(deviceID, sensor.TypeAtmospheric, time.Unix(ts, 0), ms); err != nil {
+			t.Fatalf("RecordMeasurements() error = %v", err)
+		}
+	}
+	record(1, 100, sensor.Measurement{Metric: "temperature", Value: 20}, sensor.Measurement{Metric: "humidity", Value: 40})
+	record(2, 100, sensor.Measurement{Metric: "temperature", Value: 21})
+	record(1, 200, sensor.Measurement{Metric: "lux", Value: 300})
+
+	rows, err := d.StreamReadings(ReadingsFilter{})
+	if err != nil {
+		t.Fatalf("StreamReadings() error = %v", err)
+	}
+	defer rows.Close()
+
+	var got []Reading
+	for rows.Next() {
+		r, _ := rows.Reading()
+		got = append(got, r)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("rows.Err() = %v", err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d readings, want 3: %+v", len(got), got)
+	}
+	if got[0].DeviceID != 1 || len(got[0].Values) != 2 || got[0].Values["humidity"] != 40 {
+		t.Errorf("first reading = %+v", got[0])
+	}
+	if got[1].DeviceID != 2 || got[1].Values["temperature"] != 21 {
+		t.Errorf("second reading = %+v", got[1])
+	}
+	if got[2].Values["lux"] != 300 {
+		t.Errorf("third reading = %+v", got[2])
+	}
+
+	ms, _ := d.Metrics()
+	found := false
+	for _, m := range ms {
+		found = found || m.Name == "lux"
+	}
+	if !found {
+		t.Errorf("unregistered metric lux was not auto-registered")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	d, err := NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer d.Close()
+
+	record := func(deviceID uint8, name, kind, state string, ts int64) {
+		t.Helper()
+		e := sensor.Event{Sensor: name, Kind: kind, State: state, Timestamp: time.Unix(ts, 0), Attributes: map[string]string{"line": "17"}}
+		if _, err := d.RecordEvent(deviceID, e); err != nil {
+			t.Fatalf("RecordEvent() error = %v", err)
+		}
+	}
+	record(1, "front_door", sensor.EventKindContact, sensor.StateOpen, 100)
+	record(1, "front_door", sensor.EventKindContact, sensor.StateClosed, 110)
+	record(2, "hall", sensor.EventKindMotion, sensor.StateStart, 120)
+
+	tests := []struct {
+		name   string
+		filter EventsFilter
+		want   []string
+	}{
+		{"all newest first", EventsFilter{}, []string{sensor.StateStart, sensor.StateClosed, sensor.StateOpen}},
+		{"by device", EventsFilter{DeviceIDs: []uint8{1}}, []string{sensor.StateClosed, sensor.StateOpen}},
+		{"by kind", EventsFilter{Kinds: []string{sensor.EventKindMotion}}, []string{sensor.StateStart}},
+		{"by sensor", EventsFilter{Sensors: []string{"front_door"}, Limit: 1}, []string{sensor.StateClosed}},
+		{"time range", EventsFilter{From: time.Unix(105, 0), To: time.Unix(120, 0)}, []string{sensor.StateClosed}},
+		{"before cursor", EventsFilter{Before: 2}, []string{sensor.StateOpen}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := d.Events(tt.filter)
+			if err != nil {
+				t.Fatalf("Events() error = %v", err)
+			}
+			var got []string
+			for _, e := range events {
+				got = append(got, e.State)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Events() states = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	events, _ := d.Events(EventsFilter{Limit: 1})
+	if events[0].Attributes["line"] != "17" || events[0].DeviceID != 2 || events[0].Timestamp.Unix() != 120 {
+		t.Errorf("Events() newest = %+v", events[0])
+	}
+}
+
+func TestNewDB_addsColumns(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leader.db")
+	old, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`
+	create table alert_rules(
+	    id integer not null primary key,
+	    name text not null,
+	    device_id integer,
+	    metric text not null,
+	    condition text not null,
+	    threshold real not null,
+	    hysteresis real not null default 0,
+	    window_secs integer not null default 0,
+	    for_secs integer not null default 0,
+	    cooldown_secs integer not null default 0,
+	    disabled integer not null default 0
+	);
+	insert into alert_rules(name, metric, condition, threshold) values ('hot', 'temperature', 'above', 30);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	for i := 0; i < 2; i++ {
+		d, err := NewDB(file)
+		if err != nil {
+			t.Fatalf("NewDB() open %d error = %v", i, err)
+		}
+		rules, err := d.AlertRules()
+		d.Close()
+		if err != nil {
+			t.Fatalf("AlertRules() error = %v", err)
+		}
+		if len(rules) != 1 || rules[0].Name != "hot" || len(rules[0].Notifiers) != 0 {
+			t.Errorf("AlertRules() = %+v", rules)
+		}
+	}
+}
+
+func TestRecordCalibratedMeasurements(t *testing.T) {
+	d, err := NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer d.Close()
+
+	temperature := func(v float64) []sensor.Measurement {
+		return []sensor.Measurement{{Metric: sensor.MetricTemperature, Value: v}}
+	}
+	if err := d.RecordCalibratedMeasurements(1, sensor.TypeAtmospheric, time.Unix(100, 0), temperature(22), temperature(23)); err != nil {
+		t.Fatalf("RecordCalibratedMeasurements() error = %v", err)
+	}
+	// a raw value which cannot be stored stores neither value, so no corrected value is left without its raw value
+	bad := []sensor.Measurement{{Metric: "no_such_metric", Value: 1}}
+	if err := d.RecordCalibratedMeasurements(1, sensor.TypeAtmospheric, time.Unix(200, 0), temperature(22), bad); !errors.Is(err, ErrUnknownMetric) {
+		t.Fatalf("RecordCalibratedMeasurements() unknown raw metric error = %v, want %v", err, ErrUnknownMetric)
+	}
+
+	if n, err := d.Recalibrate(1, sensor.MetricTemperature, 1, -2, time.Time{}, time.Time{}); err != nil || n != 1 {
+		t.Fatalf("Recalibrate() = %d, %v, want 1", n, err)
+	}
+	samples, err := d.Samples(ReadingsFilter{Metrics: []string{sensor.MetricTemperature}})
+	if err != nil {
+		t.Fatalf("Samples() error = %v", err)
+	}
+	if len(samples) != 1 || samples[0].Value != 21 {
+		t.Errorf("Samples() = %+v, want one value of 21, corrected from the raw 23", samples)
+	}
+}
+
+func TestRecordMeasurements_registersMetrics(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leader.db")
+	d, err := NewDB(file)
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer func() { d.Close() }()
+
+	record := func(sensorType uint8, metric string) {
+		t.Helper()
+		if err := d.RecordMeasurements(1, sensorType, time.Unix(100, 0), []sensor.Measurement{{Metric: metric, Value: 1}}); err != nil {
+			t.Fatalf("RecordMeasurements() error = %v", err)
+		}
+	}
+	probe := "28-0316a2795eff." + sensor.MetricTemperature
+	// a probe's temperature shares the unit of temperature, but keeps the type of the sensor which reported it
+	record(sensor.TypeDS18B20, probe)
+	record(sensor.TypeExec, probe)
+	record(sensor.TypeExec, "co2")
+	if _, err := d.RegisterMetric(sensor.Metric{Name: "co2", Unit: "ppm", SensorType: sensor.TypeAtmospheric}); err != nil {
+		t.Fatalf("RegisterMetric() error = %v", err)
+	}
+
+	// registering the sensor registry's metrics again on restart changes no sensor type
+	d.Close()
+	if d, err = NewDB(file); err != nil {
+		t.Fatalf("NewDB() reopen error = %v", err)
+	}
+	for _, want := range []sensor.Metric{
+		{Name: probe, Unit: "C", SensorType: sensor.TypeDS18B20},
+		{Name: "co2", Unit: "ppm", SensorType: sensor.TypeExec},
+		{Name: sensor.MetricTemperature, Unit: "C", SensorType: sensor.TypeAtmospheric},
+	} {
+		if got, err := d.Metric(want.Name); err != nil || got != want {
+			t.Errorf("Metric(%s) = %+v, %v, want %+v", want.Name, got, err, want)
+		}
+	}
+}
+
+func TestRecordMeasurements_sameSecond(t *testing.T) {
+	d, err := NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer d.Close()
+
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = logger }()
+	for _, v := range []struct {
+		ts    time.Time
+		value float64
+	}{
+		{time.Unix(100, 0), 20},
+		// a resent reading is stored once without a warning
+		{time.Unix(100, 0), 20},
+		{time.Unix(100, int64(500*time.Millisecond)), 21},
+	} {
+		if err := d.RecordMeasurements(1, sensor.TypeAtmospheric, v.ts, []sensor.Measurement{{Metric: sensor.MetricTemperature, Value: v.value}}); err != nil {
+			t.Fatalf("RecordMeasurements() error = %v", err)
+		}
+	}
+
+	if got := strings.Count(logs.String(), "Rejected a conflicting value"); got != 1 {
+		t.Errorf("logged %d rejected values, want 1: %s", got, logs.String())
+	}
+	if !strings.Contains(logs.String(), `"value":21,"stored":20`) {
+		t.Errorf("rejected value log does not name both values: %s", logs.String())
+	}
+	samples, err := d.Samples(ReadingsFilter{})
+	if err != nil {
+		t.Fatalf("Samples() error = %v", err)
+	}
+	if len(samples) != 1 || samples[0].Value != 20 {
+		t.Errorf("Samples() = %+v, want the first value of 20", samples)
+	}
+}
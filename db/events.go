@@ -0,0 +1,140 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// Event is a stored state change reported by a sensor, such as a door opening
+type Event struct {
+	ID         int64             `json:"id"`
+	DeviceID   uint8             `json:"deviceID"`
+	Sensor     string            `json:"sensor"`
+	Kind       string            `json:"kind"`
+	State      string            `json:"state"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// EventsFilter selects events in [From, To), newest first. A zero From or To leaves that end of the range open,
+// and an empty DeviceIDs, Sensors or Kinds selects all of them. Before pages through results by returning only
+// events with a lower ID, and a Limit of 0 returns every match.
+type EventsFilter struct {
+	From      time.Time
+	To        time.Time
+	DeviceIDs []uint8
+	Sensors   []string
+	Kinds     []string
+	Before    int64
+	Limit     int
+}
+
+// RecordEvent stores an event reported by deviceID, returning it as stored
+func (d *DB) RecordEvent(deviceID uint8, e sensor.Event) (Event, error) {
+	log.Debug().Uint8("deviceID", deviceID).Str("sensor", e.Sensor).Str("state", e.State).Msg("db: RecordEvent")
+	attrs, err := json.Marshal(e.Attributes)
+	if err != nil {
+		return Event{}, fmt.Errorf("RecordEvent: %w", err)
+	}
+
+	res, err := d.db.Exec(`
+	insert into events(device_id, sensor, kind, state, ts_ms, attributes)
+	values (?, ?, ?, ?, ?, ?)`,
+		deviceID, e.Sensor, e.Kind, e.State, e.Timestamp.UnixMilli(), string(attrs))
+	if err != nil {
+		return Event{}, fmt.Errorf("RecordEvent: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Event{}, fmt.Errorf("RecordEvent: %w", err)
+	}
+
+	return Event{
+		ID:         id,
+		DeviceID:   deviceID,
+		Sensor:     e.Sensor,
+		Kind:       e.Kind,
+		State:      e.State,
+		Timestamp:  time.UnixMilli(e.Timestamp.UnixMilli()),
+		Attributes: e.Attributes,
+	}, nil
+}
+
+// Events returns stored events matching f, newest first
+func (d *DB) Events(f EventsFilter) ([]Event, error) {
+	log.Debug().Interface("filter", f).Msg("db: Events")
+	var (
+		where []string
+		args  []any
+	)
+	if !f.From.IsZero() {
+		where = append(where, "ts_ms >= ?")
+		args = append(args, f.From.UnixMilli())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "ts_ms < ?")
+		args = append(args, f.To.UnixMilli())
+	}
+	if len(f.DeviceIDs) > 0 {
+		where = append(where, "device_id in ("+placeholders(len(f.DeviceIDs))+")")
+		for _, id := range f.DeviceIDs {
+			args = append(args, id)
+		}
+	}
+	if len(f.Sensors) > 0 {
+		where = append(where, "sensor in ("+placeholders(len(f.Sensors))+")")
+		for _, s := range f.Sensors {
+			args = append(args, s)
+		}
+	}
+	if len(f.Kinds) > 0 {
+		where = append(where, "kind in ("+placeholders(len(f.Kinds))+")")
+		for _, k := range f.Kinds {
+			args = append(args, k)
+		}
+	}
+	if f.Before > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.Before)
+	}
+
+	q := `select id, device_id, sensor, kind, state, ts_ms, attributes from events`
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	// ids increase with insertion, so paging by id stays stable as new events arrive
+	q += " order by id desc"
+	if f.Limit > 0 {
+		q += " limit ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := d.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Events: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []Event{}
+	for rows.Next() {
+		var (
+			e     Event
+			tsMs  int64
+			attrs string
+		)
+		if err := rows.Scan(&e.ID, &e.DeviceID, &e.Sensor, &e.Kind, &e.State, &tsMs, &attrs); err != nil {
+			return nil, fmt.Errorf("Events: failed to scan: %w", err)
+		}
+		e.Timestamp = time.UnixMilli(tsMs)
+		if err := json.Unmarshal([]byte(attrs), &e.Attributes); err != nil {
+			return nil, fmt.Errorf("Events: invalid attributes of event %d: %w", e.ID, err)
+		}
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
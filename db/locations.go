@@ -0,0 +1,162 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// Location is a site, a floor of a site, or a room
+type Location struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// Kind is site, floor or room
+	Kind string `json:"kind"`
+	// ParentID is the location containing this one. Sites have none.
+	ParentID *int64 `json:"parentID"`
+}
+
+// Assignment places a device, or one sensor instance of a device, in a location and gives it labels
+type Assignment struct {
+	DeviceID uint8 `json:"deviceID"`
+	// Sensor is the sensor instance, as it prefixes its metrics. Blank assigns the whole device.
+	Sensor     string   `json:"sensor"`
+	LocationID *int64   `json:"locationID"`
+	Labels     []string `json:"labels"`
+}
+
+// Locations returns every location, ordered by ID
+func (d *DB) Locations() ([]Location, error) {
+	log.Debug().Msg("db: Locations")
+	rows, err := d.db.Query(`select id, name, kind, parent_id from locations order by id`)
+	if err != nil {
+		return nil, fmt.Errorf("Locations: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []Location{}
+	for rows.Next() {
+		var (
+			l        Location
+			parentID sql.NullInt64
+		)
+		if err := rows.Scan(&l.ID, &l.Name, &l.Kind, &parentID); err != nil {
+			return nil, fmt.Errorf("Locations: failed to scan: %w", err)
+		}
+		if parentID.Valid {
+			l.ParentID = &parentID.Int64
+		}
+		out = append(out, l)
+	}
+
+	return out, rows.Err()
+}
+
+// CreateLocation stores a new location, returning it with its ID set
+func (d *DB) CreateLocation(l Location) (Location, error) {
+	log.Debug().Str("name", l.Name).Msg("db: CreateLocation")
+	res, err := d.db.Exec(`insert into locations(name, kind, parent_id) values (?, ?, ?)`, l.Name, l.Kind, l.ParentID)
+	if err != nil {
+		return Location{}, fmt.Errorf("CreateLocation: %w", err)
+	}
+	if l.ID, err = res.LastInsertId(); err != nil {
+		return Location{}, fmt.Errorf("CreateLocation: %w", err)
+	}
+
+	return l, nil
+}
+
+// UpdateLocation replaces the location with l.ID, returning ErrNotFound if there is none
+func (d *DB) UpdateLocation(l Location) error {
+	log.Debug().Int64("id", l.ID).Msg("db: UpdateLocation")
+	res, err := d.db.Exec(`update locations set name = ?, kind = ?, parent_id = ? where id = ?`, l.Name, l.Kind, l.ParentID, l.ID)
+	if err != nil {
+		return fmt.Errorf("UpdateLocation: %w", err)
+	}
+
+	return requireRowAffected(res, "UpdateLocation")
+}
+
+// DeleteLocation deletes the location with id, returning ErrNotFound if there is none. Locations inside it move
+// to its parent, and devices assigned to it are left without a location.
+func (d *DB) DeleteLocation(id int64) error {
+	log.Debug().Int64("id", id).Msg("db: DeleteLocation")
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("DeleteLocation: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`update locations set parent_id = (select parent_id from locations where id = ?) where parent_id = ?`, id, id); err != nil {
+		return fmt.Errorf("DeleteLocation: failed to move children: %w", err)
+	}
+	if _, err := tx.Exec(`update assignments set location_id = null where location_id = ?`, id); err != nil {
+		return fmt.Errorf("DeleteLocation: failed to unassign: %w", err)
+	}
+	res, err := tx.Exec(`delete from locations where id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("DeleteLocation: %w", err)
+	}
+	if err := requireRowAffected(res, "DeleteLocation"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Assignments returns every assignment, ordered by device and sensor
+func (d *DB) Assignments() ([]Assignment, error) {
+	log.Debug().Msg("db: Assignments")
+	rows, err := d.db.Query(`select device_id, sensor, location_id, labels from assignments order by device_id, sensor`)
+	if err != nil {
+		return nil, fmt.Errorf("Assignments: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []Assignment{}
+	for rows.Next() {
+		var (
+			a          Assignment
+			locationID sql.NullInt64
+			labels     string
+		)
+		if err := rows.Scan(&a.DeviceID, &a.Sensor, &locationID, &labels); err != nil {
+			return nil, fmt.Errorf("Assignments: failed to scan: %w", err)
+		}
+		if locationID.Valid {
+			a.LocationID = &locationID.Int64
+		}
+		a.Labels = []string{}
+		if labels != "" {
+			a.Labels = strings.Split(labels, ",")
+		}
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
+
+// SetAssignment stores a as the assignment of its device and sensor, replacing any existing one
+func (d *DB) SetAssignment(a Assignment) error {
+	log.Debug().Uint8("deviceID", a.DeviceID).Str("sensor", a.Sensor).Msg("db: SetAssignment")
+	if _, err := d.db.Exec(`
+	insert into assignments(device_id, sensor, location_id, labels) values (?, ?, ?, ?)
+	on conflict(device_id, sensor) do update set location_id = excluded.location_id, labels = excluded.labels`,
+		a.DeviceID, a.Sensor, a.LocationID, strings.Join(a.Labels, ",")); err != nil {
+		return fmt.Errorf("SetAssignment: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAssignment deletes the assignment of a device's sensor, returning ErrNotFound if there is none
+func (d *DB) DeleteAssignment(deviceID uint8, sensor string) error {
+	log.Debug().Uint8("deviceID", deviceID).Str("sensor", sensor).Msg("db: DeleteAssignment")
+	res, err := d.db.Exec(`delete from assignments where device_id = ? and sensor = ?`, deviceID, sensor)
+	if err != nil {
+		return fmt.Errorf("DeleteAssignment: %w", err)
+	}
+
+	return requireRowAffected(res, "DeleteAssignment")
+}
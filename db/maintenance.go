@@ -0,0 +1,81 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// MaintenanceWindow is a planned period, such as a reboot, during which a node is expected to go offline
+type MaintenanceWindow struct {
+	ID int64 `json:"id"`
+	// DeviceID is the node under maintenance. Nil covers every node.
+	DeviceID *uint8    `json:"deviceID"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Reason   string    `json:"reason"`
+}
+
+// Covers reports whether the window applies to deviceID at t
+func (m MaintenanceWindow) Covers(deviceID uint8, t time.Time) bool {
+	return (m.DeviceID == nil || *m.DeviceID == deviceID) && !t.Before(m.Start) && t.Before(m.End)
+}
+
+// CreateMaintenanceWindow stores a new window, returning it with its ID set
+func (d *DB) CreateMaintenanceWindow(m MaintenanceWindow) (MaintenanceWindow, error) {
+	log.Debug().Time("start", m.Start).Time("end", m.End).Msg("db: CreateMaintenanceWindow")
+	res, err := d.db.Exec(`insert into maintenance_windows(device_id, start_ms, end_ms, reason) values (?, ?, ?, ?)`,
+		m.DeviceID, m.Start.UnixMilli(), m.End.UnixMilli(), m.Reason)
+	if err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("CreateMaintenanceWindow: %w", err)
+	}
+	if m.ID, err = res.LastInsertId(); err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("CreateMaintenanceWindow: %w", err)
+	}
+
+	return m, nil
+}
+
+// DeleteMaintenanceWindow deletes the window with id, returning ErrNotFound if there is none
+func (d *DB) DeleteMaintenanceWindow(id int64) error {
+	log.Debug().Int64("id", id).Msg("db: DeleteMaintenanceWindow")
+	res, err := d.db.Exec(`delete from maintenance_windows where id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("DeleteMaintenanceWindow: %w", err)
+	}
+
+	return requireRowAffected(res, "DeleteMaintenanceWindow")
+}
+
+// MaintenanceWindows returns the windows which have not ended by since, ordered by start
+func (d *DB) MaintenanceWindows(since time.Time) ([]MaintenanceWindow, error) {
+	log.Debug().Msg("db: MaintenanceWindows")
+	rows, err := d.db.Query(`
+	select id, device_id, start_ms, end_ms, reason from maintenance_windows where end_ms > ? order by start_ms, id`,
+		since.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("MaintenanceWindows: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []MaintenanceWindow{}
+	for rows.Next() {
+		var (
+			m              MaintenanceWindow
+			deviceID       sql.NullInt64
+			startMs, endMs int64
+		)
+		if err := rows.Scan(&m.ID, &deviceID, &startMs, &endMs, &m.Reason); err != nil {
+			return nil, fmt.Errorf("MaintenanceWindows: failed to scan: %w", err)
+		}
+		if deviceID.Valid {
+			id := uint8(deviceID.Int64)
+			m.DeviceID = &id
+		}
+		m.Start, m.End = time.UnixMilli(startMs), time.UnixMilli(endMs)
+		out = append(out, m)
+	}
+
+	return out, rows.Err()
+}
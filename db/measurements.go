@@ -0,0 +1,495 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+var ErrUnknownMetric = errors.New("unknown metric")
+
+// Reading is every value a device reported at a single timestamp, keyed by metric name
+type Reading struct {
+	DeviceID  uint8
+	Timestamp time.Time
+	Values    map[string]float64
+}
+
+// Sample is a single stored value of a metric
+type Sample struct {
+	DeviceID  uint8     `json:"deviceID"`
+	Metric    string    `json:"metric"`
+	Unit      string    `json:"unit"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// ReadingsFilter selects stored values in [From, To). A zero From or To leaves that end of the range open,
+// and an empty DeviceIDs or Metrics selects all devices or metrics.
+type ReadingsFilter struct {
+	From      time.Time
+	To        time.Time
+	DeviceIDs []uint8
+	Metrics   []string
+	// NewestFirst orders results in reverse chronological order
+	NewestFirst bool
+}
+
+// where builds the where clause and args for f, against measurements aliased as ms and metrics as m
+func (f ReadingsFilter) where() (string, []any) {
+	var (
+		where []string
+		args  []any
+	)
+	if !f.From.IsZero() {
+		where = append(where, "ms.ts >= ?")
+		args = append(args, f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "ms.ts < ?")
+		args = append(args, f.To.Unix())
+	}
+	if len(f.DeviceIDs) > 0 {
+		where = append(where, "ms.device_id in ("+placeholders(len(f.DeviceIDs))+")")
+		for _, id := range f.DeviceIDs {
+			args = append(args, id)
+		}
+	}
+	if len(f.Metrics) > 0 {
+		where = append(where, "m.name in ("+placeholders(len(f.Metrics))+")")
+		for _, name := range f.Metrics {
+			args = append(args, name)
+		}
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+
+	return " where " + strings.Join(where, " and "), args
+}
+
+// RegisterMetric adds a metric to the metrics table or updates its unit, returning its ID. A metric keeps the sensor
+// type it was first registered with, so the type of the sensor which first reported it is never overwritten.
+func (d *DB) RegisterMetric(m sensor.Metric) (int64, error) {
+	d.metricLock.Lock()
+	defer d.metricLock.Unlock()
+
+	var id int64
+	if err := d.db.QueryRow(`
+	insert into metrics(name, unit, sensor_type) values (?, ?, ?)
+	on conflict(name) do update set unit = excluded.unit
+	returning id`, m.Name, m.Unit, m.SensorType).Scan(&id); err != nil {
+		return 0, fmt.Errorf("RegisterMetric: %w", err)
+	}
+	d.metricIDs[m.Name] = id
+
+	return id, nil
+}
+
+// Metrics returns every metric which has been registered, by name
+func (d *DB) Metrics() ([]sensor.Metric, error) {
+	rows, err := d.db.Query(`select name, unit, sensor_type from metrics order by name`)
+	if err != nil {
+		return nil, fmt.Errorf("Metrics: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	var out []sensor.Metric
+	for rows.Next() {
+		var m sensor.Metric
+		if err := rows.Scan(&m.Name, &m.Unit, &m.SensorType); err != nil {
+			return nil, fmt.Errorf("Metrics: failed to scan: %w", err)
+		}
+		out = append(out, m)
+	}
+
+	return out, rows.Err()
+}
+
+// Metric returns a registered metric by name, or ErrUnknownMetric
+func (d *DB) Metric(name string) (sensor.Metric, error) {
+	m := sensor.Metric{Name: name}
+	err := d.db.QueryRow(`select unit, sensor_type from metrics where name = ?`, name).Scan(&m.Unit, &m.SensorType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sensor.Metric{}, fmt.Errorf("Metric: %w: %s", ErrUnknownMetric, name)
+	} else if err != nil {
+		return sensor.Metric{}, fmt.Errorf("Metric: %w", err)
+	}
+
+	return m, nil
+}
+
+// MetricNames returns the names of every registered metric
+func (d *DB) MetricNames() ([]string, error) {
+	ms, err := d.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(ms))
+	for i, m := range ms {
+		names[i] = m.Name
+	}
+
+	return names, nil
+}
+
+// metricID returns the ID of a registered metric, or ErrUnknownMetric
+func (d *DB) metricID(name string) (int64, error) {
+	d.metricLock.Lock()
+	defer d.metricLock.Unlock()
+	if id, ok := d.metricIDs[name]; ok {
+		return id, nil
+	}
+
+	var id int64
+	err := d.db.QueryRow(`select id from metrics where name = ?`, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownMetric, name)
+	} else if err != nil {
+		return 0, err
+	}
+	d.metricIDs[name] = id
+
+	return id, nil
+}
+
+// ensureMetric returns the ID of a metric, registering it first if it has never been seen, with the sensor type
+// which reported it. Metrics unknown to the sensor registry are registered without a unit.
+func (d *DB) ensureMetric(name string, sensorType uint8) (int64, error) {
+	id, err := d.metricID(name)
+	if !errors.Is(err, ErrUnknownMetric) {
+		return id, err
+	}
+
+	// metrics of a named sensor instance share the unit of the base metric
+	m, _ := sensor.MetricByName(sensor.BaseMetric(name))
+	m.Name = name
+	m.SensorType = sensorType
+	log.Info().Str("metric", name).Uint8("sensorType", sensorType).Msg("Registering new metric")
+
+	return d.RegisterMetric(m)
+}
+
+// RecordMeasurements stores every measurement a device took at ts, registering new metrics as needed.
+// Only the first value of a metric in each second is kept, and a later one which differs is logged.
+func (d *DB) RecordMeasurements(deviceID, sensorType uint8, ts time.Time, ms []sensor.Measurement) error {
+	log.Debug().Interface("data", ms).Msg("db: RecordMeasurements")
+	if err := d.recordMeasurements(deviceID, sensorType, ts, ms, nil); err != nil {
+		return fmt.Errorf("RecordMeasurements: %w", err)
+	}
+
+	return nil
+}
+
+// RecordCalibratedMeasurements stores measurements as RecordMeasurements does, and raw, the uncorrected values of
+// the calibrated ones, in the same transaction. Either both are stored or neither is, so that Recalibrate never
+// mistakes a corrected value for a raw one.
+func (d *DB) RecordCalibratedMeasurements(deviceID, sensorType uint8, ts time.Time, ms, raw []sensor.Measurement) error {
+	log.Debug().Interface("data", ms).Interface("raw", raw).Msg("db: RecordCalibratedMeasurements")
+	if err := d.recordMeasurements(deviceID, sensorType, ts, ms, raw); err != nil {
+		return fmt.Errorf("RecordCalibratedMeasurements: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) recordMeasurements(deviceID, sensorType uint8, ts time.Time, ms, raw []sensor.Measurement) error {
+	ids := make([]int64, len(ms))
+	for i, m := range ms {
+		id, err := d.ensureMetric(m.Metric, sensorType)
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+	rawIDs := make([]int64, len(raw))
+	for i, m := range raw {
+		id, err := d.metricID(m.Metric)
+		if err != nil {
+			return err
+		}
+		rawIDs[i] = id
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i, m := range ms {
+		stored, err := insertValue(tx, "measurements", deviceID, ids[i], ts, m.Value)
+		if err != nil {
+			return fmt.Errorf("failed to insert: %w", err)
+		}
+		// timestamps are stored in seconds, so a second reading within the same second is rejected
+		if stored != m.Value {
+			log.Warn().Uint8("deviceID", deviceID).Str("metric", m.Metric).Time("ts", ts).Float64("value", m.Value).
+				Float64("stored", stored).Msg("Rejected a conflicting value within the same second, keeping the first")
+		}
+	}
+	for i, m := range raw {
+		if _, err := insertValue(tx, "raw_measurements", deviceID, rawIDs[i], ts, m.Value); err != nil {
+			return fmt.Errorf("failed to insert raw value: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertValue stores value in table unless a value of the metric is already stored for the device in the same
+// second, and returns the value which is stored
+func insertValue(tx *sql.Tx, table string, deviceID uint8, metricID int64, ts time.Time, value float64) (float64, error) {
+	res, err := tx.Exec(`
+	insert into `+table+`(device_id, metric_id, ts, value) values (?, ?, ?, ?) on conflict do nothing`,
+		deviceID, metricID, ts.Unix(), value)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return value, err
+	}
+
+	var stored float64
+	if err := tx.QueryRow(`select value from `+table+` where device_id = ? and metric_id = ? and ts = ?`,
+		deviceID, metricID, ts.Unix()).Scan(&stored); err != nil {
+		return 0, err
+	}
+
+	return stored, nil
+}
+
+// ImportReadings records readings for deviceID in a single transaction, skipping any value whose device,
+// metric and timestamp are already stored. It returns the number of readings which had any value inserted.
+func (d *DB) ImportReadings(deviceID uint8, readings []Reading) (int, error) {
+	log.Debug().Int("count", len(readings)).Uint8("deviceID", deviceID).Msg("db: ImportReadings")
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ImportReadings: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	insert or ignore into measurements(device_id, metric_id, ts, value) values (?, ?, ?, ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("ImportReadings: failed to prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	inserted := 0
+	for _, r := range readings {
+		stored := false
+		for name, value := range r.Values {
+			id, err := d.metricID(name)
+			if err != nil {
+				return 0, fmt.Errorf("ImportReadings: %w", err)
+			}
+			res, err := stmt.Exec(deviceID, id, r.Timestamp.Unix(), value)
+			if err != nil {
+				return 0, fmt.Errorf("ImportReadings: failed to insert: %w", err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				stored = true
+			}
+		}
+		if stored {
+			inserted++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ImportReadings: failed to commit: %w", err)
+	}
+
+	return inserted, nil
+}
+
+// ReadingRows iterates over readings one timestamp at a time, so large ranges are never held in memory.
+// Callers must Close it when done.
+type ReadingRows struct {
+	rows *sql.Rows
+	cur  Reading
+	// pending is a row which has been read, but belongs to the next reading
+	pending *Sample
+	err     error
+}
+
+// Next advances to the next reading, returning false when there are no more rows or an error occurred.
+func (r *ReadingRows) Next() bool {
+	var cur *Reading
+	for {
+		if r.pending == nil {
+			if r.err != nil || !r.rows.Next() {
+				break
+			}
+			s, err := scanSample(r.rows)
+			if err != nil {
+				r.err = fmt.Errorf("ReadingRows: failed to scan: %w", err)
+				return false
+			}
+			r.pending = &s
+		}
+
+		if cur == nil {
+			cur = &Reading{
+				DeviceID:  r.pending.DeviceID,
+				Timestamp: r.pending.Timestamp,
+				Values:    make(map[string]float64),
+			}
+		} else if r.pending.DeviceID != cur.DeviceID || !r.pending.Timestamp.Equal(cur.Timestamp) {
+			break
+		}
+		cur.Values[r.pending.Metric] = r.pending.Value
+		r.pending = nil
+	}
+
+	if cur == nil {
+		return false
+	}
+	r.cur = *cur
+
+	return true
+}
+
+// Reading returns the current reading
+func (r *ReadingRows) Reading() (Reading, error) {
+	return r.cur, nil
+}
+
+// Err returns any error encountered during iteration
+func (r *ReadingRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	return r.rows.Err()
+}
+
+func (r *ReadingRows) Close() error {
+	return r.rows.Close()
+}
+
+const selectSamples = `
+	select
+		 ms.device_id,
+		 m.name,
+		 m.unit,
+		 ms.ts,
+		 ms.value
+	 from measurements ms
+	 join metrics m on m.id = ms.metric_id`
+
+func scanSample(rows *sql.Rows) (Sample, error) {
+	var (
+		s     Sample
+		tsInt int64
+	)
+	if err := rows.Scan(&s.DeviceID, &s.Metric, &s.Unit, &tsInt, &s.Value); err != nil {
+		return Sample{}, err
+	}
+	s.Timestamp = time.Unix(tsInt, 0)
+
+	return s, nil
+}
+
+// StreamReadings returns an iterator over readings matching f, in chronological order unless f.NewestFirst is set.
+func (d *DB) StreamReadings(f ReadingsFilter) (*ReadingRows, error) {
+	log.Debug().Interface("filter", f).Msg("db: StreamReadings")
+	where, args := f.where()
+	order := " order by ms.ts, ms.device_id"
+	if f.NewestFirst {
+		order = " order by ms.ts desc, ms.device_id"
+	}
+
+	rows, err := d.db.Query(selectSamples+where+order, args...)
+	if err != nil {
+		return nil, fmt.Errorf("StreamReadings: failed to get rows: %w", err)
+	}
+
+	return &ReadingRows{rows: rows}, nil
+}
+
+// GetRecentStats retrieves readings of metrics from the last days in reverse chronological order.
+// Empty metrics retrieves every metric.
+func (d *DB) GetRecentStats(days int, metrics []string) ([]Reading, error) {
+	log.Debug().Msg("db: GetRecentStats")
+	rows, err := d.StreamReadings(ReadingsFilter{
+		From:        time.Now().Add(-time.Hour * time.Duration(24*days)),
+		Metrics:     metrics,
+		NewestFirst: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetRecentStats: %w", err)
+	}
+	defer rows.Close()
+
+	var a []Reading
+	for rows.Next() {
+		r, _ := rows.Reading()
+		a = append(a, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetRecentStats: error in iteration: %w", err)
+	}
+
+	return a, nil
+}
+
+// Samples returns every value matching f, ordered by device, metric and time.
+func (d *DB) Samples(f ReadingsFilter) ([]Sample, error) {
+	log.Debug().Interface("filter", f).Msg("db: Samples")
+	where, args := f.where()
+	rows, err := d.db.Query(selectSamples+where+" order by ms.device_id, m.name, ms.ts", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Samples: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Sample
+	for rows.Next() {
+		s, err := scanSample(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Samples: failed to scan: %w", err)
+		}
+		out = append(out, s)
+	}
+
+	return out, rows.Err()
+}
+
+// Latest returns the most recent value of each metric for each device matching f. The time range of f is ignored.
+func (d *DB) Latest(f ReadingsFilter) ([]Sample, error) {
+	log.Debug().Interface("filter", f).Msg("db: Latest")
+	where, args := ReadingsFilter{DeviceIDs: f.DeviceIDs, Metrics: f.Metrics}.where()
+	// sqlite returns the other columns from the row holding max(ts)
+	rows, err := d.db.Query(`
+	select
+		 ms.device_id,
+		 m.name,
+		 m.unit,
+		 max(ms.ts),
+		 ms.value
+	 from measurements ms
+	 join metrics m on m.id = ms.metric_id`+where+`
+	 group by ms.device_id, ms.metric_id
+	 order by ms.device_id, m.name`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Latest: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Sample
+	for rows.Next() {
+		s, err := scanSample(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Latest: failed to scan: %w", err)
+		}
+		out = append(out, s)
+	}
+
+	return out, rows.Err()
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Delivery records an attempt to send an alert notification through a notifier
+type Delivery struct {
+	ID      int64  `json:"id"`
+	AlertID int64  `json:"alertID"`
+	Event   string `json:"event"`
+	// Notifier is the name of the notifier
+	Notifier  string    `json:"notifier"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// RecordDelivery stores the outcome of sending a notification
+func (d *DB) RecordDelivery(dl Delivery) error {
+	log.Debug().Int64("alertID", dl.AlertID).Str("notifier", dl.Notifier).Str("status", dl.Status).Msg("db: RecordDelivery")
+	if _, err := d.db.Exec(`
+	insert into notification_deliveries(alert_id, event, notifier, status, attempts, error, ts_ms)
+	values (?, ?, ?, ?, ?, ?, ?)`,
+		dl.AlertID, dl.Event, dl.Notifier, dl.Status, dl.Attempts, dl.Error, dl.Timestamp.UnixMilli()); err != nil {
+		return fmt.Errorf("RecordDelivery: %w", err)
+	}
+
+	return nil
+}
+
+// Deliveries returns the notifications sent for an alert, oldest first
+func (d *DB) Deliveries(alertID int64) ([]Delivery, error) {
+	log.Debug().Int64("alertID", alertID).Msg("db: Deliveries")
+	rows, err := d.db.Query(`
+	select id, alert_id, event, notifier, status, attempts, error, ts_ms
+	from notification_deliveries where alert_id = ? order by id`, alertID)
+	if err != nil {
+		return nil, fmt.Errorf("Deliveries: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []Delivery{}
+	for rows.Next() {
+		var (
+			dl   Delivery
+			tsMs int64
+		)
+		if err := rows.Scan(&dl.ID, &dl.AlertID, &dl.Event, &dl.Notifier, &dl.Status, &dl.Attempts, &dl.Error, &tsMs); err != nil {
+			return nil, fmt.Errorf("Deliveries: failed to scan: %w", err)
+		}
+		dl.Timestamp = time.UnixMilli(tsMs)
+		out = append(out, dl)
+	}
+
+	return out, rows.Err()
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"fmt"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// SensorError is an error reported by a sensor on a node
+type SensorError struct {
+	ID         int64     `json:"id"`
+	DeviceID   uint8     `json:"deviceID"`
+	SensorType string    `json:"sensorType"`
+	Sensor     string    `json:"sensor"`
+	Timestamp  time.Time `json:"timestamp"`
+	Message    string    `json:"message"`
+	// Restarted is set when the node restarted the sensor because of repeated errors
+	Restarted bool `json:"restarted"`
+}
+
+// SensorErrorsFilter selects sensor errors in [From, To), newest first. A zero From or To leaves that end
+// of the range open, an empty DeviceIDs selects all devices, and a Limit of 0 returns every match.
+type SensorErrorsFilter struct {
+	From      time.Time
+	To        time.Time
+	DeviceIDs []uint8
+	Limit     int
+}
+
+// RecordSensorError stores an error reported by a sensor on deviceID
+func (d *DB) RecordSensorError(deviceID uint8, r sensor.ErrorReport) error {
+	log.Debug().Uint8("deviceID", deviceID).Str("sensor", r.Name).Msg("db: RecordSensorError")
+	if _, err := d.db.Exec(`
+	insert into sensor_errors(device_id, sensor_type, sensor_name, ts, message, restarted)
+	values (?, ?, ?, ?, ?, ?)`,
+		deviceID, r.Typ, r.Name, r.Timestamp.Unix(), r.Message, r.Restarted); err != nil {
+		return fmt.Errorf("RecordSensorError: %w", err)
+	}
+
+	return nil
+}
+
+// SensorErrors returns stored sensor errors matching f, newest first
+func (d *DB) SensorErrors(f SensorErrorsFilter) ([]SensorError, error) {
+	log.Debug().Interface("filter", f).Msg("db: SensorErrors")
+	var (
+		where []string
+		args  []any
+	)
+	if !f.From.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "ts < ?")
+		args = append(args, f.To.Unix())
+	}
+	if len(f.DeviceIDs) > 0 {
+		where = append(where, "device_id in ("+placeholders(len(f.DeviceIDs))+")")
+		for _, id := range f.DeviceIDs {
+			args = append(args, id)
+		}
+	}
+
+	q := `select id, device_id, sensor_type, sensor_name, ts, message, restarted from sensor_errors`
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	q += " order by ts desc, id desc"
+	if f.Limit > 0 {
+		q += " limit ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := d.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SensorErrors: failed to get rows: %w", err)
+	}
+	defer rows.Close()
+
+	out := []SensorError{}
+	for rows.Next() {
+		var (
+			e          SensorError
+			sensorType int
+			ts         int64
+		)
+		if err := rows.Scan(&e.ID, &e.DeviceID, &sensorType, &e.Sensor, &ts, &e.Message, &e.Restarted); err != nil {
+			return nil, fmt.Errorf("SensorErrors: failed to scan: %w", err)
+		}
+		e.SensorType = sensor.NameByType(sensorType)
+		e.Timestamp = time.Unix(ts, 0)
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
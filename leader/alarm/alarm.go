@@ -0,0 +1,403 @@
+package alarm
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/metrics"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// State is a state of the alarm
+type State string
+
+const (
+	StateDisarmed State = "disarmed"
+	// StateArming is the exit delay, after which the alarm becomes armed home or away
+	StateArming    State = "arming"
+	StateArmedHome State = "armed_home"
+	StateArmedAway State = "armed_away"
+	// StatePending is the entry delay, after which the alarm triggers unless disarmed
+	StatePending   State = "pending"
+	StateTriggered State = "triggered"
+)
+
+// ZoneType decides how the sensors in a zone affect the alarm
+type ZoneType string
+
+const (
+	// ZoneEntry sensors, such as the front door, start the entry delay when armed
+	ZoneEntry ZoneType = "entry"
+	// ZoneInstant sensors, such as windows, trigger the alarm immediately when armed
+	ZoneInstant ZoneType = "instant"
+	// ZoneInterior sensors, such as hallway motion, are ignored when armed home. When armed away they
+	// trigger the alarm immediately, unless the entry delay is already running.
+	ZoneInterior ZoneType = "interior"
+	// Zone24h sensors trigger the alarm in every state, even disarmed
+	Zone24h ZoneType = "24h"
+)
+
+// Zone groups contact and motion sensors which share a rule
+type Zone struct {
+	Name string   `mapstructure:"name" json:"name"`
+	Type ZoneType `mapstructure:"type" json:"type"`
+	// Sensors are the names of the sensors in the zone. A name may be qualified by device ID, as 3/front_door,
+	// to pick out one node's sensor when several nodes use the same name.
+	Sensors []string `mapstructure:"sensors" json:"sensors"`
+}
+
+// Config holds the PIN, delays and zones of the alarm
+type Config struct {
+	PIN        string
+	ExitDelay  time.Duration
+	EntryDelay time.Duration
+	Zones      []Zone
+}
+
+var (
+	ErrInvalidPIN = errors.New("invalid PIN")
+	// ErrLockedOut is returned for every PIN attempt from a source for a while after too many invalid attempts from it,
+	// and for every attempt from any source after too many invalid attempts in total
+	ErrLockedOut         = errors.New("too many invalid PIN attempts, try again later")
+	ErrInvalidTransition = errors.New("invalid alarm transition")
+)
+
+const (
+	// maxPINAttempts invalid attempts from one source within pinLockout lock that source out
+	maxPINAttempts = 5
+	pinLockout     = time.Minute
+	// maxTotalPINAttempts invalid attempts from any sources within totalPINLockout lock every source out. Sources
+	// are told apart by client address, which a client can forge, so this caps guessing however the source is given.
+	maxTotalPINAttempts = 10
+	totalPINLockout     = 15 * time.Minute
+	tickInterval        = time.Second
+)
+
+// Status is the current state of the alarm
+type Status struct {
+	State State `json:"state"`
+	// Target is the armed state being armed into, or the armed state interrupted by an entry delay or trigger
+	Target    State     `json:"target,omitempty"`
+	ChangedAt time.Time `json:"changedAt"`
+	// Deadline is when the running exit or entry delay ends
+	Deadline *time.Time `json:"deadline,omitempty"`
+	Zones    []Zone     `json:"zones"`
+}
+
+// Alarm is the security state machine of the leader. It is armed and disarmed with a PIN, and triggered by
+// events from contact and motion sensors according to their zone. Every transition is persisted with an
+// audit log entry, so the alarm resumes in the same state when the leader restarts.
+type Alarm struct {
+	db  *db.DB
+	cfg Config
+	// zones maps sensor names, and device qualified sensor names, to their zone
+	zones map[string]Zone
+
+	lock sync.Mutex
+	st   db.AlarmState
+	// failedPINs holds the recent invalid PIN attempts of each source, so guessing from one client locks it out
+	// before it locks out the others. allFailedPINs holds those of every source. Both are kept in memory only,
+	// so restarting the leader clears them.
+	failedPINs    map[string][]time.Time
+	allFailedPINs []time.Time
+}
+
+func New(d *db.DB, cfg Config) (*Alarm, error) {
+	if cfg.PIN == "" {
+		return nil, errors.New("alarm PIN cannot be blank")
+	}
+	zones, err := zonesBySensor(cfg.Zones)
+	if err != nil {
+		return nil, err
+	}
+
+	st, ok, err := d.AlarmState()
+	if err != nil {
+		return nil, fmt.Errorf("New: error loading alarm state: %w", err)
+	}
+	if !ok {
+		st = db.AlarmState{State: string(StateDisarmed), ChangedAt: time.Now()}
+	}
+
+	a := &Alarm{db: d, cfg: cfg, zones: zones, st: st, failedPINs: make(map[string][]time.Time)}
+	log.Info().Str("state", st.State).Int("zones", len(cfg.Zones)).Msg("Alarm loaded")
+	// delays which ended while the leader was down take effect now
+	a.Tick(time.Now())
+	metrics.SetAlarmState(st.State)
+
+	return a, nil
+}
+
+func zonesBySensor(zones []Zone) (map[string]Zone, error) {
+	names := make(map[string]bool)
+	bySensor := make(map[string]Zone)
+	for _, z := range zones {
+		if z.Name == "" {
+			return nil, errors.New("alarm zone name cannot be blank")
+		}
+		if names[z.Name] {
+			return nil, fmt.Errorf("duplicate alarm zone %q", z.Name)
+		}
+		names[z.Name] = true
+
+		switch z.Type {
+		case ZoneEntry, ZoneInstant, ZoneInterior, Zone24h:
+		default:
+			return nil, fmt.Errorf("alarm zone %s: invalid type %q", z.Name, z.Type)
+		}
+		if len(z.Sensors) == 0 {
+			return nil, fmt.Errorf("alarm zone %s has no sensors", z.Name)
+		}
+		for _, s := range z.Sensors {
+			if other, ok := bySensor[s]; ok {
+				return nil, fmt.Errorf("sensor %s is in alarm zones %s and %s", s, other.Name, z.Name)
+			}
+			bySensor[s] = z
+		}
+	}
+
+	return bySensor, nil
+}
+
+// Start resolves exit and entry delays as they end, in the background
+func (a *Alarm) Start() {
+	go func() {
+		t := time.NewTicker(tickInterval)
+		for now := range t.C {
+			a.Tick(now)
+		}
+	}()
+}
+
+func (a *Alarm) Status() Status {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s := Status{
+		State:     State(a.st.State),
+		Target:    State(a.st.Target),
+		ChangedAt: a.st.ChangedAt,
+		Zones:     a.cfg.Zones,
+	}
+	if !a.st.Deadline.IsZero() {
+		deadline := a.st.Deadline
+		s.Deadline = &deadline
+	}
+
+	return s
+}
+
+// Transitions returns audit log entries matching f, newest first
+func (a *Alarm) Transitions(f db.AlarmTransitionsFilter) ([]db.AlarmTransition, error) {
+	return a.db.AlarmTransitions(f)
+}
+
+// Arm starts the exit delay into mode, either armed home or armed away. The alarm must be disarmed.
+// source identifies who armed it in the audit log.
+func (a *Alarm) Arm(mode State, pin, source string) error {
+	return a.arm(time.Now(), mode, pin, source)
+}
+
+func (a *Alarm) arm(now time.Time, mode State, pin, source string) error {
+	if mode != StateArmedHome && mode != StateArmedAway {
+		return fmt.Errorf("%w: cannot arm to %s", ErrInvalidTransition, mode)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.checkPIN(now, pin, source); err != nil {
+		return err
+	}
+	if State(a.st.State) != StateDisarmed {
+		return fmt.Errorf("%w: alarm is %s", ErrInvalidTransition, a.st.State)
+	}
+
+	if a.cfg.ExitDelay <= 0 {
+		a.transition(now, mode, "", time.Time{}, db.AlarmTransition{Reason: "armed", Source: source})
+		return nil
+	}
+	a.transition(now, StateArming, mode, now.Add(a.cfg.ExitDelay), db.AlarmTransition{Reason: "armed", Source: source})
+
+	return nil
+}
+
+// Disarm disarms the alarm from any other state, stopping a running delay or a trigger
+func (a *Alarm) Disarm(pin, source string) error {
+	return a.disarm(time.Now(), pin, source)
+}
+
+func (a *Alarm) disarm(now time.Time, pin, source string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.checkPIN(now, pin, source); err != nil {
+		return err
+	}
+	a.expire(now)
+	if State(a.st.State) == StateDisarmed {
+		return fmt.Errorf("%w: alarm is already disarmed", ErrInvalidTransition)
+	}
+	a.transition(now, StateDisarmed, "", time.Time{}, db.AlarmTransition{Reason: "disarmed", Source: source})
+
+	return nil
+}
+
+// checkPIN compares pin in constant time, locking out further attempts from source after repeated failures from it,
+// and from every source after repeated failures from any. Call with lock held.
+func (a *Alarm) checkPIN(now time.Time, pin, source string) error {
+	for s, failed := range a.failedPINs {
+		if failed = pruneAttempts(failed, now, pinLockout); len(failed) == 0 {
+			delete(a.failedPINs, s)
+		} else {
+			a.failedPINs[s] = failed
+		}
+	}
+	a.allFailedPINs = pruneAttempts(a.allFailedPINs, now, totalPINLockout)
+	if len(a.failedPINs[source]) >= maxPINAttempts {
+		log.Warn().Str("source", source).Msg("Alarm PIN attempt while locked out")
+		return ErrLockedOut
+	}
+	if len(a.allFailedPINs) >= maxTotalPINAttempts {
+		log.Warn().Str("source", source).Msg("Alarm PIN attempt while every source is locked out")
+		return ErrLockedOut
+	}
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(a.cfg.PIN)) != 1 {
+		a.failedPINs[source] = append(a.failedPINs[source], now)
+		a.allFailedPINs = append(a.allFailedPINs, now)
+		log.Warn().Str("source", source).Int("failedAttempts", len(a.failedPINs[source])).
+			Int("totalFailedAttempts", len(a.allFailedPINs)).Msg("Invalid alarm PIN")
+		return ErrInvalidPIN
+	}
+	delete(a.failedPINs, source)
+
+	return nil
+}
+
+// pruneAttempts drops the attempts older than window from failed, which is oldest first
+func pruneAttempts(failed []time.Time, now time.Time, window time.Duration) []time.Time {
+	for len(failed) > 0 && now.Sub(failed[0]) > window {
+		failed = failed[1:]
+	}
+
+	return failed
+}
+
+// HandleEvent applies the rule of the sensor's zone to an event. Sensors in no zone are ignored.
+func (a *Alarm) HandleEvent(deviceID uint8, e sensor.Event) {
+	a.handleEvent(time.Now(), deviceID, e)
+}
+
+func (a *Alarm) handleEvent(now time.Time, deviceID uint8, e sensor.Event) {
+	// closing a door or motion stopping never sets the alarm off
+	if e.State != sensor.StateOpen && e.State != sensor.StateStart {
+		return
+	}
+	z, ok := a.zones[strconv.Itoa(int(deviceID))+"/"+e.Sensor]
+	if !ok {
+		if z, ok = a.zones[e.Sensor]; !ok {
+			return
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// the event may arrive before the next tick has ended an expired delay
+	a.expire(now)
+	to, ok := a.respond(z)
+	if !ok {
+		return
+	}
+
+	t := db.AlarmTransition{Source: "sensor", Zone: z.Name, DeviceID: deviceID, Sensor: e.Sensor}
+	// an entry or trigger remembers the armed state it interrupted
+	target := State(a.st.State)
+	if target == StatePending {
+		target = State(a.st.Target)
+	} else if target == StateDisarmed {
+		target = ""
+	}
+	if to == StatePending && a.cfg.EntryDelay > 0 {
+		t.Reason = "entry delay started"
+		a.transition(now, StatePending, target, now.Add(a.cfg.EntryDelay), t)
+		return
+	}
+	t.Reason = fmt.Sprintf("%s zone %s %s", z.Type, z.Name, e.State)
+	a.transition(now, StateTriggered, target, time.Time{}, t)
+}
+
+// respond returns the state an active sensor in z moves the alarm to, if any. Call with lock held.
+func (a *Alarm) respond(z Zone) (State, bool) {
+	st := State(a.st.State)
+	if st == StateTriggered {
+		return "", false
+	}
+	if z.Type == Zone24h {
+		return StateTriggered, true
+	}
+
+	switch st {
+	case StateArmedHome, StateArmedAway:
+		switch z.Type {
+		case ZoneEntry:
+			return StatePending, true
+		case ZoneInstant:
+			return StateTriggered, true
+		case ZoneInterior:
+			if st == StateArmedAway {
+				return StateTriggered, true
+			}
+		}
+	case StatePending:
+		// interior sensors follow the entry delay, so walking from the door to the keypad is allowed
+		if z.Type == ZoneInstant {
+			return StateTriggered, true
+		}
+	}
+
+	return "", false
+}
+
+// Tick ends the exit or entry delay if its deadline has passed
+func (a *Alarm) Tick(now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.expire(now)
+}
+
+// expire ends the exit or entry delay if its deadline has passed. Call with lock held.
+func (a *Alarm) expire(now time.Time) {
+	if a.st.Deadline.IsZero() || now.Before(a.st.Deadline) {
+		return
+	}
+
+	switch State(a.st.State) {
+	case StateArming:
+		a.transition(now, State(a.st.Target), "", time.Time{}, db.AlarmTransition{Reason: "exit delay ended", Source: "timer"})
+	case StatePending:
+		a.transition(now, StateTriggered, State(a.st.Target), time.Time{}, db.AlarmTransition{Reason: "entry delay ended", Source: "timer"})
+	}
+}
+
+// transition moves to a new state and persists it with its audit log entry. The state changes even if it
+// cannot be persisted, since an alarm must not fail to trigger because of a full disk. Call with lock held.
+func (a *Alarm) transition(now time.Time, to, target State, deadline time.Time, t db.AlarmTransition) {
+	t.Timestamp = now
+	t.From = a.st.State
+	t.To = string(to)
+	a.st = db.AlarmState{State: string(to), Target: string(target), ChangedAt: now, Deadline: deadline}
+
+	lm := log.Info()
+	if to == StateTriggered || to == StatePending {
+		lm = log.Warn()
+	}
+	lm.Str("from", t.From).Str("to", t.To).Str("reason", t.Reason).Str("source", t.Source).Msg("Alarm state changed")
+	metrics.SetAlarmState(t.To)
+
+	if err := a.db.SaveAlarmTransition(a.st, t); err != nil {
+		log.Err(err).Msg("error saving alarm transition")
+	}
+}
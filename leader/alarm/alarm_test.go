@@ -0,0 +1,242 @@
+package alarm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPIN = "1234"
+
+var testZones = []Zone{
+	{Name: "front door", Type: ZoneEntry, Sensors: []string{"front_door"}},
+	{Name: "windows", Type: ZoneInstant, Sensors: []string{"window"}},
+	{Name: "hallway", Type: ZoneInterior, Sensors: []string{"2/hall"}},
+	{Name: "smoke", Type: Zone24h, Sensors: []string{"smoke"}},
+}
+
+func newTestAlarm(t *testing.T, file string) *Alarm {
+	t.Helper()
+	d, err := db.NewDB(file)
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(d.Close)
+	a, err := New(d, Config{PIN: testPIN, ExitDelay: time.Minute, EntryDelay: 30 * time.Second, Zones: testZones})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	return a
+}
+
+func open(name string) sensor.Event {
+	return sensor.Event{Sensor: name, Kind: sensor.EventKindContact, State: sensor.StateOpen}
+}
+
+func TestAlarm(t *testing.T) {
+	start := time.Unix(1000, 0)
+	// step is one input to the alarm, at a number of seconds after start
+	type step struct {
+		secs     int
+		arm      State
+		disarm   bool
+		pin      string
+		deviceID uint8
+		event    *sensor.Event
+		wantErr  error
+		want     State
+	}
+	motion := sensor.Event{Sensor: "hall", Kind: sensor.EventKindMotion, State: sensor.StateStart}
+	closed := sensor.Event{Sensor: "front_door", Kind: sensor.EventKindContact, State: sensor.StateClosed}
+	frontDoor, window, smoke := open("front_door"), open("window"), open("smoke")
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"exit delay then armed", []step{
+			{secs: 0, arm: StateArmedAway, pin: testPIN, want: StateArming},
+			{secs: 30, event: &frontDoor, want: StateArming},
+			{secs: 60, want: StateArmedAway},
+		}},
+		{"entry delay then disarmed", []step{
+			{secs: 0, arm: StateArmedAway, pin: testPIN, want: StateArming},
+			{secs: 60, want: StateArmedAway},
+			{secs: 100, event: &frontDoor, want: StatePending},
+			{secs: 105, deviceID: 2, event: &motion, want: StatePending},
+			{secs: 110, disarm: true, pin: testPIN, want: StateDisarmed},
+		}},
+		{"entry delay expires", []step{
+			{secs: 0, arm: StateArmedHome, pin: testPIN, want: StateArming},
+			{secs: 60, event: &frontDoor, want: StatePending},
+			{secs: 90, want: StateTriggered},
+			{secs: 95, disarm: true, pin: testPIN, want: StateDisarmed},
+		}},
+		{"instant zone during entry delay", []step{
+			{secs: 0, arm: StateArmedHome, pin: testPIN, want: StateArming},
+			{secs: 60, event: &frontDoor, want: StatePending},
+			{secs: 65, event: &window, want: StateTriggered},
+		}},
+		{"interior ignored when armed home", []step{
+			{secs: 0, arm: StateArmedHome, pin: testPIN, want: StateArming},
+			{secs: 60, deviceID: 2, event: &motion, want: StateArmedHome},
+		}},
+		{"interior triggers when armed away", []step{
+			{secs: 0, arm: StateArmedAway, pin: testPIN, want: StateArming},
+			{secs: 60, want: StateArmedAway},
+			{secs: 60, deviceID: 1, event: &motion, want: StateArmedAway},
+			{secs: 61, deviceID: 2, event: &motion, want: StateTriggered},
+		}},
+		{"closing never triggers", []step{
+			{secs: 0, arm: StateArmedAway, pin: testPIN, want: StateArming},
+			{secs: 60, want: StateArmedAway},
+			{secs: 61, event: &closed, want: StateArmedAway},
+		}},
+		{"24h zone triggers when disarmed", []step{
+			{secs: 0, event: &smoke, want: StateTriggered},
+		}},
+		{"wrong PIN", []step{
+			{secs: 0, arm: StateArmedAway, pin: "0000", wantErr: ErrInvalidPIN, want: StateDisarmed},
+			{secs: 1, arm: StateArmedAway, pin: testPIN, want: StateArming},
+			{secs: 2, disarm: true, pin: "", wantErr: ErrInvalidPIN, want: StateArming},
+		}},
+		{"arm twice", []step{
+			{secs: 0, arm: StateArmedAway, pin: testPIN, want: StateArming},
+			{secs: 1, arm: StateArmedHome, pin: testPIN, wantErr: ErrInvalidTransition, want: StateArming},
+		}},
+		{"disarm when disarmed", []step{
+			{secs: 0, disarm: true, pin: testPIN, wantErr: ErrInvalidTransition, want: StateDisarmed},
+		}},
+		{"invalid arm mode", []step{
+			{secs: 0, arm: StateTriggered, pin: testPIN, wantErr: ErrInvalidTransition, want: StateDisarmed},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAlarm(t, filepath.Join(t.TempDir(), "leader.db"))
+			for i, s := range tt.steps {
+				now := start.Add(time.Duration(s.secs) * time.Second)
+				var err error
+				switch {
+				case s.arm != "":
+					err = a.arm(now, s.arm, s.pin, "test")
+				case s.disarm:
+					err = a.disarm(now, s.pin, "test")
+				case s.event != nil:
+					a.handleEvent(now, s.deviceID, *s.event)
+				default:
+					a.Tick(now)
+				}
+				if !errors.Is(err, s.wantErr) {
+					t.Errorf("step %d: error = %v, want %v", i, err, s.wantErr)
+				}
+				if got := a.Status().State; got != s.want {
+					t.Fatalf("step %d: state = %s, want %s", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAlarm_lockout(t *testing.T) {
+	a := newTestAlarm(t, filepath.Join(t.TempDir(), "leader.db"))
+	now := time.Unix(1000, 0)
+	for i := 0; i < maxPINAttempts; i++ {
+		if err := a.arm(now, StateArmedAway, "0000", "test"); !errors.Is(err, ErrInvalidPIN) {
+			t.Fatalf("attempt %d: error = %v, want %v", i, err, ErrInvalidPIN)
+		}
+	}
+	if err := a.arm(now, StateArmedAway, testPIN, "test"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("correct PIN while locked out: error = %v, want %v", err, ErrLockedOut)
+	}
+	// guessing from one client does not lock out the others
+	if err := a.arm(now, StateArmedAway, testPIN, "keypad"); err != nil {
+		t.Fatalf("correct PIN from another source: error = %v", err)
+	}
+	if err := a.disarm(now, testPIN, "keypad"); err != nil {
+		t.Fatalf("disarm from another source: error = %v", err)
+	}
+	if err := a.arm(now.Add(pinLockout+time.Second), StateArmedAway, testPIN, "test"); err != nil {
+		t.Fatalf("correct PIN after lockout: error = %v", err)
+	}
+}
+
+func TestAlarm_totalLockout(t *testing.T) {
+	a := newTestAlarm(t, filepath.Join(t.TempDir(), "leader.db"))
+	now := time.Unix(1000, 0)
+	// a new source for every guess is still capped
+	for i := 0; i < maxTotalPINAttempts; i++ {
+		if err := a.arm(now, StateArmedAway, "0000", fmt.Sprintf("10.0.0.%d", i)); !errors.Is(err, ErrInvalidPIN) {
+			t.Fatalf("attempt %d: error = %v, want %v", i, err, ErrInvalidPIN)
+		}
+	}
+	if err := a.arm(now, StateArmedAway, testPIN, "keypad"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("correct PIN from a new source while locked out: error = %v, want %v", err, ErrLockedOut)
+	}
+	if err := a.arm(now.Add(pinLockout+time.Second), StateArmedAway, testPIN, "keypad"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("correct PIN after a source lockout: error = %v, want %v", err, ErrLockedOut)
+	}
+	if err := a.arm(now.Add(totalPINLockout+time.Second), StateArmedAway, testPIN, "keypad"); err != nil {
+		t.Fatalf("correct PIN after the total lockout: error = %v", err)
+	}
+}
+
+func TestAlarm_persisted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leader.db")
+	a := newTestAlarm(t, file)
+	now := time.Now()
+	if err := a.arm(now.Add(-2*time.Minute), StateArmedHome, testPIN, "test"); err != nil {
+		t.Fatalf("arm() error = %v", err)
+	}
+
+	// the exit delay ended while the leader was down
+	restarted := newTestAlarm(t, file)
+	if got := restarted.Status().State; got != StateArmedHome {
+		t.Errorf("state after restart = %s, want %s", got, StateArmedHome)
+	}
+
+	transitions, err := restarted.Transitions(db.AlarmTransitionsFilter{})
+	if err != nil {
+		t.Fatalf("Transitions() error = %v", err)
+	}
+	if len(transitions) != 2 {
+		t.Fatalf("got %d transitions, want 2: %+v", len(transitions), transitions)
+	}
+	if tr := transitions[1]; tr.From != string(StateDisarmed) || tr.To != string(StateArming) || tr.Source != "test" {
+		t.Errorf("first transition = %+v", tr)
+	}
+	if tr := transitions[0]; tr.To != string(StateArmedHome) || tr.Reason != "exit delay ended" {
+		t.Errorf("second transition = %+v", tr)
+	}
+}
+
+func TestNew_invalidZones(t *testing.T) {
+	d, err := db.NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer d.Close()
+
+	tests := []struct {
+		name  string
+		zones []Zone
+	}{
+		{"blank name", []Zone{{Type: ZoneEntry, Sensors: []string{"a"}}}},
+		{"duplicate name", []Zone{{Name: "a", Type: ZoneEntry, Sensors: []string{"a"}}, {Name: "a", Type: ZoneEntry, Sensors: []string{"b"}}}},
+		{"invalid type", []Zone{{Name: "a", Type: "sometimes", Sensors: []string{"a"}}}},
+		{"no sensors", []Zone{{Name: "a", Type: ZoneEntry}}},
+		{"sensor in two zones", []Zone{{Name: "a", Type: ZoneEntry, Sensors: []string{"a"}}, {Name: "b", Type: ZoneInstant, Sensors: []string{"a"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(d, Config{PIN: testPIN, Zones: tt.zones}); err == nil {
+				t.Error("New() error = nil, want error")
+			}
+		})
+	}
+}
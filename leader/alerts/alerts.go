@@ -0,0 +1,433 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/units"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Conditions of an alert rule
+const (
+	// ConditionAbove holds while the value is above the threshold
+	ConditionAbove = "above"
+	// ConditionBelow holds while the value is below the threshold
+	ConditionBelow = "below"
+	// ConditionRise holds while the value has risen by more than the threshold within the window
+	ConditionRise = "rise"
+	// ConditionFall holds while the value has fallen by more than the threshold within the window
+	ConditionFall = "fall"
+)
+
+// States of an alert
+const (
+	StateOpen         = "open"
+	StateAcknowledged = "acknowledged"
+	StateResolved     = "resolved"
+)
+
+// Severities of an alert
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Changes of an alert passed to a Handler
+const (
+	EventOpened    = "opened"
+	EventEscalated = "escalated"
+	EventResolved  = "resolved"
+)
+
+// Handler is called when an alert opens, escalates or resolves, with the rule which raised it
+type Handler func(event string, a db.Alert, r db.AlertRule)
+
+var (
+	ErrInvalidRule = errors.New("invalid alert rule")
+	// ErrNotOpen is returned when acknowledging an alert which is not open
+	ErrNotOpen = errors.New("alert is not open")
+)
+
+// Engine evaluates incoming measurements against the alert rules stored in the database.
+// An alert opens once a rule's condition has held for the rule's duration, and resolves once the value
+// is back past the threshold by the rule's hysteresis. Open alerts are reloaded when the leader restarts.
+type Engine struct {
+	db *db.DB
+
+	lock     sync.Mutex
+	rules    []db.AlertRule
+	series   map[seriesKey]*series
+	handlers []Handler
+}
+
+// seriesKey identifies the values of a rule's metric from one device
+type seriesKey struct {
+	ruleID   int64
+	deviceID uint8
+}
+
+type sample struct {
+	ts    time.Time
+	value float64
+}
+
+// series tracks the condition of a rule on one device
+type series struct {
+	// samples are the values within the rule's window, for rise and fall rules
+	samples []sample
+	// since is when the condition started holding, zero if it does not
+	since time.Time
+	// alert is the open or acknowledged alert, nil if there is none
+	alert      *db.Alert
+	resolvedAt time.Time
+}
+
+func New(d *db.DB) (*Engine, error) {
+	e := &Engine{db: d, series: make(map[seriesKey]*series)}
+	if err := e.loadRules(); err != nil {
+		return nil, err
+	}
+
+	active, err := d.Alerts(db.AlertsFilter{States: []string{StateOpen, StateAcknowledged}})
+	if err != nil {
+		return nil, fmt.Errorf("New: error loading active alerts: %w", err)
+	}
+	for i := range active {
+		if active[i].RuleID == 0 {
+			// raised by the offline monitor rather than a rule
+			continue
+		}
+		e.seriesOf(active[i].RuleID, active[i].DeviceID).alert = &active[i]
+	}
+	log.Info().Int("rules", len(e.rules)).Int("activeAlerts", len(active)).Msg("Alert rules loaded")
+
+	return e, nil
+}
+
+// OnChange calls h whenever an alert opens, escalates or resolves. h is called with the engine locked, so must not block.
+func (e *Engine) OnChange(h Handler) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.handlers = append(e.handlers, h)
+}
+
+// emit calls the change handlers on behalf of another alert source, such as the offline monitor
+func (e *Engine) emit(event string, a db.Alert, r db.AlertRule) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.changed(event, a, r)
+}
+
+// changed calls the change handlers. Call with lock held.
+func (e *Engine) changed(event string, a db.Alert, r db.AlertRule) {
+	for _, h := range e.handlers {
+		h(event, a, r)
+	}
+}
+
+func (e *Engine) loadRules() error {
+	rules, err := e.db.AlertRules()
+	if err != nil {
+		return fmt.Errorf("error loading alert rules: %w", err)
+	}
+	e.rules = rules
+
+	return nil
+}
+
+func (e *Engine) seriesOf(ruleID int64, deviceID uint8) *series {
+	key := seriesKey{ruleID: ruleID, deviceID: deviceID}
+	s, ok := e.series[key]
+	if !ok {
+		s = &series{}
+		e.series[key] = s
+	}
+
+	return s
+}
+
+// Evaluate checks measurements taken by deviceID at ts against every enabled rule
+func (e *Engine) Evaluate(deviceID uint8, ts time.Time, ms []sensor.Measurement) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, r := range e.rules {
+		if r.Disabled || (r.DeviceID != nil && *r.DeviceID != deviceID) {
+			continue
+		}
+		for _, m := range ms {
+			if m.Metric == r.Metric {
+				e.evaluate(r, deviceID, ts, m.Value)
+			}
+		}
+	}
+}
+
+// evaluate applies a single value to a rule. Call with lock held.
+func (e *Engine) evaluate(r db.AlertRule, deviceID uint8, ts time.Time, v float64) {
+	s := e.seriesOf(r.ID, deviceID)
+
+	// rise and fall rules compare against the oldest value within the window, and are checked as above the threshold
+	x := v
+	if r.Condition == ConditionRise || r.Condition == ConditionFall {
+		window := time.Duration(r.WindowSecs) * time.Second
+		s.samples = append(s.samples, sample{ts: ts, value: v})
+		for len(s.samples) > 1 && ts.Sub(s.samples[0].ts) > window {
+			s.samples = s.samples[1:]
+		}
+		x = v - s.samples[0].value
+		if r.Condition == ConditionFall {
+			x = -x
+		}
+	}
+
+	var holds, cleared bool
+	if r.Condition == ConditionBelow {
+		holds, cleared = x < r.Threshold, x >= r.Threshold+r.Hysteresis
+	} else {
+		holds, cleared = x > r.Threshold, x <= r.Threshold-r.Hysteresis
+	}
+
+	if s.alert != nil {
+		if cleared {
+			e.resolve(r, s, ts)
+		}
+		return
+	}
+	if !holds {
+		s.since = time.Time{}
+		return
+	}
+	if s.since.IsZero() {
+		s.since = ts
+	}
+	if ts.Sub(s.since) < time.Duration(r.ForSecs)*time.Second {
+		return
+	}
+	if !s.resolvedAt.IsZero() && ts.Sub(s.resolvedAt) < time.Duration(r.CooldownSecs)*time.Second {
+		return
+	}
+
+	m, err := e.db.Metric(r.Metric)
+	if err != nil {
+		log.Err(err).Int64("ruleID", r.ID).Msg("error looking up the unit of an alert")
+	}
+	a := db.Alert{
+		RuleID:     r.ID,
+		RuleName:   r.Name,
+		DeviceID:   deviceID,
+		Metric:     r.Metric,
+		State:      StateOpen,
+		Severity:   SeverityWarning,
+		Value:      v,
+		Threshold:  r.Threshold,
+		Unit:       m.Unit,
+		Condition:  r.Condition,
+		WindowSecs: r.WindowSecs,
+		OpenedAt:   ts,
+	}
+	a.Message = Describe(a)
+	a, err = e.db.OpenAlert(a)
+	if err != nil {
+		log.Err(err).Int64("ruleID", r.ID).Msg("error opening alert")
+		return
+	}
+	log.Warn().Int64("alertID", a.ID).Str("rule", r.Name).Uint8("deviceID", deviceID).Str("message", a.Message).Msg("Alert opened")
+	s.alert = &a
+	e.changed(EventOpened, a, r)
+}
+
+// resolve resolves the series' alert. Call with lock held.
+func (e *Engine) resolve(r db.AlertRule, s *series, ts time.Time) {
+	if err := e.db.ResolveAlert(s.alert.ID, StateResolved, ts); err != nil {
+		log.Err(err).Int64("alertID", s.alert.ID).Msg("error resolving alert")
+		return
+	}
+	log.Info().Int64("alertID", s.alert.ID).Str("rule", s.alert.RuleName).Uint8("deviceID", s.alert.DeviceID).Msg("Alert resolved")
+	a := *s.alert
+	a.State = StateResolved
+	a.ResolvedAt = &ts
+	e.changed(EventResolved, a, r)
+	s.alert = nil
+	s.since = time.Time{}
+	s.resolvedAt = ts
+}
+
+// Describe returns the message of an alert raised by a rule, from its value, threshold and unit
+func Describe(a db.Alert) string {
+	value, threshold := withUnit(a.Value, a.Unit), withUnit(a.Threshold, a.Unit)
+	window := time.Duration(a.WindowSecs) * time.Second
+	switch a.Condition {
+	case ConditionRise:
+		return fmt.Sprintf("%s on device %d rose more than %s in %s, to %s", a.Metric, a.DeviceID, threshold, window, value)
+	case ConditionFall:
+		return fmt.Sprintf("%s on device %d fell more than %s in %s, to %s", a.Metric, a.DeviceID, threshold, window, value)
+	default:
+		return fmt.Sprintf("%s on device %d is %s, %s %s", a.Metric, a.DeviceID, value, a.Condition, threshold)
+	}
+}
+
+// withUnit formats x to at most two decimal places, followed by unit if there is one
+func withUnit(x float64, unit string) string {
+	s := strconv.FormatFloat(math.Round(x*100)/100, 'f', -1, 64)
+	if unit == "" {
+		return s
+	}
+
+	return s + " " + unit
+}
+
+// InUnits converts the value, threshold and message of an alert raised by a rule to prefs. Node offline alerts,
+// and alerts stored before their rule's condition was, are returned unchanged.
+func InUnits(a db.Alert, prefs units.Preferences) db.Alert {
+	if a.Condition == "" {
+		return a
+	}
+
+	stored := a.Unit
+	a.Value, a.Unit = prefs.Convert(a.Value, stored)
+	if a.Condition == ConditionRise || a.Condition == ConditionFall {
+		a.Threshold, _ = prefs.ConvertChange(a.Threshold, stored)
+	} else {
+		a.Threshold, _ = prefs.Convert(a.Threshold, stored)
+	}
+	a.Message = Describe(a)
+
+	return a
+}
+
+// Acknowledge marks an open alert as seen. It stays active until its condition clears.
+func (e *Engine) Acknowledge(id int64) (db.Alert, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	a, err := e.db.Alert(id)
+	if err != nil {
+		return db.Alert{}, err
+	}
+	if a.State != StateOpen {
+		return db.Alert{}, fmt.Errorf("%w: alert %d is %s", ErrNotOpen, id, a.State)
+	}
+	now := time.Now()
+	if err := e.db.AcknowledgeAlert(id, StateAcknowledged, []string{StateOpen}, now); err != nil {
+		return db.Alert{}, err
+	}
+	a.State = StateAcknowledged
+	a.AcknowledgedAt = &now
+	if s, ok := e.series[seriesKey{ruleID: a.RuleID, deviceID: a.DeviceID}]; ok && s.alert != nil && s.alert.ID == id {
+		s.alert = &a
+	}
+
+	return a, nil
+}
+
+// Alerts returns stored alerts matching f, newest first
+func (e *Engine) Alerts(f db.AlertsFilter) ([]db.Alert, error) {
+	return e.db.Alerts(f)
+}
+
+func (e *Engine) Rules() []db.AlertRule {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]db.AlertRule{}, e.rules...)
+}
+
+// ValidateRule checks the fields of r which the database cannot
+func ValidateRule(r db.AlertRule) error {
+	switch {
+	case r.Name == "":
+		return fmt.Errorf("%w: name cannot be blank", ErrInvalidRule)
+	case r.Metric == "":
+		return fmt.Errorf("%w: metric cannot be blank", ErrInvalidRule)
+	case r.Hysteresis < 0 || r.WindowSecs < 0 || r.ForSecs < 0 || r.CooldownSecs < 0:
+		return fmt.Errorf("%w: hysteresis and durations cannot be negative", ErrInvalidRule)
+	}
+	switch r.Condition {
+	case ConditionAbove, ConditionBelow:
+	case ConditionRise, ConditionFall:
+		if r.WindowSecs == 0 {
+			return fmt.Errorf("%w: %s rules need a window", ErrInvalidRule, r.Condition)
+		}
+	default:
+		return fmt.Errorf("%w: condition must be above, below, rise or fall", ErrInvalidRule)
+	}
+
+	return nil
+}
+
+// CreateRule validates and stores a new rule, which applies to measurements from then on
+func (e *Engine) CreateRule(r db.AlertRule) (db.AlertRule, error) {
+	if err := ValidateRule(r); err != nil {
+		return db.AlertRule{}, err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	r, err := e.db.CreateAlertRule(r)
+	if err != nil {
+		return db.AlertRule{}, err
+	}
+
+	return r, e.loadRules()
+}
+
+// UpdateRule validates and replaces a rule. Its open alerts resolve once the new condition clears.
+func (e *Engine) UpdateRule(r db.AlertRule) error {
+	if err := ValidateRule(r); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := e.db.UpdateAlertRule(r); err != nil {
+		return err
+	}
+	e.resetSeries(r.ID, false)
+
+	return e.loadRules()
+}
+
+// DeleteRule deletes a rule, resolving its open alerts
+func (e *Engine) DeleteRule(id int64) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := e.db.DeleteAlertRule(id); err != nil {
+		return err
+	}
+	e.resetSeries(id, true)
+
+	return e.loadRules()
+}
+
+// resetSeries forgets the tracked values of a rule, resolving its open alerts if resolve is set.
+// Call with lock held, before the rules are reloaded.
+func (e *Engine) resetSeries(ruleID int64, resolve bool) {
+	var rule db.AlertRule
+	for _, r := range e.rules {
+		if r.ID == ruleID {
+			rule = r
+		}
+	}
+
+	now := time.Now()
+	for key, s := range e.series {
+		if key.ruleID != ruleID {
+			continue
+		}
+		if s.alert != nil && resolve {
+			e.resolve(rule, s, now)
+		}
+		if s.alert == nil {
+			delete(e.series, key)
+			continue
+		}
+		s.samples, s.since = nil, time.Time{}
+	}
+}
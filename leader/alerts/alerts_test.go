@@ -0,0 +1,311 @@
+package alerts
+
+import (
+	"errors"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/units"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) (*db.DB, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "leader.db")
+	d, err := db.NewDB(file)
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(d.Close)
+
+	return d, file
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	// point is a value of the rule's metric, a number of seconds after start
+	type point struct {
+		secs  int
+		value float64
+		// want is the state of the newest alert after the value, blank for no alert
+		want string
+	}
+	tests := []struct {
+		name   string
+		rule   db.AlertRule
+		points []point
+		// wantAlerts is the number of alerts opened
+		wantAlerts int
+	}{
+		{
+			name: "above opens and resolves",
+			rule: db.AlertRule{Condition: ConditionAbove, Threshold: 250},
+			points: []point{
+				{0, 200, ""},
+				{10, 260, StateOpen},
+				{20, 240, StateResolved},
+			},
+			wantAlerts: 1,
+		},
+		{
+			name: "below for a duration",
+			rule: db.AlertRule{Condition: ConditionBelow, Threshold: 18, ForSecs: 600},
+			points: []point{
+				{0, 17.5, ""},
+				{300, 17, ""},
+				{400, 18.5, ""},
+				{500, 17.9, ""},
+				{1099, 17.9, ""},
+				{1100, 17.8, StateOpen},
+			},
+			wantAlerts: 1,
+		},
+		{
+			name: "hysteresis",
+			rule: db.AlertRule{Condition: ConditionAbove, Threshold: 30, Hysteresis: 2},
+			points: []point{
+				{0, 31, StateOpen},
+				{10, 29, StateOpen},
+				{20, 30.5, StateOpen},
+				{30, 28, StateResolved},
+			},
+			wantAlerts: 1,
+		},
+		{
+			name: "cooldown",
+			rule: db.AlertRule{Condition: ConditionAbove, Threshold: 30, CooldownSecs: 60},
+			points: []point{
+				{0, 31, StateOpen},
+				{10, 29, StateResolved},
+				{20, 31, StateResolved},
+				{69, 31, StateResolved},
+				{70, 31, StateOpen},
+			},
+			wantAlerts: 2,
+		},
+		{
+			name: "rise within window",
+			rule: db.AlertRule{Condition: ConditionRise, Threshold: 15, WindowSecs: 1800},
+			points: []point{
+				{0, 40, ""},
+				{900, 50, ""},
+				{1800, 56, StateOpen},
+				// 40 has left the window, so the rise is from 50
+				{1900, 60, StateResolved},
+			},
+			wantAlerts: 1,
+		},
+		{
+			name: "fall",
+			rule: db.AlertRule{Condition: ConditionFall, Threshold: 5, WindowSecs: 600},
+			points: []point{
+				{0, 1010, ""},
+				{300, 1004, StateOpen},
+			},
+			wantAlerts: 1,
+		},
+		{
+			name: "other device",
+			rule: db.AlertRule{Condition: ConditionAbove, Threshold: 30, DeviceID: new(uint8)},
+			points: []point{
+				{0, 31, ""},
+			},
+		},
+		{
+			name: "disabled",
+			rule: db.AlertRule{Condition: ConditionAbove, Threshold: 30, Disabled: true},
+			points: []point{
+				{0, 31, ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDB(t)
+			e, err := New(d)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			tt.rule.Name = tt.name
+			tt.rule.Metric = "nursery.temperature"
+			if _, err := e.CreateRule(tt.rule); err != nil {
+				t.Fatalf("CreateRule() error = %v", err)
+			}
+
+			for i, p := range tt.points {
+				e.Evaluate(1, start.Add(time.Duration(p.secs)*time.Second), []sensor.Measurement{
+					{Metric: "nursery.temperature", Value: p.value},
+					{Metric: "nursery.humidity", Value: 1000},
+				})
+				as, err := e.Alerts(db.AlertsFilter{Limit: 1})
+				if err != nil {
+					t.Fatalf("Alerts() error = %v", err)
+				}
+				got := ""
+				if len(as) > 0 {
+					got = as[0].State
+				}
+				if got != p.want {
+					t.Fatalf("point %d: alert state = %q, want %q", i, got, p.want)
+				}
+			}
+
+			as, _ := e.Alerts(db.AlertsFilter{})
+			if len(as) != tt.wantAlerts {
+				t.Errorf("got %d alerts, want %d", len(as), tt.wantAlerts)
+			}
+		})
+	}
+}
+
+func TestEngine_acknowledgeAndReload(t *testing.T) {
+	d, file := newTestDB(t)
+	e, err := New(d)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := e.CreateRule(db.AlertRule{Name: "voc", Metric: sensor.MetricVOCIndex, Condition: ConditionAbove, Threshold: 250}); err != nil {
+		t.Fatalf("CreateRule() error = %v", err)
+	}
+	now := time.Now()
+	e.Evaluate(1, now, []sensor.Measurement{{Metric: sensor.MetricVOCIndex, Value: 300}})
+	as, _ := e.Alerts(db.AlertsFilter{})
+	if len(as) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(as))
+	}
+	if want := sensor.MetricVOCIndex + " on device 1 is 300, above 250"; as[0].Threshold != 250 || as[0].Condition != ConditionAbove ||
+		as[0].Message != want {
+		t.Errorf("opened alert = %+v, want threshold 250 and message %q", as[0], want)
+	}
+
+	acked, err := e.Acknowledge(as[0].ID)
+	if err != nil {
+		t.Fatalf("Acknowledge() error = %v", err)
+	}
+	if acked.State != StateAcknowledged || acked.AcknowledgedAt == nil {
+		t.Errorf("Acknowledge() = %+v", acked)
+	}
+	if _, err := e.Acknowledge(as[0].ID); !errors.Is(err, ErrNotOpen) {
+		t.Errorf("Acknowledge() twice error = %v, want %v", err, ErrNotOpen)
+	}
+	if _, err := e.Acknowledge(as[0].ID + 1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Acknowledge() missing error = %v, want %v", err, db.ErrNotFound)
+	}
+
+	// an engine started after a restart resolves the acknowledged alert
+	d.Close()
+	d, err = db.NewDB(file)
+	if err != nil {
+		t.Fatalf("NewDB() reopen error = %v", err)
+	}
+	defer d.Close()
+	e, err = New(d)
+	if err != nil {
+		t.Fatalf("New() after restart error = %v", err)
+	}
+	e.Evaluate(1, now.Add(time.Minute), []sensor.Measurement{{Metric: sensor.MetricVOCIndex, Value: 100}})
+	a, err := d.Alert(as[0].ID)
+	if err != nil {
+		t.Fatalf("Alert() error = %v", err)
+	}
+	if a.State != StateResolved || a.ResolvedAt == nil || a.AcknowledgedAt == nil {
+		t.Errorf("alert after restart = %+v", a)
+	}
+}
+
+func TestInUnits(t *testing.T) {
+	tests := []struct {
+		name          string
+		alert         db.Alert
+		prefs         units.Preferences
+		wantValue     float64
+		wantThreshold float64
+		wantUnit      string
+		wantMessage   string
+	}{
+		{
+			name:          "metric is unchanged",
+			alert:         db.Alert{DeviceID: 2, Metric: "nursery.temperature", Condition: ConditionBelow, Value: 17.5, Threshold: 18, Unit: units.Celsius},
+			prefs:         units.Metric,
+			wantValue:     17.5,
+			wantThreshold: 18,
+			wantUnit:      units.Celsius,
+			wantMessage:   "nursery.temperature on device 2 is 17.5 C, below 18 C",
+		},
+		{
+			name:          "imperial",
+			alert:         db.Alert{DeviceID: 2, Metric: "nursery.temperature", Condition: ConditionBelow, Value: 17.5, Threshold: 18, Unit: units.Celsius},
+			prefs:         units.Imperial,
+			wantValue:     63.5,
+			wantThreshold: 64.4,
+			wantUnit:      units.Fahrenheit,
+			wantMessage:   "nursery.temperature on device 2 is 63.5 F, below 64.4 F",
+		},
+		{
+			name: "rise threshold is a change",
+			alert: db.Alert{DeviceID: 1, Metric: "temperature", Condition: ConditionRise, WindowSecs: 600, Value: 30, Threshold: 5,
+				Unit: units.Celsius},
+			prefs:         units.Imperial,
+			wantValue:     86,
+			wantThreshold: 9,
+			wantUnit:      units.Fahrenheit,
+			wantMessage:   "temperature on device 1 rose more than 9 F in 10m0s, to 86 F",
+		},
+		{
+			name:          "unconvertible unit",
+			alert:         db.Alert{DeviceID: 1, Metric: "humidity", Condition: ConditionAbove, Value: 71, Threshold: 70, Unit: "%"},
+			prefs:         units.Imperial,
+			wantValue:     71,
+			wantThreshold: 70,
+			wantUnit:      "%",
+			wantMessage:   "humidity on device 1 is 71 %, above 70 %",
+		},
+		{
+			name:        "offline alerts are unchanged",
+			alert:       db.Alert{DeviceID: 1, Value: 600, Unit: "s", Message: "node 1 has not been seen for 10m0s"},
+			prefs:       units.Imperial,
+			wantValue:   600,
+			wantUnit:    "s",
+			wantMessage: "node 1 has not been seen for 10m0s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := InUnits(tt.alert, tt.prefs)
+			if math.Abs(got.Value-tt.wantValue) > 0.01 || math.Abs(got.Threshold-tt.wantThreshold) > 0.01 || got.Unit != tt.wantUnit {
+				t.Errorf("InUnits() = %v, %v %s, want %v, %v %s", got.Value, got.Threshold, got.Unit, tt.wantValue, tt.wantThreshold, tt.wantUnit)
+			}
+			if got.Message != tt.wantMessage {
+				t.Errorf("InUnits() message = %q, want %q", got.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	valid := db.AlertRule{Name: "n", Metric: "m", Condition: ConditionAbove}
+	tests := []struct {
+		name    string
+		modify  func(r *db.AlertRule)
+		wantErr bool
+	}{
+		{"valid", func(r *db.AlertRule) {}, false},
+		{"blank name", func(r *db.AlertRule) { r.Name = "" }, true},
+		{"blank metric", func(r *db.AlertRule) { r.Metric = "" }, true},
+		{"unknown condition", func(r *db.AlertRule) { r.Condition = "sideways" }, true},
+		{"rise without window", func(r *db.AlertRule) { r.Condition = ConditionRise }, true},
+		{"rise with window", func(r *db.AlertRule) { r.Condition, r.WindowSecs = ConditionRise, 60 }, false},
+		{"negative hysteresis", func(r *db.AlertRule) { r.Hysteresis = -1 }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid
+			tt.modify(&r)
+			if err := ValidateRule(r); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
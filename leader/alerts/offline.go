@@ -0,0 +1,347 @@
+package alerts
+
+import (
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OfflineRuleName is the rule name of node offline alerts, which are not raised by a stored rule
+const OfflineRuleName = "node offline"
+
+// Offline states of a node, as shown in the node list
+const (
+	NodeOnline      = "online"
+	NodeWarning     = SeverityWarning
+	NodeCritical    = SeverityCritical
+	NodeMaintenance = "maintenance"
+	// NodeUnmonitored is a node whose offline policy is disabled
+	NodeUnmonitored = "unmonitored"
+)
+
+const offlineCheckInterval = 5 * time.Second
+
+// OfflinePolicy decides when a silent node raises an alert
+type OfflinePolicy struct {
+	// WarningAfterSecs and CriticalAfterSecs are how long a node may go without announcing itself
+	WarningAfterSecs  int  `mapstructure:"warningAfterSecs"`
+	CriticalAfterSecs int  `mapstructure:"criticalAfterSecs"`
+	Disabled          bool `mapstructure:"disabled"`
+	// Notifiers are the names of the notifiers offline alerts are sent to. Empty sends them to every notifier.
+	Notifiers []string `mapstructure:"notifiers"`
+}
+
+// NodeOfflinePolicy overrides the default policy for one node
+type NodeOfflinePolicy struct {
+	DeviceID      uint8 `mapstructure:"deviceID"`
+	OfflinePolicy `mapstructure:",squash"`
+}
+
+// OfflineConfig holds the default offline policy and any per node overrides
+type OfflineConfig struct {
+	OfflinePolicy `mapstructure:",squash"`
+	Nodes         []NodeOfflinePolicy `mapstructure:"nodes"`
+}
+
+var defaultOfflinePolicy = OfflinePolicy{WarningAfterSecs: 60, CriticalAfterSecs: 15 * 60}
+
+// NodeSeen is when a node last announced itself to the leader
+type NodeSeen struct {
+	DeviceID   uint8
+	LastSeenAt time.Time
+}
+
+// OfflineMonitor raises a warning alert for a node which has stopped announcing itself, escalating it to
+// critical if the node stays silent, and resolving it when the node returns. Nodes within a maintenance
+// window raise no new alerts and do not escalate.
+type OfflineMonitor struct {
+	engine *Engine
+	cfg    OfflineConfig
+	nodes  func() []NodeSeen
+
+	lock        sync.Mutex
+	alerts      map[uint8]*db.Alert
+	maintenance []db.MaintenanceWindow
+	states      map[uint8]string
+	// lastSeen holds every node which has announced itself since the leader started, and every node with an
+	// offline alert left open by a previous leader. Devices which only have stored measurements, such as retired
+	// or imported nodes, are not monitored until they announce themselves.
+	lastSeen map[uint8]time.Time
+}
+
+func NewOfflineMonitor(e *Engine, cfg OfflineConfig, nodes func() []NodeSeen) (*OfflineMonitor, error) {
+	for _, p := range append([]OfflinePolicy{cfg.OfflinePolicy}, policies(cfg.Nodes)...) {
+		if p.WarningAfterSecs < 0 || p.CriticalAfterSecs < 0 {
+			return nil, fmt.Errorf("%w: offline durations cannot be negative", ErrInvalidRule)
+		}
+	}
+
+	m := &OfflineMonitor{
+		engine:   e,
+		cfg:      cfg,
+		nodes:    nodes,
+		alerts:   make(map[uint8]*db.Alert),
+		states:   make(map[uint8]string),
+		lastSeen: make(map[uint8]time.Time),
+	}
+	active, err := e.db.Alerts(db.AlertsFilter{States: []string{StateOpen, StateAcknowledged}})
+	if err != nil {
+		return nil, fmt.Errorf("NewOfflineMonitor: error loading active alerts: %w", err)
+	}
+	for i := range active {
+		if active[i].RuleID == 0 && active[i].RuleName == OfflineRuleName {
+			a := &active[i]
+			m.alerts[a.DeviceID] = a
+			m.states[a.DeviceID] = a.Severity
+			// the node had been silent for Value seconds when its alert opened
+			m.lastSeen[a.DeviceID] = a.OpenedAt.Add(-time.Duration(a.Value * float64(time.Second)))
+		}
+	}
+	if err := m.loadMaintenance(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func policies(nodes []NodeOfflinePolicy) []OfflinePolicy {
+	out := make([]OfflinePolicy, len(nodes))
+	for i, n := range nodes {
+		out[i] = n.OfflinePolicy
+	}
+
+	return out
+}
+
+// policy returns the policy of deviceID, with unset durations taken from the default policy
+func (m *OfflineMonitor) policy(deviceID uint8) OfflinePolicy {
+	p := m.cfg.OfflinePolicy
+	for _, n := range m.cfg.Nodes {
+		if n.DeviceID == deviceID {
+			p.Disabled = n.Disabled
+			if n.WarningAfterSecs > 0 {
+				p.WarningAfterSecs = n.WarningAfterSecs
+			}
+			if n.CriticalAfterSecs > 0 {
+				p.CriticalAfterSecs = n.CriticalAfterSecs
+			}
+			if len(n.Notifiers) > 0 {
+				p.Notifiers = n.Notifiers
+			}
+		}
+	}
+	if p.WarningAfterSecs == 0 {
+		p.WarningAfterSecs = defaultOfflinePolicy.WarningAfterSecs
+	}
+	if p.CriticalAfterSecs == 0 {
+		p.CriticalAfterSecs = defaultOfflinePolicy.CriticalAfterSecs
+	}
+
+	return p
+}
+
+func (m *OfflineMonitor) loadMaintenance(now time.Time) error {
+	windows, err := m.engine.db.MaintenanceWindows(now)
+	if err != nil {
+		return fmt.Errorf("error loading maintenance windows: %w", err)
+	}
+	m.maintenance = windows
+
+	return nil
+}
+
+// Start checks every node in the background
+func (m *OfflineMonitor) Start() {
+	go func() {
+		t := time.NewTicker(offlineCheckInterval)
+		for now := range t.C {
+			m.Check(now)
+		}
+	}()
+}
+
+// Check compares when each known node was last seen against its policy as of now
+func (m *OfflineMonitor) Check(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, n := range m.nodes() {
+		if seen, ok := m.lastSeen[n.DeviceID]; !ok || n.LastSeenAt.After(seen) {
+			m.lastSeen[n.DeviceID] = n.LastSeenAt
+		}
+	}
+	for id, lastSeen := range m.lastSeen {
+		m.check(NodeSeen{DeviceID: id, LastSeenAt: lastSeen}, now)
+	}
+
+	// drop windows which have ended so the cache does not grow forever
+	current := m.maintenance[:0]
+	for _, w := range m.maintenance {
+		if w.End.After(now) {
+			current = append(current, w)
+		}
+	}
+	m.maintenance = current
+}
+
+// check updates the offline alert of a single node. Call with lock held.
+func (m *OfflineMonitor) check(n NodeSeen, now time.Time) {
+	p := m.policy(n.DeviceID)
+	silent := now.Sub(n.LastSeenAt)
+	alert := m.alerts[n.DeviceID]
+
+	rule := db.AlertRule{Name: OfflineRuleName, DeviceID: &n.DeviceID, Notifiers: p.Notifiers}
+
+	if p.Disabled {
+		m.states[n.DeviceID] = NodeUnmonitored
+		if alert != nil {
+			m.resolve(rule, alert, now, fmt.Sprintf("offline alerts are disabled for node %d", n.DeviceID))
+		}
+		return
+	}
+	severity := ""
+	if silent >= time.Duration(p.CriticalAfterSecs)*time.Second {
+		severity = SeverityCritical
+	} else if silent >= time.Duration(p.WarningAfterSecs)*time.Second {
+		severity = SeverityWarning
+	}
+	if severity == "" {
+		m.states[n.DeviceID] = NodeOnline
+		if alert != nil {
+			m.resolve(rule, alert, now, fmt.Sprintf("node %d is back online", n.DeviceID))
+		}
+		return
+	}
+
+	inMaintenance := m.inMaintenance(n.DeviceID, now)
+	if inMaintenance {
+		m.states[n.DeviceID] = NodeMaintenance
+	} else if alert != nil {
+		m.states[n.DeviceID] = alert.Severity
+	}
+	// a planned reboot neither raises nor escalates alerts, but a node still offline once the window ends will
+	if inMaintenance || (alert != nil && (alert.Severity == severity || alert.Severity == SeverityCritical)) {
+		return
+	}
+
+	message := fmt.Sprintf("node %d has not been seen for %s", n.DeviceID, silent.Round(time.Second))
+	if alert == nil {
+		a, err := m.engine.db.OpenAlert(db.Alert{
+			RuleName: OfflineRuleName,
+			DeviceID: n.DeviceID,
+			State:    StateOpen,
+			Severity: severity,
+			Value:    silent.Seconds(),
+			Unit:     "s",
+			Message:  message,
+			OpenedAt: now,
+		})
+		if err != nil {
+			log.Err(err).Uint8("deviceID", n.DeviceID).Msg("error opening node offline alert")
+			return
+		}
+		log.Warn().Int64("alertID", a.ID).Uint8("deviceID", n.DeviceID).Str("severity", severity).Msg("Node offline alert opened")
+		m.alerts[n.DeviceID] = &a
+		m.states[n.DeviceID] = severity
+		m.engine.emit(EventOpened, a, rule)
+		return
+	}
+
+	if err := m.engine.db.EscalateAlert(alert.ID, severity, silent.Seconds(), message); err != nil {
+		log.Err(err).Int64("alertID", alert.ID).Msg("error escalating node offline alert")
+		return
+	}
+	log.Warn().Int64("alertID", alert.ID).Uint8("deviceID", n.DeviceID).Str("severity", severity).Msg("Node offline alert escalated")
+	alert.Severity, alert.Value, alert.Message = severity, silent.Seconds(), message
+	m.states[n.DeviceID] = severity
+	m.engine.emit(EventEscalated, *alert, rule)
+}
+
+// resolve resolves the offline alert of a node which has returned or is no longer monitored. Call with lock held.
+func (m *OfflineMonitor) resolve(rule db.AlertRule, alert *db.Alert, now time.Time, message string) {
+	if err := m.engine.db.ResolveAlert(alert.ID, StateResolved, now); err != nil {
+		log.Err(err).Int64("alertID", alert.ID).Msg("error resolving node offline alert")
+		return
+	}
+	log.Info().Int64("alertID", alert.ID).Uint8("deviceID", alert.DeviceID).Str("reason", message).Msg("Node offline alert resolved")
+	a := *alert
+	a.State = StateResolved
+	a.ResolvedAt = &now
+	a.Message = message
+	delete(m.alerts, a.DeviceID)
+	m.engine.emit(EventResolved, a, rule)
+}
+
+func (m *OfflineMonitor) inMaintenance(deviceID uint8, now time.Time) bool {
+	for _, w := range m.maintenance {
+		if w.Covers(deviceID, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NodeStates returns the offline state of each node checked so far, including nodes with an offline alert which
+// have not been seen since the leader started
+func (m *OfflineMonitor) NodeStates() map[uint8]string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	out := make(map[uint8]string, len(m.states))
+	for id, st := range m.states {
+		out[id] = st
+	}
+
+	return out
+}
+
+// Maintenance returns the maintenance windows which have not yet ended, ordered by start
+func (m *OfflineMonitor) Maintenance() []db.MaintenanceWindow {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+
+	out := []db.MaintenanceWindow{}
+	for _, w := range m.maintenance {
+		if w.End.After(now) {
+			out = append(out, w)
+		}
+	}
+
+	return out
+}
+
+// AddMaintenance stores a new maintenance window
+func (m *OfflineMonitor) AddMaintenance(w db.MaintenanceWindow) (db.MaintenanceWindow, error) {
+	if !w.End.After(w.Start) {
+		return db.MaintenanceWindow{}, fmt.Errorf("%w: maintenance window must end after it starts", ErrInvalidRule)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	w, err := m.engine.db.CreateMaintenanceWindow(w)
+	if err != nil {
+		return db.MaintenanceWindow{}, err
+	}
+	m.maintenance = append(m.maintenance, w)
+	sort.SliceStable(m.maintenance, func(i, j int) bool {
+		return m.maintenance[i].Start.Before(m.maintenance[j].Start)
+	})
+
+	return w, nil
+}
+
+// DeleteMaintenance deletes a maintenance window, ending it early if it is running
+func (m *OfflineMonitor) DeleteMaintenance(id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.engine.db.DeleteMaintenanceWindow(id); err != nil {
+		return err
+	}
+
+	return m.loadMaintenance(time.Now())
+}
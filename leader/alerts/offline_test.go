@@ -0,0 +1,273 @@
+package alerts
+
+import (
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOfflineMonitor_Check(t *testing.T) {
+	start := time.Unix(10000, 0)
+	// step checks the monitor a number of seconds after start, with the node last seen at lastSeen seconds
+	type step struct {
+		secs, lastSeen int
+		// want is the node's offline state after the check
+		want string
+	}
+	tests := []struct {
+		name        string
+		cfg         OfflineConfig
+		maintenance []db.MaintenanceWindow
+		steps       []step
+		// wantEvents are the alert changes emitted, with their severity
+		wantEvents []string
+	}{
+		{
+			name: "warning escalates to critical then resolves",
+			cfg:  OfflineConfig{OfflinePolicy: OfflinePolicy{WarningAfterSecs: 60, CriticalAfterSecs: 900}},
+			steps: []step{
+				{0, 0, NodeOnline},
+				{59, 0, NodeOnline},
+				{60, 0, NodeWarning},
+				{120, 0, NodeWarning},
+				{900, 0, NodeCritical},
+				{1000, 0, NodeCritical},
+				{1005, 1004, NodeOnline},
+			},
+			wantEvents: []string{"opened warning", "escalated critical", "resolved critical"},
+		},
+		{
+			name: "recovers before escalating",
+			cfg:  OfflineConfig{},
+			steps: []step{
+				{60, 0, NodeWarning},
+				{70, 65, NodeOnline},
+				{200, 65, NodeWarning},
+			},
+			wantEvents: []string{"opened warning", "resolved warning", "opened warning"},
+		},
+		{
+			name: "straight to critical",
+			cfg:  OfflineConfig{OfflinePolicy: OfflinePolicy{WarningAfterSecs: 60, CriticalAfterSecs: 300}},
+			steps: []step{
+				{400, 0, NodeCritical},
+			},
+			wantEvents: []string{"opened critical"},
+		},
+		{
+			name: "per node override",
+			cfg: OfflineConfig{
+				OfflinePolicy: OfflinePolicy{WarningAfterSecs: 60},
+				Nodes:         []NodeOfflinePolicy{{DeviceID: 1, OfflinePolicy: OfflinePolicy{WarningAfterSecs: 600}}},
+			},
+			steps: []step{
+				{300, 0, NodeOnline},
+				{600, 0, NodeWarning},
+			},
+			wantEvents: []string{"opened warning"},
+		},
+		{
+			name: "disabled node",
+			cfg:  OfflineConfig{Nodes: []NodeOfflinePolicy{{DeviceID: 1, OfflinePolicy: OfflinePolicy{Disabled: true}}}},
+			steps: []step{
+				{5000, 0, NodeUnmonitored},
+			},
+		},
+		{
+			name: "maintenance suppresses opening until it ends",
+			cfg:  OfflineConfig{},
+			maintenance: []db.MaintenanceWindow{
+				{DeviceID: deviceID(1), Start: start, End: start.Add(10 * time.Minute)},
+			},
+			steps: []step{
+				{120, 0, NodeMaintenance},
+				{599, 0, NodeMaintenance},
+				{600, 0, NodeWarning},
+			},
+			wantEvents: []string{"opened warning"},
+		},
+		{
+			name: "maintenance holds escalation",
+			cfg:  OfflineConfig{},
+			maintenance: []db.MaintenanceWindow{
+				{Start: start.Add(100 * time.Second), End: start.Add(time.Hour)},
+			},
+			steps: []step{
+				{60, 0, NodeWarning},
+				{1000, 0, NodeMaintenance},
+				{1010, 1005, NodeOnline},
+			},
+			wantEvents: []string{"opened warning", "resolved warning"},
+		},
+		{
+			name: "maintenance of another node",
+			cfg:  OfflineConfig{},
+			maintenance: []db.MaintenanceWindow{
+				{DeviceID: deviceID(2), Start: start, End: start.Add(time.Hour)},
+			},
+			steps: []step{
+				{60, 0, NodeWarning},
+			},
+			wantEvents: []string{"opened warning"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDB(t)
+			for _, w := range tt.maintenance {
+				if _, err := d.CreateMaintenanceWindow(w); err != nil {
+					t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+				}
+			}
+			e, err := New(d)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			var events []string
+			e.OnChange(func(event string, a db.Alert, r db.AlertRule) {
+				if a.RuleName != OfflineRuleName || r.Name != OfflineRuleName || a.DeviceID != 1 {
+					t.Errorf("handler got alert %+v, rule %+v", a, r)
+				}
+				events = append(events, event+" "+a.Severity)
+			})
+
+			var lastSeen time.Time
+			m, err := NewOfflineMonitor(e, tt.cfg, func() []NodeSeen {
+				return []NodeSeen{{DeviceID: 1, LastSeenAt: lastSeen}}
+			})
+			if err != nil {
+				t.Fatalf("NewOfflineMonitor() error = %v", err)
+			}
+			// windows are cached from when the monitor was created, so they must not have ended by then
+			m.maintenance, _ = d.MaintenanceWindows(start)
+
+			for _, s := range tt.steps {
+				lastSeen = start.Add(time.Duration(s.lastSeen) * time.Second)
+				m.Check(start.Add(time.Duration(s.secs) * time.Second))
+				if got := m.NodeStates()[1]; got != s.want {
+					t.Errorf("after %ds state = %q, want %q", s.secs, got, s.want)
+				}
+			}
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestOfflineMonitor_reload(t *testing.T) {
+	d, _ := newTestDB(t)
+	e, _ := New(d)
+	start := time.Unix(10000, 0)
+	nodes := func() []NodeSeen { return []NodeSeen{{DeviceID: 1, LastSeenAt: start}} }
+	m, err := NewOfflineMonitor(e, OfflineConfig{}, nodes)
+	if err != nil {
+		t.Fatalf("NewOfflineMonitor() error = %v", err)
+	}
+	m.Check(start.Add(time.Minute))
+
+	// a restarted leader escalates the alert it already opened rather than opening another
+	e, _ = New(d)
+	m, err = NewOfflineMonitor(e, OfflineConfig{}, nodes)
+	if err != nil {
+		t.Fatalf("NewOfflineMonitor() reload error = %v", err)
+	}
+	if got := m.NodeStates()[1]; got != NodeWarning {
+		t.Errorf("reloaded state = %q, want %q", got, NodeWarning)
+	}
+	m.Check(start.Add(time.Hour))
+
+	as, err := d.Alerts(db.AlertsFilter{})
+	if err != nil {
+		t.Fatalf("Alerts() error = %v", err)
+	}
+	if len(as) != 1 || as[0].Severity != SeverityCritical || as[0].State != StateOpen || as[0].RuleID != 0 {
+		t.Errorf("Alerts() = %+v", as)
+	}
+}
+
+func TestOfflineMonitor_knownDevices(t *testing.T) {
+	d, _ := newTestDB(t)
+	start := time.Unix(10000, 0)
+	// node 2 only has measurements, such as from a retired node or an import, so it is never checked
+	if err := d.RecordMeasurements(2, 1, start, []sensor.Measurement{{Metric: sensor.MetricTemperature, Value: 20}}); err != nil {
+		t.Fatalf("RecordMeasurements() error = %v", err)
+	}
+	// node 3 has no measurements, only an offline alert left open by the previous leader
+	if _, err := d.OpenAlert(db.Alert{
+		RuleName: OfflineRuleName, DeviceID: 3, State: StateOpen, Severity: SeverityWarning,
+		Value: 60, OpenedAt: start.Add(time.Minute),
+	}); err != nil {
+		t.Fatalf("OpenAlert() error = %v", err)
+	}
+
+	e, _ := New(d)
+	var events []string
+	e.OnChange(func(event string, a db.Alert, r db.AlertRule) {
+		events = append(events, fmt.Sprintf("%s %d %s", event, a.DeviceID, a.Severity))
+	})
+	nodes := []NodeSeen{{DeviceID: 1, LastSeenAt: start.Add(time.Hour)}}
+	cfg := OfflineConfig{Nodes: []NodeOfflinePolicy{{DeviceID: 4, OfflinePolicy: OfflinePolicy{Disabled: true}}}}
+	m, err := NewOfflineMonitor(e, cfg, func() []NodeSeen { return nodes })
+	if err != nil {
+		t.Fatalf("NewOfflineMonitor() error = %v", err)
+	}
+
+	m.Check(start.Add(time.Hour))
+	want := map[uint8]string{1: NodeOnline, 3: NodeCritical}
+	if got := m.NodeStates(); !reflect.DeepEqual(got, want) {
+		t.Errorf("NodeStates() = %v, want %v", got, want)
+	}
+	if wantEvents := []string{"escalated 3 critical"}; !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("events = %v, want %v", events, wantEvents)
+	}
+	if as, err := d.Alerts(db.AlertsFilter{DeviceIDs: []uint8{2}}); err != nil || len(as) != 0 {
+		t.Errorf("Alerts() of measured only node = %+v, %v, want none", as, err)
+	}
+
+	// node 3 returns, and node 4 is seen but not monitored
+	events = nil
+	nodes[0].LastSeenAt = start.Add(2 * time.Hour)
+	nodes = append(nodes, NodeSeen{DeviceID: 3, LastSeenAt: start.Add(2 * time.Hour)}, NodeSeen{DeviceID: 4})
+	m.Check(start.Add(2 * time.Hour))
+	if got := m.NodeStates(); got[3] != NodeOnline || got[4] != NodeUnmonitored {
+		t.Errorf("NodeStates() = %v", got)
+	}
+	if wantEvents := []string{"resolved 3 critical"}; !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("events = %v, want %v", events, wantEvents)
+	}
+}
+
+func TestOfflineMonitor_AddMaintenance(t *testing.T) {
+	d, _ := newTestDB(t)
+	e, _ := New(d)
+	m, err := NewOfflineMonitor(e, OfflineConfig{}, func() []NodeSeen { return nil })
+	if err != nil {
+		t.Fatalf("NewOfflineMonitor() error = %v", err)
+	}
+
+	now := time.Now()
+	if _, err := m.AddMaintenance(db.MaintenanceWindow{Start: now, End: now}); err == nil {
+		t.Errorf("AddMaintenance() empty window error = nil")
+	}
+	w, err := m.AddMaintenance(db.MaintenanceWindow{DeviceID: deviceID(2), Start: now, End: now.Add(time.Hour), Reason: "reboot"})
+	if err != nil {
+		t.Fatalf("AddMaintenance() error = %v", err)
+	}
+	if got := m.Maintenance(); len(got) != 1 || got[0].ID != w.ID || got[0].Reason != "reboot" {
+		t.Errorf("Maintenance() = %+v", got)
+	}
+	if err := m.DeleteMaintenance(w.ID); err != nil {
+		t.Fatalf("DeleteMaintenance() error = %v", err)
+	}
+	if got := m.Maintenance(); len(got) != 0 {
+		t.Errorf("Maintenance() after delete = %+v", got)
+	}
+}
+
+func deviceID(id uint8) *uint8 {
+	return &id
+}
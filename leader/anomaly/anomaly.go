@@ -0,0 +1,454 @@
+// Package anomaly watches sensor streams for values which static alert thresholds miss: outliers from a series'
+// own baseline, flatlines and stuck values from a frozen sensor, and slow drift such as VOC creep. Anomalies are
+// recorded as events.
+package anomaly
+
+import (
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventKind is the kind of the events anomalies are recorded as. The event's sensor is the metric, and its state
+// is the type of anomaly when it starts, or StateCleared when a lasting anomaly ends.
+const EventKind = "anomaly"
+
+// Types of anomaly
+const (
+	// TypeOutlier is a value far from both the series' rolling baseline and its usual value at that hour
+	TypeOutlier = "outlier"
+	// TypeFlatline is a series whose spread has collapsed far below its usual deviation
+	TypeFlatline = "flatline"
+	// TypeStuck is a series repeating exactly the same value
+	TypeStuck = "stuck"
+	// TypeDrift is a series whose recent mean has moved away from its long term mean
+	TypeDrift = "drift"
+)
+
+// StateCleared is the event state of a flatline, stuck or drift anomaly ending
+const StateCleared = "cleared"
+
+// Config sets which metrics are watched and how far they must stray to be anomalous
+type Config struct {
+	Disabled bool `mapstructure:"disabled"`
+	// SensorTypes are the names of the sensor types watched. The system sensor is left out by default, as its
+	// CPU temperatures follow load rather than the weather.
+	SensorTypes []string `mapstructure:"sensorTypes"`
+	// Metrics are the metrics watched, matched without any sensor instance prefix
+	Metrics []string `mapstructure:"metrics"`
+	// WindowSamples is the span of the rolling mean and deviation
+	WindowSamples int `mapstructure:"windowSamples"`
+	// MinSamples is how many values a series needs before it is checked
+	MinSamples int `mapstructure:"minSamples"`
+	// OutlierZ is how many deviations from the baseline a value must be to be an outlier
+	OutlierZ float64 `mapstructure:"outlierZ"`
+	// SeasonalDays is the span, in days, of the profile of each hour of the day, and SeasonalMinDays is how many
+	// days an hour needs before its profile can excuse an outlier
+	SeasonalDays    int `mapstructure:"seasonalDays"`
+	SeasonalMinDays int `mapstructure:"seasonalMinDays"`
+	// StuckSamples is how many identical values in a row make a series stuck
+	StuckSamples int `mapstructure:"stuckSamples"`
+	// FlatlineMins is how long a series' spread must stay below FlatlineRatio of its long term deviation
+	FlatlineMins  int     `mapstructure:"flatlineMins"`
+	FlatlineRatio float64 `mapstructure:"flatlineRatio"`
+	// DriftWindowSamples is the span of the long term mean, and DriftZ is how many long term deviations the rolling
+	// mean must move from it
+	DriftWindowSamples int     `mapstructure:"driftWindowSamples"`
+	DriftZ             float64 `mapstructure:"driftZ"`
+}
+
+// DefaultConfig watches the raw atmospheric metrics, which are expected to vary
+var DefaultConfig = Config{
+	SensorTypes:        []string{sensor.NameByType(sensor.TypeAtmospheric), sensor.NameByType(sensor.TypeDS18B20)},
+	Metrics:            []string{sensor.MetricTemperature, sensor.MetricHumidity, sensor.MetricPressure, sensor.MetricVOCIndex},
+	WindowSamples:      60,
+	MinSamples:         30,
+	OutlierZ:           4,
+	SeasonalDays:       7,
+	SeasonalMinDays:    3,
+	StuckSamples:       20,
+	FlatlineMins:       60,
+	FlatlineRatio:      0.05,
+	DriftWindowSamples: 2880,
+	DriftZ:             3,
+}
+
+// withDefaults fills every unset field from DefaultConfig
+func (c Config) withDefaults() Config {
+	d := DefaultConfig
+	if len(c.SensorTypes) == 0 {
+		c.SensorTypes = d.SensorTypes
+	}
+	if len(c.Metrics) == 0 {
+		c.Metrics = d.Metrics
+	}
+	setInt := func(v *int, def int) {
+		if *v == 0 {
+			*v = def
+		}
+	}
+	setFloat := func(v *float64, def float64) {
+		if *v == 0 {
+			*v = def
+		}
+	}
+	setInt(&c.WindowSamples, d.WindowSamples)
+	setInt(&c.MinSamples, d.MinSamples)
+	setFloat(&c.OutlierZ, d.OutlierZ)
+	setInt(&c.SeasonalDays, d.SeasonalDays)
+	setInt(&c.SeasonalMinDays, d.SeasonalMinDays)
+	setInt(&c.StuckSamples, d.StuckSamples)
+	setInt(&c.FlatlineMins, d.FlatlineMins)
+	setFloat(&c.FlatlineRatio, d.FlatlineRatio)
+	setInt(&c.DriftWindowSamples, d.DriftWindowSamples)
+	setFloat(&c.DriftZ, d.DriftZ)
+
+	return c
+}
+
+func (c Config) validate() error {
+	for name, v := range map[string]int{
+		"windowSamples": c.WindowSamples, "minSamples": c.MinSamples,
+		"seasonalDays": c.SeasonalDays, "seasonalMinDays": c.SeasonalMinDays,
+		"stuckSamples": c.StuckSamples, "flatlineMins": c.FlatlineMins, "driftWindowSamples": c.DriftWindowSamples,
+	} {
+		if v < 1 {
+			return fmt.Errorf("anomaly %s must be positive", name)
+		}
+	}
+	if c.OutlierZ <= 0 || c.FlatlineRatio <= 0 || c.DriftZ <= 0 {
+		return fmt.Errorf("anomaly outlierZ, flatlineRatio and driftZ must be positive")
+	}
+	if c.DriftWindowSamples <= c.WindowSamples {
+		return fmt.Errorf("anomaly driftWindowSamples must be longer than windowSamples")
+	}
+
+	return nil
+}
+
+// Anomaly is an anomalous value of a series, or the end of a lasting anomaly
+type Anomaly struct {
+	DeviceID  uint8
+	Metric    string
+	Type      string
+	Cleared   bool
+	Timestamp time.Time
+	Value     float64
+	// Expected and Deviation are the baseline the value was compared against, and Score how far it strayed
+	Expected  float64
+	Deviation float64
+	Score     float64
+}
+
+// Event returns the event an anomaly is recorded as
+func (a Anomaly) Event() sensor.Event {
+	state := a.Type
+	if a.Cleared {
+		state = StateCleared
+	}
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', 6, 64)
+	}
+
+	return sensor.Event{
+		Sensor:    a.Metric,
+		Kind:      EventKind,
+		State:     state,
+		Timestamp: a.Timestamp,
+		Attributes: map[string]string{
+			"type":      a.Type,
+			"value":     format(a.Value),
+			"expected":  format(a.Expected),
+			"deviation": format(a.Deviation),
+			"score":     format(a.Score),
+		},
+	}
+}
+
+// ewStats is an exponentially weighted mean and variance
+type ewStats struct {
+	n              int
+	mean, variance float64
+}
+
+func (s *ewStats) add(x, alpha float64) {
+	s.n++
+	if s.n == 1 {
+		s.mean = x
+		return
+	}
+	diff := x - s.mean
+	incr := alpha * diff
+	s.mean += incr
+	s.variance = (1 - alpha) * (s.variance + diff*incr)
+}
+
+func (s ewStats) std() float64 {
+	return math.Sqrt(s.variance)
+}
+
+type point struct {
+	ts    time.Time
+	value float64
+}
+
+// hourProfile is the usual value of a series at one hour of the day. It learns once a day, from the values seen
+// during that hour, so it remembers the hour over days whatever the poll rate.
+type hourProfile struct {
+	// daily is the day to day mean and variance of the hour's mean
+	daily ewStats
+	// within is the usual variance of the values during the hour
+	within float64
+}
+
+func (p hourProfile) std() float64 {
+	return math.Sqrt(p.daily.variance + p.within)
+}
+
+// hourStats accumulates the values of the hour in progress
+type hourStats struct {
+	start      time.Time
+	n          int
+	sum, sumSq float64
+}
+
+// series is the baseline of one metric of one device
+type series struct {
+	rolling, longTerm ewStats
+	// hours is the profile of the series by hour of the day, and hour is the hour in progress
+	hours [24]hourProfile
+	hour  hourStats
+
+	last    float64
+	repeats int
+	// recent holds the values of the last FlatlineMins
+	recent []point
+	// active holds the lasting anomalies in progress
+	active map[string]bool
+}
+
+type seriesKey struct {
+	deviceID uint8
+	metric   string
+}
+
+// Detector keeps a baseline per device and metric, checking each new value against it
+type Detector struct {
+	db          *db.DB
+	cfg         Config
+	sensorTypes map[string]bool
+	metrics     map[string]bool
+
+	lock   sync.Mutex
+	series map[seriesKey]*series
+}
+
+// New returns a Detector which records anomalies through d. Unset config fields take their DefaultConfig value.
+func New(d *db.DB, cfg Config) (*Detector, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &Detector{
+		db:          d,
+		cfg:         cfg,
+		sensorTypes: set(cfg.SensorTypes),
+		metrics:     set(cfg.Metrics),
+		series:      make(map[seriesKey]*series),
+	}, nil
+}
+
+func set(names []string) map[string]bool {
+	out := make(map[string]bool, len(names))
+	for _, n := range names {
+		out[n] = true
+	}
+
+	return out
+}
+
+// HandleMeasurements checks a readout of deviceID, recording any anomalies as events. It is a net.MeasurementHandler.
+func (d *Detector) HandleMeasurements(deviceID, sensorType uint8, ts time.Time, ms []sensor.Measurement) {
+	for _, a := range d.Observe(deviceID, sensorType, ts, ms) {
+		log.Info().Uint8("deviceID", a.DeviceID).Str("metric", a.Metric).Str("type", a.Type).Bool("cleared", a.Cleared).
+			Float64("value", a.Value).Float64("expected", a.Expected).Msg("Sensor anomaly")
+		if _, err := d.db.RecordEvent(deviceID, a.Event()); err != nil {
+			log.Err(err).Msg("error recording anomaly")
+		}
+	}
+}
+
+// Observe checks a readout of a sensor of deviceID against the baselines of its watched metrics, then adds it to them
+func (d *Detector) Observe(deviceID, sensorType uint8, ts time.Time, ms []sensor.Measurement) []Anomaly {
+	if !d.sensorTypes[sensor.NameByType(int(sensorType))] {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var out []Anomaly
+	for _, m := range ms {
+		if !d.metrics[sensor.BaseMetric(m.Metric)] || math.IsNaN(m.Value) {
+			continue
+		}
+		k := seriesKey{deviceID: deviceID, metric: m.Metric}
+		s, ok := d.series[k]
+		if !ok {
+			s = &series{active: make(map[string]bool)}
+			d.series[k] = s
+		}
+		for _, a := range d.observe(s, ts, m.Value) {
+			a.DeviceID, a.Metric, a.Timestamp = deviceID, m.Metric, ts
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
+
+// observe checks x against s, then adds it to s. Call with lock held.
+func (d *Detector) observe(s *series, ts time.Time, x float64) []Anomaly {
+	var out []Anomaly
+	if start := startOfHour(ts); !start.Equal(s.hour.start) {
+		d.endHour(s)
+		s.hour = hourStats{start: start}
+	}
+
+	// a flatlined or stuck series has no rolling deviation to speak of, so its recovery is not an outlier
+	if s.rolling.n >= d.cfg.MinSamples && !s.active[TypeStuck] && !s.active[TypeFlatline] {
+		if a, ok := d.outlier(s, s.hours[ts.Hour()], x); ok {
+			out = append(out, a)
+		}
+	}
+
+	// stuck
+	if s.rolling.n > 0 && x == s.last {
+		s.repeats++
+	} else {
+		s.repeats = 0
+	}
+	stuck := s.repeats+1 >= d.cfg.StuckSamples && s.longTerm.std() > 0
+	out = append(out, d.lasting(s, TypeStuck, stuck, s.repeats == 0, x, s.last, s.longTerm.std(), float64(s.repeats+1))...)
+
+	// flatline
+	s.recent = append(s.recent, point{ts: ts, value: x})
+	cutoff := ts.Add(-time.Duration(d.cfg.FlatlineMins) * time.Minute)
+	i := 0
+	for i < len(s.recent)-1 && s.recent[i+1].ts.Before(cutoff) {
+		i++
+	}
+	s.recent = s.recent[i:]
+	spread := s.spread()
+	limit := d.cfg.FlatlineRatio * s.longTerm.std()
+	spansWindow := !s.recent[0].ts.After(cutoff) && len(s.recent) >= d.cfg.MinSamples
+	flat := spansWindow && !s.active[TypeStuck] && spread <= limit
+	out = append(out, d.lasting(s, TypeFlatline, flat, spread > limit, x, s.rolling.mean, s.longTerm.std(), spread)...)
+
+	// drift
+	if s.longTerm.n >= d.cfg.DriftWindowSamples/2 && s.longTerm.std() > 0 {
+		score := math.Abs(s.rolling.mean-s.longTerm.mean) / s.longTerm.std()
+		drifting := score > d.cfg.DriftZ
+		// hysteresis, so a drift hovering at the threshold does not flap
+		recovered := score < d.cfg.DriftZ/2
+		out = append(out, d.lasting(s, TypeDrift, drifting, recovered, x, s.longTerm.mean, s.longTerm.std(), score)...)
+	}
+
+	s.rolling.add(x, alpha(d.cfg.WindowSamples))
+	s.longTerm.add(d.clampLongTerm(s, x), alpha(d.cfg.DriftWindowSamples))
+	s.hour.n++
+	s.hour.sum += x
+	s.hour.sumSq += x * x
+	s.last = x
+
+	return out
+}
+
+// outlier checks x against the rolling baseline. A value the hour of the day's profile expects is not an outlier.
+func (d *Detector) outlier(s *series, hour hourProfile, x float64) (Anomaly, bool) {
+	std := s.rolling.std()
+	if std == 0 {
+		return Anomaly{}, false
+	}
+	score := math.Abs(x-s.rolling.mean) / std
+	if score <= d.cfg.OutlierZ {
+		return Anomaly{}, false
+	}
+	if hour.daily.n >= d.cfg.SeasonalMinDays && hour.std() > 0 && math.Abs(x-hour.daily.mean)/hour.std() <= d.cfg.OutlierZ {
+		return Anomaly{}, false
+	}
+
+	return Anomaly{Type: TypeOutlier, Value: x, Expected: s.rolling.mean, Deviation: std, Score: score}, true
+}
+
+// endHour adds the hour in progress to the profile of its hour of the day. Call with lock held.
+func (d *Detector) endHour(s *series) {
+	h := s.hour
+	if h.n == 0 {
+		return
+	}
+	mean := h.sum / float64(h.n)
+	within := math.Max(0, h.sumSq/float64(h.n)-mean*mean)
+
+	p := &s.hours[h.start.Hour()]
+	a := alpha(d.cfg.SeasonalDays)
+	p.daily.add(mean, a)
+	if p.daily.n == 1 {
+		p.within = within
+	} else {
+		p.within += a * (within - p.within)
+	}
+}
+
+// startOfHour truncates ts to the hour in its location
+func startOfHour(ts time.Time) time.Time {
+	y, m, d := ts.Date()
+
+	return time.Date(y, m, d, ts.Hour(), 0, 0, 0, ts.Location())
+}
+
+// clampLongTerm limits x to DriftZ long term deviations from the long term mean. Otherwise a slow creep inflates
+// the long term deviation as fast as it moves the rolling mean, and is never far enough away to be a drift.
+func (d *Detector) clampLongTerm(s *series, x float64) float64 {
+	if s.longTerm.n < d.cfg.MinSamples {
+		return x
+	}
+	limit := d.cfg.DriftZ * s.longTerm.std()
+
+	return math.Max(s.longTerm.mean-limit, math.Min(s.longTerm.mean+limit, x))
+}
+
+// lasting starts an anomaly of typ when start holds and it is not already in progress, and clears it when clear holds
+func (d *Detector) lasting(s *series, typ string, start, clear bool, x, expected, deviation, score float64) []Anomaly {
+	a := Anomaly{Type: typ, Value: x, Expected: expected, Deviation: deviation, Score: score}
+	switch {
+	case start && !s.active[typ]:
+		s.active[typ] = true
+		return []Anomaly{a}
+	case clear && s.active[typ]:
+		delete(s.active, typ)
+		a.Cleared = true
+		return []Anomaly{a}
+	}
+
+	return nil
+}
+
+func (s *series) spread() float64 {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, p := range s.recent {
+		lo, hi = math.Min(lo, p.value), math.Max(hi, p.value)
+	}
+
+	return hi - lo
+}
+
+// alpha is the weight of an exponentially weighted average spanning n samples
+func alpha(n int) float64 {
+	return 2 / (float64(n) + 1)
+}
@@ -0,0 +1,281 @@
+package anomaly
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+// feed observes values of temperature one minute apart from ts, returning the anomalies and the next timestamp
+func feed(t *testing.T, d *Detector, ts time.Time, values []float64) ([]Anomaly, time.Time) {
+	t.Helper()
+
+	return feedEvery(t, d, ts, time.Minute, values)
+}
+
+// feedEvery observes values of temperature interval apart from ts, returning the anomalies and the next timestamp
+func feedEvery(t *testing.T, d *Detector, ts time.Time, interval time.Duration, values []float64) ([]Anomaly, time.Time) {
+	t.Helper()
+	var out []Anomaly
+	for _, v := range values {
+		out = append(out, d.Observe(1, sensor.TypeAtmospheric, ts, []sensor.Measurement{{Metric: sensor.MetricTemperature, Value: v}})...)
+		ts = ts.Add(interval)
+	}
+
+	return out, ts
+}
+
+// noise returns n values around mean with standard deviation std
+func noise(r *rand.Rand, n int, mean, std float64) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = mean + r.NormFloat64()*std
+	}
+
+	return out
+}
+
+func newDetector(t *testing.T, cfg Config) *Detector {
+	t.Helper()
+	d, err := New(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func types(as []Anomaly) []string {
+	var out []string
+	for _, a := range as {
+		typ := a.Type
+		if a.Cleared {
+			typ += " " + StateCleared
+		}
+		out = append(out, typ)
+	}
+
+	return out
+}
+
+// only returns the types of the anomalies of typ
+func only(as []Anomaly, typ string) []string {
+	var out []Anomaly
+	for _, a := range as {
+		if a.Type == typ {
+			out = append(out, a)
+		}
+	}
+
+	return types(out)
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestOutlier(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	d := newDetector(t, Config{})
+
+	got, ts := feed(t, d, start, noise(r, 600, 20, 0.2))
+	if len(got) != 0 {
+		t.Fatalf("noise: got %v, want no anomalies", types(got))
+	}
+	got, ts = feed(t, d, ts, []float64{26})
+	if !equal(types(got), []string{TypeOutlier}) {
+		t.Fatalf("spike: got %v, want an outlier", types(got))
+	}
+	if got[0].Value != 26 || math.Abs(got[0].Expected-20) > 0.2 || got[0].Score < DefaultConfig.OutlierZ {
+		t.Errorf("spike: got %+v", got[0])
+	}
+	if got, _ = feed(t, d, ts, noise(r, 10, 20, 0.2)); len(got) != 0 {
+		t.Errorf("after spike: got %v, want no anomalies", types(got))
+	}
+}
+
+func TestSeasonalProfile(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	d := newDetector(t, Config{})
+
+	// the sun reaches the sensor at noon every day, warming it for half an hour. Readings come at the default poll
+	// rate of 15 seconds, so the noon profile must remember the whole hour over days, not its cool last minutes.
+	const perHour = 240
+	ts := start
+	for i := 0; i < 5; i++ {
+		values := noise(r, 24*perHour, 20, 0.2)
+		for j := 12 * perHour; j < 12*perHour+perHour/2; j++ {
+			values[j] += 10
+		}
+		var got []Anomaly
+		got, ts = feedEvery(t, d, ts, 15*time.Second, values)
+		outliers := 0
+		for _, a := range got {
+			// noise alone is occasionally an outlier, so only the warming and its end are counted
+			if a.Type == TypeOutlier && a.Timestamp.Hour() == 12 {
+				outliers++
+			}
+		}
+		if i == 0 && outliers == 0 {
+			t.Errorf("day %d: got no outliers, want the first warming flagged", i)
+		}
+		if i >= DefaultConfig.SeasonalMinDays && outliers != 0 {
+			t.Errorf("day %d: got %d outliers, want the warming expected at noon", i, outliers)
+		}
+	}
+}
+
+func TestStuck(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	d := newDetector(t, Config{StuckSamples: 10})
+
+	_, ts := feed(t, d, start, noise(r, 100, 20, 0.2))
+	stuck := make([]float64, 15)
+	for i := range stuck {
+		stuck[i] = 20.1
+	}
+	got, ts := feed(t, d, ts, stuck)
+	if !equal(types(got), []string{TypeStuck}) {
+		t.Fatalf("stuck: got %v, want stuck once", types(got))
+	}
+	if got[0].Score != 10 {
+		t.Errorf("stuck: got score %v, want 10 repeats", got[0].Score)
+	}
+	if got, _ = feed(t, d, ts, []float64{20.3}); !equal(types(got), []string{TypeStuck + " " + StateCleared}) {
+		t.Errorf("recovered: got %v, want stuck cleared", types(got))
+	}
+}
+
+func TestFlatline(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	d := newDetector(t, Config{FlatlineMins: 30})
+
+	_, ts := feed(t, d, start, noise(r, 300, 20, 0.5))
+	// barely moving, but never exactly repeating
+	flat := make([]float64, 60)
+	for i := range flat {
+		flat[i] = 20 + 0.001*math.Sin(float64(i))
+	}
+	got, ts := feed(t, d, ts, flat)
+	if !equal(types(got), []string{TypeFlatline}) {
+		t.Fatalf("flat: got %v, want flatline once", types(got))
+	}
+	if got[0].Timestamp.Before(ts.Add(-30 * time.Minute)) {
+		t.Errorf("flat: flagged at %v, want only after 30 flat minutes", got[0].Timestamp)
+	}
+	if got, _ = feed(t, d, ts, noise(r, 5, 20, 0.5)); !equal(types(got), []string{TypeFlatline + " " + StateCleared}) {
+		t.Errorf("recovered: got %v, want flatline cleared", types(got))
+	}
+}
+
+func TestDrift(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	d := newDetector(t, Config{})
+
+	_, ts := feed(t, d, start, noise(r, 3000, 100, 2))
+	// VOC creeping up too slowly for any single reading to be an outlier
+	creep := noise(r, 600, 100, 2)
+	for i := range creep {
+		creep[i] += float64(i) * 0.05
+	}
+	got, ts := feed(t, d, ts, creep)
+	if !equal(types(got), []string{TypeDrift}) {
+		t.Fatalf("creep: got %v, want drift once", types(got))
+	}
+	if got[0].Expected > got[0].Value {
+		t.Errorf("creep: got %+v, want above the long term mean", got[0])
+	}
+	// dropping back from the creep is also an outlier
+	got, _ = feed(t, d, ts, noise(r, 3000, 100, 2))
+	if !equal(only(got, TypeDrift), []string{TypeDrift + " " + StateCleared}) {
+		t.Errorf("recovered: got %v, want drift cleared", types(got))
+	}
+}
+
+func TestObserveMetrics(t *testing.T) {
+	d := newDetector(t, Config{Metrics: []string{sensor.MetricHumidity}, MinSamples: 5})
+
+	ts := start
+	for i := 0; i < 50; i++ {
+		ms := []sensor.Measurement{
+			{Metric: "attic.humidity", Value: 40 + float64(i%2)},
+			{Metric: "basement.humidity", Value: 60 + float64(i%2)},
+			{Metric: sensor.MetricTemperature, Value: 20 + float64(i%2)},
+		}
+		if got := d.Observe(1, sensor.TypeAtmospheric, ts, ms); len(got) != 0 {
+			t.Fatalf("got %v, want no anomalies", types(got))
+		}
+		ts = ts.Add(time.Minute)
+	}
+	spike := []sensor.Measurement{
+		{Metric: "attic.humidity", Value: 90},
+		{Metric: "basement.humidity", Value: 60},
+		{Metric: sensor.MetricTemperature, Value: 90},
+	}
+	// the system sensor is not watched by default
+	if got := d.Observe(1, sensor.TypeSystem, ts, spike); len(got) != 0 {
+		t.Errorf("system sensor: got %v, want no anomalies", types(got))
+	}
+	got := d.Observe(1, sensor.TypeAtmospheric, ts, spike)
+	if len(got) != 1 || got[0].Metric != "attic.humidity" || got[0].DeviceID != 1 || !got[0].Timestamp.Equal(ts) {
+		t.Errorf("got %+v, want one attic.humidity outlier", got)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{WindowSamples: -1},
+		{OutlierZ: -2},
+		{WindowSamples: 100, DriftWindowSamples: 50},
+		{SeasonalMinDays: -1},
+	} {
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("New(%+v): got no error", cfg)
+		}
+	}
+}
+
+func TestHandleMeasurements(t *testing.T) {
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(database, Config{MinSamples: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := start
+	for i := 0; i < 20; i++ {
+		d.HandleMeasurements(2, sensor.TypeAtmospheric, ts, []sensor.Measurement{{Metric: sensor.MetricPressure, Value: 1000 + float64(i%2)}})
+		ts = ts.Add(time.Minute)
+	}
+	d.HandleMeasurements(2, sensor.TypeAtmospheric, ts, []sensor.Measurement{{Metric: sensor.MetricPressure, Value: 950}})
+
+	events, err := database.Events(db.EventsFilter{Kinds: []string{EventKind}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	e := events[0]
+	if e.DeviceID != 2 || e.Sensor != sensor.MetricPressure || e.State != TypeOutlier || e.Attributes["value"] != "950" {
+		t.Errorf("got %+v", e)
+	}
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alarm"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/rs/zerolog/log"
+	stdnet "net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultAlarmAuditLimit = 100
+	maxAlarmAuditLimit     = 1000
+)
+
+type ArmRequest struct {
+	// Mode is home or away
+	Mode string `json:"mode"`
+	PIN  string `json:"pin"`
+}
+
+type DisarmRequest struct {
+	PIN string `json:"pin"`
+}
+
+type AlarmAuditResponse struct {
+	Transitions []db.AlarmTransition `json:"transitions"`
+	// Next is passed as before to fetch the following page, and is 0 on the last page
+	Next int64 `json:"next"`
+}
+
+// requireAlarm responds with 404 if the alarm is not configured
+func (a *API) requireAlarm(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.alarm == nil {
+			writeMessage(w, "alarm is not configured", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) getAlarm(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.alarm.Status())
+}
+
+// postArm arms the alarm. Body: {"mode": "home" or "away", "pin": "..."}
+func (a *API) postArm(w http.ResponseWriter, r *http.Request) {
+	var req ArmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	var mode alarm.State
+	switch req.Mode {
+	case "home":
+		mode = alarm.StateArmedHome
+	case "away":
+		mode = alarm.StateArmedAway
+	default:
+		writeMessage(w, "mode must be home or away", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.alarm.Arm(mode, req.PIN, pinSource(r)); err != nil {
+		writeAlarmError(w, err)
+		return
+	}
+
+	writeJSON(w, a.alarm.Status())
+}
+
+// postDisarm disarms the alarm. Body: {"pin": "..."}
+func (a *API) postDisarm(w http.ResponseWriter, r *http.Request) {
+	var req DisarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.alarm.Disarm(req.PIN, pinSource(r)); err != nil {
+		writeAlarmError(w, err)
+		return
+	}
+
+	writeJSON(w, a.alarm.Status())
+}
+
+// pinSource identifies the client of a PIN attempt by host, so reconnecting from another port does not reset its
+// failed attempts. The host comes from forwarding headers when there are any, so a client can forge it. The alarm
+// therefore also caps invalid attempts across every source.
+func pinSource(r *http.Request) string {
+	if host, _, err := stdnet.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+func writeAlarmError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, alarm.ErrInvalidPIN):
+		writeMessage(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, alarm.ErrLockedOut):
+		writeMessage(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, alarm.ErrInvalidTransition):
+		writeMessage(w, err.Error(), http.StatusConflict)
+	default:
+		respondInternalServerError(w, err.Error())
+	}
+}
+
+// getAlarmAudit returns the alarm's state transitions, newest first.
+// Query params: from and to (RFC3339 or unix seconds), limit (default 100, max 1000) and before,
+// the next cursor of the previous page.
+func (a *API) getAlarmAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, err := export.ParseTime(q.Get("from"))
+	if err != nil {
+		writeMessage(w, fmt.Sprintf("from: %s", err), http.StatusBadRequest)
+		return
+	}
+	to, err := export.ParseTime(q.Get("to"))
+	if err != nil {
+		writeMessage(w, fmt.Sprintf("to: %s", err), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(r, defaultAlarmAuditLimit, maxAlarmAuditLimit)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before, err := parseBefore(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transitions, err := a.alarm.Transitions(db.AlarmTransitionsFilter{From: from, To: to, Before: before, Limit: limit})
+	if err != nil {
+		log.Err(err).Msg("getAlarmAudit db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	resp := AlarmAuditResponse{Transitions: transitions}
+	if len(transitions) == limit {
+		resp.Next = transitions[len(transitions)-1].ID
+	}
+
+	writeJSON(w, resp)
+}
+
+// parseBefore reads the before query param, a page cursor
+func parseBefore(r *http.Request) (int64, error) {
+	b := r.URL.Query().Get("before")
+	if b == "" {
+		return 0, nil
+	}
+	before, err := strconv.ParseInt(b, 10, 64)
+	if err != nil || before < 1 {
+		return 0, fmt.Errorf("invalid before %q", b)
+	}
+
+	return before, nil
+}
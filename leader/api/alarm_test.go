@@ -0,0 +1,146 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Heanthor/quill-secure/leader/alarm"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testPIN = "1234"
+
+func newAlarmAPI(t *testing.T) *API {
+	t.Helper()
+	d := newTestDB(t)
+	alm, err := alarm.New(d, alarm.Config{PIN: testPIN})
+	if err != nil {
+		t.Fatalf("alarm.New() error = %v", err)
+	}
+
+	return newTestAPI(t, Config{DB: d, Alarm: alm})
+}
+
+// alarmRequest posts body to path as the client at remoteAddr
+func alarmRequest(a *API, path, body, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	a.GetRouter().ServeHTTP(w, r)
+
+	return w
+}
+
+func TestAlarm_notConfigured(t *testing.T) {
+	a := newTestAPI(t, Config{})
+	decode(t, request(a, http.MethodGet, "/api/alarm/", "", false), http.StatusNotFound, nil)
+	decode(t, request(a, http.MethodPost, "/api/alarm/arm", `{"mode":"away","pin":"1234"}`, false), http.StatusNotFound, nil)
+}
+
+func TestAlarm_armDisarm(t *testing.T) {
+	a := newAlarmAPI(t)
+	const client = "10.0.0.2:5000"
+
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		wantCode  int
+		wantState alarm.State
+	}{
+		{name: "invalid body", path: "/api/alarm/arm", body: "{", wantCode: http.StatusBadRequest},
+		{name: "invalid mode", path: "/api/alarm/arm", body: `{"mode":"night","pin":"1234"}`, wantCode: http.StatusBadRequest},
+		{name: "wrong PIN", path: "/api/alarm/arm", body: `{"mode":"away","pin":"0000"}`, wantCode: http.StatusUnauthorized},
+		{name: "arm", path: "/api/alarm/arm", body: `{"mode":"away","pin":"1234"}`, wantCode: http.StatusOK, wantState: alarm.StateArmedAway},
+		{name: "arm again", path: "/api/alarm/arm", body: `{"mode":"home","pin":"1234"}`, wantCode: http.StatusConflict},
+		{name: "disarm wrong PIN", path: "/api/alarm/disarm", body: `{"pin":"4321"}`, wantCode: http.StatusUnauthorized},
+		{name: "disarm", path: "/api/alarm/disarm", body: `{"pin":"1234"}`, wantCode: http.StatusOK, wantState: alarm.StateDisarmed},
+		{name: "disarm again", path: "/api/alarm/disarm", body: `{"pin":"1234"}`, wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := alarmRequest(a, tt.path, tt.body, client)
+			if tt.wantState == "" {
+				decode(t, w, tt.wantCode, nil)
+				return
+			}
+			var st alarm.Status
+			decode(t, w, tt.wantCode, &st)
+			if st.State != tt.wantState {
+				t.Errorf("state = %s, want %s", st.State, tt.wantState)
+			}
+		})
+	}
+
+	var audit AlarmAuditResponse
+	decode(t, request(a, http.MethodGet, "/api/alarm/audit", "", false), http.StatusOK, &audit)
+	if len(audit.Transitions) != 2 || audit.Transitions[0].Source != "10.0.0.2" {
+		t.Errorf("audit = %+v, want arm and disarm from 10.0.0.2", audit.Transitions)
+	}
+}
+
+func TestAlarm_lockout(t *testing.T) {
+	a := newAlarmAPI(t)
+	const attacker, owner = "10.0.0.66", "10.0.0.2:5000"
+
+	// each attempt comes from a new port, which must not reset the count
+	for i := 0; i < 5; i++ {
+		w := alarmRequest(a, "/api/alarm/arm", `{"mode":"away","pin":"0000"}`, attacker+":"+strconv.Itoa(5000+i))
+		decode(t, w, http.StatusUnauthorized, nil)
+	}
+	decode(t, alarmRequest(a, "/api/alarm/arm", `{"mode":"away","pin":"1234"}`, attacker+":6000"), http.StatusTooManyRequests, nil)
+
+	// the owner is not locked out by someone else's guesses
+	decode(t, alarmRequest(a, "/api/alarm/arm", `{"mode":"away","pin":"1234"}`, owner), http.StatusOK, nil)
+	decode(t, alarmRequest(a, "/api/alarm/disarm", `{"pin":"1234"}`, owner), http.StatusOK, nil)
+}
+
+func TestAlarm_lockoutForgedAddress(t *testing.T) {
+	a := newAlarmAPI(t)
+	decode(t, alarmRequest(a, "/api/alarm/arm", `{"mode":"away","pin":"1234"}`, "10.0.0.2:5000"), http.StatusOK, nil)
+
+	// a forwarding header is trusted for the client address, so an attacker can claim a new address every time
+	disarm := func(pin string, i int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/alarm/disarm", strings.NewReader(`{"pin":"`+pin+`"}`))
+		r.RemoteAddr = "203.0.113.7:4000"
+		r.Header.Set("X-Real-IP", "198.51.100."+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		a.GetRouter().ServeHTTP(w, r)
+
+		return w
+	}
+	guesses := 0
+	for ; guesses < 100; guesses++ {
+		if w := disarm(fmt.Sprintf("%04d", guesses), guesses); w.Code == http.StatusTooManyRequests {
+			break
+		} else if w.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: status = %d, want %d", guesses, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if guesses != 10 {
+		t.Fatalf("locked out after %d guesses from rotating addresses, want 10", guesses)
+	}
+	decode(t, disarm(testPIN, 200), http.StatusTooManyRequests, nil)
+}
+
+func TestAlarm_audit(t *testing.T) {
+	a := newAlarmAPI(t)
+	for i := 0; i < 3; i++ {
+		decode(t, alarmRequest(a, "/api/alarm/arm", `{"mode":"home","pin":"1234"}`, "10.0.0.2:1"), http.StatusOK, nil)
+		decode(t, alarmRequest(a, "/api/alarm/disarm", `{"pin":"1234"}`, "10.0.0.2:1"), http.StatusOK, nil)
+	}
+
+	var page AlarmAuditResponse
+	decode(t, request(a, http.MethodGet, "/api/alarm/audit?limit=4", "", false), http.StatusOK, &page)
+	if len(page.Transitions) != 4 || page.Next == 0 {
+		t.Fatalf("first page = %d transitions, next %d", len(page.Transitions), page.Next)
+	}
+	var rest AlarmAuditResponse
+	decode(t, request(a, http.MethodGet, "/api/alarm/audit?limit=4&before="+strconv.FormatInt(page.Next, 10), "", false), http.StatusOK, &rest)
+	if len(rest.Transitions) != 2 || rest.Next != 0 {
+		t.Errorf("second page = %d transitions, next %d", len(rest.Transitions), rest.Next)
+	}
+	decode(t, request(a, http.MethodGet, "/api/alarm/audit?before=x", "", false), http.StatusBadRequest, nil)
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultAlertsLimit = 100
+	maxAlertsLimit     = 1000
+)
+
+type AlertsResponse struct {
+	Alerts []db.Alert `json:"alerts"`
+	// Next is passed as before to fetch the following page, and is 0 on the last page
+	Next int64 `json:"next"`
+}
+
+// getAlerts returns alerts, newest first, with values, thresholds and messages in the requested units.
+// Query params: from and to (RFC3339 or unix seconds), states and devices (comma separated),
+// limit (default 100, max 1000) and before, the next cursor of the previous page, location and labels
+// to select devices by where they are, and units and unit overrides, as for getQuery.
+func (a *API) getAlerts(w http.ResponseWriter, r *http.Request) {
+	f, err := parseAlertsFilter(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefs, err := a.parseUnits(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lf, err := parseLocationFilter(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, ok := a.narrowDevices(f.DeviceIDs, lf)
+	if !ok {
+		writeJSON(w, AlertsResponse{Alerts: []db.Alert{}})
+		return
+	}
+	f.DeviceIDs = devices
+
+	as, err := a.alerts.Alerts(f)
+	if err != nil {
+		log.Err(err).Msg("getAlerts db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	resp := AlertsResponse{Alerts: as}
+	if len(as) == f.Limit {
+		resp.Next = as[len(as)-1].ID
+	}
+	for i := range as {
+		as[i] = alerts.InUnits(as[i], prefs)
+	}
+
+	writeJSON(w, resp)
+}
+
+func parseAlertsFilter(r *http.Request) (db.AlertsFilter, error) {
+	rf, err := parseReadingsFilter(r)
+	if err != nil {
+		return db.AlertsFilter{}, err
+	}
+	limit, err := parseLimit(r, defaultAlertsLimit, maxAlertsLimit)
+	if err != nil {
+		return db.AlertsFilter{}, err
+	}
+	before, err := parseBefore(r)
+	if err != nil {
+		return db.AlertsFilter{}, err
+	}
+
+	states := export.ParseList(r.URL.Query().Get("states"))
+	for _, s := range states {
+		if s != alerts.StateOpen && s != alerts.StateAcknowledged && s != alerts.StateResolved {
+			return db.AlertsFilter{}, fmt.Errorf("invalid state %q", s)
+		}
+	}
+
+	return db.AlertsFilter{
+		From:      rf.From,
+		To:        rf.To,
+		States:    states,
+		DeviceIDs: rf.DeviceIDs,
+		Before:    before,
+		Limit:     limit,
+	}, nil
+}
+
+// postAcknowledgeAlert marks an open alert as seen, returning it in the units of the query params, as for getQuery
+func (a *API) postAcknowledgeAlert(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := a.parseUnits(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alert, err := a.alerts.Acknowledge(id)
+	if err != nil {
+		writeAlertsError(w, err)
+		return
+	}
+
+	writeJSON(w, alerts.InUnits(alert, prefs))
+}
+
+// getAlertDeliveries returns the notifications sent for an alert, oldest first
+func (a *API) getAlertDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+
+	dls, err := a.db.Deliveries(id)
+	if err != nil {
+		log.Err(err).Msg("getAlertDeliveries db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	writeJSON(w, dls)
+}
+
+func (a *API) getAlertRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.alerts.Rules())
+}
+
+func (a *API) postAlertRule(w http.ResponseWriter, r *http.Request) {
+	var rule db.AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.checkNotifiers(rule); err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rule, err := a.alerts.CreateRule(rule)
+	if err != nil {
+		writeAlertsError(w, err)
+		return
+	}
+
+	writeJSON(w, rule, http.StatusCreated)
+}
+
+func (a *API) putAlertRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+	var rule db.AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	rule.ID = id
+	if err := a.checkNotifiers(rule); err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.alerts.UpdateRule(rule); err != nil {
+		writeAlertsError(w, err)
+		return
+	}
+
+	writeJSON(w, rule)
+}
+
+func (a *API) deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.alerts.DeleteRule(id); err != nil {
+		writeAlertsError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkNotifiers fails if a rule routes to a notifier which is not configured
+func (a *API) checkNotifiers(rule db.AlertRule) error {
+	for _, name := range rule.Notifiers {
+		if a.notifiers == nil || !a.notifiers.Has(name) {
+			return fmt.Errorf("unknown notifier %q", name)
+		}
+	}
+
+	return nil
+}
+
+// idParam reads the id path param, responding with 400 if it is invalid
+func idParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		writeMessage(w, "invalid id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+func writeAlertsError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		writeMessage(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, alerts.ErrInvalidRule):
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, alerts.ErrNotOpen):
+		writeMessage(w, err.Error(), http.StatusConflict)
+	default:
+		log.Err(err).Msg("alerts error")
+		respondInternalServerError(w, err.Error())
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPostAcknowledgeAlert(t *testing.T) {
+	d := newTestDB(t)
+	engine, err := alerts.New(d)
+	if err != nil {
+		t.Fatalf("alerts.New() error = %v", err)
+	}
+	a := newTestAPI(t, Config{DB: d, Alerts: engine, AdminToken: testAdminToken})
+	if _, err := engine.CreateRule(db.AlertRule{Name: "voc", Metric: sensor.MetricVOCIndex, Condition: alerts.ConditionAbove, Threshold: 250}); err != nil {
+		t.Fatalf("CreateRule() error = %v", err)
+	}
+	engine.Evaluate(1, time.Now(), []sensor.Measurement{{Metric: sensor.MetricVOCIndex, Value: 300}})
+
+	// acknowledging silences an alert, so it needs the admin token
+	decode(t, request(a, http.MethodPost, "/api/alerts/1/acknowledge", "", false), http.StatusUnauthorized, nil)
+
+	var alert db.Alert
+	decode(t, request(a, http.MethodPost, "/api/alerts/1/acknowledge", "", true), http.StatusOK, &alert)
+	if alert.State != alerts.StateAcknowledged || alert.AcknowledgedAt == nil {
+		t.Errorf("acknowledged alert = %+v", alert)
+	}
+	decode(t, request(a, http.MethodPost, "/api/alerts/1/acknowledge", "", true), http.StatusConflict, nil)
+	decode(t, request(a, http.MethodPost, "/api/alerts/2/acknowledge", "", true), http.StatusNotFound, nil)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/calibration"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+// RecalibrateRequest selects the stored values to rewrite with the current calibration. A nil From or To leaves
+// that end of the range open.
+type RecalibrateRequest struct {
+	DeviceID uint8      `json:"deviceID"`
+	Metric   string     `json:"metric"`
+	From     *time.Time `json:"from"`
+	To       *time.Time `json:"to"`
+}
+
+func (a *API) getCalibrations(w http.ResponseWriter, r *http.Request) {
+	cals, err := a.calibrations.Calibrations()
+	if err != nil {
+		log.Err(err).Msg("getCalibrations db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	writeJSON(w, cals)
+}
+
+// putCalibration sets the calibration of a device's metric, replacing any existing one. It applies to values
+// received from now on; stored values are rewritten by postRecalibrate.
+func (a *API) putCalibration(w http.ResponseWriter, r *http.Request) {
+	var cal db.Calibration
+	if err := json.NewDecoder(r.Body).Decode(&cal); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	cal, err := a.calibrations.Set(cal)
+	if err != nil {
+		writeCalibrationError(w, err)
+		return
+	}
+
+	writeJSON(w, cal)
+}
+
+func (a *API) deleteCalibration(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.calibrations.Delete(id); err != nil {
+		writeCalibrationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postRecalibrate rewrites stored values of a device's metric from their raw values with its current calibration
+func (a *API) postRecalibrate(w http.ResponseWriter, r *http.Request) {
+	var req RecalibrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Metric == "" {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	var from, to time.Time
+	if req.From != nil {
+		from = *req.From
+	}
+	if req.To != nil {
+		to = *req.To
+	}
+
+	n, err := a.calibrations.Recalibrate(req.DeviceID, req.Metric, from, to)
+	if err != nil {
+		writeCalibrationError(w, err)
+		return
+	}
+
+	writeJSON(w, H{"updated": n})
+}
+
+func writeCalibrationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound), errors.Is(err, db.ErrUnknownMetric):
+		writeMessage(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, calibration.ErrInvalid):
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Err(err).Msg("calibration error")
+		respondInternalServerError(w, err.Error())
+	}
+}
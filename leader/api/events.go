@@ -0,0 +1,83 @@
+package api
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/rs/zerolog/log"
+	"net/http"
+)
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+type EventsResponse struct {
+	Events []db.Event `json:"events"`
+	// Next is passed as before to fetch the following page, and is 0 on the last page
+	Next int64 `json:"next"`
+}
+
+// getEvents returns events reported by event driven sensors, newest first.
+// Query params: from and to (RFC3339 or unix seconds), devices, sensors and kinds (comma separated),
+// limit (default 100, max 1000) and before, the next cursor of the previous page, and location and labels
+// to select devices by where they are.
+func (a *API) getEvents(w http.ResponseWriter, r *http.Request) {
+	f, err := parseEventsFilter(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lf, err := parseLocationFilter(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, ok := a.narrowDevices(f.DeviceIDs, lf)
+	if !ok {
+		writeJSON(w, EventsResponse{Events: []db.Event{}})
+		return
+	}
+	f.DeviceIDs = devices
+
+	events, err := a.db.Events(f)
+	if err != nil {
+		log.Err(err).Msg("getEvents db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	resp := EventsResponse{Events: events}
+	if len(events) == f.Limit {
+		resp.Next = events[len(events)-1].ID
+	}
+
+	writeJSON(w, resp)
+}
+
+func parseEventsFilter(r *http.Request) (db.EventsFilter, error) {
+	rf, err := parseReadingsFilter(r)
+	if err != nil {
+		return db.EventsFilter{}, err
+	}
+	limit, err := parseLimit(r, defaultEventsLimit, maxEventsLimit)
+	if err != nil {
+		return db.EventsFilter{}, err
+	}
+
+	before, err := parseBefore(r)
+	if err != nil {
+		return db.EventsFilter{}, err
+	}
+
+	q := r.URL.Query()
+	return db.EventsFilter{
+		From:      rf.From,
+		To:        rf.To,
+		DeviceIDs: rf.DeviceIDs,
+		Sensors:   export.ParseList(q.Get("sensors")),
+		Kinds:     export.ParseList(q.Get("kinds")),
+		Before:    before,
+		Limit:     limit,
+	}, nil
+}
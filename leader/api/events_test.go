@@ -0,0 +1,137 @@
+package api
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/locations"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newEventsAPI records five events, with IDs 1 to 5 a hundred seconds apart. Node 2 is in the Garage.
+func newEventsAPI(t *testing.T) *API {
+	t.Helper()
+	a := newTestAPI(t, Config{})
+	if _, err := a.locations.CreateLocation(db.Location{Name: "Garage", Kind: locations.KindSite}); err != nil {
+		t.Fatalf("CreateLocation() error = %v", err)
+	}
+	if _, err := a.locations.SetAssignment(db.Assignment{DeviceID: 2, LocationID: int64Ptr(1)}); err != nil {
+		t.Fatalf("SetAssignment() error = %v", err)
+	}
+
+	for i, e := range []struct {
+		deviceID            uint8
+		sensor, kind, state string
+	}{
+		{1, "hallway_motion", sensor.EventKindMotion, sensor.StateStart},
+		{1, "hallway_motion", sensor.EventKindMotion, sensor.StateStop},
+		{1, "front_door", sensor.EventKindContact, sensor.StateOpen},
+		{2, "garage_door", sensor.EventKindContact, sensor.StateClosed},
+		{2, "garage_motion", sensor.EventKindMotion, sensor.StateStart},
+	} {
+		if _, err := a.db.RecordEvent(e.deviceID, sensor.Event{
+			Sensor:    e.sensor,
+			Kind:      e.kind,
+			State:     e.state,
+			Timestamp: time.Unix(int64(i+1)*100, 0),
+		}); err != nil {
+			t.Fatalf("RecordEvent() error = %v", err)
+		}
+	}
+
+	return a
+}
+
+func eventIDs(events []db.Event) []int64 {
+	ids := []int64{}
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+
+	return ids
+}
+
+func TestGetEvents(t *testing.T) {
+	a := newEventsAPI(t)
+	tests := []struct {
+		name  string
+		query string
+		want  []int64
+	}{
+		{name: "all newest first", want: []int64{5, 4, 3, 2, 1}},
+		{name: "device", query: "devices=1", want: []int64{3, 2, 1}},
+		{name: "kind", query: "kinds=motion", want: []int64{5, 2, 1}},
+		{name: "sensors", query: "sensors=front_door,garage_door", want: []int64{4, 3}},
+		{name: "time range excludes to", query: "from=200&to=400", want: []int64{3, 2}},
+		{name: "device and kind", query: "devices=1&kinds=contact", want: []int64{3}},
+		{name: "location", query: "location=1", want: []int64{5, 4}},
+		{name: "device outside location", query: "devices=1&location=1", want: []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp EventsResponse
+			decode(t, request(a, http.MethodGet, "/api/events?"+tt.query, "", false), http.StatusOK, &resp)
+			if got := eventIDs(resp.Events); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getEvents() IDs = %v, want %v", got, tt.want)
+			}
+			if resp.Next != 0 {
+				t.Errorf("getEvents() next = %d, want 0", resp.Next)
+			}
+		})
+	}
+
+	var resp EventsResponse
+	decode(t, request(a, http.MethodGet, "/api/events?devices=1&limit=1", "", false), http.StatusOK, &resp)
+	if e := resp.Events[0]; e.DeviceID != 1 || e.Sensor != "front_door" || e.State != sensor.StateOpen || e.Timestamp.Unix() != 300 {
+		t.Errorf("getEvents() newest event = %+v", e)
+	}
+}
+
+func TestGetEvents_paging(t *testing.T) {
+	a := newEventsAPI(t)
+	var (
+		got    []int64
+		before int64
+	)
+	for pages := 1; ; pages++ {
+		target := "/api/events?limit=2"
+		if before != 0 {
+			target += "&before=" + strconv.FormatInt(before, 10)
+		}
+		var resp EventsResponse
+		decode(t, request(a, http.MethodGet, target, "", false), http.StatusOK, &resp)
+		got = append(got, eventIDs(resp.Events)...)
+		if resp.Next == 0 {
+			if pages != 3 {
+				t.Errorf("got %d pages, want 3", pages)
+			}
+			break
+		}
+		if pages == 3 {
+			t.Fatalf("third page has next %d, want 0", resp.Next)
+		}
+		before = resp.Next
+	}
+	if want := []int64{5, 4, 3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paged IDs = %v, want %v", got, want)
+	}
+
+	// paging combines with filters
+	var resp EventsResponse
+	decode(t, request(a, http.MethodGet, "/api/events?kinds=motion&limit=2&before=5", "", false), http.StatusOK, &resp)
+	if got := eventIDs(resp.Events); !reflect.DeepEqual(got, []int64{2, 1}) || resp.Next != 1 {
+		t.Errorf("filtered page = %v, next %d, want [2 1], next 1", got, resp.Next)
+	}
+}
+
+func TestGetEvents_badParams(t *testing.T) {
+	a := newEventsAPI(t)
+	for _, query := range []string{"limit=0", "limit=1001", "before=x", "before=-1", "devices=x", "from=yesterday", "location=0"} {
+		if w := request(a, http.MethodGet, "/api/events?"+query, "", false); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /api/events?%s status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -2,12 +2,26 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alarm"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"github.com/Heanthor/quill-secure/leader/atmosphere"
+	"github.com/Heanthor/quill-secure/leader/backup"
+	"github.com/Heanthor/quill-secure/leader/calibration"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/Heanthor/quill-secure/leader/importer"
+	"github.com/Heanthor/quill-secure/leader/locations"
+	"github.com/Heanthor/quill-secure/leader/metrics"
 	"github.com/Heanthor/quill-secure/leader/net"
+	"github.com/Heanthor/quill-secure/leader/notify"
+	"github.com/Heanthor/quill-secure/leader/units"
 	"github.com/Heanthor/quill-secure/model"
+	"github.com/Heanthor/quill-secure/node/sensor"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"net/http"
 	"strconv"
@@ -18,6 +32,43 @@ type API struct {
 	r           chi.Router
 	db          *db.DB
 	activeNodes net.ActiveNodesFunc
+	nodes       net.NodesFunc
+	// backups is nil if backups are not configured
+	backups *backup.Manager
+	// alarm is nil if the alarm is not configured
+	alarm     *alarm.Alarm
+	alerts    *alerts.Engine
+	notifiers *notify.Dispatcher
+	offline   *alerts.OfflineMonitor
+	// units is the default unit preference of responses
+	units        units.Preferences
+	calibrations *calibration.Calibrator
+	atmosphere   *atmosphere.Atmosphere
+	locations    *locations.Directory
+}
+
+// Config holds the settings and dependencies of the API
+type Config struct {
+	Env         string
+	DB          *db.DB
+	ActiveNodes net.ActiveNodesFunc
+	Nodes       net.NodesFunc
+	// DashboardStatsDays is the default number of days returned by /api/dashboard/stats
+	DashboardStatsDays int
+	// AdminToken is the bearer token required by admin endpoints and /metrics. Admin endpoints are disabled if blank.
+	AdminToken string
+	// Backups is nil if backups are not configured
+	Backups *backup.Manager
+	// Alarm is nil if the alarm is not configured
+	Alarm     *alarm.Alarm
+	Alerts    *alerts.Engine
+	Notifiers *notify.Dispatcher
+	Offline   *alerts.OfflineMonitor
+	// Units is the default unit preference of responses, overridden by the units query param. Zero is metric.
+	Units        units.Preferences
+	Calibrations *calibration.Calibrator
+	Atmosphere   *atmosphere.Atmosphere
+	Locations    *locations.Directory
 }
 
 type ErrorResponse struct {
@@ -36,40 +87,136 @@ type DashboardStatsResponseItem struct {
 
 	UnixTS       int64   `json:"unixTS"`
 	TemperatureF float32 `json:"temperatureF"`
+	// Units are the units of temperature, pressure and altitude
+	Units units.Preferences `json:"units"`
 }
 
-func NewRouter(env string, db *db.DB, activeNodes net.ActiveNodesFunc, dashboardStatsDays int) *API {
+// maxImportBytes caps the size of an uploaded import file
+const maxImportBytes = 64 << 20
+
+func NewRouter(cfg Config) *API {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(instrumentLatency)
 
 	origins := []string{"https://quillsecure.com", "https://www.quillsecure.com"}
-	if env == model.EnvLocal {
+	if cfg.Env == model.EnvLocal {
 		origins = append(origins, "http://*")
 	}
 	r.Use(cors.Handler(cors.Options{
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
 		AllowedOrigins: origins,
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: false,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
-	a := API{r: r, db: db, activeNodes: activeNodes}
+	a := API{
+		r:            r,
+		db:           cfg.DB,
+		activeNodes:  cfg.ActiveNodes,
+		nodes:        cfg.Nodes,
+		backups:      cfg.Backups,
+		alarm:        cfg.Alarm,
+		alerts:       cfg.Alerts,
+		notifiers:    cfg.Notifiers,
+		offline:      cfg.Offline,
+		units:        cfg.Units,
+		calibrations: cfg.Calibrations,
+		atmosphere:   cfg.Atmosphere,
+		locations:    cfg.Locations,
+	}
+	if a.units == (units.Preferences{}) {
+		a.units = units.Metric
+	}
 
 	r.Route("/api", func(r chi.Router) {
 		r.Route("/dashboard", func(r chi.Router) {
-			r.Get("/stats", a.getDashboardStats(dashboardStatsDays))
+			r.Get("/stats", a.getDashboardStats(cfg.DashboardStatsDays))
 			r.Get("/sensorsConnected", a.getSensorsConnected)
 		})
+		r.Get("/nodes", a.getNodes)
+		r.Get("/sensorErrors", a.getSensorErrors)
+		r.Get("/events", a.getEvents)
+		r.Get("/metrics", a.getMetrics)
+		r.Get("/query", a.getQuery)
+		r.Get("/latest", a.getLatest)
+		r.Get("/export", a.getExport)
+		r.Route("/alarm", func(r chi.Router) {
+			r.Use(a.requireAlarm)
+			r.Get("/", a.getAlarm)
+			r.Post("/arm", a.postArm)
+			r.Post("/disarm", a.postDisarm)
+			r.Get("/audit", a.getAlarmAudit)
+		})
+		r.Route("/alerts", func(r chi.Router) {
+			r.Get("/", a.getAlerts)
+			r.Get("/{id}/deliveries", a.getAlertDeliveries)
+			r.Get("/rules", a.getAlertRules)
+			r.Group(func(r chi.Router) {
+				r.Use(requireAdminToken(cfg.AdminToken))
+				r.Post("/{id}/acknowledge", a.postAcknowledgeAlert)
+				r.Post("/rules", a.postAlertRule)
+				r.Put("/rules/{id}", a.putAlertRule)
+				r.Delete("/rules/{id}", a.deleteAlertRule)
+			})
+		})
+		r.Get("/atmosphere", a.getAtmosphere)
+		r.Route("/locations", func(r chi.Router) {
+			r.Get("/", a.getLocations)
+			r.Group(func(r chi.Router) {
+				r.Use(requireAdminToken(cfg.AdminToken))
+				r.Post("/", a.postLocation)
+				r.Put("/{id}", a.putLocation)
+				r.Delete("/{id}", a.deleteLocation)
+			})
+		})
+		r.Route("/assignments", func(r chi.Router) {
+			r.Get("/", a.getAssignments)
+			r.Group(func(r chi.Router) {
+				r.Use(requireAdminToken(cfg.AdminToken))
+				r.Put("/", a.putAssignment)
+				r.Delete("/{deviceID}", a.deleteAssignment)
+			})
+		})
+		r.Route("/calibrations", func(r chi.Router) {
+			r.Get("/", a.getCalibrations)
+			r.Group(func(r chi.Router) {
+				r.Use(requireAdminToken(cfg.AdminToken))
+				r.Put("/", a.putCalibration)
+				r.Delete("/{id}", a.deleteCalibration)
+			})
+		})
+		r.Route("/maintenance", func(r chi.Router) {
+			r.Use(a.requireOffline)
+			r.Get("/", a.getMaintenance)
+			r.Group(func(r chi.Router) {
+				r.Use(requireAdminToken(cfg.AdminToken))
+				r.Post("/", a.postMaintenance)
+				r.Delete("/{id}", a.deleteMaintenance)
+			})
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireAdminToken(cfg.AdminToken))
+			r.Post("/import", a.postImport)
+			r.Route("/admin", func(r chi.Router) {
+				r.Get("/backup", a.getBackupStatus)
+				r.Post("/backup", a.postBackup)
+				r.Post("/recalibrate", a.postRecalibrate)
+			})
+		})
 	})
 
 	r.Get("/whoami", a.easterEgg)
+	// metrics expose node health and request rates, so they are scraped with the admin token
+	r.With(requireAdminToken(cfg.AdminToken)).Handle("/metrics", promhttp.Handler())
 
 	return &a
 }
@@ -83,17 +230,76 @@ func (a *API) Listen(port int) error {
 	return http.ListenAndServe(":"+strconv.Itoa(port), a.r)
 }
 
+// instrumentLatency records handler latency by route pattern, so path parameters do not explode label cardinality
+func instrumentLatency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		metrics.HTTPLatency.
+			WithLabelValues(r.Method, route, strconv.Itoa(ww.Status())).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
 func (a *API) getSensorsConnected(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, H{"activeSensors": a.activeNodes()})
 }
 
+// getAtmosphere returns the reference pressure altitude is computed against, in the requested units
+func (a *API) getAtmosphere(w http.ResponseWriter, r *http.Request) {
+	prefs, err := a.parseUnits(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	st := a.atmosphere.Status()
+	st.ReferencePressure = units.Convert(st.ReferencePressure, units.HPa, prefs.Pressure)
+	if st.SiteElevation != nil {
+		elevation := units.Convert(*st.SiteElevation, units.Metres, prefs.Altitude)
+		st.SiteElevation = &elevation
+	}
+
+	writeJSON(w, H{"status": st, "units": prefs})
+}
+
+// getNodes lists every node seen since the leader started, with the health of each of its sensors and its offline alert state
+func (a *API) getNodes(w http.ResponseWriter, r *http.Request) {
+	nodes := a.nodes()
+	if a.offline != nil {
+		states := a.offline.NodeStates()
+		for i := range nodes {
+			nodes[i].OfflineAlert = states[nodes[i].DeviceID]
+		}
+	}
+
+	writeJSON(w, nodes)
+}
+
 func (a *API) getDashboardStats(dashboardStatsDays int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		days, err := strconv.Atoi(r.URL.Query().Get("days"))
 		if err != nil {
 			days = dashboardStatsDays
 		}
-		stats, err := a.db.GetRecentStats(days)
+		prefs, err := a.parseUnits(r)
+		if err != nil {
+			writeMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stats, err := a.db.GetRecentStats(days, []string{
+			sensor.MetricTemperature,
+			sensor.MetricHumidity,
+			sensor.MetricPressure,
+			sensor.MetricAltitude,
+			sensor.MetricVOCIndex,
+		})
 		if err != nil {
 			log.Err(err).Msg("getDashboardStats db error")
 			respondInternalServerError(w, err.Error())
@@ -102,16 +308,17 @@ func (a *API) getDashboardStats(dashboardStatsDays int) http.HandlerFunc {
 
 		resp := make([]DashboardStatsResponseItem, len(stats))
 		for i, item := range stats {
-			temperatureF := item.Temperature*9/5 + 32
+			temperature := item.Values[sensor.MetricTemperature]
 			resp[i] = DashboardStatsResponseItem{
 				Timestamp:    item.Timestamp,
-				Temperature:  item.Temperature,
-				Humidity:     item.Humidity,
-				Pressure:     item.Pressure,
-				Altitude:     item.Altitude,
-				VOCIndex:     item.VOCIndex,
+				Temperature:  float32(units.Convert(temperature, units.Celsius, prefs.Temperature)),
+				Humidity:     float32(item.Values[sensor.MetricHumidity]),
+				Pressure:     float32(units.Convert(item.Values[sensor.MetricPressure], units.HPa, prefs.Pressure)),
+				Altitude:     float32(units.Convert(item.Values[sensor.MetricAltitude], units.Metres, prefs.Altitude)),
+				VOCIndex:     float32(item.Values[sensor.MetricVOCIndex]),
 				UnixTS:       item.Timestamp.Unix(),
-				TemperatureF: temperatureF,
+				TemperatureF: float32(units.Convert(temperature, units.Celsius, units.Fahrenheit)),
+				Units:        prefs,
 			}
 		}
 
@@ -124,6 +331,121 @@ func (a *API) getDashboardStats(dashboardStatsDays int) http.HandlerFunc {
 	}
 }
 
+// getExport streams readings as CSV or NDJSON.
+// Query params: format (csv|ndjson), from and to (RFC3339 or unix seconds), devices and metrics (comma separated).
+func (a *API) getExport(w http.ResponseWriter, r *http.Request) {
+	f, err := parseReadingsFilter(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	known, err := a.db.MetricNames()
+	if err != nil {
+		log.Err(err).Msg("getExport db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+	opts := export.Options{
+		Format:  r.URL.Query().Get("format"),
+		Metrics: f.Metrics,
+	}
+	if err := opts.Validate(known); err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Metrics = opts.Metrics
+
+	rows, err := a.db.StreamReadings(f)
+	if err != nil {
+		log.Err(err).Msg("getExport db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", opts.ContentType())
+	w.Header().Set("Content-Disposition", `attachment; filename="readings.`+opts.Format+`"`)
+	// headers are already sent once streaming starts, so errors can only be logged
+	n, err := export.Write(w, rows, opts)
+	if err != nil {
+		log.Err(err).Int("written", n).Msg("getExport streaming error")
+		return
+	}
+	log.Debug().Int("written", n).Msg("getExport finished")
+}
+
+// postImport imports readings from the request body.
+// Query params: format (driverlog|csv), device (required), columns (metric=column pairs, csv only).
+func (a *API) postImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	deviceID, err := strconv.ParseUint(q.Get("device"), 10, 8)
+	if err != nil {
+		writeMessage(w, "device must be a device ID", http.StatusBadRequest)
+		return
+	}
+	columns, err := importer.ParseColumns(q.Get("columns"))
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	known, err := a.db.MetricNames()
+	if err != nil {
+		log.Err(err).Msg("postImport db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	res, err := importer.Import(body, a.db, importer.Options{
+		Format:   q.Get("format"),
+		DeviceID: uint8(deviceID),
+		Metrics:  known,
+		Columns:  columns,
+	})
+	if err != nil {
+		log.Err(err).Interface("result", res).Msg("postImport error")
+		writeJSON(w, H{"error": err.Error(), "result": res}, http.StatusBadRequest)
+		return
+	}
+	log.Info().
+		Uint64("deviceID", deviceID).
+		Int("imported", res.Imported).
+		Int("duplicates", res.Duplicates).
+		Int("rejected", res.RejectedCount).
+		Msg("Import complete")
+
+	writeJSON(w, res)
+}
+
+func (a *API) getBackupStatus(w http.ResponseWriter, r *http.Request) {
+	if a.backups == nil {
+		writeMessage(w, "backups are not configured", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, a.backups.Status())
+}
+
+// postBackup starts a backup in the background. Poll getBackupStatus for the result.
+func (a *API) postBackup(w http.ResponseWriter, r *http.Request) {
+	if a.backups == nil {
+		writeMessage(w, "backups are not configured", http.StatusNotFound)
+		return
+	}
+
+	if err := a.backups.Trigger(); err != nil {
+		if errors.Is(err, backup.ErrInProgress) {
+			writeMessage(w, err.Error(), http.StatusConflict)
+			return
+		}
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	writeJSON(w, a.backups.Status(), http.StatusAccepted)
+}
+
 func (a *API) easterEgg(w http.ResponseWriter, r *http.Request) {
 	payload := `
     ____        _ _ _  _____                          
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/locations"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "secret"
+
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	d, err := db.NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(d.Close)
+
+	return d
+}
+
+// newTestAPI returns an API for cfg. A fresh database and location directory are used when they are unset.
+func newTestAPI(t *testing.T, cfg Config) *API {
+	t.Helper()
+	if cfg.DB == nil {
+		cfg.DB = newTestDB(t)
+	}
+	if cfg.Locations == nil {
+		dir, err := locations.New(cfg.DB)
+		if err != nil {
+			t.Fatalf("locations.New() error = %v", err)
+		}
+		cfg.Locations = dir
+	}
+
+	return NewRouter(cfg)
+}
+
+// request serves a request through the router, with the admin token if admin is set
+func request(a *API, method, target, body string, admin bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if admin {
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	w := httptest.NewRecorder()
+	a.GetRouter().ServeHTTP(w, r)
+
+	return w
+}
+
+// decode unmarshals the body of a response, failing the test unless it has the wanted status
+func decode(t *testing.T, w *httptest.ResponseRecorder, status int, v any) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body.String(), err)
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "disabled", token: "", header: "Bearer " + testAdminToken, want: http.StatusForbidden},
+		{name: "missing", token: testAdminToken, want: http.StatusUnauthorized},
+		{name: "wrong", token: testAdminToken, header: "Bearer nope", want: http.StatusUnauthorized},
+		// backups are not configured, so getting through the check ends in a 404
+		{name: "valid", token: testAdminToken, header: "Bearer " + testAdminToken, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAPI(t, Config{AdminToken: tt.token})
+			r := httptest.NewRequest(http.MethodGet, "/api/admin/backup", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			a.GetRouter().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMetricsRequireAdminToken(t *testing.T) {
+	a := newTestAPI(t, Config{AdminToken: testAdminToken})
+	if w := request(a, http.MethodGet, "/metrics", "", false); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /metrics without token status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := request(a, http.MethodGet, "/metrics", "", true); w.Code != http.StatusOK {
+		t.Errorf("GET /metrics status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,400 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/Heanthor/quill-secure/leader/locations"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Aggregations of grouped readings
+const (
+	aggAvg = "avg"
+	aggMin = "min"
+	aggMax = "max"
+)
+
+// defaultGroupStep is the width of the time buckets grouped series are averaged over
+const defaultGroupStep = 5 * time.Minute
+
+func (a *API) getLocations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.locations.Locations())
+}
+
+func (a *API) postLocation(w http.ResponseWriter, r *http.Request) {
+	var l db.Location
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	l, err := a.locations.CreateLocation(l)
+	if err != nil {
+		writeLocationsError(w, err)
+		return
+	}
+
+	writeJSON(w, l, http.StatusCreated)
+}
+
+func (a *API) putLocation(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+	var l db.Location
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	l.ID = id
+
+	if err := a.locations.UpdateLocation(l); err != nil {
+		writeLocationsError(w, err)
+		return
+	}
+
+	writeJSON(w, l)
+}
+
+func (a *API) deleteLocation(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.locations.DeleteLocation(id); err != nil {
+		writeLocationsError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) getAssignments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.locations.Assignments())
+}
+
+// putAssignment places a device, or a sensor instance of it, in a location with labels
+func (a *API) putAssignment(w http.ResponseWriter, r *http.Request) {
+	var as db.Assignment
+	if err := json.NewDecoder(r.Body).Decode(&as); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	as, err := a.locations.SetAssignment(as)
+	if err != nil {
+		writeLocationsError(w, err)
+		return
+	}
+
+	writeJSON(w, as)
+}
+
+// deleteAssignment removes the assignment of a device, or of one of its sensors given by the sensor query param
+func (a *API) deleteAssignment(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.ParseUint(chi.URLParam(r, "deviceID"), 10, 8)
+	if err != nil {
+		writeMessage(w, "invalid deviceID", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.locations.DeleteAssignment(uint8(deviceID), r.URL.Query().Get("sensor")); err != nil {
+		writeLocationsError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeLocationsError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		writeMessage(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, locations.ErrInvalid):
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Err(err).Msg("locations error")
+		respondInternalServerError(w, err.Error())
+	}
+}
+
+// parseLocationFilter reads the location (a location ID, including the locations inside it) and labels
+// (comma separated, all must match) query params
+func parseLocationFilter(r *http.Request) (locations.Filter, error) {
+	q := r.URL.Query()
+	f := locations.Filter{Labels: export.ParseList(q.Get("labels"))}
+	if s := q.Get("location"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 1 {
+			return locations.Filter{}, fmt.Errorf("invalid location %q", s)
+		}
+		f.LocationID = id
+	}
+
+	return f, nil
+}
+
+// narrowDevices restricts ids, where empty means every device, to the devices f can match.
+// It returns false if no device can match.
+func (a *API) narrowDevices(ids []uint8, f locations.Filter) ([]uint8, bool) {
+	if f.IsZero() {
+		return ids, true
+	}
+
+	var out []uint8
+	for _, id := range a.locations.DeviceIDs(f) {
+		if len(ids) == 0 || containsDevice(ids, id) {
+			out = append(out, id)
+		}
+	}
+
+	return out, len(out) > 0
+}
+
+func containsDevice(ids []uint8, id uint8) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grouping is how readings are grouped, read from the groupBy, agg and stepSecs query params
+type grouping struct {
+	by   string
+	agg  string
+	step time.Duration
+}
+
+func parseGrouping(r *http.Request) (grouping, error) {
+	q := r.URL.Query()
+	g := grouping{by: q.Get("groupBy"), agg: q.Get("agg"), step: defaultGroupStep}
+	if g.by == "" {
+		return g, nil
+	}
+	if err := locations.ValidateGroupBy(g.by); err != nil {
+		return grouping{}, err
+	}
+	switch g.agg {
+	case "":
+		g.agg = aggAvg
+	case aggAvg, aggMin, aggMax:
+	default:
+		return grouping{}, fmt.Errorf("unknown agg %q, must be %s, %s or %s", g.agg, aggAvg, aggMin, aggMax)
+	}
+	if s := q.Get("stepSecs"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs < 1 {
+			return grouping{}, fmt.Errorf("invalid stepSecs %q", s)
+		}
+		g.step = time.Duration(secs) * time.Second
+	}
+
+	return g, nil
+}
+
+// aggregate accumulates values for an aggregation
+type aggregate struct {
+	sum, min, max float64
+	n             int
+}
+
+func (g *aggregate) add(v float64) {
+	if g.n == 0 || v < g.min {
+		g.min = v
+	}
+	if g.n == 0 || v > g.max {
+		g.max = v
+	}
+	g.sum += v
+	g.n++
+}
+
+func (g aggregate) value(agg string) float64 {
+	switch agg {
+	case aggMin:
+		return g.min
+	case aggMax:
+		return g.max
+	}
+
+	return g.sum / float64(g.n)
+}
+
+// GroupSeriesResponseItem is a series aggregated over every device and sensor of one type in a group
+type GroupSeriesResponseItem struct {
+	Group string `json:"group"`
+	// SensorType keeps unlike series apart, so a room's air temperature is not averaged with its nodes' CPU temperatures
+	SensorType string `json:"sensorType"`
+	// Metric is the metric without any sensor instance prefix, so instances in the group are aggregated together
+	Metric string        `json:"metric"`
+	Unit   string        `json:"unit"`
+	Agg    string        `json:"agg"`
+	Points []SeriesPoint `json:"points"`
+}
+
+// GroupLatestResponseItem aggregates the latest value of a metric of every device and sensor of one type in a group
+type GroupLatestResponseItem struct {
+	Group      string  `json:"group"`
+	SensorType string  `json:"sensorType"`
+	Metric     string  `json:"metric"`
+	Unit       string  `json:"unit"`
+	Agg        string  `json:"agg"`
+	Value      float64 `json:"value"`
+	// Count is how many series were aggregated, and Timestamp is the newest of their values
+	Count     int       `json:"count"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type groupKey struct {
+	group, sensorType, metric string
+}
+
+func (k groupKey) less(o groupKey) bool {
+	if k.group != o.group {
+		return k.group < o.group
+	}
+	if k.sensorType != o.sensorType {
+		return k.sensorType < o.sensorType
+	}
+
+	return k.metric < o.metric
+}
+
+// metricSensorTypes returns the name of the sensor type of each metric
+func (a *API) metricSensorTypes() (map[string]string, error) {
+	ms, err := a.db.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(ms))
+	for _, m := range ms {
+		out[m.Name] = sensor.NameByType(int(m.SensorType))
+	}
+
+	return out, nil
+}
+
+// groupSeries aggregates samples, already converted to the response units, into a series per group, sensor type
+// and metric. types maps each metric to its sensor type.
+func (a *API) groupSeries(samples []db.Sample, g grouping, types map[string]string) []GroupSeriesResponseItem {
+	type bucketKey struct {
+		groupKey
+		ts int64
+	}
+	buckets := make(map[bucketKey]*aggregate)
+	units := make(map[groupKey]string)
+	for _, s := range samples {
+		metric := sensor.BaseMetric(s.Metric)
+		ts := s.Timestamp.Truncate(g.step).Unix()
+		for _, group := range a.locations.Groups(s.DeviceID, s.Metric, g.by) {
+			k := bucketKey{groupKey: groupKey{group: group, sensorType: types[s.Metric], metric: metric}, ts: ts}
+			if buckets[k] == nil {
+				buckets[k] = &aggregate{}
+			}
+			buckets[k].add(s.Value)
+			units[k.groupKey] = s.Unit
+		}
+	}
+
+	keys := make([]bucketKey, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].groupKey != keys[j].groupKey {
+			return keys[i].groupKey.less(keys[j].groupKey)
+		}
+		return keys[i].ts < keys[j].ts
+	})
+
+	resp := []GroupSeriesResponseItem{}
+	var last groupKey
+	for i, k := range keys {
+		n := len(resp)
+		if i == 0 || k.groupKey != last {
+			resp = append(resp, GroupSeriesResponseItem{
+				Group:      k.group,
+				SensorType: k.sensorType,
+				Metric:     k.metric,
+				Unit:       units[k.groupKey],
+				Agg:        g.agg,
+			})
+			n++
+			last = k.groupKey
+		}
+		resp[n-1].Points = append(resp[n-1].Points, SeriesPoint{
+			Timestamp: time.Unix(k.ts, 0),
+			Value:     roundAggregate(buckets[k].value(g.agg)),
+		})
+	}
+
+	return resp
+}
+
+// groupLatest aggregates latest samples, already converted to the response units, per group, sensor type and metric.
+// types maps each metric to its sensor type.
+func (a *API) groupLatest(samples []db.Sample, g grouping, types map[string]string) []GroupLatestResponseItem {
+	type latest struct {
+		aggregate
+		unit string
+		ts   time.Time
+	}
+	groups := make(map[groupKey]*latest)
+	for _, s := range samples {
+		for _, group := range a.locations.Groups(s.DeviceID, s.Metric, g.by) {
+			k := groupKey{group: group, sensorType: types[s.Metric], metric: sensor.BaseMetric(s.Metric)}
+			if groups[k] == nil {
+				groups[k] = &latest{unit: s.Unit}
+			}
+			groups[k].add(s.Value)
+			if s.Timestamp.After(groups[k].ts) {
+				groups[k].ts = s.Timestamp
+			}
+		}
+	}
+
+	keys := make([]groupKey, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(keys[j])
+	})
+
+	resp := make([]GroupLatestResponseItem, len(keys))
+	for i, k := range keys {
+		l := groups[k]
+		resp[i] = GroupLatestResponseItem{
+			Group:      k.group,
+			SensorType: k.sensorType,
+			Metric:     k.metric,
+			Unit:       l.unit,
+			Agg:        g.agg,
+			Value:      roundAggregate(l.value(g.agg)),
+			Count:      l.n,
+			Timestamp:  l.ts,
+		}
+	}
+
+	return resp
+}
+
+// roundAggregate trims the float noise averaging adds
+func roundAggregate(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/locations"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// groupTestStart is aligned to the 600 second buckets the tests group by
+var groupTestStart = time.Unix(1700000400, 0)
+
+// newGroupingAPI puts nodes 1 and 2 on the Ground floor of Home. Node 1 reports its own CPU temperature next to the
+// air temperature, which must not be averaged with the air temperatures of the floor.
+func newGroupingAPI(t *testing.T) *API {
+	t.Helper()
+	a := newTestAPI(t, Config{})
+	for _, l := range []db.Location{
+		{Name: "Home", Kind: locations.KindSite},
+		{Name: "Ground", Kind: locations.KindFloor, ParentID: int64Ptr(1)},
+	} {
+		if _, err := a.locations.CreateLocation(l); err != nil {
+			t.Fatalf("CreateLocation() error = %v", err)
+		}
+	}
+	for _, id := range []uint8{1, 2} {
+		if _, err := a.locations.SetAssignment(db.Assignment{DeviceID: id, LocationID: int64Ptr(2)}); err != nil {
+			t.Fatalf("SetAssignment() error = %v", err)
+		}
+	}
+
+	record := func(deviceID, sensorType uint8, secs int, metric string, v float64) {
+		ts := groupTestStart.Add(time.Duration(secs) * time.Second)
+		if err := a.db.RecordMeasurements(deviceID, sensorType, ts, []sensor.Measurement{{Metric: metric, Value: v}}); err != nil {
+			t.Fatalf("RecordMeasurements() error = %v", err)
+		}
+	}
+	record(1, sensor.TypeAtmospheric, 0, sensor.MetricTemperature, 20)
+	record(2, sensor.TypeAtmospheric, 60, sensor.MetricTemperature, 24)
+	record(1, sensor.TypeAtmospheric, 600, sensor.MetricTemperature, 21)
+	record(2, sensor.TypeAtmospheric, 650, sensor.MetricTemperature, 25)
+	record(1, sensor.TypeSystem, 0, "cpu_thermal.temperature", 50)
+	record(1, sensor.TypeSystem, 600, "cpu_thermal.temperature", 54)
+
+	return a
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func TestGetQuery_grouped(t *testing.T) {
+	a := newGroupingAPI(t)
+	at := func(secs int, v float64) SeriesPoint {
+		return SeriesPoint{Timestamp: groupTestStart.Add(time.Duration(secs) * time.Second).UTC(), Value: v}
+	}
+
+	tests := []struct {
+		query string
+		want  []GroupSeriesResponseItem
+	}{
+		{
+			query: "groupBy=floor&stepSecs=600",
+			want: []GroupSeriesResponseItem{
+				{Group: "Home/Ground", SensorType: "atmospheric", Metric: "temperature", Unit: "C", Agg: "avg", Points: []SeriesPoint{at(0, 22), at(600, 23)}},
+				{Group: "Home/Ground", SensorType: "system", Metric: "temperature", Unit: "C", Agg: "avg", Points: []SeriesPoint{at(0, 50), at(600, 54)}},
+			},
+		},
+		{
+			query: "groupBy=floor&stepSecs=600&agg=min&metrics=temperature",
+			want: []GroupSeriesResponseItem{
+				{Group: "Home/Ground", SensorType: "atmospheric", Metric: "temperature", Unit: "C", Agg: "min", Points: []SeriesPoint{at(0, 20), at(600, 21)}},
+			},
+		},
+		{
+			query: "groupBy=site&stepSecs=600&agg=max&metrics=temperature",
+			want: []GroupSeriesResponseItem{
+				{Group: "Home", SensorType: "atmospheric", Metric: "temperature", Unit: "C", Agg: "max", Points: []SeriesPoint{at(0, 24), at(600, 25)}},
+			},
+		},
+		{
+			// one hour long bucket, starting on the hour, holds every reading
+			query: "groupBy=floor&stepSecs=3600&metrics=temperature",
+			want: []GroupSeriesResponseItem{
+				{Group: "Home/Ground", SensorType: "atmospheric", Metric: "temperature", Unit: "C", Agg: "avg", Points: []SeriesPoint{at(-1200, 22.5)}},
+			},
+		},
+		{
+			// grouped values are converted, and the default step is 5 minutes
+			query: "groupBy=room&metrics=temperature&units=imperial",
+			want: []GroupSeriesResponseItem{
+				{Group: locations.Unassigned, SensorType: "atmospheric", Metric: "temperature", Unit: "F", Agg: "avg", Points: []SeriesPoint{at(0, 71.6), at(600, 73.4)}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var got []GroupSeriesResponseItem
+			target := "/api/query?from=1700000000&to=1700002000&" + tt.query
+			decode(t, request(a, http.MethodGet, target, "", false), http.StatusOK, &got)
+			for i := range got {
+				for j := range got[i].Points {
+					got[i].Points[j].Timestamp = got[i].Points[j].Timestamp.UTC()
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	for _, query := range []string{"groupBy=building", "groupBy=floor&agg=median", "groupBy=floor&stepSecs=0"} {
+		decode(t, request(a, http.MethodGet, "/api/query?"+query, "", false), http.StatusBadRequest, nil)
+	}
+}
+
+func TestGetLatest_grouped(t *testing.T) {
+	a := newGroupingAPI(t)
+
+	var got []GroupLatestResponseItem
+	decode(t, request(a, http.MethodGet, "/api/latest?groupBy=floor", "", false), http.StatusOK, &got)
+	if len(got) != 2 {
+		t.Fatalf("got %+v, want air and CPU temperature", got)
+	}
+	air, cpu := got[0], got[1]
+	if air.SensorType != "atmospheric" || air.Metric != "temperature" || air.Value != 23 || air.Count != 2 ||
+		!air.Timestamp.Equal(groupTestStart.Add(650*time.Second)) {
+		t.Errorf("air = %+v", air)
+	}
+	if cpu.SensorType != "system" || cpu.Metric != "temperature" || cpu.Value != 54 || cpu.Count != 1 {
+		t.Errorf("cpu = %+v", cpu)
+	}
+}
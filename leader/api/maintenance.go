@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Heanthor/quill-secure/db"
+	"net/http"
+	"time"
+)
+
+// MaintenanceRequest schedules a maintenance window. Start defaults to now, and End may be given
+// instead as DurationMins. DeviceID is omitted to cover every node.
+type MaintenanceRequest struct {
+	DeviceID     *uint8     `json:"deviceID"`
+	Start        *time.Time `json:"start"`
+	End          *time.Time `json:"end"`
+	DurationMins int        `json:"durationMins"`
+	Reason       string     `json:"reason"`
+}
+
+// requireOffline responds with 404 if node offline alerts are not configured
+func (a *API) requireOffline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.offline == nil {
+			writeMessage(w, "node offline alerts are not configured", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getMaintenance lists the maintenance windows which have not yet ended
+func (a *API) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.offline.Maintenance())
+}
+
+func (a *API) postMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMessage(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	mw := db.MaintenanceWindow{DeviceID: req.DeviceID, Start: time.Now(), Reason: req.Reason}
+	if req.Start != nil {
+		mw.Start = *req.Start
+	}
+	switch {
+	case req.End != nil:
+		mw.End = *req.End
+	case req.DurationMins > 0:
+		mw.End = mw.Start.Add(time.Duration(req.DurationMins) * time.Minute)
+	default:
+		writeMessage(w, "end or durationMins is required", http.StatusBadRequest)
+		return
+	}
+
+	mw, err := a.offline.AddMaintenance(mw)
+	if err != nil {
+		writeAlertsError(w, err)
+		return
+	}
+
+	writeJSON(w, mw, http.StatusCreated)
+}
+
+func (a *API) deleteMaintenance(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.offline.DeleteMaintenance(id); err != nil {
+		writeAlertsError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
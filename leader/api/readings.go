@@ -0,0 +1,218 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/Heanthor/quill-secure/leader/locations"
+	"github.com/Heanthor/quill-secure/leader/units"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+// defaultQueryRange is how far back getQuery looks when no from is given
+const defaultQueryRange = 24 * time.Hour
+
+type SeriesPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+type SeriesResponseItem struct {
+	DeviceID uint8  `json:"deviceID"`
+	Metric   string `json:"metric"`
+	Unit     string `json:"unit"`
+	// Location is the path of the location the series was measured in, e.g. Home/Ground floor/Kitchen
+	Location string        `json:"location,omitempty"`
+	Labels   []string      `json:"labels,omitempty"`
+	Points   []SeriesPoint `json:"points"`
+}
+
+// parseReadingsFilter reads from, to, devices and metrics query params
+func parseReadingsFilter(r *http.Request) (db.ReadingsFilter, error) {
+	q := r.URL.Query()
+	from, err := export.ParseTime(q.Get("from"))
+	if err != nil {
+		return db.ReadingsFilter{}, fmt.Errorf("from: %w", err)
+	}
+	to, err := export.ParseTime(q.Get("to"))
+	if err != nil {
+		return db.ReadingsFilter{}, fmt.Errorf("to: %w", err)
+	}
+	devices, err := export.ParseDeviceIDs(q.Get("devices"))
+	if err != nil {
+		return db.ReadingsFilter{}, err
+	}
+
+	return db.ReadingsFilter{
+		From:      from,
+		To:        to,
+		DeviceIDs: devices,
+		Metrics:   export.ParseList(q.Get("metrics")),
+	}, nil
+}
+
+// getMetrics lists every metric with its unit. Query params: units and unit overrides, as for getQuery.
+func (a *API) getMetrics(w http.ResponseWriter, r *http.Request) {
+	prefs, err := a.parseUnits(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ms, err := a.db.Metrics()
+	if err != nil {
+		log.Err(err).Msg("getMetrics db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+	for i := range ms {
+		ms[i].Unit = prefs.Unit(ms[i].Unit)
+	}
+
+	writeJSON(w, ms)
+}
+
+// getQuery returns one series per device and metric, or per group, sensor type and metric when grouped.
+// Query params: from and to (RFC3339 or unix seconds, from defaults to 24h ago), devices and metrics (comma separated),
+// units (metric or imperial) and temperatureUnit, pressureUnit and altitudeUnit to override single quantities,
+// location (an ID) and labels (comma separated) to select where readings were taken, and groupBy (site, floor, room
+// or label) with agg (avg, min or max) and stepSecs (default 300) to aggregate each group into time buckets.
+func (a *API) getQuery(w http.ResponseWriter, r *http.Request) {
+	f, lf, g, prefs, err := a.parseReadingsQuery(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.From.IsZero() {
+		f.From = time.Now().Add(-defaultQueryRange)
+	}
+
+	var samples []db.Sample
+	if devices, ok := a.narrowDevices(f.DeviceIDs, lf); ok {
+		f.DeviceIDs = devices
+		if samples, err = a.db.Samples(f); err != nil {
+			log.Err(err).Msg("getQuery db error")
+			respondInternalServerError(w, err.Error())
+			return
+		}
+	}
+	samples = a.convertSamples(samples, lf, prefs)
+
+	if g.by != "" {
+		types, err := a.metricSensorTypes()
+		if err != nil {
+			log.Err(err).Msg("getQuery db error")
+			respondInternalServerError(w, err.Error())
+			return
+		}
+		writeJSON(w, a.groupSeries(samples, g, types))
+		return
+	}
+
+	resp := []SeriesResponseItem{}
+	for _, s := range samples {
+		n := len(resp)
+		if n == 0 || resp[n-1].DeviceID != s.DeviceID || resp[n-1].Metric != s.Metric {
+			item := SeriesResponseItem{DeviceID: s.DeviceID, Metric: s.Metric, Unit: s.Unit}
+			item.Location, item.Labels = a.placeOf(s)
+			resp = append(resp, item)
+			n++
+		}
+		resp[n-1].Points = append(resp[n-1].Points, SeriesPoint{Timestamp: s.Timestamp, Value: s.Value})
+	}
+
+	writeJSON(w, resp)
+}
+
+// LatestResponseItem is the latest value of a device's metric, and where it was measured
+type LatestResponseItem struct {
+	db.Sample
+	Location string   `json:"location,omitempty"`
+	Labels   []string `json:"labels,omitempty"`
+}
+
+// getLatest returns the most recent value of each metric for each device, or aggregated per group and metric.
+// Query params: devices and metrics (comma separated), and units, unit overrides, location, labels, groupBy
+// and agg, as for getQuery.
+func (a *API) getLatest(w http.ResponseWriter, r *http.Request) {
+	f, lf, g, prefs, err := a.parseReadingsQuery(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var samples []db.Sample
+	if devices, ok := a.narrowDevices(f.DeviceIDs, lf); ok {
+		f.DeviceIDs = devices
+		if samples, err = a.db.Latest(f); err != nil {
+			log.Err(err).Msg("getLatest db error")
+			respondInternalServerError(w, err.Error())
+			return
+		}
+	}
+	samples = a.convertSamples(samples, lf, prefs)
+
+	if g.by != "" {
+		types, err := a.metricSensorTypes()
+		if err != nil {
+			log.Err(err).Msg("getLatest db error")
+			respondInternalServerError(w, err.Error())
+			return
+		}
+		writeJSON(w, a.groupLatest(samples, g, types))
+		return
+	}
+
+	resp := make([]LatestResponseItem, len(samples))
+	for i, s := range samples {
+		resp[i] = LatestResponseItem{Sample: s}
+		resp[i].Location, resp[i].Labels = a.placeOf(s)
+	}
+
+	writeJSON(w, resp)
+}
+
+// parseReadingsQuery reads the params shared by getQuery and getLatest
+func (a *API) parseReadingsQuery(r *http.Request) (db.ReadingsFilter, locations.Filter, grouping, units.Preferences, error) {
+	f, err := parseReadingsFilter(r)
+	if err != nil {
+		return db.ReadingsFilter{}, locations.Filter{}, grouping{}, units.Preferences{}, err
+	}
+	lf, err := parseLocationFilter(r)
+	if err != nil {
+		return db.ReadingsFilter{}, locations.Filter{}, grouping{}, units.Preferences{}, err
+	}
+	g, err := parseGrouping(r)
+	if err != nil {
+		return db.ReadingsFilter{}, locations.Filter{}, grouping{}, units.Preferences{}, err
+	}
+	prefs, err := a.parseUnits(r)
+	if err != nil {
+		return db.ReadingsFilter{}, locations.Filter{}, grouping{}, units.Preferences{}, err
+	}
+
+	return f, lf, g, prefs, nil
+}
+
+// convertSamples drops samples taken outside of lf, and converts the rest to prefs
+func (a *API) convertSamples(samples []db.Sample, lf locations.Filter, prefs units.Preferences) []db.Sample {
+	out := make([]db.Sample, 0, len(samples))
+	for _, s := range samples {
+		if !a.locations.Matches(s.DeviceID, s.Metric, lf) {
+			continue
+		}
+		s.Value, s.Unit = prefs.Convert(s.Value, s.Unit)
+		out = append(out, s)
+	}
+
+	return out
+}
+
+// placeOf returns the location path and labels of where a sample was measured
+func (a *API) placeOf(s db.Sample) (string, []string) {
+	p := a.locations.Place(s.DeviceID, s.Metric)
+
+	return p.Path(), p.Labels
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultSensorErrorsLimit = 100
+	maxSensorErrorsLimit     = 1000
+)
+
+// getSensorErrors returns errors reported by node sensors, newest first.
+// Query params: from and to (RFC3339 or unix seconds), devices (comma separated), limit (default 100, max 1000),
+// and location and labels to select devices by where they are.
+func (a *API) getSensorErrors(w http.ResponseWriter, r *http.Request) {
+	f, err := parseSensorErrorsFilter(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lf, err := parseLocationFilter(r)
+	if err != nil {
+		writeMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, ok := a.narrowDevices(f.DeviceIDs, lf)
+	if !ok {
+		writeJSON(w, []db.SensorError{})
+		return
+	}
+	f.DeviceIDs = devices
+
+	errs, err := a.db.SensorErrors(f)
+	if err != nil {
+		log.Err(err).Msg("getSensorErrors db error")
+		respondInternalServerError(w, err.Error())
+		return
+	}
+
+	writeJSON(w, errs)
+}
+
+func parseSensorErrorsFilter(r *http.Request) (db.SensorErrorsFilter, error) {
+	rf, err := parseReadingsFilter(r)
+	if err != nil {
+		return db.SensorErrorsFilter{}, err
+	}
+
+	limit, err := parseLimit(r, defaultSensorErrorsLimit, maxSensorErrorsLimit)
+	if err != nil {
+		return db.SensorErrorsFilter{}, err
+	}
+
+	return db.SensorErrorsFilter{
+		From:      rf.From,
+		To:        rf.To,
+		DeviceIDs: rf.DeviceIDs,
+		Limit:     limit,
+	}, nil
+}
+
+// parseLimit reads the limit query param, which must be between 1 and max
+func parseLimit(r *http.Request, def, max int) (int, error) {
+	l := r.URL.Query().Get("limit")
+	if l == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(l)
+	if err != nil || limit < 1 || limit > max {
+		return 0, fmt.Errorf("limit must be between 1 and %d", max)
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"github.com/Heanthor/quill-secure/leader/units"
+	"net/http"
+)
+
+// parseUnits reads the units query param, metric or imperial, then any of temperatureUnit, pressureUnit and
+// altitudeUnit to override single quantities. Without a units param, the API's configured default system is used.
+func (a *API) parseUnits(r *http.Request) (units.Preferences, error) {
+	q := r.URL.Query()
+	p := a.units
+	if system := q.Get("units"); system != "" {
+		var err error
+		if p, err = units.ForSystem(system); err != nil {
+			return units.Preferences{}, err
+		}
+	}
+
+	return p.Override(q.Get("temperatureUnit"), q.Get("pressureUnit"), q.Get("altitudeUnit"))
+}
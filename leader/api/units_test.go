@@ -0,0 +1,210 @@
+package api
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"github.com/Heanthor/quill-secure/leader/units"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newUnitsAPI records one atmospheric reading from node 1 an hour ago, and opens an alert on its temperature
+func newUnitsAPI(t *testing.T, defaults units.Preferences) *API {
+	t.Helper()
+	d := newTestDB(t)
+	engine, err := alerts.New(d)
+	if err != nil {
+		t.Fatalf("alerts.New() error = %v", err)
+	}
+	a := newTestAPI(t, Config{DB: d, Alerts: engine, Units: defaults, DashboardStatsDays: 1})
+
+	ts := time.Now().Add(-time.Hour)
+	if err := d.RecordMeasurements(1, sensor.TypeAtmospheric, ts, []sensor.Measurement{
+		{Metric: sensor.MetricTemperature, Value: 20},
+		{Metric: sensor.MetricHumidity, Value: 50},
+		{Metric: sensor.MetricPressure, Value: 1013.25},
+		{Metric: sensor.MetricAltitude, Value: 100},
+	}); err != nil {
+		t.Fatalf("RecordMeasurements() error = %v", err)
+	}
+	alert := db.Alert{
+		RuleID:    1,
+		RuleName:  "warm",
+		DeviceID:  1,
+		Metric:    sensor.MetricTemperature,
+		State:     alerts.StateOpen,
+		Severity:  alerts.SeverityWarning,
+		Value:     20,
+		Threshold: 18,
+		Unit:      units.Celsius,
+		Condition: alerts.ConditionAbove,
+		OpenedAt:  ts,
+	}
+	alert.Message = alerts.Describe(alert)
+	if _, err := d.OpenAlert(alert); err != nil {
+		t.Fatalf("OpenAlert() error = %v", err)
+	}
+
+	return a
+}
+
+// unitValues are the values of the reading in newUnitsAPI, in the units of one request
+type unitValues struct {
+	temperature, pressure, altitude float64
+	prefs                           units.Preferences
+}
+
+func (v unitValues) of(unit string) float64 {
+	switch unit {
+	case v.prefs.Temperature:
+		return v.temperature
+	case v.prefs.Pressure:
+		return v.pressure
+	case v.prefs.Altitude:
+		return v.altitude
+	}
+
+	return math.NaN()
+}
+
+func near(got, want float64) bool {
+	return math.Abs(got-want) < 0.01
+}
+
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults units.Preferences
+		query    string
+		want     unitValues
+	}{
+		{
+			name: "metric",
+			want: unitValues{20, 1013.25, 100, units.Metric},
+		},
+		{
+			name:  "imperial",
+			query: "units=imperial",
+			want:  unitValues{68, 29.92, 328.08, units.Imperial},
+		},
+		{
+			name:     "imperial default",
+			defaults: units.Imperial,
+			want:     unitValues{68, 29.92, 328.08, units.Imperial},
+		},
+		{
+			name:  "imperial with mmHg",
+			query: "units=imperial&pressureUnit=mmHg",
+			want: unitValues{68, 760, 328.08, units.Preferences{
+				System: units.SystemImperial, Temperature: units.Fahrenheit, Pressure: units.MmHg, Altitude: units.Feet,
+			}},
+		},
+		{
+			name:  "metric with Fahrenheit",
+			query: "temperatureUnit=f",
+			want: unitValues{68, 1013.25, 100, units.Preferences{
+				System: units.SystemMetric, Temperature: units.Fahrenheit, Pressure: units.HPa, Altitude: units.Metres,
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newUnitsAPI(t, tt.defaults)
+			// converted are the metrics with a convertible unit, and the unit they are stored in
+			converted := map[string]string{
+				sensor.MetricTemperature: units.Celsius,
+				sensor.MetricPressure:    units.HPa,
+				sensor.MetricAltitude:    units.Metres,
+			}
+
+			var metrics []sensor.Metric
+			decode(t, request(a, http.MethodGet, "/api/metrics?"+tt.query, "", false), http.StatusOK, &metrics)
+			got := make(map[string]string)
+			for _, m := range metrics {
+				got[m.Name] = m.Unit
+			}
+			for name, stored := range converted {
+				if want := tt.want.prefs.Unit(stored); got[name] != want {
+					t.Errorf("getMetrics() %s unit = %q, want %q", name, got[name], want)
+				}
+			}
+			if got[sensor.MetricHumidity] != "%" {
+				t.Errorf("getMetrics() humidity unit = %q, want unchanged", got[sensor.MetricHumidity])
+			}
+
+			var series []SeriesResponseItem
+			decode(t, request(a, http.MethodGet, "/api/query?from=0&"+tt.query, "", false), http.StatusOK, &series)
+			if len(series) != 4 {
+				t.Fatalf("getQuery() returned %d series, want 4", len(series))
+			}
+			for _, s := range series {
+				if s.Metric == sensor.MetricHumidity {
+					if s.Unit != "%" || s.Points[0].Value != 50 {
+						t.Errorf("getQuery() humidity = %v %s, want 50 %%", s.Points[0].Value, s.Unit)
+					}
+					continue
+				}
+				if want := tt.want.of(s.Unit); !near(s.Points[0].Value, want) {
+					t.Errorf("getQuery() %s = %v %s, want %v", s.Metric, s.Points[0].Value, s.Unit, want)
+				}
+			}
+
+			var latest []LatestResponseItem
+			decode(t, request(a, http.MethodGet, "/api/latest?metrics=temperature,pressure,altitude&"+tt.query, "", false),
+				http.StatusOK, &latest)
+			if len(latest) != len(converted) {
+				t.Fatalf("getLatest() returned %d values, want %d", len(latest), len(converted))
+			}
+			for _, s := range latest {
+				if want := tt.want.of(s.Unit); !near(s.Value, want) {
+					t.Errorf("getLatest() %s = %v %s, want %v", s.Metric, s.Value, s.Unit, want)
+				}
+			}
+
+			var stats []DashboardStatsResponseItem
+			decode(t, request(a, http.MethodGet, "/api/dashboard/stats?"+tt.query, "", false), http.StatusOK, &stats)
+			if len(stats) != 1 {
+				t.Fatalf("getDashboardStats() returned %d items, want 1", len(stats))
+			}
+			s := stats[0]
+			if !near(float64(s.Temperature), tt.want.temperature) || !near(float64(s.Pressure), tt.want.pressure) ||
+				!near(float64(s.Altitude), tt.want.altitude) || s.Units != tt.want.prefs {
+				t.Errorf("getDashboardStats() = %+v, want %+v", s, tt.want)
+			}
+			if s.Humidity != 50 || s.TemperatureF != 68 {
+				t.Errorf("getDashboardStats() humidity, temperatureF = %v, %v, want 50, 68", s.Humidity, s.TemperatureF)
+			}
+
+			var resp AlertsResponse
+			decode(t, request(a, http.MethodGet, "/api/alerts?"+tt.query, "", false), http.StatusOK, &resp)
+			if len(resp.Alerts) != 1 {
+				t.Fatalf("getAlerts() returned %d alerts, want 1", len(resp.Alerts))
+			}
+			alert := resp.Alerts[0]
+			wantThreshold, _ := tt.want.prefs.Convert(18, units.Celsius)
+			if alert.Unit != tt.want.prefs.Temperature || !near(alert.Value, tt.want.temperature) ||
+				!near(alert.Threshold, wantThreshold) || alert.Message != alerts.Describe(alert) {
+				t.Errorf("getAlerts() = %+v, want %v and threshold %v %s", alert, tt.want.temperature, wantThreshold,
+					tt.want.prefs.Temperature)
+			}
+		})
+	}
+}
+
+func TestUnits_invalid(t *testing.T) {
+	a := newUnitsAPI(t, units.Metric)
+	for _, target := range []string{
+		"/api/metrics?units=nautical",
+		"/api/query?pressureUnit=furlong",
+		"/api/latest?temperatureUnit=hPa",
+		"/api/dashboard/stats?altitudeUnit=C",
+		"/api/alerts?units=kelvin",
+	} {
+		if w := request(a, http.MethodGet, target, "", false); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s status = %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package atmosphere computes altitude and sea-level pressure from the station pressure nodes report, against a
+// reference pressure which is configured or fetched periodically, instead of trusting each node's fixed reference.
+package atmosphere
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricSeaLevelPressure is station pressure reduced to sea level, comparable with weather reports
+const MetricSeaLevelPressure = "sea_level_pressure"
+
+// StandardPressure is the mean sea-level pressure in hPa, used when no reference is configured
+const StandardPressure = 1013.25
+
+func init() {
+	sensor.RegisterMetric(sensor.Metric{Name: MetricSeaLevelPressure, Unit: "hPa", SensorType: sensor.TypeAtmospheric})
+}
+
+const (
+	defaultRefreshInterval = 30 * time.Minute
+	refreshTimeout         = 10 * time.Second
+)
+
+// plausible pressure range in hPa, outside of which a fetched reference is rejected
+const minPressure, maxPressure = 850, 1090
+
+// Altitude returns the altitude in metres at which the station pressure is pressure, where sea-level pressure is
+// reference, using the international barometric formula
+func Altitude(pressure, reference float64) float64 {
+	return 44330 * (1 - math.Pow(pressure/reference, 1/5.255))
+}
+
+// SeaLevelPressure returns the sea-level pressure equivalent to station pressure at elevation metres
+func SeaLevelPressure(pressure, elevation float64) float64 {
+	return pressure / math.Pow(1-elevation/44330, 5.255)
+}
+
+// Config sets the reference pressure and where nodes are
+type Config struct {
+	// SeaLevelPressure is the reference pressure in hPa, defaulting to StandardPressure.
+	// It is replaced by the fetched value when Reference is configured.
+	SeaLevelPressure float64 `mapstructure:"seaLevelPressure"`
+	// SiteElevation is the elevation of the nodes in metres. Sea-level pressure is only reported when it is set.
+	SiteElevation *float64 `mapstructure:"siteElevation"`
+	// Nodes overrides SiteElevation for single nodes
+	Nodes     []NodeElevation `mapstructure:"nodes"`
+	Reference ReferenceConfig `mapstructure:"reference"`
+}
+
+// NodeElevation is the elevation in metres of one node
+type NodeElevation struct {
+	DeviceID  uint8   `mapstructure:"deviceID"`
+	Elevation float64 `mapstructure:"elevation"`
+}
+
+// ReferenceConfig fetches the reference pressure periodically from a JSON API, such as a weather service
+type ReferenceConfig struct {
+	URL string `mapstructure:"url"`
+	// Field is the dotted path of the pressure in the response, e.g. current.pressure_msl
+	Field        string `mapstructure:"field"`
+	IntervalMins int    `mapstructure:"intervalMins"`
+}
+
+// Status describes the reference pressure in use
+type Status struct {
+	ReferencePressure float64    `json:"referencePressure"`
+	Source            string     `json:"source"`
+	UpdatedAt         *time.Time `json:"updatedAt,omitempty"`
+	LastError         string     `json:"lastError,omitempty"`
+	SiteElevation     *float64   `json:"siteElevation"`
+}
+
+// Atmosphere derives altitude and sea-level pressure from the pressure of each readout
+type Atmosphere struct {
+	cfg        Config
+	elevations map[uint8]float64
+	client     *http.Client
+
+	lock      sync.RWMutex
+	reference float64
+	updatedAt *time.Time
+	lastError string
+}
+
+func New(cfg Config) (*Atmosphere, error) {
+	if cfg.SeaLevelPressure == 0 {
+		cfg.SeaLevelPressure = StandardPressure
+	}
+	if cfg.SeaLevelPressure < minPressure || cfg.SeaLevelPressure > maxPressure {
+		return nil, fmt.Errorf("seaLevelPressure %v hPa is not between %d and %d", cfg.SeaLevelPressure, minPressure, maxPressure)
+	}
+	if cfg.Reference.URL != "" && cfg.Reference.Field == "" {
+		return nil, fmt.Errorf("reference.field is required with reference.url")
+	}
+
+	a := &Atmosphere{
+		cfg:        cfg,
+		elevations: make(map[uint8]float64),
+		client:     &http.Client{Timeout: refreshTimeout},
+		reference:  cfg.SeaLevelPressure,
+	}
+	for _, n := range cfg.Nodes {
+		a.elevations[n.DeviceID] = n.Elevation
+	}
+
+	return a, nil
+}
+
+// Start fetches the reference pressure now and then periodically, if a reference URL is configured
+func (a *Atmosphere) Start() {
+	if a.cfg.Reference.URL == "" {
+		return
+	}
+	interval := time.Duration(a.cfg.Reference.IntervalMins) * time.Minute
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+
+	go func() {
+		for {
+			if err := a.Refresh(context.Background()); err != nil {
+				log.Warn().Err(err).Msg("Could not refresh reference pressure, keeping the previous value")
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Refresh fetches the reference pressure from the configured URL
+func (a *Atmosphere) Refresh(ctx context.Context) error {
+	p, err := a.fetch(ctx)
+	now := time.Now()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err != nil {
+		a.lastError = err.Error()
+		return err
+	}
+	a.reference, a.updatedAt, a.lastError = p, &now, ""
+	log.Debug().Float64("hPa", p).Msg("Reference pressure refreshed")
+
+	return nil
+}
+
+func (a *Atmosphere) fetch(ctx context.Context) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.cfg.Reference.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("reference returned %s", resp.Status)
+	}
+
+	var body any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("error decoding reference: %w", err)
+	}
+	for _, part := range strings.Split(a.cfg.Reference.Field, ".") {
+		obj, ok := body.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("reference has no field %s", a.cfg.Reference.Field)
+		}
+		body = obj[part]
+	}
+	p, ok := body.(float64)
+	if !ok {
+		return 0, fmt.Errorf("reference field %s is not a number", a.cfg.Reference.Field)
+	}
+	if p < minPressure || p > maxPressure {
+		return 0, fmt.Errorf("reference pressure %v hPa is implausible", p)
+	}
+
+	return p, nil
+}
+
+// Status returns the reference pressure in use and where it came from
+func (a *Atmosphere) Status() Status {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	source := "config"
+	if a.cfg.Reference.URL != "" {
+		source = a.cfg.Reference.URL
+	}
+
+	return Status{
+		ReferencePressure: a.reference,
+		Source:            source,
+		UpdatedAt:         a.updatedAt,
+		LastError:         a.lastError,
+		SiteElevation:     a.cfg.SiteElevation,
+	}
+}
+
+// elevation returns the elevation of deviceID, and false if it is unknown
+func (a *Atmosphere) elevation(deviceID uint8) (float64, bool) {
+	if e, ok := a.elevations[deviceID]; ok {
+		return e, true
+	}
+	if a.cfg.SiteElevation != nil {
+		return *a.cfg.SiteElevation, true
+	}
+
+	return 0, false
+}
+
+// Derive computes altitude from each pressure in ms, replacing the altitude reported by the node, and sea-level
+// pressure when the node's elevation is known. Metrics of a named sensor instance derive metrics of the same instance.
+// Only the readouts of atmospheric sensors are used, as other sensors, such as exec sensors, may report a pressure
+// which is not barometric.
+func (a *Atmosphere) Derive(deviceID, sensorType uint8, ts time.Time, ms []sensor.Measurement) []sensor.Measurement {
+	if sensorType != sensor.TypeAtmospheric {
+		return nil
+	}
+	a.lock.RLock()
+	reference := a.reference
+	a.lock.RUnlock()
+	elevation, knownElevation := a.elevation(deviceID)
+
+	var out []sensor.Measurement
+	for _, m := range ms {
+		if sensor.BaseMetric(m.Metric) != sensor.MetricPressure || m.Value <= 0 {
+			continue
+		}
+		prefix := strings.TrimSuffix(m.Metric, sensor.MetricPressure)
+		out = append(out, sensor.Measurement{Metric: prefix + sensor.MetricAltitude, Value: Altitude(m.Value, reference)})
+		if knownElevation {
+			out = append(out, sensor.Measurement{Metric: prefix + MetricSeaLevelPressure, Value: SeaLevelPressure(m.Value, elevation)})
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,128 @@
+package atmosphere
+
+import (
+	"context"
+	"fmt"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFormulas(t *testing.T) {
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+		tol  float64
+	}{
+		{"altitude at reference", Altitude(1013.25, 1013.25), 0, 0.001},
+		{"altitude 1000m", Altitude(898.75, 1013.25), 1000, 2},
+		{"altitude against high reference", Altitude(1000, 1030), 248, 2},
+		{"sea level at sea level", SeaLevelPressure(1013.25, 0), 1013.25, 0.001},
+		{"sea level from 1000m", SeaLevelPressure(898.75, 1000), 1013.25, 0.2},
+		{"sea level from 120m", SeaLevelPressure(998.9, 120), 1013.3, 0.2},
+	}
+	for _, tt := range tests {
+		if math.Abs(tt.got-tt.want) > tt.tol {
+			t.Errorf("%s = %.3f, want %.3f ± %v", tt.name, tt.got, tt.want, tt.tol)
+		}
+	}
+
+	// the two are inverse: a station's altitude against its own sea-level pressure is its elevation
+	if got := Altitude(950, SeaLevelPressure(950, 540)); math.Abs(got-540) > 0.001 {
+		t.Errorf("round trip altitude = %v, want 540", got)
+	}
+}
+
+func TestAtmosphere_Derive(t *testing.T) {
+	elevation := 100.0
+	a, err := New(Config{SiteElevation: &elevation, Nodes: []NodeElevation{{DeviceID: 2, Elevation: 500}}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ms := []sensor.Measurement{
+		{Metric: sensor.MetricTemperature, Value: 20},
+		{Metric: sensor.MetricPressure, Value: 1000},
+		{Metric: sensor.MetricAltitude, Value: 3},
+		{Metric: "attic." + sensor.MetricPressure, Value: 990},
+	}
+	got := make(map[string]float64)
+	for _, m := range a.Derive(1, sensor.TypeAtmospheric, time.Now(), ms) {
+		got[m.Metric] = m.Value
+	}
+	want := map[string]float64{
+		sensor.MetricAltitude:             Altitude(1000, StandardPressure),
+		MetricSeaLevelPressure:            SeaLevelPressure(1000, 100),
+		"attic." + sensor.MetricAltitude:  Altitude(990, StandardPressure),
+		"attic." + MetricSeaLevelPressure: SeaLevelPressure(990, 100),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Derive() = %v, want %v", got, want)
+	}
+
+	for _, m := range a.Derive(2, sensor.TypeAtmospheric, time.Now(), ms[1:2]) {
+		if m.Metric == MetricSeaLevelPressure && m.Value != SeaLevelPressure(1000, 500) {
+			t.Errorf("Derive() node elevation sea level pressure = %v", m.Value)
+		}
+	}
+
+	// pressure reported by other sensors may not be barometric
+	if out := a.Derive(1, sensor.TypeExec, time.Now(), ms); len(out) != 0 {
+		t.Errorf("Derive() of an exec sensor = %v, want nothing", out)
+	}
+
+	// without an elevation only altitude is derived
+	a, _ = New(Config{SeaLevelPressure: 1020})
+	if out := a.Derive(1, sensor.TypeAtmospheric, time.Now(), ms); len(out) != 2 || out[0].Value != Altitude(1000, 1020) {
+		t.Errorf("Derive() without elevation = %v", out)
+	}
+}
+
+func TestAtmosphere_Refresh(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		field   string
+		body    string
+		want    float64
+		wantErr bool
+	}{
+		{name: "nested field", field: "current.pressure_msl", body: `{"current": {"pressure_msl": 1021.4}}`, want: 1021.4},
+		{name: "missing field keeps previous", field: "current.pressure", body: `{"current": {"pressure_msl": 1000}}`, want: 1021.4, wantErr: true},
+		{name: "not a number", field: "current", body: `{"current": {"pressure_msl": 1000}}`, want: 1021.4, wantErr: true},
+		{name: "implausible", field: "p", body: `{"p": 101325}`, want: 1021.4, wantErr: true},
+		{name: "top level field", field: "p", body: `{"p": 1008}`, want: 1008},
+	}
+	if _, err := New(Config{Reference: ReferenceConfig{URL: srv.URL}}); err == nil {
+		t.Errorf("New() without field error = nil")
+	}
+
+	// cases run in order against one Atmosphere, so a failed refresh keeps the previous reference
+	a, err := New(Config{Reference: ReferenceConfig{URL: srv.URL, Field: "unset"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.cfg.Reference.Field = tt.field
+			body = tt.body
+			err := a.Refresh(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			st := a.Status()
+			if st.ReferencePressure != tt.want || st.Source != srv.URL || (st.LastError != "") != tt.wantErr {
+				t.Errorf("Status() = %+v, want reference %v", st, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package backup
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	filePrefix = "leader_"
+	fileSuffix = ".db"
+	gzSuffix   = ".gz"
+	// timeLayout sorts lexically in chronological order
+	timeLayout = "20060102T150405Z"
+)
+
+var ErrInProgress = errors.New("backup already in progress")
+
+// Config controls where and how often backups are taken
+type Config struct {
+	Dir string
+	// Interval between scheduled backups. Zero disables the schedule, backups can still be triggered.
+	Interval time.Duration
+	// Keep is the number of most recent backups retained. Zero keeps every backup.
+	Keep int
+	// Compress gzips each backup after it has been verified
+	Compress bool
+}
+
+// Status describes the most recent backup run
+type Status struct {
+	Running        bool      `json:"running"`
+	LastStartedAt  time.Time `json:"lastStartedAt"`
+	LastFinishedAt time.Time `json:"lastFinishedAt"`
+	LastFile       string    `json:"lastFile"`
+	LastSizeBytes  int64     `json:"lastSizeBytes"`
+	LastError      string    `json:"lastError"`
+	Backups        []string  `json:"backups"`
+}
+
+// Manager takes online backups of the leader database, and rotates old ones
+type Manager struct {
+	db  *db.DB
+	cfg Config
+
+	lock   sync.Mutex
+	status Status
+}
+
+func NewManager(d *db.DB, cfg Config) (*Manager, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("backup dir cannot be blank")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("NewManager: error creating backup dir: %w", err)
+	}
+
+	return &Manager{db: d, cfg: cfg}, nil
+}
+
+// StartSchedule takes a backup every cfg.Interval in the background
+func (m *Manager) StartSchedule() {
+	if m.cfg.Interval <= 0 {
+		return
+	}
+
+	log.Info().Dur("interval", m.cfg.Interval).Str("dir", m.cfg.Dir).Msg("Scheduled backups enabled")
+	go func() {
+		t := time.NewTicker(m.cfg.Interval)
+		for range t.C {
+			if _, err := m.Run(); err != nil && !errors.Is(err, ErrInProgress) {
+				log.Err(err).Msg("Scheduled backup failed")
+			}
+		}
+	}()
+}
+
+// Trigger starts a backup in the background, returning ErrInProgress if one is already running
+func (m *Manager) Trigger() error {
+	if !m.begin() {
+		return ErrInProgress
+	}
+
+	go func() {
+		if _, err := m.run(); err != nil {
+			log.Err(err).Msg("Triggered backup failed")
+		}
+	}()
+
+	return nil
+}
+
+// Run takes a backup and blocks until it is verified and rotated, returning the backup path
+func (m *Manager) Run() (string, error) {
+	if !m.begin() {
+		return "", ErrInProgress
+	}
+
+	return m.run()
+}
+
+// Status returns the state of the most recent backup, and the backups currently on disk
+func (m *Manager) Status() Status {
+	m.lock.Lock()
+	s := m.status
+	m.lock.Unlock()
+
+	backups, err := List(m.cfg.Dir)
+	if err != nil {
+		log.Err(err).Msg("Error listing backups")
+	}
+	s.Backups = backups
+
+	return s
+}
+
+func (m *Manager) begin() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.status.Running {
+		return false
+	}
+	m.status.Running = true
+	m.status.LastStartedAt = time.Now()
+
+	return true
+}
+
+func (m *Manager) run() (string, error) {
+	path, err := m.backup()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.status.Running = false
+	m.status.LastFinishedAt = time.Now()
+	if err != nil {
+		m.status.LastError = err.Error()
+		return "", err
+	}
+	m.status.LastError = ""
+	m.status.LastFile = path
+	if fi, err := os.Stat(path); err == nil {
+		m.status.LastSizeBytes = fi.Size()
+	}
+	log.Info().Str("file", path).Int64("bytes", m.status.LastSizeBytes).Msg("Backup complete")
+
+	return path, nil
+}
+
+func (m *Manager) backup() (string, error) {
+	path := filepath.Join(m.cfg.Dir, filePrefix+time.Now().UTC().Format(timeLayout)+fileSuffix)
+	tmp := path + ".tmp"
+	// vacuum into refuses to overwrite, so clear out any leftover from a crashed run
+	os.Remove(tmp)
+
+	if err := m.db.BackupTo(tmp); err != nil {
+		return "", err
+	}
+	if err := db.IntegrityCheck(tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("backup failed verification: %w", err)
+	}
+
+	if m.cfg.Compress {
+		err := compressFile(tmp, path+gzSuffix)
+		os.Remove(tmp)
+		if err != nil {
+			return "", err
+		}
+		path += gzSuffix
+	} else if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := rotate(m.cfg.Dir, m.cfg.Keep); err != nil {
+		log.Err(err).Msg("Error rotating backups")
+	}
+
+	return path, nil
+}
+
+// List returns the backups in dir, oldest first
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, filePrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, fileSuffix) || strings.HasSuffix(name, fileSuffix+gzSuffix) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// rotate deletes all but the keep most recent backups in dir
+func rotate(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := List(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > keep {
+		log.Info().Str("file", backups[0]).Msg("Removing old backup")
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Verify checks that the backup at path, compressed or not, is an intact sqlite database
+func Verify(path string) error {
+	if !strings.HasSuffix(path, gzSuffix) {
+		return db.IntegrityCheck(path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "verify-*.db")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := decompressFile(path, tmp.Name()); err != nil {
+		return err
+	}
+
+	return db.IntegrityCheck(tmp.Name())
+}
+
+// Restore verifies the backup at path and replaces dbFile with it.
+// The existing database is kept alongside as dbFile.pre-restore-<time>.
+// The leader must not be running while restoring.
+func Restore(path, dbFile string) error {
+	staged := dbFile + ".restore"
+	var err error
+	if strings.HasSuffix(path, gzSuffix) {
+		err = decompressFile(path, staged)
+	} else {
+		err = copyFile(path, staged)
+	}
+	if err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("error staging backup: %w", err)
+	}
+	if err := db.IntegrityCheck(staged); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("backup failed verification: %w", err)
+	}
+
+	if _, err := os.Stat(dbFile); err == nil {
+		old := dbFile + ".pre-restore-" + time.Now().UTC().Format(timeLayout)
+		if err := os.Rename(dbFile, old); err != nil {
+			os.Remove(staged)
+			return fmt.Errorf("error moving existing database aside: %w", err)
+		}
+		log.Info().Str("file", old).Msg("Existing database moved aside")
+	}
+
+	return os.Rename(staged, dbFile)
+}
+
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("error compressing backup: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("error compressing backup: %w", err)
+	}
+
+	return out.Close()
+}
+
+func decompressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("error reading compressed backup: %w", err)
+	}
+	defer gz.Close()
+
+	return writeFile(dst, gz)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeFile(dst, in)
+}
+
+func writeFile(dst string, r io.Reader) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) (*db.DB, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "leader.db")
+	d, err := db.NewDB(file)
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(d.Close)
+	if err := d.RecordMeasurements(1, sensor.TypeAtmospheric, time.Unix(1660369274, 0), []sensor.Measurement{
+		{Metric: sensor.MetricTemperature, Value: 25},
+	}); err != nil {
+		t.Fatalf("RecordMeasurements() error = %v", err)
+	}
+
+	return d, file
+}
+
+func TestManager_Run(t *testing.T) {
+	tests := []struct {
+		name       string
+		compress   bool
+		wantSuffix string
+	}{
+		{name: "plain", wantSuffix: fileSuffix},
+		{name: "compressed", compress: true, wantSuffix: fileSuffix + gzSuffix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDB(t)
+			m, err := NewManager(d, Config{Dir: t.TempDir(), Compress: tt.compress})
+			if err != nil {
+				t.Fatalf("NewManager() error = %v", err)
+			}
+
+			path, err := m.Run()
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if !strings.HasSuffix(path, tt.wantSuffix) {
+				t.Errorf("Run() path = %s, want suffix %s", path, tt.wantSuffix)
+			}
+			if err := Verify(path); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			if s := m.Status(); s.Running || s.LastFile != path || len(s.Backups) != 1 {
+				t.Errorf("Status() = %+v", s)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"leader_20220101T000000Z.db",
+		"leader_20220102T000000Z.db.gz",
+		"leader_20220103T000000Z.db",
+		"unrelated.db",
+	}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(dir, n), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rotate(dir, 2); err != nil {
+		t.Fatalf("rotate() error = %v", err)
+	}
+	backups, _ := List(dir)
+	want := []string{filepath.Join(dir, names[1]), filepath.Join(dir, names[2])}
+	if strings.Join(backups, ",") != strings.Join(want, ",") {
+		t.Errorf("rotate() left %v, want %v", backups, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unrelated.db")); err != nil {
+		t.Errorf("rotate() removed unrelated file")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	d, _ := newTestDB(t)
+	m, err := NewManager(d, Config{Dir: t.TempDir(), Compress: true})
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	path, err := m.Run()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	target := filepath.Join(t.TempDir(), "restored.db")
+	if err := os.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(path, target); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	restored, err := db.NewDB(target)
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer restored.Close()
+	stats, err := restored.GetRecentStats(100000, nil)
+	if err != nil || len(stats) != 1 {
+		t.Errorf("restored db stats = %v, %v", stats, err)
+	}
+	moved, _ := filepath.Glob(target + ".pre-restore-*")
+	if len(moved) != 1 {
+		t.Errorf("existing database not moved aside")
+	}
+
+	corrupt := filepath.Join(t.TempDir(), "leader_corrupt.db")
+	os.WriteFile(corrupt, []byte("not a database"), 0644)
+	if err := Restore(corrupt, target); err == nil {
+		t.Errorf("Restore() of corrupt backup should fail")
+	}
+}
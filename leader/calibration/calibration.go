@@ -0,0 +1,172 @@
+// Package calibration corrects sensor values at ingest with per device and metric calibrations, and rewrites
+// stored history when asked to.
+package calibration
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// Kinds of calibration
+const (
+	// KindOffset adds Offset to the raw value
+	KindOffset = "offset"
+	// KindLinear multiplies the raw value by Scale, then adds Offset
+	KindLinear = "linear"
+	// KindTwoPoint maps RawLow to ActualLow and RawHigh to ActualHigh, interpolating between them
+	KindTwoPoint = "two_point"
+)
+
+// ErrInvalid is returned for a calibration which cannot be applied
+var ErrInvalid = errors.New("invalid calibration")
+
+type key struct {
+	deviceID uint8
+	metric   string
+}
+
+// Calibrator holds the calibrations of every device, applying them to incoming measurements
+type Calibrator struct {
+	db *db.DB
+
+	lock         sync.RWMutex
+	calibrations map[key]db.Calibration
+}
+
+func New(d *db.DB) (*Calibrator, error) {
+	c := &Calibrator{db: d}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	log.Info().Int("calibrations", len(c.calibrations)).Msg("Calibrations loaded")
+
+	return c, nil
+}
+
+func (c *Calibrator) load() error {
+	cals, err := c.db.Calibrations()
+	if err != nil {
+		return fmt.Errorf("error loading calibrations: %w", err)
+	}
+	byKey := make(map[key]db.Calibration, len(cals))
+	for _, cal := range cals {
+		byKey[key{deviceID: cal.DeviceID, metric: cal.Metric}] = cal
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calibrations = byKey
+
+	return nil
+}
+
+// Validate checks cal and fills in its Scale and Offset from its kind
+func Validate(cal *db.Calibration) error {
+	if cal.Metric == "" {
+		return fmt.Errorf("%w: metric cannot be blank", ErrInvalid)
+	}
+	switch cal.Kind {
+	case KindOffset:
+		cal.Scale = 1
+	case KindLinear:
+		if cal.Scale == 0 {
+			return fmt.Errorf("%w: linear scale cannot be 0", ErrInvalid)
+		}
+	case KindTwoPoint:
+		if cal.RawHigh == cal.RawLow {
+			return fmt.Errorf("%w: two point raw values must differ", ErrInvalid)
+		}
+		cal.Scale = (cal.ActualHigh - cal.ActualLow) / (cal.RawHigh - cal.RawLow)
+		cal.Offset = cal.ActualLow - cal.Scale*cal.RawLow
+		if cal.Scale == 0 {
+			return fmt.Errorf("%w: two point actual values must differ", ErrInvalid)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q, must be %s, %s or %s", ErrInvalid, cal.Kind, KindOffset, KindLinear, KindTwoPoint)
+	}
+	if cal.Kind != KindTwoPoint {
+		cal.RawLow, cal.ActualLow, cal.RawHigh, cal.ActualHigh = 0, 0, 0, 0
+	}
+
+	return nil
+}
+
+// Calibrate returns ms with each calibrated metric of deviceID corrected, and the raw values of the corrected
+// measurements. ms is not modified.
+func (c *Calibrator) Calibrate(deviceID uint8, ms []sensor.Measurement) ([]sensor.Measurement, []sensor.Measurement) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.calibrations) == 0 {
+		return ms, nil
+	}
+
+	var (
+		out = make([]sensor.Measurement, len(ms))
+		raw []sensor.Measurement
+	)
+	for i, m := range ms {
+		out[i] = m
+		if cal, ok := c.calibrations[key{deviceID: deviceID, metric: m.Metric}]; ok {
+			out[i].Value = m.Value*cal.Scale + cal.Offset
+			raw = append(raw, m)
+		}
+	}
+
+	return out, raw
+}
+
+// Calibrations returns every calibration, ordered by device and metric
+func (c *Calibrator) Calibrations() ([]db.Calibration, error) {
+	return c.db.Calibrations()
+}
+
+// Set validates and stores a calibration, applying it to values received from now on.
+// Stored values are unchanged until Recalibrate is called.
+func (c *Calibrator) Set(cal db.Calibration) (db.Calibration, error) {
+	if err := Validate(&cal); err != nil {
+		return db.Calibration{}, err
+	}
+	cal.UpdatedAt = time.Now()
+	cal, err := c.db.SetCalibration(cal)
+	if err != nil {
+		return db.Calibration{}, err
+	}
+	log.Info().Uint8("deviceID", cal.DeviceID).Str("metric", cal.Metric).Float64("scale", cal.Scale).
+		Float64("offset", cal.Offset).Msg("Calibration set")
+
+	return cal, c.load()
+}
+
+// Delete removes a calibration, so values received from now on are stored raw
+func (c *Calibrator) Delete(id int64) error {
+	if err := c.db.DeleteCalibration(id); err != nil {
+		return err
+	}
+
+	return c.load()
+}
+
+// Recalibrate rewrites the stored values of metric on deviceID in [from, to) from their raw values with the
+// current calibration, or restores the raw values if the metric is no longer calibrated. It returns the number
+// of values rewritten. Metrics derived from the rewritten values are not recomputed.
+func (c *Calibrator) Recalibrate(deviceID uint8, metric string, from, to time.Time) (int64, error) {
+	c.lock.RLock()
+	cal, ok := c.calibrations[key{deviceID: deviceID, metric: metric}]
+	c.lock.RUnlock()
+	if !ok {
+		cal = db.Calibration{Scale: 1}
+	}
+
+	n, err := c.db.Recalibrate(deviceID, metric, cal.Scale, cal.Offset, from, to)
+	if err != nil {
+		return 0, err
+	}
+	log.Info().Uint8("deviceID", deviceID).Str("metric", metric).Int64("values", n).Msg("Recalibrated stored values")
+
+	return n, nil
+}
@@ -0,0 +1,150 @@
+package calibration
+
+import (
+	"errors"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		cal         db.Calibration
+		raw, want   float64
+		wantInvalid bool
+	}{
+		{name: "offset", cal: db.Calibration{Metric: "temperature", Kind: KindOffset, Scale: 3, Offset: -1.8}, raw: 23.8, want: 22},
+		{name: "linear", cal: db.Calibration{Metric: "humidity", Kind: KindLinear, Scale: 1.05, Offset: -2}, raw: 40, want: 40},
+		{
+			name: "two point",
+			cal:  db.Calibration{Metric: "humidity", Kind: KindTwoPoint, RawLow: 14, ActualLow: 11.3, RawHigh: 78, ActualHigh: 75.3},
+			raw:  50, want: 47.3,
+		},
+		{
+			name: "two point stretches",
+			cal:  db.Calibration{Metric: "humidity", Kind: KindTwoPoint, RawLow: 10, ActualLow: 0, RawHigh: 60, ActualHigh: 100},
+			raw:  35, want: 50,
+		},
+		{name: "blank metric", cal: db.Calibration{Kind: KindOffset}, wantInvalid: true},
+		{name: "unknown kind", cal: db.Calibration{Metric: "temperature", Kind: "cubic"}, wantInvalid: true},
+		{name: "zero scale", cal: db.Calibration{Metric: "temperature", Kind: KindLinear}, wantInvalid: true},
+		{name: "same raw points", cal: db.Calibration{Metric: "humidity", Kind: KindTwoPoint, RawLow: 5, RawHigh: 5, ActualHigh: 10}, wantInvalid: true},
+		{name: "same actual points", cal: db.Calibration{Metric: "humidity", Kind: KindTwoPoint, RawLow: 5, RawHigh: 10}, wantInvalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := tt.cal
+			err := Validate(&cal)
+			if errors.Is(err, ErrInvalid) != tt.wantInvalid {
+				t.Fatalf("Validate() error = %v, wantInvalid %v", err, tt.wantInvalid)
+			}
+			if tt.wantInvalid {
+				return
+			}
+			if got := tt.raw*cal.Scale + cal.Offset; math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("calibrated %v = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalibrator(t *testing.T) {
+	d, err := db.NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(d.Close)
+
+	record := func(c *Calibrator, ts int64, temperature float64) {
+		t.Helper()
+		ms, raw := c.Calibrate(1, []sensor.Measurement{
+			{Metric: sensor.MetricTemperature, Value: temperature},
+			{Metric: sensor.MetricHumidity, Value: 40},
+		})
+		if err := d.RecordCalibratedMeasurements(1, sensor.TypeAtmospheric, time.Unix(ts, 0), ms, raw); err != nil {
+			t.Fatalf("RecordCalibratedMeasurements() error = %v", err)
+		}
+	}
+	temperatures := func() []float64 {
+		t.Helper()
+		samples, err := d.Samples(db.ReadingsFilter{Metrics: []string{sensor.MetricTemperature}})
+		if err != nil {
+			t.Fatalf("Samples() error = %v", err)
+		}
+		var out []float64
+		for _, s := range samples {
+			out = append(out, math.Round(s.Value*100)/100)
+		}
+		return out
+	}
+	assertTemperatures := func(step string, want ...float64) {
+		t.Helper()
+		got := temperatures()
+		if len(got) != len(want) {
+			t.Fatalf("%s: temperatures = %v, want %v", step, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: temperatures = %v, want %v", step, got, want)
+				return
+			}
+		}
+	}
+
+	c, err := New(d)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	record(c, 100, 23)
+
+	cal, err := c.Set(db.Calibration{DeviceID: 1, Metric: sensor.MetricTemperature, Kind: KindOffset, Offset: -1.5})
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	record(c, 200, 24)
+	assertTemperatures("after set", 23, 22.5)
+
+	// other devices and metrics are untouched
+	if ms, raw := c.Calibrate(2, []sensor.Measurement{{Metric: sensor.MetricTemperature, Value: 24}}); ms[0].Value != 24 || raw != nil {
+		t.Errorf("Calibrate() device 2 = %v, raw %v", ms, raw)
+	}
+
+	// calibrations survive a restart
+	c, err = New(d)
+	if err != nil {
+		t.Fatalf("New() reload error = %v", err)
+	}
+	if _, err := c.Set(db.Calibration{DeviceID: 1, Metric: sensor.MetricTemperature, Kind: KindOffset, Offset: -2}); err != nil {
+		t.Fatalf("Set() replace error = %v", err)
+	}
+	if cals, _ := c.Calibrations(); len(cals) != 1 || cals[0].ID != cal.ID || cals[0].Offset != -2 {
+		t.Errorf("Calibrations() = %+v", cals)
+	}
+	record(c, 300, 25)
+	assertTemperatures("before recalibrate", 23, 22.5, 23)
+
+	n, err := c.Recalibrate(1, sensor.MetricTemperature, time.Time{}, time.Time{})
+	if err != nil || n != 3 {
+		t.Fatalf("Recalibrate() = %d, %v, want 3", n, err)
+	}
+	assertTemperatures("after recalibrate", 21, 22, 23)
+
+	if err := c.Delete(cal.ID); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if n, err := c.Recalibrate(1, sensor.MetricTemperature, time.Unix(200, 0), time.Time{}); err != nil || n != 2 {
+		t.Fatalf("Recalibrate() after delete = %d, %v, want 2", n, err)
+	}
+	assertTemperatures("after delete", 21, 24, 25)
+
+	if _, err := c.Recalibrate(1, "no_such_metric", time.Time{}, time.Time{}); !errors.Is(err, db.ErrUnknownMetric) {
+		t.Errorf("Recalibrate() unknown metric error = %v", err)
+	}
+	if err := c.Delete(cal.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Delete() twice error = %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/backup"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"time"
+)
+
+// backupConfig reads the backup section of the leader config
+func backupConfig() backup.Config {
+	return backup.Config{
+		Dir:      viper.GetString("backup.dir"),
+		Interval: time.Duration(viper.GetInt("backup.intervalHours")) * time.Hour,
+		Keep:     viper.GetInt("backup.keep"),
+		Compress: viper.GetBool("backup.compress"),
+	}
+}
+
+// runBackup takes a single backup using the configured backup settings
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	d, err := db.NewDB(viper.GetString("dbFile"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	defer d.Close()
+
+	m, err := backup.NewManager(d, backupConfig())
+	if err != nil {
+		return err
+	}
+	path, err := m.Run()
+	if err != nil {
+		return err
+	}
+	log.Info().Str("file", path).Msg("Backup written")
+
+	return nil
+}
+
+// runRestore replaces the leader database with a verified backup. The leader must be stopped first.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := fs.String("from", "", "backup file to restore, compressed or not")
+	verifyOnly := fs.Bool("verify", false, "only verify the backup, do not restore it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+
+	if *verifyOnly {
+		if err := backup.Verify(*from); err != nil {
+			return err
+		}
+		log.Info().Str("file", *from).Msg("Backup verified")
+		return nil
+	}
+
+	dbFile := viper.GetString("dbFile")
+	if err := backup.Restore(*from, dbFile); err != nil {
+		return err
+	}
+	log.Info().Str("file", *from).Str("dbFile", dbFile).Msg("Backup restored")
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+)
+
+// runExport writes readings to a file or stdout, with the same options as /api/export
+func runExport(args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	var (
+		out     = fs.String("out", "", "file to write to, stdout if blank")
+		format  = fs.String("format", export.FormatCSV, "csv or ndjson")
+		from    = fs.String("from", "", "start of range, RFC3339 or unix seconds")
+		to      = fs.String("to", "", "end of range (exclusive), RFC3339 or unix seconds")
+		devices = fs.String("devices", "", "comma separated device IDs, all devices if blank")
+		metrics = fs.String("metrics", "", "comma separated metrics, all metrics if blank")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	fromT, err := export.ParseTime(*from)
+	if err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	toT, err := export.ParseTime(*to)
+	if err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+	deviceIDs, err := export.ParseDeviceIDs(*devices)
+	if err != nil {
+		return err
+	}
+
+	d, err := db.NewDB(viper.GetString("dbFile"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	defer d.Close()
+
+	known, err := d.MetricNames()
+	if err != nil {
+		return err
+	}
+	opts := export.Options{Format: *format, Metrics: export.ParseList(*metrics)}
+	if err := opts.Validate(known); err != nil {
+		return err
+	}
+
+	rows, err := d.StreamReadings(db.ReadingsFilter{From: fromT, To: toT, DeviceIDs: deviceIDs, Metrics: opts.Metrics})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		var f *os.File
+		if f, err = os.Create(*out); err != nil {
+			return fmt.Errorf("error creating output file: %w", err)
+		}
+		// a failed close can lose buffered writes, so it fails the export unless it has already failed
+		defer func() {
+			if closeErr := f.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("error closing output file: %w", closeErr)
+			}
+		}()
+		w = f
+	}
+
+	n, err := export.Write(w, rows, opts)
+	if err != nil {
+		return fmt.Errorf("export failed after %d readings: %w", n, err)
+	}
+	log.Info().Int("readings", n).Str("out", *out).Msg("Export complete")
+
+	return nil
+}
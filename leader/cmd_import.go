@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/importer"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"os"
+)
+
+// runImport imports historical readings from a driver log or CSV file
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	var (
+		in       = fs.String("in", "", "file to import")
+		format   = fs.String("format", importer.FormatDriverLog, "driverlog or csv")
+		deviceID = fs.Uint("device", 0, "device ID to attribute readings to")
+		columns  = fs.String("columns", "", "csv column mapping, e.g. temperature=temp_c,ts=time")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+	if *deviceID == 0 || *deviceID > 255 {
+		return fmt.Errorf("-device must be between 1 and 255")
+	}
+	cols, err := importer.ParseColumns(*columns)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %w", err)
+	}
+	defer f.Close()
+
+	d, err := db.NewDB(viper.GetString("dbFile"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	defer d.Close()
+
+	known, err := d.MetricNames()
+	if err != nil {
+		return err
+	}
+	res, err := importer.Import(f, d, importer.Options{
+		Format:   *format,
+		DeviceID: uint8(*deviceID),
+		Metrics:  known,
+		Columns:  cols,
+	})
+	for _, rej := range res.Rejected {
+		log.Warn().Int("line", rej.Line).Str("text", rej.Text).Str("reason", rej.Reason).Msg("Rejected line")
+	}
+	if err != nil {
+		return fmt.Errorf("import failed after %d readings: %w", res.Imported, err)
+	}
+	log.Info().
+		Int("imported", res.Imported).
+		Int("duplicates", res.Duplicates).
+		Int("rejected", res.RejectedCount).
+		Msg("Import complete")
+
+	return nil
+}
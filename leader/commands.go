@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands are one-shot subcommands which run instead of the leader daemon, e.g. `leader export -out readings.csv`
+var commands = map[string]func(args []string) error{
+	"export":  runExport,
+	"import":  runImport,
+	"backup":  runBackup,
+	"restore": runRestore,
+}
+
+// runCommand runs the named subcommand, returning false if there is no such command
+func runCommand(name string, args []string) (bool, error) {
+	cmd, ok := commands[name]
+	if !ok {
+		return false, nil
+	}
+
+	return true, cmd(args)
+}
+
+func commandNames() string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+func usageError(format string, a ...any) error {
+	return fmt.Errorf(format+" (commands: %s)", append(a, commandNames())...)
+}
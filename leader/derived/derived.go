@@ -0,0 +1,230 @@
+// Package derived computes comfort metrics from the raw values reported by atmospheric sensors, so they can be
+// stored, queried and alerted on like any other metric.
+package derived
+
+import (
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricDewPoint         = "dew_point"
+	MetricHeatIndex        = "heat_index"
+	MetricAbsoluteHumidity = "absolute_humidity"
+	MetricAirQuality       = "air_quality"
+	MetricMoldRisk         = "mold_risk"
+)
+
+func init() {
+	sensor.RegisterMetric(sensor.Metric{Name: MetricDewPoint, Unit: "C", SensorType: sensor.TypeAtmospheric})
+	sensor.RegisterMetric(sensor.Metric{Name: MetricHeatIndex, Unit: "C", SensorType: sensor.TypeAtmospheric})
+	sensor.RegisterMetric(sensor.Metric{Name: MetricAbsoluteHumidity, Unit: "g/m3", SensorType: sensor.TypeAtmospheric})
+	sensor.RegisterMetric(sensor.Metric{Name: MetricAirQuality, Unit: "", SensorType: sensor.TypeAtmospheric})
+	sensor.RegisterMetric(sensor.Metric{Name: MetricMoldRisk, Unit: "%", SensorType: sensor.TypeAtmospheric})
+}
+
+const (
+	// MoldHumidity is the relative humidity at and above which mold can grow
+	MoldHumidity = 70
+	// MoldWindow is how far back mold risk looks
+	MoldWindow = 24 * time.Hour
+	// MoldMinCoverage is how much of MoldWindow readings must cover before mold risk is reported, so a single
+	// humid reading after startup is not a sustained risk
+	MoldMinCoverage = 6 * time.Hour
+	// moldMaxGap caps how long a reading is taken to hold, so a polling gap does not count as its last value
+	moldMaxGap = 15 * time.Minute
+)
+
+// Air quality categories of the SGP40 VOC index, which averages 100 in typical indoor air
+const (
+	AirQualityGood = iota + 1
+	AirQualityModerate
+	AirQualityPoor
+	AirQualityUnhealthy
+	AirQualityVeryUnhealthy
+)
+
+// DewPoint returns the temperature in C at which air of temperature c and relative humidity rh saturates,
+// using the Magnus formula
+func DewPoint(c, rh float64) float64 {
+	const b, l = 17.62, 243.12
+	g := math.Log(rh/100) + b*c/(l+c)
+
+	return l * g / (b - g)
+}
+
+// HeatIndex returns how hot air of temperature c and relative humidity rh feels, in C, using the
+// US National Weather Service regression. Below about 27C it is close to the air temperature.
+func HeatIndex(c, rh float64) float64 {
+	f := c*9/5 + 32
+	hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+	if (hi+f)/2 >= 80 {
+		hi = -42.379 + 2.04901523*f + 10.14333127*rh - 0.22475541*f*rh - 0.00683783*f*f - 0.05481717*rh*rh +
+			0.00122874*f*f*rh + 0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+		if rh < 13 && f >= 80 && f <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+		} else if rh > 85 && f >= 80 && f <= 87 {
+			hi += (rh - 85) / 10 * (87 - f) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9
+}
+
+// AbsoluteHumidity returns the grams of water vapour per cubic metre of air of temperature c and relative humidity rh
+func AbsoluteHumidity(c, rh float64) float64 {
+	return 6.112 * math.Exp(17.67*c/(c+243.5)) * rh * 2.1674 / (273.15 + c)
+}
+
+// AirQuality returns the category of a VOC index
+func AirQuality(vocIndex float64) int {
+	switch {
+	case vocIndex <= 100:
+		return AirQualityGood
+	case vocIndex <= 200:
+		return AirQualityModerate
+	case vocIndex <= 300:
+		return AirQualityPoor
+	case vocIndex <= 400:
+		return AirQualityUnhealthy
+	default:
+		return AirQualityVeryUnhealthy
+	}
+}
+
+// humiditySample is a relative humidity kept for mold risk
+type humiditySample struct {
+	ts time.Time
+	rh float64
+}
+
+type seriesKey struct {
+	deviceID uint8
+	// instance is the sensor instance prefix of the metrics, blank for the default instance
+	instance string
+}
+
+// Deriver adds derived metrics to each readout. It keeps recent humidity per sensor for mold risk.
+type Deriver struct {
+	lock     sync.Mutex
+	humidity map[seriesKey][]humiditySample
+}
+
+func New() *Deriver {
+	return &Deriver{humidity: make(map[seriesKey][]humiditySample)}
+}
+
+// Derive returns the metrics derived from ms, which a device reported at ts. Metrics of a named sensor instance,
+// such as attic.temperature, derive metrics of the same instance, such as attic.dew_point.
+func (d *Deriver) Derive(deviceID uint8, ts time.Time, ms []sensor.Measurement) []sensor.Measurement {
+	type values struct {
+		temperature, humidity, voc *float64
+	}
+	var (
+		instances  []string
+		byInstance = make(map[string]*values)
+	)
+	for i := range ms {
+		instance, base := splitMetric(ms[i].Metric)
+		v, ok := byInstance[instance]
+		if !ok {
+			v = &values{}
+			byInstance[instance] = v
+			instances = append(instances, instance)
+		}
+		switch base {
+		case sensor.MetricTemperature:
+			v.temperature = &ms[i].Value
+		case sensor.MetricHumidity:
+			v.humidity = &ms[i].Value
+		case sensor.MetricVOCIndex:
+			v.voc = &ms[i].Value
+		}
+	}
+
+	var out []sensor.Measurement
+	add := func(instance, metric string, value float64) {
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			out = append(out, sensor.Measurement{Metric: qualify(instance, metric), Value: value})
+		}
+	}
+	for _, instance := range instances {
+		v := byInstance[instance]
+		if v.temperature != nil && v.humidity != nil && *v.humidity > 0 {
+			add(instance, MetricDewPoint, DewPoint(*v.temperature, *v.humidity))
+			add(instance, MetricHeatIndex, HeatIndex(*v.temperature, *v.humidity))
+			add(instance, MetricAbsoluteHumidity, AbsoluteHumidity(*v.temperature, *v.humidity))
+		}
+		if v.humidity != nil {
+			if risk, ok := d.moldRisk(seriesKey{deviceID: deviceID, instance: instance}, ts, *v.humidity); ok {
+				add(instance, MetricMoldRisk, risk)
+			}
+		}
+		if v.voc != nil {
+			add(instance, MetricAirQuality, float64(AirQuality(*v.voc)))
+		}
+	}
+
+	return out
+}
+
+// moldRisk records rh and returns the percentage of the time in the last MoldWindow humidity was at or above
+// MoldHumidity. Each reading holds until the next, for at most moldMaxGap. It returns false until the readings
+// cover MoldMinCoverage.
+func (d *Deriver) moldRisk(key seriesKey, ts time.Time, rh float64) (float64, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	samples := append(d.humidity[key], humiditySample{ts: ts, rh: rh})
+	cutoff := ts.Add(-MoldWindow)
+	// keep the last reading before the window, as it holds into the window
+	i := 0
+	for i+1 < len(samples) && !samples[i+1].ts.After(cutoff) {
+		i++
+	}
+	samples = samples[i:]
+	d.humidity[key] = samples
+
+	var covered, high time.Duration
+	for i := 0; i+1 < len(samples); i++ {
+		from, to := samples[i].ts, samples[i+1].ts
+		if end := from.Add(moldMaxGap); end.Before(to) {
+			to = end
+		}
+		if from.Before(cutoff) {
+			from = cutoff
+		}
+		if !to.After(from) {
+			continue
+		}
+		covered += to.Sub(from)
+		if samples[i].rh >= MoldHumidity {
+			high += to.Sub(from)
+		}
+	}
+	if covered < MoldMinCoverage {
+		return 0, false
+	}
+
+	return 100 * high.Seconds() / covered.Seconds(), true
+}
+
+// splitMetric splits a metric name into its sensor instance prefix and base metric
+func splitMetric(name string) (string, string) {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+
+	return "", name
+}
+
+func qualify(instance, metric string) string {
+	if instance == "" {
+		return metric
+	}
+
+	return instance + "." + metric
+}
@@ -0,0 +1,145 @@
+package derived
+
+import (
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFormulas(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(c, rh float64) float64
+		c    float64
+		rh   float64
+		want float64
+		tol  float64
+	}{
+		{"dew point 20C 50%", DewPoint, 20, 50, 9.26, 0.05},
+		{"dew point 25C 60%", DewPoint, 25, 60, 16.69, 0.05},
+		{"dew point saturated", DewPoint, 10, 100, 10, 0.01},
+		{"dew point cold", DewPoint, -5, 80, -7.9, 0.1},
+		// NWS heat index chart: 90F at 70% feels like 106F, 94F at 55% like 106F, 86F at 90% like 105F
+		{"heat index 90F 70%", HeatIndex, 32.22, 70, 41.1, 0.3},
+		{"heat index 94F 55%", HeatIndex, 34.44, 55, 41.1, 0.3},
+		{"heat index humid adjustment", HeatIndex, 30, 90, 40.6, 0.3},
+		{"heat index 80F 40%", HeatIndex, 26.67, 40, 26.7, 0.3},
+		{"heat index mild", HeatIndex, 20, 50, 19.4, 0.1},
+		{"absolute humidity 20C 50%", AbsoluteHumidity, 20, 50, 8.64, 0.05},
+		{"absolute humidity 25C 60%", AbsoluteHumidity, 25, 60, 13.8, 0.05},
+		{"absolute humidity 30C 100%", AbsoluteHumidity, 30, 100, 30.3, 0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fn(tt.c, tt.rh); math.Abs(got-tt.want) > tt.tol {
+				t.Errorf("got %.3f, want %.2f ± %.2f", got, tt.want, tt.tol)
+			}
+		})
+	}
+}
+
+func TestAirQuality(t *testing.T) {
+	tests := []struct {
+		voc  float64
+		want int
+	}{
+		{0, AirQualityGood},
+		{100, AirQualityGood},
+		{101, AirQualityModerate},
+		{250, AirQualityPoor},
+		{400, AirQualityUnhealthy},
+		{500, AirQualityVeryUnhealthy},
+	}
+	for _, tt := range tests {
+		if got := AirQuality(tt.voc); got != tt.want {
+			t.Errorf("AirQuality(%v) = %d, want %d", tt.voc, got, tt.want)
+		}
+	}
+}
+
+func TestDeriver_Derive(t *testing.T) {
+	ts := time.Unix(100000, 0)
+	ms := []sensor.Measurement{
+		{Metric: sensor.MetricTemperature, Value: 20},
+		{Metric: sensor.MetricHumidity, Value: 50},
+		{Metric: sensor.MetricVOCIndex, Value: 150},
+		{Metric: "attic.temperature", Value: 25},
+		{Metric: "attic.humidity", Value: 60},
+		{Metric: "probe.temperature", Value: 4},
+	}
+
+	got := make(map[string]float64)
+	for _, m := range New().Derive(1, ts, ms) {
+		got[m.Metric] = m.Value
+	}
+	want := map[string]float64{
+		MetricDewPoint:                    DewPoint(20, 50),
+		MetricHeatIndex:                   HeatIndex(20, 50),
+		MetricAbsoluteHumidity:            AbsoluteHumidity(20, 50),
+		MetricAirQuality:                  AirQualityModerate,
+		"attic." + MetricDewPoint:         DewPoint(25, 60),
+		"attic." + MetricHeatIndex:        HeatIndex(25, 60),
+		"attic." + MetricAbsoluteHumidity: AbsoluteHumidity(25, 60),
+	}
+	if len(got) != len(want) {
+		t.Errorf("Derive() = %v, want %v", got, want)
+	}
+	for name, v := range want {
+		if g, ok := got[name]; !ok || g != v {
+			t.Errorf("Derive() %s = %v (present %v), want %v", name, g, ok, v)
+		}
+	}
+}
+
+func TestDeriver_moldRisk(t *testing.T) {
+	start := time.Unix(100000, 0)
+	d := New()
+	// feed reports rh every interval from the from hour until before the to hour
+	feed := func(from, to float64, interval time.Duration, rh float64) {
+		for ts := start.Add(hours(from)); ts.Before(start.Add(hours(to))); ts = ts.Add(interval) {
+			d.Derive(2, ts, []sensor.Measurement{{Metric: sensor.MetricHumidity, Value: rh}})
+		}
+	}
+	// check reports rh at the at hour, and checks the mold risk derived
+	check := func(at, rh float64, want float64, wantOK bool) {
+		t.Helper()
+		var risk float64
+		found := false
+		for _, m := range d.Derive(2, start.Add(hours(at)), []sensor.Measurement{{Metric: sensor.MetricHumidity, Value: rh}}) {
+			if m.Metric == MetricMoldRisk {
+				risk, found = m.Value, true
+			}
+		}
+		if found != wantOK || math.Abs(risk-want) > 0.01 {
+			t.Errorf("at %vh mold risk = %.2f (present %v), want %.2f (present %v)", at, risk, found, want, wantOK)
+		}
+	}
+
+	// a humid reading straight after startup is not yet a risk
+	check(0, 90, 0, false)
+	feed(1.0/6, 5.5, 10*time.Minute, 60)
+	check(5.5, 60, 0, false)
+	feed(5.5, 6, 10*time.Minute, 60)
+	// 6 hours are covered, the first 10 minutes of them humid
+	check(6, 80, 2.78, true)
+	// readings 6 times as frequent do not weigh 6 times as much
+	feed(6, 12, 100*time.Second, 80)
+	check(12, 80, 51.39, true)
+	// nothing is heard for 2 hours, so only the first 15 minutes of that gap count
+	check(14, 50, 52.38, true)
+	feed(14, 30, 10*time.Minute, 50)
+	// the window has moved on to start at 6h: 6 humid hours and 15 minutes of 22 and a quarter
+	check(30, 50, 28.09, true)
+
+	// other devices keep their own history
+	for _, m := range d.Derive(3, start.Add(hours(30)), []sensor.Measurement{{Metric: sensor.MetricHumidity, Value: 40}}) {
+		if m.Metric == MetricMoldRisk {
+			t.Errorf("device 3 mold risk = %v, want none yet", m.Value)
+		}
+	}
+}
+
+func hours(h float64) time.Duration {
+	return time.Duration(h * float64(time.Hour))
+}
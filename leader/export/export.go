@@ -0,0 +1,192 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// RowIterator is satisfied by *db.ReadingRows
+type RowIterator interface {
+	Next() bool
+	Reading() (db.Reading, error)
+	Err() error
+}
+
+// Options controls the shape of an export
+type Options struct {
+	Format string
+	// Metrics is the set of metrics to include, in column order. Empty means all metrics.
+	Metrics []string
+}
+
+// Validate checks the format and metric names against the known metrics, filling in defaults
+func (o *Options) Validate(known []string) error {
+	if o.Format == "" {
+		o.Format = FormatCSV
+	}
+	if o.Format != FormatCSV && o.Format != FormatNDJSON {
+		return fmt.Errorf("unknown export format %q", o.Format)
+	}
+	if len(o.Metrics) == 0 {
+		o.Metrics = known
+	}
+	for _, m := range o.Metrics {
+		if !contains(known, m) {
+			return fmt.Errorf("unknown metric %q", m)
+		}
+	}
+
+	return nil
+}
+
+// ContentType returns the MIME type of the export format
+func (o Options) ContentType() string {
+	if o.Format == FormatNDJSON {
+		return "application/x-ndjson"
+	}
+
+	return "text/csv"
+}
+
+// Write streams every row to w in the requested format, returning the number of readings written.
+// opts must have been validated.
+func Write(w io.Writer, rows RowIterator, opts Options) (int, error) {
+	switch opts.Format {
+	case FormatCSV:
+		return writeCSV(w, rows, opts.Metrics)
+	case FormatNDJSON:
+		return writeNDJSON(w, rows, opts.Metrics)
+	default:
+		return 0, fmt.Errorf("unknown export format %q", opts.Format)
+	}
+}
+
+func writeCSV(w io.Writer, rows RowIterator, metrics []string) (int, error) {
+	cw := csv.NewWriter(w)
+	header := append([]string{"timestamp", "unix_ts", "device_id"}, metrics...)
+	if err := cw.Write(header); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	record := make([]string, len(header))
+	for rows.Next() {
+		r, err := rows.Reading()
+		if err != nil {
+			return n, err
+		}
+
+		record[0] = r.Timestamp.UTC().Format(time.RFC3339)
+		record[1] = strconv.FormatInt(r.Timestamp.Unix(), 10)
+		record[2] = strconv.Itoa(int(r.DeviceID))
+		for i, m := range metrics {
+			record[3+i] = ""
+			if v, ok := r.Values[m]; ok {
+				record[3+i] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return n, err
+		}
+		n++
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return n, err
+	}
+
+	return n, rows.Err()
+}
+
+func writeNDJSON(w io.Writer, rows RowIterator, metrics []string) (int, error) {
+	enc := json.NewEncoder(w)
+
+	n := 0
+	for rows.Next() {
+		r, err := rows.Reading()
+		if err != nil {
+			return n, err
+		}
+
+		line := map[string]any{
+			"timestamp": r.Timestamp.UTC(),
+			"unixTS":    r.Timestamp.Unix(),
+			"deviceID":  r.DeviceID,
+		}
+		for _, m := range metrics {
+			if v, ok := r.Values[m]; ok {
+				line[m] = v
+			}
+		}
+		if err := enc.Encode(line); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseTime accepts either RFC3339 or unix seconds. A blank string is the zero time.
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("time must be RFC3339 or unix seconds")
+	}
+
+	return t, nil
+}
+
+// ParseList splits a comma separated list, dropping blank entries
+func ParseList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+
+	return out
+}
+
+// ParseDeviceIDs parses a comma separated list of device IDs
+func ParseDeviceIDs(s string) ([]uint8, error) {
+	var ids []uint8
+	for _, part := range ParseList(s) {
+		id, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device ID %q", part)
+		}
+		ids = append(ids, uint8(id))
+	}
+
+	return ids, nil
+}
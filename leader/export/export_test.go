@@ -0,0 +1,98 @@
+package export
+
+import (
+	"bytes"
+	"github.com/Heanthor/quill-secure/db"
+	"testing"
+	"time"
+)
+
+type sliceRows struct {
+	readings []db.Reading
+	i        int
+}
+
+func (s *sliceRows) Next() bool {
+	s.i++
+	return s.i <= len(s.readings)
+}
+
+func (s *sliceRows) Reading() (db.Reading, error) {
+	return s.readings[s.i-1], nil
+}
+
+func (s *sliceRows) Err() error {
+	return nil
+}
+
+func TestWrite(t *testing.T) {
+	readings := []db.Reading{
+		{DeviceID: 1, Timestamp: time.Unix(1660369274, 0), Values: map[string]float64{
+			"temperature": 25.5,
+			"humidity":    43,
+		}},
+		{DeviceID: 2, Timestamp: time.Unix(1660369275, 0), Values: map[string]float64{
+			"temperature": 20,
+			"humidity":    50.25,
+			"lux":         300,
+		}},
+		{DeviceID: 3, Timestamp: time.Unix(1660369276, 0), Values: map[string]float64{
+			"temperature": 19,
+		}},
+	}
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{
+			name: "csv with selected metrics",
+			opts: Options{Format: FormatCSV, Metrics: []string{"temperature", "humidity"}},
+			want: "timestamp,unix_ts,device_id,temperature,humidity\n" +
+				"2022-08-13T05:41:14Z,1660369274,1,25.5,43\n" +
+				"2022-08-13T05:41:15Z,1660369275,2,20,50.25\n" +
+				"2022-08-13T05:41:16Z,1660369276,3,19,\n",
+		},
+		{
+			name: "ndjson with selected metrics",
+			opts: Options{Format: FormatNDJSON, Metrics: []string{"humidity"}},
+			want: `{"deviceID":1,"humidity":43,"timestamp":"2022-08-13T05:41:14Z","unixTS":1660369274}` + "\n" +
+				`{"deviceID":2,"humidity":50.25,"timestamp":"2022-08-13T05:41:15Z","unixTS":1660369275}` + "\n" +
+				`{"deviceID":3,"timestamp":"2022-08-13T05:41:16Z","unixTS":1660369276}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := Write(&buf, &sliceRows{readings: readings}, tt.opts)
+			if err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if n != len(readings) {
+				t.Errorf("Write() n = %d, want %d", n, len(readings))
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Write() got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "defaults", opts: Options{}},
+		{name: "unknown format", opts: Options{Format: "xml"}, wantErr: true},
+		{name: "unknown metric", opts: Options{Metrics: []string{"lux"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate([]string{"temperature", "humidity"}); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/export"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FormatDriverLog is raw sensor_driver.py output, one `ts,temp,humidity,pressure,altitude,voc` line per reading
+	FormatDriverLog = "driverlog"
+	// FormatCSV is a CSV file with a header row, whose columns are mapped to metrics
+	FormatCSV = "csv"
+
+	// batchSize is the number of readings written per database transaction
+	batchSize = 500
+	// maxReportedRejections caps how many rejected lines are returned in a Result
+	maxReportedRejections = 1000
+)
+
+// timestampColumns are checked in order when no timestamp column is mapped
+var timestampColumns = []string{"unix_ts", "ts", "timestamp"}
+
+// Store is satisfied by *db.DB
+type Store interface {
+	ImportReadings(deviceID uint8, readings []db.Reading) (int, error)
+}
+
+// Options controls how input is parsed and attributed
+type Options struct {
+	Format string
+	// DeviceID is the device every imported reading is attributed to
+	DeviceID uint8
+	// Metrics are the registered metric names which CSV columns may be imported into
+	Metrics []string
+	// Columns maps metric names, and "ts" for the timestamp, to CSV header names. Only used for FormatCSV.
+	// Metrics which are not mapped are read from a column of the same name, if present.
+	Columns map[string]string
+}
+
+// Rejection describes an input line which could not be imported
+type Rejection struct {
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	Reason string `json:"reason"`
+}
+
+// Result summarizes an import
+type Result struct {
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	// RejectedCount is the total number of rejected lines. Rejected holds at most maxReportedRejections of them.
+	RejectedCount int         `json:"rejectedCount"`
+	Rejected      []Rejection `json:"rejected"`
+}
+
+func (r *Result) reject(line int, text, reason string) {
+	r.RejectedCount++
+	if len(r.Rejected) < maxReportedRejections {
+		r.Rejected = append(r.Rejected, Rejection{Line: line, Text: text, Reason: reason})
+	}
+}
+
+// ParseColumns parses a column mapping of the form "temperature=temp_c,ts=time"
+func ParseColumns(s string) (map[string]string, error) {
+	cols := make(map[string]string)
+	for _, pair := range export.ParseList(s) {
+		metric, column, ok := strings.Cut(pair, "=")
+		if !ok || metric == "" || column == "" {
+			return nil, fmt.Errorf("invalid column mapping %q, expected metric=column", pair)
+		}
+		cols[strings.TrimSpace(metric)] = strings.TrimSpace(column)
+	}
+
+	return cols, nil
+}
+
+// Import reads readings from r and writes them to store in batches.
+// Lines which cannot be parsed are reported in the Result rather than failing the import.
+func Import(r io.Reader, store Store, opts Options) (Result, error) {
+	b := batcher{store: store, deviceID: opts.DeviceID}
+	var err error
+	switch opts.Format {
+	case FormatDriverLog, "":
+		err = parseDriverLog(r, &b)
+	case FormatCSV:
+		err = parseCSV(r, opts.Metrics, opts.Columns, &b)
+	default:
+		return Result{}, fmt.Errorf("unknown import format %q", opts.Format)
+	}
+	if err == nil {
+		err = b.flush()
+	}
+
+	return b.result, err
+}
+
+// batcher buffers parsed readings and writes them to the store batchSize at a time
+type batcher struct {
+	store    Store
+	deviceID uint8
+	pending  []db.Reading
+	result   Result
+}
+
+func (b *batcher) add(r db.Reading) error {
+	b.pending = append(b.pending, r)
+	if len(b.pending) >= batchSize {
+		return b.flush()
+	}
+
+	return nil
+}
+
+func (b *batcher) flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	n, err := b.store.ImportReadings(b.deviceID, b.pending)
+	if err != nil {
+		return err
+	}
+	b.result.Imported += n
+	b.result.Duplicates += len(b.pending) - n
+	b.pending = b.pending[:0]
+
+	return nil
+}
+
+func parseDriverLog(r io.Reader, b *batcher) error {
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !sensor.ValidAtmosphericSensorLine(line) {
+			b.result.reject(lineNo, line, "not a sensor driver line")
+			continue
+		}
+
+		adl := sensor.ParseValidAtmosphericSensorLine(line)
+		if adl.Timestamp.Unix() <= 0 {
+			b.result.reject(lineNo, line, "invalid timestamp")
+			continue
+		}
+		r := db.Reading{Timestamp: adl.Timestamp, Values: make(map[string]float64)}
+		for _, m := range adl.Measurements() {
+			r.Values[m.Metric] = m.Value
+		}
+		if err := b.add(r); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func parseCSV(r io.Reader, metrics []string, columns map[string]string, b *batcher) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("error reading CSV header: %w", err)
+	}
+	index := make(map[string]int, len(header))
+	for i, h := range header {
+		index[strings.TrimSpace(h)] = i
+	}
+
+	tsCol, err := timestampColumn(index, columns)
+	if err != nil {
+		return err
+	}
+	metricCols := make(map[string]int)
+	for _, m := range metrics {
+		name := m
+		if mapped, ok := columns[m]; ok {
+			name = mapped
+		}
+		if i, ok := index[name]; ok {
+			metricCols[m] = i
+		} else if _, ok := columns[m]; ok {
+			return fmt.Errorf("mapped column %q for %s not found in header", name, m)
+		}
+	}
+	for m := range columns {
+		if _, ok := metricCols[m]; !ok && m != "ts" {
+			return fmt.Errorf("unknown metric %q in column mapping", m)
+		}
+	}
+	if len(metricCols) == 0 {
+		return errors.New("no metric columns found in header")
+	}
+
+	lineNo := 1
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		lineNo++
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				b.result.reject(lineNo, "", parseErr.Err.Error())
+				continue
+			}
+			return err
+		}
+
+		text := strings.Join(record, ",")
+		if tsCol >= len(record) {
+			b.result.reject(lineNo, text, "missing timestamp")
+			continue
+		}
+		ts, err := export.ParseTime(strings.TrimSpace(record[tsCol]))
+		if err != nil || ts.Unix() <= 0 {
+			b.result.reject(lineNo, text, "invalid timestamp")
+			continue
+		}
+
+		reading := db.Reading{Timestamp: ts, Values: make(map[string]float64, len(metricCols))}
+		if reason := setValues(reading.Values, record, metricCols); reason != "" {
+			b.result.reject(lineNo, text, reason)
+			continue
+		}
+		if len(reading.Values) == 0 {
+			b.result.reject(lineNo, text, "no values")
+			continue
+		}
+		if err := b.add(reading); err != nil {
+			return err
+		}
+	}
+}
+
+func timestampColumn(index map[string]int, columns map[string]string) (int, error) {
+	if name, ok := columns["ts"]; ok {
+		if i, ok := index[name]; ok {
+			return i, nil
+		}
+		return 0, fmt.Errorf("mapped timestamp column %q not found in header", name)
+	}
+	for _, name := range timestampColumns {
+		if i, ok := index[name]; ok {
+			return i, nil
+		}
+	}
+
+	return 0, errors.New("no timestamp column found in header, map one with ts=<column>")
+}
+
+// setValues fills values from the mapped columns of record, returning a rejection reason on failure.
+// Blank cells are skipped.
+func setValues(values map[string]float64, record []string, metricCols map[string]int) string {
+	for m, i := range metricCols {
+		if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+		if err != nil {
+			return fmt.Sprintf("invalid %s value %q", m, record[i])
+		}
+		values[m] = f
+	}
+
+	return ""
+}
@@ -0,0 +1,108 @@
+package importer
+
+import (
+	"github.com/Heanthor/quill-secure/db"
+	"strings"
+	"testing"
+)
+
+// fakeStore skips readings whose timestamp it has already seen, like the real database
+type fakeStore struct {
+	seen     map[int64]db.Reading
+	deviceID uint8
+}
+
+func (f *fakeStore) ImportReadings(deviceID uint8, mes []db.Reading) (int, error) {
+	f.deviceID = deviceID
+	n := 0
+	for _, m := range mes {
+		if _, ok := f.seen[m.Timestamp.Unix()]; ok {
+			continue
+		}
+		f.seen[m.Timestamp.Unix()] = m
+		n++
+	}
+
+	return n, nil
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		opts         Options
+		want         Result
+		wantTemp     map[int64]float64
+		wantRejected []int
+	}{
+		{
+			name: "driver log with debug output and duplicates",
+			input: "Temperature: 25.2 C\n" +
+				"1660369274,25.25,43.15,1009.12,70.4,0\n" +
+				"\n" +
+				"1660369274,25.25,43.15,1009.12,70.4,0\n" +
+				"0,1,2,3,4,5\n" +
+				"1660369289,26,44,1009,70,12\n",
+			opts:         Options{Format: FormatDriverLog, DeviceID: 3},
+			want:         Result{Imported: 2, Duplicates: 1, RejectedCount: 2},
+			wantTemp:     map[int64]float64{1660369274: 25.25, 1660369289: 26},
+			wantRejected: []int{1, 5},
+		},
+		{
+			name: "csv with column mapping",
+			input: "time,temp_c,humidity\n" +
+				"1660369274,21.5,40\n" +
+				"2022-08-13T05:41:29Z,22,\n" +
+				"yesterday,22,41\n" +
+				"1660369300,warm,41\n",
+			opts: Options{
+				Format:   FormatCSV,
+				DeviceID: 3,
+				Metrics:  []string{"temperature", "humidity"},
+				Columns:  map[string]string{"ts": "time", "temperature": "temp_c"},
+			},
+			want:         Result{Imported: 2, RejectedCount: 2},
+			wantTemp:     map[int64]float64{1660369274: 21.5, 1660369289: 22},
+			wantRejected: []int{4, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{seen: make(map[int64]db.Reading)}
+			got, err := Import(strings.NewReader(tt.input), store, tt.opts)
+			if err != nil {
+				t.Fatalf("Import() error = %v", err)
+			}
+			if got.Imported != tt.want.Imported || got.Duplicates != tt.want.Duplicates || got.RejectedCount != tt.want.RejectedCount {
+				t.Errorf("Import() = %+v, want %+v", got, tt.want)
+			}
+			for i, line := range tt.wantRejected {
+				if i >= len(got.Rejected) || got.Rejected[i].Line != line {
+					t.Errorf("Import() rejected = %+v, want lines %v", got.Rejected, tt.wantRejected)
+					break
+				}
+			}
+			if store.deviceID != tt.opts.DeviceID {
+				t.Errorf("readings attributed to device %d, want %d", store.deviceID, tt.opts.DeviceID)
+			}
+			for ts, temp := range tt.wantTemp {
+				if got := store.seen[ts].Values["temperature"]; got != temp {
+					t.Errorf("temperature at %d = %v, want %v", ts, got, temp)
+				}
+			}
+		})
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	cols, err := ParseColumns("temperature=temp_c, ts=time")
+	if err != nil {
+		t.Fatalf("ParseColumns() error = %v", err)
+	}
+	if cols["temperature"] != "temp_c" || cols["ts"] != "time" {
+		t.Errorf("ParseColumns() = %v", cols)
+	}
+	if _, err := ParseColumns("temperature"); err == nil {
+		t.Errorf("ParseColumns() expected error for missing column")
+	}
+}
@@ -0,0 +1,414 @@
+// Package locations places devices and their sensors in sites, floors and rooms and gives them labels, so that
+// readings can be filtered and grouped by where they were taken.
+package locations
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of location, from outermost to innermost
+const (
+	KindSite  = "site"
+	KindFloor = "floor"
+	KindRoom  = "room"
+)
+
+// Groupings of readings
+const (
+	GroupBySite  = KindSite
+	GroupByFloor = KindFloor
+	GroupByRoom  = KindRoom
+	GroupByLabel = "label"
+)
+
+// Groups of readings with no location or label at the grouped level
+const (
+	Unassigned = "unassigned"
+	Unlabeled  = "unlabeled"
+)
+
+var ErrInvalid = errors.New("invalid location")
+
+// rank orders kinds so a location may only be inside a location of a lower rank
+var rank = map[string]int{KindSite: 0, KindFloor: 1, KindRoom: 2}
+
+type assignmentKey struct {
+	deviceID uint8
+	sensor   string
+}
+
+// Directory holds every location and assignment, resolving where a metric was measured
+type Directory struct {
+	db *db.DB
+
+	lock        sync.RWMutex
+	locations   map[int64]db.Location
+	assignments map[assignmentKey]db.Assignment
+}
+
+func New(d *db.DB) (*Directory, error) {
+	dir := &Directory{db: d}
+	if err := dir.load(); err != nil {
+		return nil, err
+	}
+	log.Info().Int("locations", len(dir.locations)).Int("assignments", len(dir.assignments)).Msg("Locations loaded")
+
+	return dir, nil
+}
+
+func (d *Directory) load() error {
+	locs, err := d.db.Locations()
+	if err != nil {
+		return fmt.Errorf("error loading locations: %w", err)
+	}
+	as, err := d.db.Assignments()
+	if err != nil {
+		return fmt.Errorf("error loading assignments: %w", err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.locations = make(map[int64]db.Location, len(locs))
+	for _, l := range locs {
+		d.locations[l.ID] = l
+	}
+	d.assignments = make(map[assignmentKey]db.Assignment, len(as))
+	for _, a := range as {
+		d.assignments[assignmentKey{deviceID: a.DeviceID, sensor: a.Sensor}] = a
+	}
+
+	return nil
+}
+
+// Locations returns every location, ordered by ID
+func (d *Directory) Locations() []db.Location {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	out := make([]db.Location, 0, len(d.locations))
+	for _, l := range d.locations {
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+
+	return out
+}
+
+// validate checks l's kind and that it fits inside its parent. Call with lock held.
+func (d *Directory) validate(l db.Location) error {
+	if l.Name == "" {
+		return fmt.Errorf("%w: name cannot be blank", ErrInvalid)
+	}
+	r, ok := rank[l.Kind]
+	if !ok {
+		return fmt.Errorf("%w: unknown kind %q, must be %s, %s or %s", ErrInvalid, l.Kind, KindSite, KindFloor, KindRoom)
+	}
+	if l.ParentID == nil {
+		return nil
+	}
+	if l.Kind == KindSite {
+		return fmt.Errorf("%w: a site cannot be inside another location", ErrInvalid)
+	}
+	parent, ok := d.locations[*l.ParentID]
+	if !ok {
+		return fmt.Errorf("%w: parent %d does not exist", ErrInvalid, *l.ParentID)
+	}
+	if rank[parent.Kind] >= r {
+		return fmt.Errorf("%w: a %s cannot be inside a %s", ErrInvalid, l.Kind, parent.Kind)
+	}
+
+	return nil
+}
+
+// CreateLocation validates and stores a new location
+func (d *Directory) CreateLocation(l db.Location) (db.Location, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	l.Name = strings.TrimSpace(l.Name)
+	if err := d.validate(l); err != nil {
+		return db.Location{}, err
+	}
+
+	l, err := d.db.CreateLocation(l)
+	if err != nil {
+		return db.Location{}, err
+	}
+	d.locations[l.ID] = l
+
+	return l, nil
+}
+
+// UpdateLocation validates and replaces the location with l.ID
+func (d *Directory) UpdateLocation(l db.Location) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.locations[l.ID]; !ok {
+		return fmt.Errorf("UpdateLocation: %w", db.ErrNotFound)
+	}
+	l.Name = strings.TrimSpace(l.Name)
+	if err := d.validate(l); err != nil {
+		return err
+	}
+	// a location's kind may not change to one which no longer fits around what is inside it
+	for _, child := range d.locations {
+		if child.ParentID != nil && *child.ParentID == l.ID && rank[child.Kind] <= rank[l.Kind] {
+			return fmt.Errorf("%w: %s %q is inside it", ErrInvalid, child.Kind, child.Name)
+		}
+	}
+
+	if err := d.db.UpdateLocation(l); err != nil {
+		return err
+	}
+	d.locations[l.ID] = l
+
+	return nil
+}
+
+// DeleteLocation deletes a location. Locations inside it move to its parent, and devices assigned to it are
+// left without a location.
+func (d *Directory) DeleteLocation(id int64) error {
+	if err := d.db.DeleteLocation(id); err != nil {
+		return err
+	}
+
+	return d.load()
+}
+
+// Assignments returns every assignment, ordered by device and sensor
+func (d *Directory) Assignments() []db.Assignment {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	out := make([]db.Assignment, 0, len(d.assignments))
+	for _, a := range d.assignments {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].DeviceID != out[j].DeviceID {
+			return out[i].DeviceID < out[j].DeviceID
+		}
+		return out[i].Sensor < out[j].Sensor
+	})
+
+	return out
+}
+
+// SetAssignment places a device or sensor in a location with labels, replacing its previous assignment
+func (d *Directory) SetAssignment(a db.Assignment) (db.Assignment, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if a.LocationID != nil {
+		if _, ok := d.locations[*a.LocationID]; !ok {
+			return db.Assignment{}, fmt.Errorf("%w: location %d does not exist", ErrInvalid, *a.LocationID)
+		}
+	}
+	labels := []string{}
+	for _, l := range a.Labels {
+		l = strings.TrimSpace(l)
+		if strings.Contains(l, ",") {
+			return db.Assignment{}, fmt.Errorf("%w: label %q cannot contain a comma", ErrInvalid, l)
+		}
+		if l != "" {
+			labels = append(labels, l)
+		}
+	}
+	a.Labels = labels
+
+	if err := d.db.SetAssignment(a); err != nil {
+		return db.Assignment{}, err
+	}
+	d.assignments[assignmentKey{deviceID: a.DeviceID, sensor: a.Sensor}] = a
+
+	return a, nil
+}
+
+// DeleteAssignment removes the assignment of a device or sensor
+func (d *Directory) DeleteAssignment(deviceID uint8, sensor string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.db.DeleteAssignment(deviceID, sensor); err != nil {
+		return err
+	}
+	delete(d.assignments, assignmentKey{deviceID: deviceID, sensor: sensor})
+
+	return nil
+}
+
+// Place is where a metric was measured
+type Place struct {
+	// Locations is the location chain from the site inwards, ending at the assigned location
+	Locations []db.Location
+	Labels    []string
+}
+
+// Path names the place's locations from the site inwards, e.g. Home/Ground floor/Kitchen
+func (p Place) Path() string {
+	names := make([]string, len(p.Locations))
+	for i, l := range p.Locations {
+		names[i] = l.Name
+	}
+
+	return strings.Join(names, "/")
+}
+
+// Place returns where metric of deviceID was measured. A sensor instance's assignment, taken from the metric's
+// instance prefix, overrides the location of its device's assignment, and the labels of both apply.
+func (d *Directory) Place(deviceID uint8, metric string) Place {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.place(deviceID, sensorOf(metric))
+}
+
+// place resolves the place of a sensor instance, or of the whole device if sensor is blank. Call with lock held.
+func (d *Directory) place(deviceID uint8, sensor string) Place {
+	var p Place
+	device, deviceOK := d.assignments[assignmentKey{deviceID: deviceID}]
+	locationID := device.LocationID
+	if deviceOK {
+		p.Labels = append(p.Labels, device.Labels...)
+	}
+	if sensor != "" {
+		if s, ok := d.assignments[assignmentKey{deviceID: deviceID, sensor: sensor}]; ok {
+			if s.LocationID != nil {
+				locationID = s.LocationID
+			}
+			for _, l := range s.Labels {
+				if !contains(p.Labels, l) {
+					p.Labels = append(p.Labels, l)
+				}
+			}
+		}
+	}
+
+	// walk out to the site, guarding against a cycle left by direct database edits
+	for id := locationID; id != nil && len(p.Locations) < len(rank); {
+		l, ok := d.locations[*id]
+		if !ok {
+			break
+		}
+		p.Locations = append([]db.Location{l}, p.Locations...)
+		id = l.ParentID
+	}
+
+	return p
+}
+
+// sensorOf returns the sensor instance prefix of a metric, blank for the default instance
+func sensorOf(metric string) string {
+	if i := strings.LastIndex(metric, "."); i >= 0 {
+		return metric[:i]
+	}
+
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter selects readings by where they were measured. A zero Filter selects everything.
+type Filter struct {
+	// LocationID selects readings in a location or any location inside it
+	LocationID int64
+	// Labels selects readings with every one of the labels
+	Labels []string
+}
+
+func (f Filter) IsZero() bool {
+	return f.LocationID == 0 && len(f.Labels) == 0
+}
+
+func (f Filter) matches(p Place) bool {
+	if f.LocationID != 0 {
+		found := false
+		for _, l := range p.Locations {
+			found = found || l.ID == f.LocationID
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, l := range f.Labels {
+		if !contains(p.Labels, l) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Matches reports whether metric of deviceID was measured where f selects
+func (d *Directory) Matches(deviceID uint8, metric string, f Filter) bool {
+	if f.IsZero() {
+		return true
+	}
+
+	return f.matches(d.Place(deviceID, metric))
+}
+
+// DeviceIDs returns the devices which are, or have a sensor which is, where f selects, ordered by ID
+func (d *Directory) DeviceIDs(f Filter) []uint8 {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	seen := make(map[uint8]bool)
+	for k := range d.assignments {
+		if !seen[k.deviceID] && f.matches(d.place(k.deviceID, k.sensor)) {
+			seen[k.deviceID] = true
+		}
+	}
+	out := make([]uint8, 0, len(seen))
+	for id := range seen {
+		out = append(out, id)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i] < out[j]
+	})
+
+	return out
+}
+
+// ValidateGroupBy checks a grouping
+func ValidateGroupBy(groupBy string) error {
+	switch groupBy {
+	case GroupBySite, GroupByFloor, GroupByRoom, GroupByLabel:
+		return nil
+	}
+
+	return fmt.Errorf("unknown groupBy %q, must be %s, %s, %s or %s", groupBy, GroupBySite, GroupByFloor, GroupByRoom, GroupByLabel)
+}
+
+// Groups returns the groups metric of deviceID belongs to when grouped by groupBy. Readings belong to the group
+// of each of their labels, and to the location of the grouped kind their location is in, named by its path.
+func (d *Directory) Groups(deviceID uint8, metric, groupBy string) []string {
+	p := d.Place(deviceID, metric)
+	if groupBy == GroupByLabel {
+		if len(p.Labels) == 0 {
+			return []string{Unlabeled}
+		}
+		return p.Labels
+	}
+
+	for i, l := range p.Locations {
+		if l.Kind == groupBy {
+			return []string{Place{Locations: p.Locations[:i+1]}.Path()}
+		}
+	}
+
+	return []string{Unassigned}
+}
@@ -0,0 +1,268 @@
+package locations
+
+import (
+	"errors"
+	"github.com/Heanthor/quill-secure/db"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestDirectory(t *testing.T) (*Directory, *db.DB) {
+	t.Helper()
+	d, err := db.NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(d.Close)
+	dir, err := New(d)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	return dir, d
+}
+
+func id(i int64) *int64 {
+	return &i
+}
+
+// house creates Home (1) with floors Ground (2) and Upstairs (3), and rooms Kitchen (4) on Ground and
+// Bedroom (5) upstairs
+func house(t *testing.T, dir *Directory) {
+	t.Helper()
+	for _, l := range []db.Location{
+		{Name: "Home", Kind: KindSite},
+		{Name: "Ground", Kind: KindFloor, ParentID: id(1)},
+		{Name: "Upstairs", Kind: KindFloor, ParentID: id(1)},
+		{Name: " Kitchen ", Kind: KindRoom, ParentID: id(2)},
+		{Name: "Bedroom", Kind: KindRoom, ParentID: id(3)},
+	} {
+		if _, err := dir.CreateLocation(l); err != nil {
+			t.Fatalf("CreateLocation(%s) error = %v", l.Name, err)
+		}
+	}
+}
+
+func TestDirectory_CreateLocation(t *testing.T) {
+	dir, _ := newTestDirectory(t)
+	house(t, dir)
+
+	tests := []struct {
+		name string
+		l    db.Location
+	}{
+		{"blank name", db.Location{Name: " ", Kind: KindRoom}},
+		{"unknown kind", db.Location{Name: "Attic", Kind: "loft"}},
+		{"site inside site", db.Location{Name: "Cabin", Kind: KindSite, ParentID: id(1)}},
+		{"floor inside room", db.Location{Name: "Mezzanine", Kind: KindFloor, ParentID: id(4)}},
+		{"room inside room", db.Location{Name: "Pantry", Kind: KindRoom, ParentID: id(4)}},
+		{"missing parent", db.Location{Name: "Garage", Kind: KindRoom, ParentID: id(99)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := dir.CreateLocation(tt.l); !errors.Is(err, ErrInvalid) {
+				t.Errorf("CreateLocation() error = %v, want ErrInvalid", err)
+			}
+		})
+	}
+
+	// a room may sit directly in a site
+	if _, err := dir.CreateLocation(db.Location{Name: "Shed", Kind: KindRoom, ParentID: id(1)}); err != nil {
+		t.Errorf("CreateLocation() room in site error = %v", err)
+	}
+	// a floor with rooms cannot become a room
+	if err := dir.UpdateLocation(db.Location{ID: 2, Name: "Ground", Kind: KindRoom, ParentID: id(1)}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("UpdateLocation() error = %v, want ErrInvalid", err)
+	}
+	if err := dir.UpdateLocation(db.Location{ID: 42, Name: "Nowhere", Kind: KindSite}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("UpdateLocation() missing error = %v, want ErrNotFound", err)
+	}
+}
+
+// assign puts device 1 in the Kitchen, with its bedroom sensor in the Bedroom and its outside sensor labeled
+// outdoor, and device 2 upstairs
+func assign(t *testing.T, dir *Directory) {
+	t.Helper()
+	for _, a := range []db.Assignment{
+		{DeviceID: 1, LocationID: id(4), Labels: []string{"downstairs", " indoor"}},
+		{DeviceID: 1, Sensor: "bedroom", LocationID: id(5), Labels: []string{"indoor", "sleep"}},
+		{DeviceID: 1, Sensor: "outside", Labels: []string{"outdoor"}},
+		{DeviceID: 2, LocationID: id(3)},
+	} {
+		if _, err := dir.SetAssignment(a); err != nil {
+			t.Fatalf("SetAssignment() error = %v", err)
+		}
+	}
+}
+
+func TestDirectory_Place(t *testing.T) {
+	dir, d := newTestDirectory(t)
+	house(t, dir)
+	assign(t, dir)
+	if _, err := dir.SetAssignment(db.Assignment{DeviceID: 3, LocationID: id(99)}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("SetAssignment() missing location error = %v", err)
+	}
+
+	tests := []struct {
+		deviceID   uint8
+		metric     string
+		wantPath   string
+		wantLabels []string
+		wantGroups map[string][]string
+	}{
+		{
+			deviceID: 1, metric: "temperature", wantPath: "Home/Ground/Kitchen", wantLabels: []string{"downstairs", "indoor"},
+			wantGroups: map[string][]string{GroupByFloor: {"Home/Ground"}, GroupByLabel: {"downstairs", "indoor"}},
+		},
+		{
+			deviceID: 1, metric: "bedroom.temperature", wantPath: "Home/Upstairs/Bedroom", wantLabels: []string{"downstairs", "indoor", "sleep"},
+			wantGroups: map[string][]string{GroupByRoom: {"Home/Upstairs/Bedroom"}, GroupBySite: {"Home"}},
+		},
+		{
+			// a sensor without a location of its own is where its device is
+			deviceID: 1, metric: "outside.temperature", wantPath: "Home/Ground/Kitchen", wantLabels: []string{"downstairs", "indoor", "outdoor"},
+		},
+		{
+			deviceID: 2, metric: "humidity", wantPath: "Home/Upstairs",
+			wantGroups: map[string][]string{GroupByRoom: {Unassigned}, GroupByFloor: {"Home/Upstairs"}, GroupByLabel: {Unlabeled}},
+		},
+		{
+			deviceID: 3, metric: "humidity", wantPath: "",
+			wantGroups: map[string][]string{GroupBySite: {Unassigned}},
+		},
+	}
+	for _, tt := range tests {
+		p := dir.Place(tt.deviceID, tt.metric)
+		if p.Path() != tt.wantPath || !reflect.DeepEqual(p.Labels, tt.wantLabels) {
+			t.Errorf("Place(%d, %s) = %s %v, want %s %v", tt.deviceID, tt.metric, p.Path(), p.Labels, tt.wantPath, tt.wantLabels)
+		}
+		for by, want := range tt.wantGroups {
+			if got := dir.Groups(tt.deviceID, tt.metric, by); !reflect.DeepEqual(got, want) {
+				t.Errorf("Groups(%d, %s, %s) = %v, want %v", tt.deviceID, tt.metric, by, got, want)
+			}
+		}
+	}
+
+	// deleting a floor moves its rooms to the site and unassigns its devices, and survives a reload
+	if err := dir.DeleteLocation(3); err != nil {
+		t.Fatalf("DeleteLocation() error = %v", err)
+	}
+	dir, err := New(d)
+	if err != nil {
+		t.Fatalf("New() reload error = %v", err)
+	}
+	if got := dir.Place(1, "bedroom.humidity").Path(); got != "Home/Bedroom" {
+		t.Errorf("Place() after delete = %s, want Home/Bedroom", got)
+	}
+	if got := dir.Place(2, "humidity").Path(); got != "" {
+		t.Errorf("Place() of unassigned device = %s, want none", got)
+	}
+	if err := dir.DeleteAssignment(1, "outside"); err != nil {
+		t.Fatalf("DeleteAssignment() error = %v", err)
+	}
+	if err := dir.DeleteAssignment(1, "outside"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("DeleteAssignment() twice error = %v", err)
+	}
+	if got := len(dir.Assignments()); got != 3 {
+		t.Errorf("Assignments() = %d, want 3", got)
+	}
+}
+
+func TestDirectory_Groups(t *testing.T) {
+	dir, _ := newTestDirectory(t)
+	house(t, dir)
+	assign(t, dir)
+
+	tests := []struct {
+		deviceID uint8
+		metric   string
+		groupBy  string
+		want     []string
+	}{
+		{1, "temperature", GroupBySite, []string{"Home"}},
+		{1, "temperature", GroupByFloor, []string{"Home/Ground"}},
+		{1, "temperature", GroupByRoom, []string{"Home/Ground/Kitchen"}},
+		{1, "temperature", GroupByLabel, []string{"downstairs", "indoor"}},
+		{1, "bedroom.temperature", GroupByFloor, []string{"Home/Upstairs"}},
+		{1, "bedroom.temperature", GroupByLabel, []string{"downstairs", "indoor", "sleep"}},
+		// a sensor without a location of its own is grouped with its device
+		{1, "outside.temperature", GroupByRoom, []string{"Home/Ground/Kitchen"}},
+		// device 2 is on a floor but in no room
+		{2, "humidity", GroupByFloor, []string{"Home/Upstairs"}},
+		{2, "humidity", GroupByRoom, []string{Unassigned}},
+		{2, "humidity", GroupByLabel, []string{Unlabeled}},
+		{3, "humidity", GroupBySite, []string{Unassigned}},
+	}
+	for _, tt := range tests {
+		if got := dir.Groups(tt.deviceID, tt.metric, tt.groupBy); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Groups(%d, %s, %s) = %v, want %v", tt.deviceID, tt.metric, tt.groupBy, got, tt.want)
+		}
+	}
+	if err := ValidateGroupBy("building"); err == nil {
+		t.Errorf("ValidateGroupBy(building) error = nil")
+	}
+}
+
+func TestDirectory_Matches(t *testing.T) {
+	dir, _ := newTestDirectory(t)
+	house(t, dir)
+	assign(t, dir)
+
+	tests := []struct {
+		name     string
+		f        Filter
+		deviceID uint8
+		metric   string
+		want     bool
+	}{
+		{"zero filter", Filter{}, 9, "temperature", true},
+		{"site contains room", Filter{LocationID: 1}, 1, "temperature", true},
+		{"floor contains room", Filter{LocationID: 2}, 1, "temperature", true},
+		{"other floor", Filter{LocationID: 3}, 1, "temperature", false},
+		{"sensor in its own room", Filter{LocationID: 5}, 1, "bedroom.temperature", true},
+		{"sensor not in device room", Filter{LocationID: 4}, 1, "bedroom.temperature", false},
+		{"device label", Filter{Labels: []string{"downstairs"}}, 1, "temperature", true},
+		{"device label applies to its sensors", Filter{Labels: []string{"downstairs"}}, 1, "outside.temperature", true},
+		{"sensor label", Filter{Labels: []string{"outdoor"}}, 1, "outside.temperature", true},
+		{"sensor label not on device", Filter{Labels: []string{"outdoor"}}, 1, "temperature", false},
+		{"sensor label not on other sensors", Filter{Labels: []string{"outdoor"}}, 1, "bedroom.temperature", false},
+		{"every label", Filter{Labels: []string{"indoor", "sleep"}}, 1, "bedroom.temperature", true},
+		{"missing one label", Filter{Labels: []string{"indoor", "sleep"}}, 1, "temperature", false},
+		{"location and label", Filter{LocationID: 2, Labels: []string{"downstairs"}}, 1, "temperature", true},
+		{"unassigned device", Filter{LocationID: 1}, 3, "temperature", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dir.Matches(tt.deviceID, tt.metric, tt.f); got != tt.want {
+				t.Errorf("Matches(%d, %s, %+v) = %v, want %v", tt.deviceID, tt.metric, tt.f, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectory_DeviceIDs(t *testing.T) {
+	dir, _ := newTestDirectory(t)
+	house(t, dir)
+	assign(t, dir)
+
+	tests := []struct {
+		f    Filter
+		want []uint8
+	}{
+		{Filter{LocationID: 1}, []uint8{1, 2}},
+		// device 1 has a sensor upstairs
+		{Filter{LocationID: 3}, []uint8{1, 2}},
+		{Filter{LocationID: 5}, []uint8{1}},
+		{Filter{LocationID: 4}, []uint8{1}},
+		{Filter{Labels: []string{"outdoor"}}, []uint8{1}},
+		{Filter{Labels: []string{"indoor", "sleep"}}, []uint8{1}},
+		{Filter{LocationID: 2, Labels: []string{"downstairs"}}, []uint8{1}},
+		{Filter{Labels: []string{"garden"}}, []uint8{}},
+	}
+	for _, tt := range tests {
+		if got := dir.DeviceIDs(tt.f); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DeviceIDs(%+v) = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
@@ -5,8 +5,19 @@ import (
 	"fmt"
 	"github.com/Heanthor/quill-secure/boot"
 	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alarm"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"github.com/Heanthor/quill-secure/leader/anomaly"
 	"github.com/Heanthor/quill-secure/leader/api"
+	"github.com/Heanthor/quill-secure/leader/atmosphere"
+	"github.com/Heanthor/quill-secure/leader/backup"
+	"github.com/Heanthor/quill-secure/leader/calibration"
+	"github.com/Heanthor/quill-secure/leader/derived"
+	"github.com/Heanthor/quill-secure/leader/locations"
+	"github.com/Heanthor/quill-secure/leader/metrics"
 	"github.com/Heanthor/quill-secure/leader/net"
+	"github.com/Heanthor/quill-secure/leader/notify"
+	"github.com/Heanthor/quill-secure/leader/units"
 	"github.com/Heanthor/quill-secure/node/sensor"
 	"github.com/mitchellh/go-homedir"
 	"github.com/rs/zerolog"
@@ -16,6 +27,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -42,8 +54,22 @@ func main() {
 		zerolog.SetGlobalLevel(level)
 	}
 
+	if len(os.Args) > 1 {
+		ok, err := runCommand(os.Args[1], os.Args[2:])
+		if !ok {
+			err = usageError("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal().Err(err).Str("command", os.Args[1]).Msg("Command failed")
+		}
+		return
+	}
+
 	log.Info().Str("env", env).Msg("QuillSecure Leader booting...")
 	gob.Register(sensor.Data{})
+	gob.Register(sensor.NodeStatus{})
+	gob.Register(sensor.ErrorReport{})
+	gob.Register(sensor.Event{})
 
 	d, err := db.NewDB(viper.GetString("dbFile"))
 	if err != nil {
@@ -59,7 +85,122 @@ func main() {
 		log.Fatal().Err(err).Msg("Error initializing listener")
 	}
 
-	a := api.NewRouter(env, d, n.ActiveNodesFunc(), viper.GetInt("api.dashboardStatsDays"))
+	calibrator, err := calibration.New(d)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error initializing calibrations")
+	}
+	n.SetCalibration(calibrator.Calibrate)
+	deriver := derived.New()
+	n.AddDerived(func(deviceID, _ uint8, ts time.Time, ms []sensor.Measurement) []sensor.Measurement {
+		return deriver.Derive(deviceID, ts, ms)
+	})
+	var atmosphereConfig atmosphere.Config
+	if err := viper.UnmarshalKey("atmosphere", &atmosphereConfig); err != nil {
+		log.Fatal().Err(err).Msg("Invalid atmosphere config")
+	}
+	atm, err := atmosphere.New(atmosphereConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid atmosphere config")
+	}
+	n.AddDerived(atm.Derive)
+	atm.Start()
+
+	var backups *backup.Manager
+	if cfg := backupConfig(); cfg.Dir != "" {
+		backups, err = backup.NewManager(d, cfg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing backups")
+		}
+		backups.StartSchedule()
+	}
+
+	var alm *alarm.Alarm
+	if viper.GetString("alarm.pin") != "" {
+		cfg, err := alarmConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid alarm config")
+		}
+		alm, err = alarm.New(d, cfg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing alarm")
+		}
+		n.OnEvent(alm.HandleEvent)
+		alm.Start()
+	}
+
+	alertEngine, err := alerts.New(d)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error initializing alert rules")
+	}
+	n.OnMeasurements(func(deviceID, _ uint8, ts time.Time, ms []sensor.Measurement) {
+		alertEngine.Evaluate(deviceID, ts, ms)
+	})
+
+	var anomalyConfig anomaly.Config
+	if err := viper.UnmarshalKey("anomaly", &anomalyConfig); err != nil {
+		log.Fatal().Err(err).Msg("Invalid anomaly config")
+	}
+	if !anomalyConfig.Disabled {
+		detector, err := anomaly.New(d, anomalyConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid anomaly config")
+		}
+		n.OnMeasurements(detector.HandleMeasurements)
+	}
+
+	unitPrefs, err := units.ForSystem(viper.GetString("api.units"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid api.units config")
+	}
+
+	var notifierConfigs []notify.Config
+	if err := viper.UnmarshalKey("notifiers", &notifierConfigs); err != nil {
+		log.Fatal().Err(err).Msg("Invalid notifiers config")
+	}
+	dispatcher, err := notify.NewDispatcher(d, notifierConfigs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error initializing notifiers")
+	}
+	dispatcher.Start()
+	alertEngine.OnChange(func(event string, a db.Alert, r db.AlertRule) {
+		dispatcher.Dispatch(notify.FromAlert(event, alerts.InUnits(a, unitPrefs)), r.Notifiers)
+	})
+
+	var offlineConfig alerts.OfflineConfig
+	if err := viper.UnmarshalKey("nodeOffline", &offlineConfig); err != nil {
+		log.Fatal().Err(err).Msg("Invalid nodeOffline config")
+	}
+	offline, err := alerts.NewOfflineMonitor(alertEngine, offlineConfig, nodesSeen(n.NodesFunc()))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error initializing node offline alerts")
+	}
+	offline.Start()
+
+	metrics.RegisterActiveNodes(n.ActiveNodesFunc())
+	metrics.RegisterQueueDepth(n.QueueDepth)
+
+	dir, err := locations.New(d)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error initializing locations")
+	}
+
+	a := api.NewRouter(api.Config{
+		Env:                env,
+		DB:                 d,
+		ActiveNodes:        n.ActiveNodesFunc(),
+		Nodes:              n.NodesFunc(),
+		DashboardStatsDays: viper.GetInt("api.dashboardStatsDays"),
+		AdminToken:         viper.GetString("api.adminToken"),
+		Backups:            backups,
+		Alarm:              alm,
+		Alerts:             alertEngine,
+		Notifiers:          dispatcher,
+		Offline:            offline,
+		Units:              unitPrefs,
+		Calibrations:       calibrator,
+		Atmosphere:         atm,
+		Locations:          dir,
+	})
 	go func() {
 		port := viper.GetInt("api.port")
 		log.Info().Int("port", port).Msg("API initialized")
@@ -78,8 +219,36 @@ func main() {
 	}
 }
 
+// alarmConfig reads the alarm section of the config
+func alarmConfig() (alarm.Config, error) {
+	var zones []alarm.Zone
+	if err := viper.UnmarshalKey("alarm.zones", &zones); err != nil {
+		return alarm.Config{}, fmt.Errorf("alarm.zones: %w", err)
+	}
+
+	return alarm.Config{
+		PIN:        viper.GetString("alarm.pin"),
+		ExitDelay:  time.Duration(viper.GetInt("alarm.exitDelaySecs")) * time.Second,
+		EntryDelay: time.Duration(viper.GetInt("alarm.entryDelaySecs")) * time.Second,
+		Zones:      zones,
+	}, nil
+}
+
+// nodesSeen adapts the node list for the offline monitor
+func nodesSeen(nodes net.NodesFunc) func() []alerts.NodeSeen {
+	return func() []alerts.NodeSeen {
+		ns := nodes()
+		out := make([]alerts.NodeSeen, len(ns))
+		for i, n := range ns {
+			out[i] = alerts.NodeSeen{DeviceID: n.DeviceID, LastSeenAt: n.LastSeenAt}
+		}
+
+		return out
+	}
+}
+
 func registerCloseHandler(net *net.LeaderNet, d *db.DB) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+const namespace = "quillsecure_leader"
+
+var (
+	// SensorValue holds the latest value reported for each device and metric
+	SensorValue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sensor_value",
+		Help:      "Latest sensor value reported by a device.",
+	}, []string{"device_id", "metric"})
+
+	// SensorRestarts holds the number of times each sensor process has been restarted, as reported by nodes
+	SensorRestarts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sensor_restarts",
+		Help:      "Number of times a node has restarted a sensor process.",
+	}, []string{"device_id", "sensor"})
+
+	// SensorHealth holds the health of each sensor as reported by nodes, 1 healthy, 2 degraded, 3 failed
+	SensorHealth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sensor_health",
+		Help:      "Health of a node's sensor: 0 unknown, 1 healthy, 2 degraded, 3 failed.",
+	}, []string{"device_id", "sensor"})
+
+	// SensorErrors counts errors reported by each sensor on each node
+	SensorErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sensor_errors_total",
+		Help:      "Number of errors reported by a node's sensor.",
+	}, []string{"device_id", "sensor"})
+
+	// AlarmState is 1 for the current state of the alarm, and 0 for every other state
+	AlarmState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "alarm_state",
+		Help:      "Current alarm state, 1 for the state the alarm is in.",
+	}, []string{"state"})
+
+	// PacketsIngested counts packets received from nodes, by packet type
+	PacketsIngested = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_ingested_total",
+		Help:      "Number of packets received from nodes.",
+	}, []string{"type"})
+
+	// DecodeErrors counts packets or sensor payloads which could not be decoded
+	DecodeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decode_errors_total",
+		Help:      "Number of packets or sensor payloads which failed to decode.",
+	}, []string{"stage"})
+
+	// DBWriteLatency tracks how long database writes take
+	DBWriteLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_write_duration_seconds",
+		Help:      "Latency of database writes.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	}, []string{"op"})
+
+	// HTTPLatency tracks API handler latency by route pattern
+	HTTPLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of API requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+)
+
+// RegisterActiveNodes exposes the active node count, computed on every scrape.
+func RegisterActiveNodes(f func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_nodes",
+		Help:      "Number of nodes currently sending data to the leader.",
+	}, func() float64 {
+		return float64(f())
+	}))
+}
+
+// RegisterQueueDepth exposes the depth of the incoming datapoints queue, computed on every scrape.
+func RegisterQueueDepth(f func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "datapoints_queue_depth",
+		Help:      "Number of sensor readouts waiting to be processed.",
+	}, func() float64 {
+		return float64(f())
+	}))
+}
+
+// SetSensorValue records the latest value of metric for deviceID
+func SetSensorValue(deviceID uint8, metric string, value float64) {
+	SensorValue.WithLabelValues(strconv.Itoa(int(deviceID)), metric).Set(value)
+}
+
+// ObserveDBWrite records the time since start as a write of type op
+func ObserveDBWrite(op string, start time.Time) {
+	DBWriteLatency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// alarmStates lists every alarm state, so the gauge of states the alarm is not in reads 0
+var alarmStates = []string{"disarmed", "arming", "armed_home", "armed_away", "pending", "triggered"}
+
+// SetAlarmState marks state as the current alarm state
+func SetAlarmState(state string) {
+	for _, s := range alarmStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		AlarmState.WithLabelValues(s).Set(v)
+	}
+}
@@ -3,10 +3,12 @@ package net
 import (
 	"fmt"
 	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/metrics"
 	mynet "github.com/Heanthor/quill-secure/net"
 	"github.com/Heanthor/quill-secure/node/sensor"
 	"github.com/rs/zerolog/log"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -28,14 +30,39 @@ type LeaderNet struct {
 
 	datapoints chan SensorData
 	nodeLock   sync.Mutex
+	// declaredMetrics caches metrics declared in node announces which have been registered, guarded by nodeLock
+	declaredMetrics map[string]sensor.Metric
+
+	handlerLock         sync.Mutex
+	eventHandlers       []EventHandler
+	measurementHandlers []MeasurementHandler
+	derivers            []DeriveFunc
+	calibrate           CalibrateFunc
 }
 
+// EventHandler is called with each sensor event received from a node
+type EventHandler func(deviceID uint8, e sensor.Event)
+
+// MeasurementHandler is called with the measurements of each sensor readout received from a node, and the type of
+// the sensor which took them
+type MeasurementHandler func(deviceID, sensorType uint8, ts time.Time, ms []sensor.Measurement)
+
+// CalibrateFunc returns the measurements of a sensor readout corrected for the device, and the raw values of
+// those which were corrected
+type CalibrateFunc func(deviceID uint8, ms []sensor.Measurement) ([]sensor.Measurement, []sensor.Measurement)
+
+// DeriveFunc returns measurements computed from those of a readout by a sensor of sensorType, which are stored
+// alongside them. A derived measurement replaces a reported measurement of the same metric.
+type DeriveFunc func(deviceID, sensorType uint8, ts time.Time, ms []sensor.Measurement) []sensor.Measurement
+
 type remoteNode struct {
 	DeviceID uint8
 	// TODO this should be a list
 	SensorType uint8
 	Active     bool
 	LastSeenAt time.Time
+	// Sensors is the sensor status from the most recent announce
+	Sensors []sensor.Status
 }
 
 type SensorData struct {
@@ -59,6 +86,7 @@ func NewLeaderNet(port, nodePingTimeoutSecs int, db *db.DB) (*LeaderNet, error)
 		datapoints:          make(chan SensorData, 100),
 		seenNodes:           make(map[uint8]remoteNode),
 		nodePingTimeoutSecs: nodePingTimeoutSecs,
+		declaredMetrics:     make(map[string]sensor.Metric),
 	}, nil
 }
 
@@ -103,6 +131,82 @@ func (l *LeaderNet) ActiveNodesFunc() ActiveNodesFunc {
 	}
 }
 
+// NodeInfo describes a node which has announced itself to the leader
+type NodeInfo struct {
+	DeviceID   uint8        `json:"deviceID"`
+	Active     bool         `json:"active"`
+	LastSeenAt time.Time    `json:"lastSeenAt"`
+	Sensors    []SensorInfo `json:"sensors"`
+	// OfflineAlert is the node's offline alert state, such as online, warning or unmonitored, filled in by the API
+	OfflineAlert string `json:"offlineAlert,omitempty"`
+}
+
+// SensorInfo is the most recently announced status of a sensor on a node
+type SensorInfo struct {
+	Type         string        `json:"type"`
+	Name         string        `json:"name"`
+	Health       sensor.Health `json:"health"`
+	HealthReason string        `json:"healthReason,omitempty"`
+	LastDataAt   *time.Time    `json:"lastDataAt"`
+	RecentErrors int           `json:"recentErrors"`
+	Restarts     int           `json:"restarts"`
+}
+
+type NodesFunc func() []NodeInfo
+
+// NodesFunc returns a function which lists every node seen since the leader started, ordered by device ID.
+func (l *LeaderNet) NodesFunc() NodesFunc {
+	return func() []NodeInfo {
+		l.nodeLock.Lock()
+		defer l.nodeLock.Unlock()
+
+		nodes := make([]NodeInfo, 0, len(l.seenNodes))
+		for _, n := range l.seenNodes {
+			nodes = append(nodes, n.info())
+		}
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].DeviceID < nodes[j].DeviceID
+		})
+
+		return nodes
+	}
+}
+
+func (n remoteNode) info() NodeInfo {
+	info := NodeInfo{
+		DeviceID:   n.DeviceID,
+		Active:     n.Active,
+		LastSeenAt: n.LastSeenAt,
+		Sensors:    make([]SensorInfo, len(n.Sensors)),
+	}
+	for i, st := range n.Sensors {
+		si := SensorInfo{
+			Type:         sensor.NameByType(int(st.Typ)),
+			Name:         st.Name,
+			Health:       st.Health,
+			HealthReason: st.HealthReason,
+			RecentErrors: st.RecentErrors,
+			Restarts:     st.Restarts,
+		}
+		if !st.LastDataAt.IsZero() {
+			lastData := st.LastDataAt
+			si.LastDataAt = &lastData
+		}
+		// a node which has gone offline can no longer vouch for its sensors
+		if !n.Active && si.Health == sensor.HealthHealthy {
+			si.Health = sensor.HealthUnknown
+		}
+		info.Sensors[i] = si
+	}
+
+	return info
+}
+
+// QueueDepth returns the number of sensor readouts waiting to be processed
+func (l *LeaderNet) QueueDepth() int {
+	return len(l.datapoints)
+}
+
 // nodeAgeWorker blocks and checks time since last ping from all connected sensors, marking inactive if they have gone silent
 func (l *LeaderNet) nodeAgeWorker() {
 	t := time.NewTicker(time.Second)
@@ -120,51 +224,205 @@ func (l *LeaderNet) nodeAgeWorker() {
 }
 
 // sensorReadoutConsumerWorker listens on l.datapoints and saves/actions on incoming sensor data.
+// Any sensor type is handled, as long as its data carries measurements or a decoder is registered for it.
 func (l *LeaderNet) sensorReadoutConsumerWorker() {
 	for {
 		sd := <-l.datapoints
-		switch sd.data.Typ {
-		case sensor.TypeFake:
+		if sd.data.Typ == sensor.TypeFake {
 			log.Debug().Msg("Parse fake sensor data")
-		case sensor.TypeAtmospheric:
-			ad := sensor.ParseValidAtmosphericSensorLine(string(sd.data.Data))
-			if err := l.DB.RecordAtmosphericMeasurement(ad, sd.sensor.DeviceID); err != nil {
-				log.Err(err).Msg("error recording atmospheric measurement")
+			continue
+		}
+
+		ts, ms, err := sd.data.Decode()
+		if err != nil {
+			metrics.DecodeErrors.WithLabelValues(sensor.NameByType(int(sd.data.Typ))).Inc()
+			log.Warn().Err(err).Uint8("deviceID", sd.sensor.DeviceID).Msg("could not decode sensor data")
+			continue
+		}
+
+		l.handlerLock.Lock()
+		derivers, calibrate := l.derivers, l.calibrate
+		l.handlerLock.Unlock()
+		var raw []sensor.Measurement
+		if calibrate != nil {
+			ms, raw = calibrate(sd.sensor.DeviceID, ms)
+		}
+		readout := ms
+		for _, f := range derivers {
+			ms = mergeMeasurements(ms, f(sd.sensor.DeviceID, sd.data.Typ, ts, readout))
+		}
+
+		start := time.Now()
+		if err := l.DB.RecordCalibratedMeasurements(sd.sensor.DeviceID, sd.data.Typ, ts, ms, raw); err != nil {
+			log.Err(err).Msg("error recording measurements")
+		} else {
+			metrics.ObserveDBWrite("measurements", start)
+		}
+		for _, m := range ms {
+			metrics.SetSensorValue(sd.sensor.DeviceID, m.Metric, m.Value)
+		}
+
+		l.handlerLock.Lock()
+		handlers := l.measurementHandlers
+		l.handlerLock.Unlock()
+		for _, h := range handlers {
+			h(sd.sensor.DeviceID, sd.data.Typ, ts, ms)
+		}
+	}
+}
+
+// mergeMeasurements returns ms with derived added, replacing any measurement of the same metric. ms is not modified.
+func mergeMeasurements(ms, derived []sensor.Measurement) []sensor.Measurement {
+	if len(derived) == 0 {
+		return ms
+	}
+	out := append(make([]sensor.Measurement, 0, len(ms)+len(derived)), ms...)
+	for _, d := range derived {
+		replaced := false
+		for i := range out {
+			if out[i].Metric == d.Metric {
+				out[i], replaced = d, true
+				break
 			}
 		}
+		if !replaced {
+			out = append(out, d)
+		}
 	}
+
+	return out
+}
+
+// SetCalibration corrects every sensor readout with f before it is stored or derived from
+func (l *LeaderNet) SetCalibration(f CalibrateFunc) {
+	l.handlerLock.Lock()
+	defer l.handlerLock.Unlock()
+	l.calibrate = f
+}
+
+// AddDerived stores the measurements f derives from every sensor readout along with the readout.
+// Each f is given the calibrated readout, without the measurements derived by other functions.
+func (l *LeaderNet) AddDerived(f DeriveFunc) {
+	l.handlerLock.Lock()
+	defer l.handlerLock.Unlock()
+	l.derivers = append(l.derivers, f)
+}
+
+// OnMeasurements calls h with the measurements of every sensor readout, once the leader has tried to store them.
+// h is called even if they could not be stored, so that alerts are still raised while the database is failing.
+func (l *LeaderNet) OnMeasurements(h MeasurementHandler) {
+	l.handlerLock.Lock()
+	defer l.handlerLock.Unlock()
+	l.measurementHandlers = append(l.measurementHandlers, h)
 }
 
 func (l *LeaderNet) handleRequest(conn net.Conn) {
+	defer conn.Close()
 	p, err := mynet.ReadPacket(conn)
 	if err != nil {
+		metrics.DecodeErrors.WithLabelValues("packet").Inc()
 		log.Err(err).Msg("handleRequest: Error decoding packet")
 		return
 	}
-	defer conn.Close()
 
 	l.parseIncomingPacket(p)
 }
 
 func (l *LeaderNet) parseIncomingPacket(p *mynet.Packet) {
+	metrics.PacketsIngested.WithLabelValues(mynet.TypeName(p.Typ)).Inc()
 	switch p.Typ {
 	case mynet.PacketTypeAnnounce:
 		l.nodeAnnounce(p)
 	case mynet.PacketTypeSensorData:
 		log.Debug().Uint8("deviceID", p.UID).Msg("sensor readout")
+		data, ok := p.Data.(sensor.Data)
+		if !ok {
+			metrics.DecodeErrors.WithLabelValues("sensorData").Inc()
+			log.Warn().Uint8("deviceID", p.UID).Msg("sensor readout packet has unexpected payload")
+			return
+		}
 		l.datapoints <- SensorData{
 			sensor: remoteNode{
 				DeviceID:   p.UID,
 				SensorType: p.Typ,
 			},
-			data: p.Data.(sensor.Data),
+			data: data,
 		}
+	case mynet.PacketTypeSensorError:
+		l.sensorError(p)
+	case mynet.PacketTypeEvent:
+		l.sensorEvent(p)
+	}
+}
+
+// sensorError stores an error reported by a sensor on a node
+func (l *LeaderNet) sensorError(p *mynet.Packet) {
+	report, ok := p.Data.(sensor.ErrorReport)
+	if !ok {
+		metrics.DecodeErrors.WithLabelValues("sensorError").Inc()
+		log.Warn().Uint8("deviceID", p.UID).Msg("sensor error packet has unexpected payload")
+		return
+	}
+	log.Warn().
+		Uint8("deviceID", p.UID).
+		Str("sensor", report.Name).
+		Bool("restarted", report.Restarted).
+		Str("error", report.Message).
+		Msg("Node sensor error")
+	metrics.SensorErrors.WithLabelValues(strconv.Itoa(int(p.UID)), report.Name).Inc()
+
+	start := time.Now()
+	if err := l.DB.RecordSensorError(p.UID, report); err != nil {
+		log.Err(err).Msg("error recording sensor error")
+		return
+	}
+	metrics.ObserveDBWrite("sensorErrors", start)
+}
+
+// sensorEvent stores a state change reported by an event driven sensor, such as a door opening
+func (l *LeaderNet) sensorEvent(p *mynet.Packet) {
+	event, ok := p.Data.(sensor.Event)
+	if !ok {
+		metrics.DecodeErrors.WithLabelValues("event").Inc()
+		log.Warn().Uint8("deviceID", p.UID).Msg("event packet has unexpected payload")
+		return
+	}
+	log.Info().
+		Uint8("deviceID", p.UID).
+		Str("sensor", event.Sensor).
+		Str("kind", event.Kind).
+		Str("state", event.State).
+		Msg("Sensor event")
+
+	start := time.Now()
+	if _, err := l.DB.RecordEvent(p.UID, event); err != nil {
+		log.Err(err).Msg("error recording event")
+	} else {
+		metrics.ObserveDBWrite("events", start)
+	}
+
+	l.handlerLock.Lock()
+	handlers := l.eventHandlers
+	l.handlerLock.Unlock()
+	for _, h := range handlers {
+		h(p.UID, event)
 	}
 }
 
+// OnEvent calls h with every sensor event received, once the leader has tried to store it. h is called even if the
+// event could not be stored, so that the alarm still sees it.
+func (l *LeaderNet) OnEvent(h EventHandler) {
+	l.handlerLock.Lock()
+	defer l.handlerLock.Unlock()
+	l.eventHandlers = append(l.eventHandlers, h)
+}
+
 // nodeAnnounce handles a node announce packet. This is a periodic ping from each node
 // which signals continued connection with the leader.
 func (l *LeaderNet) nodeAnnounce(p *mynet.Packet) {
+	// nodes which predate sensor status send no payload
+	status, _ := p.Data.(sensor.NodeStatus)
+
 	l.nodeLock.Lock()
 	defer l.nodeLock.Unlock()
 	if entry, ok := l.seenNodes[p.UID]; !ok {
@@ -174,6 +432,7 @@ func (l *LeaderNet) nodeAnnounce(p *mynet.Packet) {
 			SensorType: p.Typ,
 			Active:     true,
 			LastSeenAt: time.Now(),
+			Sensors:    status.Sensors,
 		}
 	} else {
 		entry.LastSeenAt = time.Now()
@@ -183,9 +442,76 @@ func (l *LeaderNet) nodeAnnounce(p *mynet.Packet) {
 				Msg("Previously seen node reconnected")
 			entry.Active = true
 		}
+		logRestarts(p.UID, entry.Sensors, status.Sensors)
+		logHealthChanges(p.UID, entry.Sensors, status.Sensors)
+		entry.Sensors = status.Sensors
 
 		l.seenNodes[p.UID] = entry
 	}
+
+	l.registerDeclaredMetrics(status.Sensors)
+	for _, st := range status.Sensors {
+		metrics.SensorRestarts.WithLabelValues(strconv.Itoa(int(p.UID)), st.Name).Set(float64(st.Restarts))
+		metrics.SensorHealth.WithLabelValues(strconv.Itoa(int(p.UID)), st.Name).Set(float64(st.Health))
+	}
+}
+
+// registerDeclaredMetrics registers metrics declared by sensors whose schema comes from node config,
+// such as exec sensors, so they are stored with their units. nodeLock must be held.
+func (l *LeaderNet) registerDeclaredMetrics(sensors []sensor.Status) {
+	for _, st := range sensors {
+		for _, m := range st.Metrics {
+			m.Name = sensor.QualifyMetric(st.Name, sensor.NameByType(int(st.Typ)), m.Name)
+			m.SensorType = st.Typ
+			if l.declaredMetrics[m.Name] == m {
+				continue
+			}
+			if _, err := l.DB.RegisterMetric(m); err != nil {
+				log.Err(err).Str("metric", m.Name).Msg("error registering declared metric")
+				continue
+			}
+			l.declaredMetrics[m.Name] = m
+		}
+	}
+}
+
+// logHealthChanges logs any sensor whose health differs from the previous announce
+func logHealthChanges(deviceID uint8, prev, cur []sensor.Status) {
+	prevHealth := make(map[string]sensor.Health, len(prev))
+	for _, st := range prev {
+		prevHealth[st.Name] = st.Health
+	}
+	for _, st := range cur {
+		if st.Health == prevHealth[st.Name] {
+			continue
+		}
+		lm := log.Info()
+		if st.Health == sensor.HealthDegraded || st.Health == sensor.HealthFailed {
+			lm = log.Warn()
+		}
+		lm.Uint8("deviceID", deviceID).
+			Str("sensor", st.Name).
+			Stringer("health", st.Health).
+			Str("reason", st.HealthReason).
+			Msg("Node sensor health changed")
+	}
+}
+
+// logRestarts warns about any sensor whose restart count has gone up since the previous announce
+func logRestarts(deviceID uint8, prev, cur []sensor.Status) {
+	prevRestarts := make(map[string]int, len(prev))
+	for _, st := range prev {
+		prevRestarts[st.Name] = st.Restarts
+	}
+	for _, st := range cur {
+		if st.Restarts > prevRestarts[st.Name] {
+			log.Warn().
+				Uint8("deviceID", deviceID).
+				Str("sensor", st.Name).
+				Int("restarts", st.Restarts).
+				Msg("Node restarted sensor process")
+		}
+	}
 }
 
 func (l *LeaderNet) Close() {
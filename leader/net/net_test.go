@@ -3,6 +3,7 @@ package net
 import (
 	mynet "github.com/Heanthor/quill-secure/net"
 	"github.com/Heanthor/quill-secure/node/sensor"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -49,3 +50,16 @@ func TestLeaderNet_nodeAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeMeasurements(t *testing.T) {
+	ms := []sensor.Measurement{{Metric: "pressure", Value: 1000}, {Metric: "altitude", Value: 3}}
+	got := mergeMeasurements(ms, []sensor.Measurement{{Metric: "altitude", Value: 110}, {Metric: "dew_point", Value: 9}})
+
+	want := []sensor.Measurement{{Metric: "pressure", Value: 1000}, {Metric: "altitude", Value: 110}, {Metric: "dew_point", Value: 9}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeMeasurements() = %v, want %v", got, want)
+	}
+	if ms[1].Value != 3 {
+		t.Errorf("mergeMeasurements() modified its input: %v", ms)
+	}
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterFactory("command", newCommandFromConfig)
+}
+
+// CommandNotifier runs a local command for each notification. The notification is written to the command's
+// stdin as a line of JSON, and its main fields are also set as QUILLSECURE_ALERT_* environment variables.
+type CommandNotifier struct {
+	command string
+	args    []string
+}
+
+// newCommandFromConfig is the Factory for command hooks. Options are command, the executable, and args.
+func newCommandFromConfig(cfg Config) (Notifier, error) {
+	command, err := cfg.String("command")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCommand(command, cfg.Strings("args")), nil
+}
+
+func NewCommand(command string, args []string) *CommandNotifier {
+	return &CommandNotifier{command: command, args: args}
+}
+
+func (c *CommandNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+
+	cmd := exec.CommandContext(ctx, c.command, c.args...)
+	// a trailing newline lets scripts read the notification with read or readline
+	cmd.Stdin = bytes.NewReader(append(body, '\n'))
+	cmd.Env = append(os.Environ(),
+		"QUILLSECURE_ALERT_ID="+strconv.FormatInt(n.AlertID, 10),
+		"QUILLSECURE_ALERT_EVENT="+n.Event,
+		"QUILLSECURE_ALERT_RULE="+n.Rule,
+		"QUILLSECURE_ALERT_SEVERITY="+n.Severity,
+		"QUILLSECURE_ALERT_DEVICE_ID="+strconv.Itoa(int(n.DeviceID)),
+		"QUILLSECURE_ALERT_METRIC="+n.Metric,
+		"QUILLSECURE_ALERT_VALUE="+strconv.FormatFloat(n.Value, 'f', -1, 64),
+		"QUILLSECURE_ALERT_MESSAGE="+n.Message,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", c.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
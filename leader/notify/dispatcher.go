@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Statuses of a delivery
+const (
+	StatusSent       = "sent"
+	StatusFailed     = "failed"
+	StatusSuppressed = "suppressed"
+)
+
+const (
+	defaultRetries = 2
+	queueSize      = 100
+	// deliveryTimeout bounds each attempt to send a notification
+	deliveryTimeout = 30 * time.Second
+)
+
+// target is a configured notifier with its delivery settings
+type target struct {
+	name     string
+	notifier Notifier
+	quiet    QuietHours
+	retries  int
+}
+
+type job struct {
+	n Notification
+	// routes are the notifier names to send to, empty for every notifier
+	routes []string
+}
+
+// Dispatcher sends notifications to notifiers in the background, recording each delivery in the database.
+// Notifiers with quiet hours skip notifications during them, which are recorded as suppressed and never resent.
+// Critical alerts are sent regardless of quiet hours.
+type Dispatcher struct {
+	db      *db.DB
+	targets []target
+	queue   chan job
+
+	// backoff is the wait before the first retry, doubling for each retry after
+	backoff time.Duration
+	now     func() time.Time
+}
+
+// NewDispatcher creates every configured notifier
+func NewDispatcher(d *db.DB, configs []Config) (*Dispatcher, error) {
+	dp := &Dispatcher{
+		db:      d,
+		queue:   make(chan job, queueSize),
+		backoff: time.Second,
+		now:     time.Now,
+	}
+
+	names := make(map[string]bool)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = cfg.Type
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicate notifier name %q", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		n, err := New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		quiet, err := ParseQuietHours(cfg.QuietHours)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", cfg.Name, err)
+		}
+		retries := defaultRetries
+		if cfg.Retries != nil {
+			retries = *cfg.Retries
+		}
+		dp.targets = append(dp.targets, target{name: cfg.Name, notifier: n, quiet: quiet, retries: retries})
+	}
+
+	return dp, nil
+}
+
+// Start delivers queued notifications in the background
+func (dp *Dispatcher) Start() {
+	go func() {
+		for j := range dp.queue {
+			dp.deliver(j)
+		}
+	}()
+}
+
+// Dispatch queues n to be sent to the notifiers named in routes, or every notifier if routes is empty.
+// It does not block, dropping the notification if the queue is full.
+func (dp *Dispatcher) Dispatch(n Notification, routes []string) {
+	select {
+	case dp.queue <- job{n: n, routes: routes}:
+	default:
+		log.Error().Int64("alertID", n.AlertID).Msg("notification queue full, dropping notification")
+	}
+}
+
+// deliver sends a notification to each of its notifiers in turn
+func (dp *Dispatcher) deliver(j job) {
+	for _, name := range dp.routesOf(j.routes) {
+		dl := db.Delivery{AlertID: j.n.AlertID, Event: j.n.Event, Notifier: name}
+		t, ok := dp.target(name)
+		switch {
+		case !ok:
+			dl.Status, dl.Error = StatusFailed, "unknown notifier"
+		case t.quiet.Contains(dp.now()) && j.n.Severity != alerts.SeverityCritical:
+			log.Info().Str("notifier", name).Int64("alertID", j.n.AlertID).Str("event", j.n.Event).Msg("Notification suppressed by quiet hours")
+			dl.Status = StatusSuppressed
+		default:
+			var err error
+			dl.Attempts, err = dp.send(t, j.n)
+			dl.Status = StatusSent
+			if err != nil {
+				dl.Status, dl.Error = StatusFailed, err.Error()
+			}
+		}
+
+		dl.Timestamp = dp.now()
+		if err := dp.db.RecordDelivery(dl); err != nil {
+			log.Err(err).Msg("error recording notification delivery")
+		}
+	}
+}
+
+func (dp *Dispatcher) routesOf(routes []string) []string {
+	if len(routes) > 0 {
+		return routes
+	}
+	names := make([]string, len(dp.targets))
+	for i, t := range dp.targets {
+		names[i] = t.name
+	}
+
+	return names
+}
+
+// Has reports whether a notifier called name is configured
+func (dp *Dispatcher) Has(name string) bool {
+	_, ok := dp.target(name)
+	return ok
+}
+
+func (dp *Dispatcher) target(name string) (target, bool) {
+	for _, t := range dp.targets {
+		if t.name == name {
+			return t, true
+		}
+	}
+
+	return target{}, false
+}
+
+// send tries to notify t, retrying with backoff until it succeeds, fails permanently or runs out of retries.
+// It returns the number of attempts made and the last error.
+func (dp *Dispatcher) send(t target, n Notification) (int, error) {
+	backoff := dp.backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		err := t.notifier.Notify(ctx, n)
+		cancel()
+		if err == nil {
+			log.Info().Str("notifier", t.name).Int64("alertID", n.AlertID).Str("event", n.Event).Msg("Notification sent")
+			return attempt, nil
+		}
+
+		log.Warn().Err(err).Str("notifier", t.name).Int64("alertID", n.AlertID).Int("attempt", attempt).Msg("Notification failed")
+		if errors.Is(err, ErrPermanent) || attempt > t.retries {
+			return attempt, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,126 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterFactory("email", newEmailFromConfig)
+}
+
+// EmailNotifier sends notifications by SMTP, upgrading to TLS when the server offers STARTTLS
+type EmailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+// newEmailFromConfig is the Factory for email. Options are addr (host:port of the SMTP server), from, to
+// (a list of recipients), and username and password if the server requires authentication.
+func newEmailFromConfig(cfg Config) (Notifier, error) {
+	addr, err := cfg.String("addr")
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("notifier %s: addr: %w", cfg.Name, err)
+	}
+	from, err := cfg.String("from")
+	if err != nil {
+		return nil, err
+	}
+	to := cfg.Strings("to")
+	if len(to) == 0 {
+		return nil, fmt.Errorf("notifier %s: missing option \"to\"", cfg.Name)
+	}
+
+	return NewEmail(addr, from, to, cfg.StringOr("username", ""), cfg.StringOr("password", "")), nil
+}
+
+func NewEmail(addr, from string, to []string, username, password string) *EmailNotifier {
+	return &EmailNotifier{addr: addr, from: from, to: to, username: username, password: password}
+}
+
+func (e *EmailNotifier) Notify(ctx context.Context, n Notification) error {
+	host, _, _ := net.SplitHostPort(e.addr)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return smtpError(err)
+		}
+	}
+	if e.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.username, e.password, host)); err != nil {
+			return smtpError(err)
+		}
+	}
+	if err := c.Mail(e.from); err != nil {
+		return smtpError(err)
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to); err != nil {
+			return smtpError(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(e.message(n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+
+	return c.Quit()
+}
+
+func (e *EmailNotifier) message(n Notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", n.Title())
+	fmt.Fprintf(&b, "Date: %s\r\n", n.Timestamp.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n\r\n", n.Message)
+	fmt.Fprintf(&b, "Rule: %s\r\nDevice: %d\r\nMetric: %s\r\nAlert: %d\r\n", n.Rule, n.DeviceID, n.Metric, n.AlertID)
+
+	return b.Bytes()
+}
+
+// smtpError marks permanent SMTP replies, with 5xx codes, as ErrPermanent
+func smtpError(err error) error {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && tpErr.Code >= 500 {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+
+	return err
+}
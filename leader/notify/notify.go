@@ -0,0 +1,221 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/spf13/cast"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification describes a change of an alert, sent through notifiers
+type Notification struct {
+	// Event is opened, escalated or resolved
+	Event     string  `json:"event"`
+	AlertID   int64   `json:"alertID"`
+	Rule      string  `json:"rule"`
+	Severity  string  `json:"severity"`
+	DeviceID  uint8   `json:"deviceID"`
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	// Unit is the unit of Value and Threshold
+	Unit      string    `json:"unit"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// FromAlert creates the notification of an alert opening, escalating or resolving. Convert a to the units it should be
+// sent in first, with alerts.InUnits.
+func FromAlert(event string, a db.Alert) Notification {
+	n := Notification{
+		Event:     event,
+		AlertID:   a.ID,
+		Rule:      a.RuleName,
+		Severity:  a.Severity,
+		DeviceID:  a.DeviceID,
+		Metric:    a.Metric,
+		Value:     a.Value,
+		Threshold: a.Threshold,
+		Unit:      a.Unit,
+		Message:   a.Message,
+		Timestamp: a.OpenedAt,
+	}
+	if a.ResolvedAt != nil {
+		n.Timestamp = *a.ResolvedAt
+	}
+
+	return n
+}
+
+// Title is a one line summary, used as an email subject or push title
+func (n Notification) Title() string {
+	return fmt.Sprintf("QuillSecure alert %s: %s", n.Event, n.Rule)
+}
+
+// Notifier sends notifications to one destination
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// ErrPermanent marks a failure which retrying will not fix, such as a rejected request
+var ErrPermanent = errors.New("permanent failure")
+
+// Config describes one notifier from the leader config
+type Config struct {
+	// Type selects the factory which creates the notifier
+	Type string `mapstructure:"type"`
+	// Name identifies the notifier in alert rules, defaulting to Type. Names must be unique.
+	Name string `mapstructure:"name"`
+	// QuietHours is a local time range such as 22:00-07:00 during which only critical alerts are sent
+	QuietHours string `mapstructure:"quietHours"`
+	// Retries is how many times a failed notification is retried, defaulting to 2
+	Retries *int `mapstructure:"retries"`
+	// Options holds type specific settings
+	Options map[string]interface{} `mapstructure:"options"`
+}
+
+// String returns the string option key, or an error if it is missing or blank
+func (c Config) String(key string) (string, error) {
+	s := strings.TrimSpace(cast.ToString(c.Options[key]))
+	if s == "" {
+		return "", fmt.Errorf("notifier %s: missing option %q", c.Name, key)
+	}
+
+	return s, nil
+}
+
+// StringOr returns the string option key, or def if it is not set
+func (c Config) StringOr(key, def string) string {
+	if s, err := c.String(key); err == nil {
+		return s
+	}
+
+	return def
+}
+
+// Int returns the integer option key, or def if it is not set
+func (c Config) Int(key string, def int) (int, error) {
+	v, ok := c.Options[key]
+	if !ok {
+		return def, nil
+	}
+	i, err := cast.ToIntE(v)
+	if err != nil {
+		return 0, fmt.Errorf("notifier %s: option %q: %w", c.Name, key, err)
+	}
+
+	return i, nil
+}
+
+// Strings returns the list option key, which may also be a comma separated string
+func (c Config) Strings(key string) []string {
+	var out []string
+	for _, s := range cast.ToStringSlice(c.Options[key]) {
+		for _, part := range strings.Split(s, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+
+	return out
+}
+
+// StringMap returns the map option key, such as HTTP headers
+func (c Config) StringMap(key string) map[string]string {
+	return cast.ToStringMapString(c.Options[key])
+}
+
+// Factory creates a notifier from its config
+type Factory func(cfg Config) (Notifier, error)
+
+var (
+	registryLock sync.RWMutex
+	factories    = make(map[string]Factory)
+)
+
+// RegisterFactory makes notifiers of type typ available to leader config
+func RegisterFactory(typ string, f Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	factories[typ] = f
+}
+
+// Types returns the notifier types which can be configured, sorted by name
+func Types() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	out := make([]string, 0, len(factories))
+	for typ := range factories {
+		out = append(out, typ)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// New creates a notifier from cfg using the factory registered for its type
+func New(cfg Config) (Notifier, error) {
+	if cfg.Type == "" {
+		return nil, errors.New("notifier config is missing a type")
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.Type
+	}
+
+	registryLock.RLock()
+	f, ok := factories[cfg.Type]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("notifier %s: unknown type %q, must be one of %s", cfg.Name, cfg.Type, strings.Join(Types(), ", "))
+	}
+
+	return f(cfg)
+}
+
+// QuietHours is a daily range of local time. A range which ends before it starts, such as 22:00-07:00,
+// runs past midnight. The zero value is never quiet.
+type QuietHours struct {
+	// start and end are minutes after midnight
+	start, end int
+	set        bool
+}
+
+// ParseQuietHours parses a range such as 22:00-07:00. Blank is never quiet.
+func ParseQuietHours(s string) (QuietHours, error) {
+	if s == "" {
+		return QuietHours{}, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return QuietHours{}, fmt.Errorf("invalid quiet hours %q, want HH:MM-HH:MM", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return QuietHours{}, fmt.Errorf("invalid quiet hours %q: %w", s, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return QuietHours{}, fmt.Errorf("invalid quiet hours %q: %w", s, err)
+	}
+
+	return QuietHours{start: start.Hour()*60 + start.Minute(), end: end.Hour()*60 + end.Minute(), set: true}, nil
+}
+
+// Contains reports whether t falls within the quiet hours, in t's location
+func (q QuietHours) Contains(t time.Time) bool {
+	if !q.set {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return m >= q.start && m < q.end
+	}
+
+	return m >= q.start || m < q.end
+}
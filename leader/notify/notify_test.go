@@ -0,0 +1,396 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Heanthor/quill-secure/db"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testNotification = Notification{
+	Event:     "opened",
+	AlertID:   7,
+	Rule:      "nursery cold",
+	DeviceID:  2,
+	Metric:    "nursery.temperature",
+	Value:     17.5,
+	Message:   "nursery.temperature on device 2 is 17.5, below 18",
+	Timestamp: time.Unix(1660369274, 0),
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{name: "ok", status: http.StatusNoContent},
+		{name: "server error", status: http.StatusBadGateway, wantErr: true},
+		{name: "rate limited", status: http.StatusTooManyRequests, wantErr: true},
+		{name: "rejected", status: http.StatusBadRequest, wantErr: true, wantPermanent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Notification
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Token") != "secret" {
+					t.Errorf("unexpected headers %v", r.Header)
+				}
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			err := NewWebhook(srv.URL, map[string]string{"X-Token": "secret"}).Notify(context.Background(), testNotification)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrPermanent) != tt.wantPermanent {
+				t.Errorf("Notify() error = %v, want permanent %v", err, tt.wantPermanent)
+			}
+			if got.AlertID != testNotification.AlertID || got.Message != testNotification.Message {
+				t.Errorf("webhook received %+v", got)
+			}
+		})
+	}
+}
+
+func TestNtfyNotifier(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/house" {
+			t.Errorf("path = %s, want /house", r.URL.Path)
+		}
+		if r.Header.Get("Title") != testNotification.Title() || r.Header.Get("Priority") != "5" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if r.Header.Get("Authorization") != "Bearer tk_abc" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if string(body) != testNotification.Message {
+			t.Errorf("body = %q", body)
+		}
+	}))
+	defer srv.Close()
+
+	if err := NewNtfy(srv.URL+"/", "house", "tk_abc", 5).Notify(context.Background(), testNotification); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+}
+
+func TestGotifyNotifier(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg gotifyMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		if r.URL.Path != "/message" || r.Header.Get("X-Gotify-Key") != "app-token" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		if msg.Title != testNotification.Title() || msg.Message != testNotification.Message || msg.Priority != 8 {
+			t.Errorf("message = %+v", msg)
+		}
+	}))
+	defer srv.Close()
+
+	if err := NewGotify(srv.URL, "app-token", 8).Notify(context.Background(), testNotification); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+}
+
+// smtpServer is a minimal local SMTP server, which records the messages it receives.
+// It rejects recipients at reject.example.
+type smtpServer struct {
+	addr string
+
+	lock     sync.Mutex
+	from     string
+	rcpts    []string
+	messages []string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &smtpServer{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		upper := strings.ToUpper(cmd)
+		switch {
+		case strings.HasPrefix(upper, "EHLO"), strings.HasPrefix(upper, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(upper, "MAIL FROM:"):
+			s.lock.Lock()
+			s.from = cmd[len("MAIL FROM:"):]
+			s.lock.Unlock()
+			reply("250 ok")
+		case strings.HasPrefix(upper, "RCPT TO:"):
+			if strings.Contains(cmd, "reject.example") {
+				reply("550 no such user")
+				continue
+			}
+			s.lock.Lock()
+			s.rcpts = append(s.rcpts, cmd[len("RCPT TO:"):])
+			s.lock.Unlock()
+			reply("250 ok")
+		case upper == "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.lock.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.lock.Unlock()
+			reply("250 queued")
+		case upper == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	srv := newSMTPServer(t)
+	to := []string{"a@example.com", "b@example.com"}
+	if err := NewEmail(srv.addr, "leader@example.com", to, "", "").Notify(context.Background(), testNotification); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.from != "<leader@example.com>" || len(srv.rcpts) != 2 {
+		t.Errorf("envelope from %s to %v", srv.from, srv.rcpts)
+	}
+	if len(srv.messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(srv.messages))
+	}
+	msg := srv.messages[0]
+	if !strings.Contains(msg, "Subject: "+testNotification.Title()) || !strings.Contains(msg, testNotification.Message) {
+		t.Errorf("message = %q", msg)
+	}
+}
+
+func TestEmailNotifier_rejected(t *testing.T) {
+	srv := newSMTPServer(t)
+	err := NewEmail(srv.addr, "leader@example.com", []string{"x@reject.example"}, "", "").Notify(context.Background(), testNotification)
+	if !errors.Is(err, ErrPermanent) {
+		t.Errorf("Notify() error = %v, want %v", err, ErrPermanent)
+	}
+}
+
+func TestCommandNotifier(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	n := NewCommand("sh", []string{"-c", `cat > "$OUT"; echo "$QUILLSECURE_ALERT_RULE" >> "$OUT"`})
+	t.Setenv("OUT", out)
+	if err := n.Notify(context.Background(), testNotification); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var got Notification
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil || got.AlertID != testNotification.AlertID {
+		t.Errorf("stdin = %q, err %v", lines[0], err)
+	}
+	if lines[len(lines)-1] != testNotification.Rule {
+		t.Errorf("QUILLSECURE_ALERT_RULE = %q", lines[len(lines)-1])
+	}
+
+	if err := NewCommand("sh", []string{"-c", "echo broken >&2; exit 3"}).Notify(context.Background(), testNotification); err == nil ||
+		!strings.Contains(err.Error(), "broken") {
+		t.Errorf("Notify() of failing command error = %v", err)
+	}
+}
+
+func TestParseQuietHours(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		ts, _ := time.Parse("15:04", hhmm)
+		return ts
+	}
+	tests := []struct {
+		quiet   string
+		at      string
+		want    bool
+		wantErr bool
+	}{
+		{quiet: "", at: "03:00", want: false},
+		{quiet: "22:00-07:00", at: "23:30", want: true},
+		{quiet: "22:00-07:00", at: "03:00", want: true},
+		{quiet: "22:00-07:00", at: "07:00", want: false},
+		{quiet: "22:00-07:00", at: "12:00", want: false},
+		{quiet: "13:00-14:30", at: "14:00", want: true},
+		{quiet: "13:00-14:30", at: "12:59", want: false},
+		{quiet: "late", wantErr: true},
+		{quiet: "25:00-07:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.quiet+" "+tt.at, func(t *testing.T) {
+			q, err := ParseQuietHours(tt.quiet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQuietHours() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && q.Contains(at(tt.at)) != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.at, !tt.want, tt.want)
+			}
+		})
+	}
+}
+
+// flakyNotifier fails its first failures notifications
+type flakyNotifier struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyNotifier) Notify(ctx context.Context, n Notification) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+
+	return nil
+}
+
+func TestDispatcher_deliver(t *testing.T) {
+	d, err := db.NewDB(filepath.Join(t.TempDir(), "leader.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	defer d.Close()
+
+	flaky := &flakyNotifier{failures: 1, err: errors.New("connection refused")}
+	rejected := &flakyNotifier{failures: 10, err: ErrPermanent}
+	down := &flakyNotifier{failures: 10, err: errors.New("timeout")}
+	quiet, _ := ParseQuietHours("22:00-07:00")
+	dp := &Dispatcher{
+		db: d,
+		targets: []target{
+			{name: "flaky", notifier: flaky, retries: 2},
+			{name: "rejected", notifier: rejected, retries: 2},
+			{name: "down", notifier: down, retries: 1},
+			{name: "night", notifier: &flakyNotifier{}, quiet: quiet},
+		},
+		now: func() time.Time { return time.Date(2022, 8, 13, 23, 0, 0, 0, time.Local) },
+	}
+
+	dp.deliver(job{n: testNotification})
+	dp.deliver(job{n: Notification{AlertID: 8, Event: "resolved"}, routes: []string{"flaky", "missing"}})
+	// critical alerts are sent during quiet hours
+	dp.deliver(job{n: Notification{AlertID: 9, Event: "opened", Severity: alerts.SeverityCritical}, routes: []string{"night"}})
+
+	type result struct {
+		status   string
+		attempts int
+	}
+	tests := []struct {
+		alertID int64
+		want    map[string]result
+	}{
+		{7, map[string]result{
+			"flaky":    {StatusSent, 2},
+			"rejected": {StatusFailed, 1},
+			"down":     {StatusFailed, 2},
+			"night":    {StatusSuppressed, 0},
+		}},
+		{8, map[string]result{
+			"flaky":   {StatusSent, 1},
+			"missing": {StatusFailed, 0},
+		}},
+		{9, map[string]result{
+			"night": {StatusSent, 1},
+		}},
+	}
+	for _, tt := range tests {
+		dls, err := d.Deliveries(tt.alertID)
+		if err != nil {
+			t.Fatalf("Deliveries() error = %v", err)
+		}
+		if len(dls) != len(tt.want) {
+			t.Fatalf("alert %d: got %d deliveries, want %d: %+v", tt.alertID, len(dls), len(tt.want), dls)
+		}
+		for _, dl := range dls {
+			if got := (result{dl.Status, dl.Attempts}); got != tt.want[dl.Notifier] {
+				t.Errorf("alert %d: %s delivery = %+v, want %+v", tt.alertID, dl.Notifier, got, tt.want[dl.Notifier])
+			}
+			if (dl.Status == StatusFailed) != (dl.Error != "") {
+				t.Errorf("alert %d: %s delivery error = %q", tt.alertID, dl.Notifier, dl.Error)
+			}
+		}
+	}
+}
+
+func TestNewDispatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []Config
+		wantErr bool
+	}{
+		{"webhook", []Config{{Type: "webhook", Options: map[string]interface{}{"url": "http://localhost"}}}, false},
+		{"email", []Config{{Type: "email", Options: map[string]interface{}{"addr": "localhost:25", "from": "a@b", "to": []interface{}{"c@d"}}}}, false},
+		{"missing option", []Config{{Type: "webhook"}}, true},
+		{"unknown type", []Config{{Type: "pager"}}, true},
+		{"duplicate name", []Config{
+			{Type: "webhook", Options: map[string]interface{}{"url": "http://a"}},
+			{Type: "webhook", Options: map[string]interface{}{"url": "http://b"}},
+		}, true},
+		{"invalid quiet hours", []Config{{Type: "ntfy", QuietHours: "night", Options: map[string]interface{}{"topic": "t"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDispatcher(nil, tt.configs); (err != nil) != tt.wantErr {
+				t.Errorf("NewDispatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
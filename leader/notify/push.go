@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Heanthor/quill-secure/leader/alerts"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultNtfyURL = "https://ntfy.sh"
+
+func init() {
+	RegisterFactory("ntfy", newNtfyFromConfig)
+	RegisterFactory("gotify", newGotifyFromConfig)
+}
+
+// NtfyNotifier publishes notifications to an ntfy topic
+type NtfyNotifier struct {
+	url      string
+	topic    string
+	token    string
+	priority int
+	client   *http.Client
+}
+
+// newNtfyFromConfig is the Factory for ntfy. Options are topic, url (default https://ntfy.sh),
+// token for protected topics, and priority from 1 to 5 (default 4).
+func newNtfyFromConfig(cfg Config) (Notifier, error) {
+	topic, err := cfg.String("topic")
+	if err != nil {
+		return nil, err
+	}
+	priority, err := cfg.Int("priority", 4)
+	if err != nil {
+		return nil, err
+	}
+	if priority < 1 || priority > 5 {
+		return nil, fmt.Errorf("notifier %s: priority must be between 1 and 5", cfg.Name)
+	}
+
+	return NewNtfy(cfg.StringOr("url", defaultNtfyURL), topic, cfg.StringOr("token", ""), priority), nil
+}
+
+func NewNtfy(url, topic, token string, priority int) *NtfyNotifier {
+	return &NtfyNotifier{url: strings.TrimSuffix(url, "/"), topic: topic, token: token, priority: priority, client: &http.Client{}}
+}
+
+func (p *NtfyNotifier) Notify(ctx context.Context, n Notification) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/"+p.topic, strings.NewReader(n.Message))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+	req.Header.Set("Title", n.Title())
+	req.Header.Set("Tags", "rotating_light")
+	priority := p.priority
+	if n.Severity == alerts.SeverityCritical {
+		priority = 5
+	}
+	if n.Event == alerts.EventResolved {
+		// resolving is good news, so never louder than the default
+		req.Header.Set("Tags", "white_check_mark")
+		priority = 3
+	}
+	req.Header.Set("Priority", strconv.Itoa(priority))
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	return doRequest(p.client, req)
+}
+
+// GotifyNotifier sends notifications to a Gotify server as an application
+type GotifyNotifier struct {
+	url      string
+	token    string
+	priority int
+	client   *http.Client
+}
+
+// newGotifyFromConfig is the Factory for Gotify. Options are url, token (an application token) and priority (default 8).
+func newGotifyFromConfig(cfg Config) (Notifier, error) {
+	url, err := cfg.String("url")
+	if err != nil {
+		return nil, err
+	}
+	token, err := cfg.String("token")
+	if err != nil {
+		return nil, err
+	}
+	priority, err := cfg.Int("priority", 8)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewGotify(url, token, priority), nil
+}
+
+func NewGotify(url, token string, priority int) *GotifyNotifier {
+	return &GotifyNotifier{url: strings.TrimSuffix(url, "/"), token: token, priority: priority, client: &http.Client{}}
+}
+
+type gotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+func (g *GotifyNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(gotifyMessage{Title: n.Title(), Message: n.Message, Priority: g.priority})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url+"/message", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.token)
+
+	return doRequest(g.client, req)
+}
@@ -0,0 +1,158 @@
+// Package units converts stored metric values, which are always metric, into the units a client prefers.
+package units
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Unit systems, which choose a default unit for each quantity
+const (
+	SystemMetric   = "metric"
+	SystemImperial = "imperial"
+)
+
+// Units of the quantities which can be converted. Stored values use Celsius, HPa and Metres.
+const (
+	Celsius    = "C"
+	Fahrenheit = "F"
+	HPa        = "hPa"
+	InHg       = "inHg"
+	MmHg       = "mmHg"
+	Metres     = "m"
+	Feet       = "ft"
+)
+
+// Preferences are the units a client wants values in
+type Preferences struct {
+	System      string `json:"system"`
+	Temperature string `json:"temperature"`
+	Pressure    string `json:"pressure"`
+	Altitude    string `json:"altitude"`
+}
+
+// Metric is the preference of stored values, which need no conversion
+var Metric = Preferences{System: SystemMetric, Temperature: Celsius, Pressure: HPa, Altitude: Metres}
+
+// Imperial uses US customary units
+var Imperial = Preferences{System: SystemImperial, Temperature: Fahrenheit, Pressure: InHg, Altitude: Feet}
+
+// ForSystem returns the default preferences of a unit system
+func ForSystem(system string) (Preferences, error) {
+	switch strings.ToLower(system) {
+	case "", SystemMetric:
+		return Metric, nil
+	case SystemImperial:
+		return Imperial, nil
+	}
+
+	return Preferences{}, fmt.Errorf("unknown unit system %q, must be %s or %s", system, SystemMetric, SystemImperial)
+}
+
+// Override replaces any unit which is not blank, checking each is valid for its quantity
+func (p Preferences) Override(temperature, pressure, altitude string) (Preferences, error) {
+	var err error
+	if p.Temperature, err = pick(p.Temperature, temperature, Celsius, Fahrenheit); err != nil {
+		return Preferences{}, fmt.Errorf("temperature: %w", err)
+	}
+	if p.Pressure, err = pick(p.Pressure, pressure, HPa, InHg, MmHg); err != nil {
+		return Preferences{}, fmt.Errorf("pressure: %w", err)
+	}
+	if p.Altitude, err = pick(p.Altitude, altitude, Metres, Feet); err != nil {
+		return Preferences{}, fmt.Errorf("altitude: %w", err)
+	}
+
+	return p, nil
+}
+
+// pick returns the valid unit matching want case-insensitively, or current if want is blank
+func pick(current, want string, valid ...string) (string, error) {
+	if want == "" {
+		return current, nil
+	}
+	for _, u := range valid {
+		if strings.EqualFold(u, want) {
+			return u, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown unit %q, must be one of %s", want, strings.Join(valid, ", "))
+}
+
+// Unit returns the unit values stored in unit are converted to. Units which cannot be converted are unchanged.
+func (p Preferences) Unit(unit string) string {
+	switch unit {
+	case Celsius:
+		return p.Temperature
+	case HPa:
+		return p.Pressure
+	case Metres:
+		return p.Altitude
+	}
+
+	return unit
+}
+
+// Convert converts a value stored in unit to the preferred unit, returning it with its new unit
+func (p Preferences) Convert(value float64, unit string) (float64, string) {
+	to := p.Unit(unit)
+	if to == "" || to == unit {
+		return value, unit
+	}
+
+	return Convert(value, unit, to), to
+}
+
+// ConvertChange converts a change in a value stored in unit, such as a rise of 2C, which unlike a value has no offset
+func (p Preferences) ConvertChange(change float64, unit string) (float64, string) {
+	to := p.Unit(unit)
+	if to == "" || to == unit {
+		return change, unit
+	}
+
+	return Convert(change, unit, to) - Convert(0, unit, to), to
+}
+
+const (
+	hPaPerInHg    = 33.8638866667
+	hPaPerMmHg    = 1.33322387415
+	metresPerFoot = 0.3048
+)
+
+// Convert converts value from one unit to another of the same quantity. Unknown conversions return value unchanged.
+func Convert(value float64, from, to string) float64 {
+	switch {
+	case from == to:
+		return value
+	case from == Celsius && to == Fahrenheit:
+		return value*9/5 + 32
+	case from == Fahrenheit && to == Celsius:
+		return (value - 32) * 5 / 9
+	case from == Metres && to == Feet:
+		return value / metresPerFoot
+	case from == Feet && to == Metres:
+		return value * metresPerFoot
+	}
+
+	// pressure converts through hPa
+	hpa := value
+	switch from {
+	case InHg:
+		hpa = value * hPaPerInHg
+	case MmHg:
+		hpa = value * hPaPerMmHg
+	case HPa:
+	default:
+		return value
+	}
+	switch to {
+	case InHg:
+		return hpa / hPaPerInHg
+	case MmHg:
+		return hpa / hPaPerMmHg
+	case HPa:
+		return hpa
+	}
+
+	return value
+}
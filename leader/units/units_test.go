@@ -0,0 +1,86 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		want     float64
+	}{
+		{20, Celsius, Fahrenheit, 68},
+		{-40, Celsius, Fahrenheit, -40},
+		{212, Fahrenheit, Celsius, 100},
+		{1013.25, HPa, InHg, 29.921},
+		{1013.25, HPa, MmHg, 760},
+		{29.921, InHg, MmHg, 760},
+		{760, MmHg, HPa, 1013.25},
+		{100, Metres, Feet, 328.084},
+		{1000, Feet, Metres, 304.8},
+		{50, "%", "%", 50},
+		{20, Celsius, InHg, 20},
+	}
+	for _, tt := range tests {
+		if got := Convert(tt.value, tt.from, tt.to); math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("Convert(%v, %s, %s) = %v, want %v", tt.value, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	tests := []struct {
+		name             string
+		system           string
+		temp, press, alt string
+		want             Preferences
+		wantErr          bool
+	}{
+		{name: "default is metric", want: Metric},
+		{name: "imperial", system: "Imperial", want: Imperial},
+		{
+			name:   "override pressure",
+			system: SystemImperial,
+			press:  "mmhg",
+			want:   Preferences{System: SystemImperial, Temperature: Fahrenheit, Pressure: MmHg, Altitude: Feet},
+		},
+		{
+			name: "override temperature",
+			temp: "f",
+			want: Preferences{System: SystemMetric, Temperature: Fahrenheit, Pressure: HPa, Altitude: Metres},
+		},
+		{name: "unknown system", system: "nautical", wantErr: true},
+		{name: "unknown unit", alt: "furlong", wantErr: true},
+		{name: "wrong quantity", temp: "hPa", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ForSystem(tt.system)
+			if err == nil {
+				p, err = p.Override(tt.temp, tt.press, tt.alt)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && p != tt.want {
+				t.Errorf("got %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+
+	v, unit := Imperial.Convert(25, Celsius)
+	if v != 77 || unit != Fahrenheit {
+		t.Errorf("Imperial.Convert(25, C) = %v %s, want 77 F", v, unit)
+	}
+	if v, unit := Imperial.Convert(8.5, "g/m3"); v != 8.5 || unit != "g/m3" {
+		t.Errorf("Imperial.Convert(8.5, g/m3) = %v %s, want unchanged", v, unit)
+	}
+	if v, unit := Imperial.ConvertChange(5, Celsius); v != 9 || unit != Fahrenheit {
+		t.Errorf("Imperial.ConvertChange(5, C) = %v %s, want 9 F", v, unit)
+	}
+	if v, unit := Imperial.ConvertChange(10, Metres); math.Abs(v-32.808) > 0.01 || unit != Feet {
+		t.Errorf("Imperial.ConvertChange(10, m) = %v %s, want 32.808 ft", v, unit)
+	}
+}
@@ -10,8 +10,17 @@ import (
 const (
 	PacketTypeAnnounce = iota + 1
 	PacketTypeSensorData
+	PacketTypeSensorError
+	PacketTypeEvent
 )
 
+var packetTypeNames = map[uint8]string{
+	PacketTypeAnnounce:    "announce",
+	PacketTypeSensorData:  "sensorData",
+	PacketTypeSensorError: "sensorError",
+	PacketTypeEvent:       "event",
+}
+
 type Packet struct {
 	// UID is the "deviceID" of the node sending the packet
 	UID uint8
@@ -34,6 +43,15 @@ func ParseHost(host string) (net.IP, error) {
 	return ip, nil
 }
 
+// TypeName maps packet types to human readable names
+func TypeName(typ uint8) string {
+	if n, ok := packetTypeNames[typ]; ok {
+		return n
+	}
+
+	return "unknown"
+}
+
 func (p Packet) Encode(w io.Writer) error {
 	e := gob.NewEncoder(w)
 
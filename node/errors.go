@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mynet "github.com/Heanthor/quill-secure/net"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// errorPolicy controls how the node reacts to errors reported by sensors
+type errorPolicy struct {
+	// LogInterval is the minimum time between logged errors from one sensor. Errors in between are counted and summarized.
+	LogInterval time.Duration
+	// RestartAfter is how many errors within RestartWindow cause the sensor to be restarted. Zero never restarts.
+	// Process exits are not counted, since the supervisor already restarts the process.
+	RestartAfter  int
+	RestartWindow time.Duration
+}
+
+var defaultErrorPolicy = errorPolicy{
+	LogInterval:   time.Minute,
+	RestartAfter:  10,
+	RestartWindow: 5 * time.Minute,
+}
+
+// errorState is the rate limiting and escalation state of a single sensor
+type errorState struct {
+	lastLogged time.Time
+	suppressed int
+	recent     []time.Time
+}
+
+// consumeErrors handles every error reported by a sensor until errorPings is closed
+func (s *SensorCollection) consumeErrors() {
+	states := make(map[sensor.Sensor]*errorState)
+	for e := range s.errorPings {
+		st, ok := states[e.sensor]
+		if !ok {
+			st = &errorState{}
+			states[e.sensor] = st
+		}
+		s.handleSensorError(e, st, time.Now())
+	}
+}
+
+func (s *SensorCollection) handleSensorError(e sensorErrorWrapper, st *errorState, now time.Time) {
+	s.logSensorError(e, st, now)
+	s.reportSensorError(e.sensor, e.err.Error(), false, now)
+
+	// the supervisor restarts exited processes itself, and gives up on crash loops for good
+	if s.errorPolicy.RestartAfter == 0 || errors.Is(e.err, sensor.ErrSensorExited) || errors.Is(e.err, sensor.ErrCrashLoop) {
+		return
+	}
+	rs, ok := e.sensor.(sensor.Restarter)
+	if !ok {
+		return
+	}
+
+	st.recent = append(st.recent, now)
+	for len(st.recent) > 0 && now.Sub(st.recent[0]) > s.errorPolicy.RestartWindow {
+		st.recent = st.recent[1:]
+	}
+	if len(st.recent) < s.errorPolicy.RestartAfter {
+		return
+	}
+
+	msg := fmt.Sprintf("restarting after %d errors in %s", len(st.recent), s.errorPolicy.RestartWindow)
+	st.recent = nil
+	sensorErrorRestarts.WithLabelValues(e.sensor.Name()).Inc()
+	log.Warn().Str("sensor", e.sensor.Name()).Msg("Sensor reported too many errors, " + msg)
+	if err := rs.Restart(); err != nil {
+		log.Err(err).Str("sensor", e.sensor.Name()).Msg("Failed to restart sensor")
+		return
+	}
+	s.reportSensorError(e.sensor, msg, true, now)
+}
+
+// logSensorError logs at most one error per sensor each LogInterval, then how many were suppressed
+func (s *SensorCollection) logSensorError(e sensorErrorWrapper, st *errorState, now time.Time) {
+	if !st.lastLogged.IsZero() && now.Sub(st.lastLogged) < s.errorPolicy.LogInterval {
+		st.suppressed++
+		return
+	}
+
+	lm := log.Warn().Err(e.err).Str("sensor", e.sensor.Name())
+	if st.suppressed > 0 {
+		lm = lm.Int("suppressed", st.suppressed)
+	}
+	lm.Msg("Sensor error")
+	st.lastLogged = now
+	st.suppressed = 0
+}
+
+// reportSensorError queues an error packet for the leader, dropping it if the outgoing buffer is full
+func (s *SensorCollection) reportSensorError(sn sensor.Sensor, msg string, restarted bool, now time.Time) {
+	p := mynet.Packet{
+		UID: s.deviceID,
+		Typ: mynet.PacketTypeSensorError,
+		Data: sensor.ErrorReport{
+			Typ:       sn.Type(),
+			Name:      sn.Name(),
+			Timestamp: now,
+			Message:   msg,
+			Restarted: restarted,
+		},
+	}
+
+	select {
+	case s.sendChan <- outgoingPacketWrapper{p, sn}:
+	default:
+		log.Warn().Msg("Sensor buffer is full, dropping error packet")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mynet "github.com/Heanthor/quill-secure/net"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"testing"
+	"time"
+)
+
+// restartableSensor counts restarts requested by the node
+type restartableSensor struct {
+	sensor.FakeSensor
+	restarts int
+}
+
+func (r *restartableSensor) Restart() error {
+	r.restarts++
+	return nil
+}
+
+func TestSensorCollection_handleSensorError(t *testing.T) {
+	start := time.Unix(1660369274, 0)
+	policy := errorPolicy{
+		LogInterval:   time.Minute,
+		RestartAfter:  3,
+		RestartWindow: time.Minute,
+	}
+
+	tests := []struct {
+		name         string
+		err          error
+		at           []time.Duration
+		wantRestarts int
+		wantPackets  int
+	}{
+		{
+			name:        "below threshold",
+			err:         errors.New("crc mismatch"),
+			at:          []time.Duration{0, time.Second},
+			wantPackets: 2,
+		},
+		{
+			name:         "threshold within window",
+			err:          errors.New("crc mismatch"),
+			at:           []time.Duration{0, time.Second, 2 * time.Second},
+			wantRestarts: 1,
+			wantPackets:  4,
+		},
+		{
+			name:        "threshold spread past window",
+			err:         errors.New("crc mismatch"),
+			at:          []time.Duration{0, time.Minute, 2*time.Minute + time.Second},
+			wantPackets: 3,
+		},
+		{
+			name:        "process exits are left to the supervisor",
+			err:         fmt.Errorf("%w: exit status 1", sensor.ErrSensorExited),
+			at:          []time.Duration{0, time.Second, 2 * time.Second},
+			wantPackets: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := SensorCollection{
+				deviceID:    1,
+				sendChan:    make(chan outgoingPacketWrapper, 10),
+				errorPolicy: policy,
+			}
+			sn := &restartableSensor{}
+			st := &errorState{}
+			for _, at := range tt.at {
+				s.handleSensorError(sensorErrorWrapper{sensor: sn, err: tt.err}, st, start.Add(at))
+			}
+
+			if sn.restarts != tt.wantRestarts {
+				t.Errorf("restarts = %d, want %d", sn.restarts, tt.wantRestarts)
+			}
+			if len(s.sendChan) != tt.wantPackets {
+				t.Fatalf("packets = %d, want %d", len(s.sendChan), tt.wantPackets)
+			}
+			for range tt.at {
+				w := <-s.sendChan
+				if w.p.Typ != mynet.PacketTypeSensorError {
+					t.Errorf("packet type = %d, want %d", w.p.Typ, mynet.PacketTypeSensorError)
+				}
+			}
+			if tt.wantRestarts > 0 {
+				if report := (<-s.sendChan).p.Data.(sensor.ErrorReport); !report.Restarted {
+					t.Errorf("last report %+v not marked restarted", report)
+				}
+			}
+		})
+	}
+}
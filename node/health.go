@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// healthPolicy decides when a sensor is degraded or failed
+type healthPolicy struct {
+	// DegradedAfter and FailedAfter are how long a sensor may go without sending data
+	DegradedAfter time.Duration
+	FailedAfter   time.Duration
+	// DegradedErrors and FailedErrors are how many errors within ErrorWindow a sensor may report
+	ErrorWindow    time.Duration
+	DegradedErrors int
+	FailedErrors   int
+}
+
+// defaultHealthCheckInterval is used when no check interval is configured
+const defaultHealthCheckInterval = 10 * time.Second
+
+var defaultHealthPolicy = healthPolicy{
+	DegradedAfter:  time.Minute,
+	FailedAfter:    5 * time.Minute,
+	ErrorWindow:    5 * time.Minute,
+	DegradedErrors: 3,
+	FailedErrors:   10,
+}
+
+// healthTracker records the data and errors seen from a single sensor
+type healthTracker struct {
+	lock         sync.Mutex
+	registeredAt time.Time
+	// eventDriven sensors only report changes, so are not expected to send data on any schedule
+	eventDriven bool
+	lastData    time.Time
+	errors      []time.Time
+
+	health sensor.Health
+	reason string
+}
+
+func newHealthTracker(now time.Time, eventDriven bool) *healthTracker {
+	return &healthTracker{registeredAt: now, eventDriven: eventDriven}
+}
+
+func (h *healthTracker) dataSeen(now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastData = now
+}
+
+func (h *healthTracker) errorSeen(now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.errors = append(h.errors, now)
+}
+
+// evaluate combines the result of Ping with data age and error rate, keeping the worst of the three.
+// It returns the new health, and whether it changed since the last evaluation.
+func (h *healthTracker) evaluate(p healthPolicy, pingErr error, now time.Time) (sensor.Health, string, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for len(h.errors) > 0 && now.Sub(h.errors[0]) > p.ErrorWindow {
+		h.errors = h.errors[1:]
+	}
+
+	health, reason := sensor.HealthHealthy, ""
+	worsen := func(to sensor.Health, why string) {
+		if to > health {
+			health, reason = to, why
+		}
+	}
+
+	if pingErr != nil {
+		if errors.Is(pingErr, sensor.ErrSensorFailed) {
+			worsen(sensor.HealthFailed, pingErr.Error())
+		} else {
+			worsen(sensor.HealthDegraded, pingErr.Error())
+		}
+	}
+
+	// an unchanged door is not a stale one, so only sampled sensors are checked for data age
+	if !h.eventDriven {
+		since := h.lastData
+		if since.IsZero() {
+			since = h.registeredAt
+		}
+		if age := now.Sub(since); age > p.FailedAfter {
+			worsen(sensor.HealthFailed, fmt.Sprintf("no data for %s", age.Round(time.Second)))
+		} else if age > p.DegradedAfter {
+			worsen(sensor.HealthDegraded, fmt.Sprintf("no data for %s", age.Round(time.Second)))
+		}
+	}
+
+	if n := len(h.errors); n >= p.FailedErrors {
+		worsen(sensor.HealthFailed, fmt.Sprintf("%d errors in %s", n, p.ErrorWindow))
+	} else if n >= p.DegradedErrors {
+		worsen(sensor.HealthDegraded, fmt.Sprintf("%d errors in %s", n, p.ErrorWindow))
+	}
+
+	changed := health != h.health
+	h.health, h.reason = health, reason
+
+	return health, reason, changed
+}
+
+// status fills the health fields of st from the most recent evaluation
+func (h *healthTracker) status(st sensor.Status) sensor.Status {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	st.Health = h.health
+	st.HealthReason = h.reason
+	st.LastDataAt = h.lastData
+	st.RecentErrors = len(h.errors)
+
+	return st
+}
+
+// StartSensorHealthCheck pings every sensor each interval, logging any change in health.
+// The latest health is included in each announce to the leader.
+func (s *SensorCollection) StartSensorHealthCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	s.checkSensorHealth()
+	go func() {
+		t := time.NewTicker(interval)
+		for range t.C {
+			s.checkSensorHealth()
+		}
+	}()
+}
+
+func (s *SensorCollection) checkSensorHealth() {
+	now := time.Now()
+	for _, sn := range s.activeSensors {
+		health, reason, changed := s.health[sn].evaluate(s.healthPolicy, sn.Ping(), now)
+		if !changed {
+			continue
+		}
+
+		lm := log.Info()
+		if health != sensor.HealthHealthy {
+			lm = log.Warn()
+		}
+		lm.Str("sensor", sn.Name()).Stringer("health", health).Str("reason", reason).Msg("Sensor health changed")
+	}
+}
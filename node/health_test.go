@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"testing"
+	"time"
+)
+
+func TestHealthTracker_evaluate(t *testing.T) {
+	start := time.Unix(1660369274, 0)
+
+	tests := []struct {
+		name       string
+		lastData   time.Duration
+		errors     []time.Duration
+		pingErr    error
+		event      bool
+		at         time.Duration
+		wantHealth sensor.Health
+		wantReason string
+	}{
+		{
+			name:       "fresh data",
+			lastData:   50 * time.Second,
+			at:         time.Minute,
+			wantHealth: sensor.HealthHealthy,
+		},
+		{
+			name:       "no data since registration",
+			at:         2 * time.Minute,
+			wantHealth: sensor.HealthDegraded,
+			wantReason: "no data for 2m0s",
+		},
+		{
+			name:       "event driven sensors are never stale",
+			event:      true,
+			at:         time.Hour,
+			wantHealth: sensor.HealthHealthy,
+		},
+		{
+			name:       "stale data",
+			lastData:   time.Minute,
+			at:         7 * time.Minute,
+			wantHealth: sensor.HealthFailed,
+			wantReason: "no data for 6m0s",
+		},
+		{
+			name:       "ping degraded",
+			lastData:   time.Minute,
+			pingErr:    errors.New("process is not running"),
+			at:         time.Minute,
+			wantHealth: sensor.HealthDegraded,
+			wantReason: "process is not running",
+		},
+		{
+			name:       "ping failed beats degraded errors",
+			lastData:   time.Minute,
+			errors:     []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second},
+			pingErr:    fmt.Errorf("%w: gave up", sensor.ErrSensorFailed),
+			at:         time.Minute,
+			wantHealth: sensor.HealthFailed,
+			wantReason: "sensor failed: gave up",
+		},
+		{
+			name:       "errors within window",
+			lastData:   time.Minute,
+			errors:     []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second},
+			at:         time.Minute,
+			wantHealth: sensor.HealthDegraded,
+			wantReason: "3 errors in 5m0s",
+		},
+		{
+			name:       "errors outside window",
+			lastData:   6 * time.Minute,
+			errors:     []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second},
+			at:         6 * time.Minute,
+			wantHealth: sensor.HealthHealthy,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealthTracker(start, tt.event)
+			if tt.lastData > 0 {
+				h.dataSeen(start.Add(tt.lastData))
+			}
+			for _, e := range tt.errors {
+				h.errorSeen(start.Add(e))
+			}
+
+			health, reason, changed := h.evaluate(defaultHealthPolicy, tt.pingErr, start.Add(tt.at))
+			if health != tt.wantHealth {
+				t.Errorf("evaluate() health = %v, want %v", health, tt.wantHealth)
+			}
+			if reason != tt.wantReason {
+				t.Errorf("evaluate() reason = %q, want %q", reason, tt.wantReason)
+			}
+			if !changed {
+				t.Errorf("evaluate() changed = false on first evaluation")
+			}
+		})
+	}
+}
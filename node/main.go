@@ -14,6 +14,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -58,19 +59,23 @@ func main() {
 
 	log.Info().Str("env", env).Msg("QuillSecure Node booting...")
 	gob.Register(sensor.Data{})
+	gob.Register(sensor.NodeStatus{})
+	gob.Register(sensor.ErrorReport{})
+	gob.Register(sensor.Event{})
 
 	sc := NewSensorCollection(deviceID,
 		viper.GetString("leaderHost"),
 		viper.GetInt("leaderPort"),
 		viper.GetInt("pingIntervalSecs"),
-		viper.GetInt("packetBufferSize"))
+		viper.GetInt("packetBufferSize"),
+		sensorHealthPolicy(),
+		sensorErrorPolicy())
 	setCloseHandler(&sc)
 
 	// find and activate all sensor connected to device
-	sc.RegisterSensors(
-		viper.GetString("sensors.atmospheric.executable"),
-		viper.GetInt("sensors.atmospheric.pollFrequencySec"),
-	)
+	sc.RegisterSensors(sensorConfigs())
+	sc.StartMetricsListener(viper.GetInt("metricsPort"))
+	sc.StartSensorHealthCheck(time.Duration(viper.GetInt("sensorHealth.checkIntervalSecs")) * time.Second)
 	// start periodic health ping to leader
 	sc.StartLeaderHealthCheck()
 
@@ -81,7 +86,7 @@ func main() {
 }
 
 func setCloseHandler(sc *SensorCollection) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -89,11 +94,77 @@ func setCloseHandler(sc *SensorCollection) {
 		sc.StopPolling()
 		// drain outgoing packets before exiting
 		// TODO should this have a timeout?
-		<-sc.doneChan
+		<-sc.sent
 		os.Exit(0)
 	}()
 }
 
+// restartPolicy reads the sensorRestart config section, falling back to sensor.DefaultRestartPolicy
+func restartPolicy() sensor.RestartPolicy {
+	p := sensor.DefaultRestartPolicy
+	if viper.IsSet("sensorRestart.initialBackoffSecs") {
+		p.InitialBackoff = time.Duration(viper.GetInt("sensorRestart.initialBackoffSecs")) * time.Second
+	}
+	if viper.IsSet("sensorRestart.maxBackoffSecs") {
+		p.MaxBackoff = time.Duration(viper.GetInt("sensorRestart.maxBackoffSecs")) * time.Second
+	}
+	if viper.IsSet("sensorRestart.maxRestarts") {
+		p.MaxRestarts = viper.GetInt("sensorRestart.maxRestarts")
+	}
+	if viper.IsSet("sensorRestart.crashLoopWindowSecs") {
+		p.CrashLoopWindow = time.Duration(viper.GetInt("sensorRestart.crashLoopWindowSecs")) * time.Second
+	}
+
+	return p
+}
+
+// sensorConfigs reads the sensors config list, giving each process backed sensor the configured restart policy.
+// The original config format, a map with a single atmospheric entry, is still accepted.
+func sensorConfigs() []sensor.Config {
+	var configs []sensor.Config
+	if viper.IsSet("sensors.atmospheric.executable") {
+		log.Warn().Msg("sensors.atmospheric is deprecated, move it to an entry in the sensors list")
+		configs = []sensor.Config{{
+			Type:             "atmospheric",
+			PollIntervalSecs: viper.GetInt("sensors.atmospheric.pollFrequencySec"),
+			Options: map[string]interface{}{
+				"executable": viper.GetString("sensors.atmospheric.executable"),
+			},
+		}}
+	} else if err := viper.UnmarshalKey("sensors", &configs); err != nil {
+		log.Fatal().Err(err).Msg("Invalid sensors config")
+	}
+
+	policy := restartPolicy()
+	for i := range configs {
+		configs[i].RestartPolicy = policy
+	}
+
+	return configs
+}
+
+// sensorHealthPolicy reads the sensorHealth config section, falling back to defaultHealthPolicy
+func sensorHealthPolicy() healthPolicy {
+	p := defaultHealthPolicy
+	if viper.IsSet("sensorHealth.degradedAfterSecs") {
+		p.DegradedAfter = time.Duration(viper.GetInt("sensorHealth.degradedAfterSecs")) * time.Second
+	}
+	if viper.IsSet("sensorHealth.failedAfterSecs") {
+		p.FailedAfter = time.Duration(viper.GetInt("sensorHealth.failedAfterSecs")) * time.Second
+	}
+	if viper.IsSet("sensorHealth.errorWindowSecs") {
+		p.ErrorWindow = time.Duration(viper.GetInt("sensorHealth.errorWindowSecs")) * time.Second
+	}
+	if viper.IsSet("sensorHealth.degradedErrors") {
+		p.DegradedErrors = viper.GetInt("sensorHealth.degradedErrors")
+	}
+	if viper.IsSet("sensorHealth.failedErrors") {
+		p.FailedErrors = viper.GetInt("sensorHealth.failedErrors")
+	}
+
+	return p
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -124,3 +195,19 @@ func initConfig() {
 
 	boot.SetGlobalLogger()
 }
+
+// sensorErrorPolicy reads the sensorErrors config section, falling back to defaultErrorPolicy
+func sensorErrorPolicy() errorPolicy {
+	p := defaultErrorPolicy
+	if viper.IsSet("sensorErrors.logIntervalSecs") {
+		p.LogInterval = time.Duration(viper.GetInt("sensorErrors.logIntervalSecs")) * time.Second
+	}
+	if viper.IsSet("sensorErrors.restartAfter") {
+		p.RestartAfter = viper.GetInt("sensorErrors.restartAfter")
+	}
+	if viper.IsSet("sensorErrors.restartWindowSecs") {
+		p.RestartWindow = time.Duration(viper.GetInt("sensorErrors.restartWindowSecs")) * time.Second
+	}
+
+	return p
+}
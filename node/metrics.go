@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+)
+
+const metricsNamespace = "quillsecure_node"
+
+var (
+	sendFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "send_failures_total",
+		Help:      "Number of packets which could not be sent to the leader.",
+	})
+
+	sensorErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sensor_errors_total",
+		Help:      "Number of errors reported by sensors.",
+	}, []string{"sensor"})
+
+	sensorErrorRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sensor_error_restarts_total",
+		Help:      "Number of times a sensor was restarted because it reported too many errors.",
+	}, []string{"sensor"})
+)
+
+// StartMetricsListener serves Prometheus metrics on port in the background.
+// A port of 0 disables the listener.
+func (s *SensorCollection) StartMetricsListener(port int) {
+	if port == 0 {
+		return
+	}
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "outbox_depth",
+		Help:      "Number of packets buffered for sending to the leader.",
+	}, func() float64 {
+		return float64(len(s.sendChan))
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Info().Int("port", port).Msg("Metrics listener initialized")
+		if err := http.ListenAndServe(":"+strconv.Itoa(port), mux); err != nil {
+			log.Err(err).Msg("Error in metrics listener")
+		}
+	}()
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -15,13 +16,23 @@ type SensorCollection struct {
 	activeSensors []sensor.Sensor
 	sensorPings   chan sensorDataWrapper
 	errorPings    chan sensorErrorWrapper
+	eventPings    chan sensorEventWrapper
 
 	leader        mynet.Dest
 	pingTicker    *time.Ticker
 	leaderHealthy bool
 
 	sendChan chan outgoingPacketWrapper
-	doneChan chan bool
+	// stop is closed by StopPolling to stop the goroutine of each sensor, and sensors waits for them to return
+	stop    chan struct{}
+	sensors *sync.WaitGroup
+	// sent is closed by sendConsumer once sendChan is closed and every packet in it has been sent
+	sent chan struct{}
+
+	// health is written once per sensor at registration, then only read
+	health       map[sensor.Sensor]*healthTracker
+	healthPolicy healthPolicy
+	errorPolicy  errorPolicy
 }
 
 type outgoingPacketWrapper struct {
@@ -30,7 +41,7 @@ type outgoingPacketWrapper struct {
 }
 
 // NewSensorCollection creates resources, but does not start any polling or processing
-func NewSensorCollection(deviceID uint8, host string, port, pingIntervalSecs, packetBufferSize int) SensorCollection {
+func NewSensorCollection(deviceID uint8, host string, port, pingIntervalSecs, packetBufferSize int, healthPolicy healthPolicy, errorPolicy errorPolicy) SensorCollection {
 	t := time.NewTicker(time.Duration(pingIntervalSecs) * time.Second)
 	sendChan := make(chan outgoingPacketWrapper, packetBufferSize)
 	ip, err := mynet.ParseHost(host)
@@ -46,9 +57,16 @@ func NewSensorCollection(deviceID uint8, host string, port, pingIntervalSecs, pa
 		},
 		sensorPings: make(chan sensorDataWrapper),
 		errorPings:  make(chan sensorErrorWrapper),
-		doneChan:    make(chan bool),
+		eventPings:  make(chan sensorEventWrapper),
+		stop:        make(chan struct{}),
+		sensors:     &sync.WaitGroup{},
+		sent:        make(chan struct{}),
 		sendChan:    sendChan,
 		pingTicker:  t,
+
+		health:       make(map[sensor.Sensor]*healthTracker),
+		healthPolicy: healthPolicy,
+		errorPolicy:  errorPolicy,
 	}
 }
 
@@ -62,35 +80,90 @@ type sensorErrorWrapper struct {
 	err    error
 }
 
-func (s *SensorCollection) RegisterSensors(atmosphericExecutable string, atmosphericPollFreq int) {
-	//s.registerSensor(&sensor.FakeSensor{Buf: "fake data"})
-	s.registerSensor(sensor.NewAtmospheric(atmosphericExecutable, atmosphericPollFreq))
+type sensorEventWrapper struct {
+	sensor sensor.Sensor
+	event  sensor.Event
+}
+
+// RegisterSensors creates and initializes a sensor for each config entry. Every sensor must have a unique name.
+func (s *SensorCollection) RegisterSensors(configs []sensor.Config) {
+	names := make(map[string]bool, len(configs))
+	for _, cfg := range configs {
+		sn, err := sensor.New(cfg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid sensor config")
+			return
+		}
+		if names[sn.Name()] {
+			log.Fatal().Str("sensor", sn.Name()).Msg("Duplicate sensor name, give each sensor of the same type a name")
+			return
+		}
+		names[sn.Name()] = true
+		s.registerSensor(sn)
+	}
+	if len(s.activeSensors) == 0 {
+		log.Warn().Msg("No sensors configured")
+	}
 }
 
 func (s *SensorCollection) registerSensor(sn sensor.Sensor) {
 	if err := sn.Init(); err != nil {
-		log.Fatal().Err(err).Str("type", sn.TypeStr()).Msg("Sensor failed to initialize")
+		log.Fatal().Err(err).Str("sensor", sn.Name()).Msg("Sensor failed to initialize")
 		return
 	}
 
-	log.Info().Str("type", sn.TypeStr()).Msg("Registered new sensor")
+	log.Info().Str("type", sn.TypeStr()).Str("sensor", sn.Name()).Msg("Registered new sensor")
+	// event driven sensors only report when something happens, so are never stale
+	var events chan sensor.Event
+	es, eventDriven := sn.(sensor.EventSource)
+	tracker := newHealthTracker(time.Now(), eventDriven)
+	s.health[sn] = tracker
 
 	// consolidate pings from sensors into single channels
+	s.sensors.Add(1)
 	go func(sn sensor.Sensor) {
+		defer s.sensors.Done()
 		data, err := sn.Data()
+		if eventDriven {
+			events = es.Events()
+		}
 		for {
 			select {
-			case <-s.doneChan:
+			case <-s.stop:
 				return
-			case d := <-data:
-				s.sensorPings <- sensorDataWrapper{
-					sensor: sn,
-					data:   d,
+			case d, more := <-data:
+				if !more {
+					log.Warn().Str("sensor", sn.Name()).Msg("Sensor data stream ended")
+					return
+				}
+				tracker.dataSeen(time.Now())
+				d.Sensor = sn.Name()
+				select {
+				case s.sensorPings <- sensorDataWrapper{sensor: sn, data: d}:
+				case <-s.stop:
+					return
+				}
+			case e, more := <-events:
+				if !more {
+					// stop selecting on the closed channel, the data channel ends the sensor
+					events = nil
+					continue
+				}
+				tracker.dataSeen(time.Now())
+				e.Typ = sn.Type()
+				e.Sensor = sn.Name()
+				select {
+				case s.eventPings <- sensorEventWrapper{sensor: sn, event: e}:
+				case <-s.stop:
+					return
 				}
 			case e := <-err:
-				s.errorPings <- sensorErrorWrapper{
-					sensor: sn,
-					err:    e,
+				sensorErrors.WithLabelValues(sn.Name()).Inc()
+				tracker.errorSeen(time.Now())
+				select {
+				case s.errorPings <- sensorErrorWrapper{sensor: sn, err: e}:
+				case <-s.stop:
+					return
 				}
 			}
 		}
@@ -99,13 +172,18 @@ func (s *SensorCollection) registerSensor(sn sensor.Sensor) {
 	s.activeSensors = append(s.activeSensors, sn)
 }
 
+// StopPolling stops every sensor and closes the channels they ping on, once nothing can send on them any more.
+// Poll then closes sendChan, and sent is closed once the packets left in it have been sent.
 func (s *SensorCollection) StopPolling() {
+	close(s.stop)
 	for _, sn := range s.activeSensors {
 		sn.Close()
 	}
+	s.sensors.Wait()
 
 	close(s.sensorPings)
-	close(s.sendChan)
+	close(s.errorPings)
+	close(s.eventPings)
 }
 
 // StartLeaderHealthCheck pings the leader node every pingIntervalSecs seconds
@@ -129,11 +207,16 @@ func (s *SensorCollection) StartLeaderHealthCheck() {
 	}()
 }
 
-// pingLeader opens a TCP conn, sends a small amount of data, and returns error if the message is not acked.
+// pingLeader opens a TCP conn, sends the status of each sensor, and returns error if the message is not acked.
 func (s *SensorCollection) pingLeader() error {
+	status := sensor.NodeStatus{}
+	for _, sn := range s.activeSensors {
+		status.Sensors = append(status.Sensors, s.health[sn].status(sensor.StatusOf(sn)))
+	}
 	p := mynet.Packet{
-		UID: s.deviceID,
-		Typ: mynet.PacketTypeAnnounce,
+		UID:  s.deviceID,
+		Typ:  mynet.PacketTypeAnnounce,
+		Data: status,
 	}
 
 	return s.SendPacket(p)
@@ -147,12 +230,13 @@ func (s *SensorCollection) sendConsumer() {
 			select {
 			case w, more := <-s.sendChan:
 				if !more {
-					s.doneChan <- true
+					close(s.sent)
 					return
 				} else {
 					if err := s.SendPacket(w.p); err != nil {
 						// TODO maybe use an error chan
-						log.Err(err).Uint8("sensor", w.s.Type()).Msg("Error sending packet")
+						sendFailures.Inc()
+						log.Err(err).Str("sensor", w.s.Name()).Msg("Error sending packet")
 					}
 				}
 			}
@@ -161,9 +245,20 @@ func (s *SensorCollection) sendConsumer() {
 }
 
 // Poll polls connected sensors, and sends any new data to the leader node
-// This method blocks on sensorPings
+// This method blocks on sensorPings, and after StopPolling until the queued packets have been sent
 func (s *SensorCollection) Poll() {
 	go s.sendConsumer()
+	// errors and events are also queued on sendChan, so it is only closed once their consumers return
+	var consumers sync.WaitGroup
+	consumers.Add(2)
+	go func() {
+		defer consumers.Done()
+		s.consumeErrors()
+	}()
+	go func() {
+		defer consumers.Done()
+		s.forwardEvents()
+	}()
 
 	for sn := range s.sensorPings {
 		data := sn.data
@@ -180,6 +275,28 @@ func (s *SensorCollection) Poll() {
 			log.Warn().Msg("Sensor buffer is full, dropping packet")
 		}
 	}
+
+	consumers.Wait()
+	close(s.sendChan)
+	<-s.sent
+}
+
+// forwardEvents sends each sensor event to the leader, until eventPings is closed
+func (s *SensorCollection) forwardEvents() {
+	for ev := range s.eventPings {
+		log.Info().Str("sensor", ev.event.Sensor).Str("kind", ev.event.Kind).Str("state", ev.event.State).Msg("Sensor event")
+		p := mynet.Packet{
+			UID:  s.deviceID,
+			Typ:  mynet.PacketTypeEvent,
+			Data: ev.event,
+		}
+
+		select {
+		case s.sendChan <- outgoingPacketWrapper{p, ev.sensor}:
+		default:
+			log.Warn().Msg("Sensor buffer is full, dropping event packet")
+		}
+	}
 }
 
 // SendPacket opens a TCP conn to leader, sends the packet, and closes the connection
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/Heanthor/quill-secure/node/sensor"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSensorCollection_StopPolling stops polling while sensors are still sending, which must neither panic
+// on a closed channel nor leave Poll blocked
+func TestSensorCollection_StopPolling(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	s := NewSensorCollection(1, addr.IP.String(), addr.Port, 60, 10, healthPolicy{}, errorPolicy{})
+	s.leaderHealthy = true
+	for _, name := range []string{"fake_1", "fake_2"} {
+		s.registerSensor(&sensor.FakeSensor{SensorName: name, Interval: time.Millisecond})
+	}
+
+	polled := make(chan struct{})
+	go func() {
+		s.Poll()
+		close(polled)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	s.StopPolling()
+	select {
+	case <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Poll() did not return after StopPolling()")
+	}
+	select {
+	case <-s.sent:
+	default:
+		t.Error("sent is not closed after Poll() returned")
+	}
+}
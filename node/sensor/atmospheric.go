@@ -1,21 +1,21 @@
 package sensor
 
 import (
+	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
-	"io"
-	"os/exec"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 )
 
 // AtmosphericSensor tracks sensor input from the BME280 and SGP40 sensor boards from Adafruit
 type AtmosphericSensor struct {
-	sensorProc     *exec.Cmd
-	sensorStdout   io.Reader
+	name           string
+	sensorProc     *Supervisor
 	executablePath string
 	pollFreq       int
+	restartPolicy  RestartPolicy
 }
 
 type AtmosphericDataLine struct {
@@ -27,10 +27,76 @@ type AtmosphericDataLine struct {
 	VOCIndex    float32
 }
 
-func NewAtmospheric(executable string, sensorPollFreqSec int) *AtmosphericSensor {
+const (
+	MetricTemperature = "temperature"
+	MetricHumidity    = "humidity"
+	MetricPressure    = "pressure"
+	MetricAltitude    = "altitude"
+	MetricVOCIndex    = "voc_index"
+)
+
+func init() {
+	RegisterMetric(Metric{Name: MetricTemperature, Unit: "C", SensorType: TypeAtmospheric})
+	RegisterMetric(Metric{Name: MetricHumidity, Unit: "%", SensorType: TypeAtmospheric})
+	RegisterMetric(Metric{Name: MetricPressure, Unit: "hPa", SensorType: TypeAtmospheric})
+	RegisterMetric(Metric{Name: MetricAltitude, Unit: "m", SensorType: TypeAtmospheric})
+	RegisterMetric(Metric{Name: MetricVOCIndex, Unit: "", SensorType: TypeAtmospheric})
+	RegisterDecoder(TypeAtmospheric, decodeAtmospheric)
+	RegisterFactory(NameByType(TypeAtmospheric), newAtmosphericFromConfig)
+}
+
+// defaultAtmosphericPollInterval is used when the config has no poll interval
+const defaultAtmosphericPollInterval = 15 * time.Second
+
+// newAtmosphericFromConfig is the Factory for atmospheric sensors. The executable option is the driver command line.
+func newAtmosphericFromConfig(cfg Config) (Sensor, error) {
+	executable, err := cfg.String("executable")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAtmospheric(cfg.Name, executable, int(cfg.PollInterval(defaultAtmosphericPollInterval).Seconds()), cfg.RestartPolicy), nil
+}
+
+// decodeAtmospheric is the DecodeFunc for raw driver lines
+func decodeAtmospheric(raw []byte) (time.Time, []Measurement, error) {
+	line := string(raw)
+	if !validateSensorLine(line) {
+		return time.Time{}, nil, errors.New("malformed atmospheric sensor line")
+	}
+	adl := ParseValidAtmosphericSensorLine(line)
+	// an unparseable timestamp comes back as the epoch, which would store the reading in 1970
+	if adl.Timestamp.Unix() <= 0 {
+		return time.Time{}, nil, fmt.Errorf("invalid atmospheric sensor timestamp in %q", line)
+	}
+
+	return adl.Timestamp, adl.Measurements(), nil
+}
+
+// Measurements converts the line into named metric values
+func (a AtmosphericDataLine) Measurements() []Measurement {
+	return []Measurement{
+		{Metric: MetricTemperature, Value: widen(a.Temperature)},
+		{Metric: MetricHumidity, Value: widen(a.Humidity)},
+		{Metric: MetricPressure, Value: widen(a.Pressure)},
+		{Metric: MetricAltitude, Value: widen(a.Altitude)},
+		{Metric: MetricVOCIndex, Value: widen(a.VOCIndex)},
+	}
+}
+
+// widen converts f to the float64 closest to its shortest decimal form, so 25.2 stays 25.2 rather than 25.200000762939453
+func widen(f float32) float64 {
+	w, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+
+	return w
+}
+
+func NewAtmospheric(name, executable string, sensorPollFreqSec int, restartPolicy RestartPolicy) *AtmosphericSensor {
 	return &AtmosphericSensor{
+		name:           name,
 		executablePath: executable,
 		pollFreq:       sensorPollFreqSec,
+		restartPolicy:  restartPolicy,
 	}
 }
 
@@ -42,55 +108,57 @@ func (a *AtmosphericSensor) TypeStr() string {
 	return NameByType(int(a.Type()))
 }
 
+func (a *AtmosphericSensor) Name() string {
+	return a.name
+}
+
+// Ping fails once the sensor process is crash looping, and is degraded while it is waiting to be restarted
 func (a *AtmosphericSensor) Ping() error {
-	//TODO implement me
-	panic("implement me")
+	select {
+	case <-a.sensorProc.Done():
+		return fmt.Errorf("%w: process is not being restarted after %d restarts", ErrSensorFailed, a.Restarts())
+	default:
+	}
+	if !a.sensorProc.Running() {
+		return errors.New("process is not running")
+	}
+
+	return nil
 }
 
 func (a *AtmosphericSensor) Init() error {
 	args := strings.Split(a.executablePath, " ")
 	args = append(args, "--poll-frequency="+strconv.Itoa(a.pollFreq))
 	log.Debug().Str("path", a.executablePath).Msg("Atmospheric executable path")
-	cmd := exec.Command(args[0], args[1:]...)
-	a.sensorProc = cmd
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	a.sensorStdout = stdout
+	a.sensorProc = NewSupervisor(a.name, args, a.restartPolicy)
 
 	// start nonblocking
-	if err := cmd.Start(); err != nil {
-		return err
-	}
+	return a.sensorProc.Start()
+}
 
-	return nil
+// Restarts returns the number of times the sensor process has been restarted
+func (a *AtmosphericSensor) Restarts() int {
+	return a.sensorProc.Restarts()
 }
 
+// Restart restarts the sensor process
+func (a *AtmosphericSensor) Restart() error {
+	return a.sensorProc.Restart()
+}
+
+// Data reads newline delimited lines from the sensor process. Each time the process exits, the exit status is sent
+// as an ErrSensorExited on the error channel. If the process cannot be kept running, ErrCrashLoop is sent
+// and the data channel is closed.
 func (a *AtmosphericSensor) Data() (chan Data, chan error) {
-	errCh := make(chan error)
 	dataCh := make(chan Data)
 
 	go func() {
-		buf := make([]byte, 4096)
-		for {
-			n, err := a.sensorStdout.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					// sensor program died or program exited
-				} else {
-					errCh <- err
-				}
-			}
-
-			if n == 0 {
-				time.Sleep(100 * time.Millisecond)
+		defer close(dataCh)
+		for sensorLine := range a.sensorProc.Lines() {
+			sensorLine = strings.TrimSpace(sensorLine)
+			if sensorLine == "" {
 				continue
 			}
-
-			sensorLine := string(buf[:n])
-			sensorLine = strings.TrimSpace(sensorLine)
 			lm := log.Debug().Str("line", sensorLine)
 			if !validateSensorLine(sensorLine) {
 				lm.Msg("invalid sensor line")
@@ -101,13 +169,16 @@ func (a *AtmosphericSensor) Data() (chan Data, chan error) {
 				Typ:  a.Type(),
 				Data: []byte(sensorLine),
 			}
-			dataCh <- d
+			select {
+			case dataCh <- d:
+			case <-a.sensorProc.Stopped():
+				return
+			}
 			lm.Msg("sensor line")
-			time.Sleep(100 * time.Millisecond)
 		}
 	}()
 
-	return dataCh, errCh
+	return dataCh, a.sensorProc.Errors()
 }
 
 func validateSensorLine(line string) bool {
@@ -115,6 +186,12 @@ func validateSensorLine(line string) bool {
 	return strings.Count(line, ",") == 5
 }
 
+// ValidAtmosphericSensorLine reports whether line is shaped like sensor driver output,
+// and so can be passed to ParseValidAtmosphericSensorLine.
+func ValidAtmosphericSensorLine(line string) bool {
+	return validateSensorLine(line)
+}
+
 // ParseValidAtmosphericSensorLine assumes the sensor line is well-formed.
 // If a part is missing, an empty struct is returned.
 // If all parts are present but not valid types, that field will be unset.
@@ -149,8 +226,6 @@ func parseFloat32(part string) float32 {
 }
 
 func (a *AtmosphericSensor) Close() {
-	// TODO kill the proc
-	log.Info().Msg("close atmospheric sensor process")
-	a.sensorProc.Process.Signal(syscall.SIGINT)
-	a.sensorProc.Wait()
+	log.Info().Str("name", a.name).Msg("close atmospheric sensor process")
+	a.sensorProc.Stop()
 }
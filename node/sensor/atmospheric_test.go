@@ -0,0 +1,108 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newHelperSensor(t *testing.T, mode string, policy RestartPolicy) *AtmosphericSensor {
+	t.Helper()
+	a := NewAtmospheric("atmospheric", strings.Join(helperArgs(t, mode), " "), 1, policy)
+	if err := a.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	return a
+}
+
+func TestAtmosphericSensor_Data(t *testing.T) {
+	// never restart, so the data channel closes after the first exit
+	a := newHelperSensor(t, "framing", RestartPolicy{})
+	data, errs := a.Data()
+
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for more := true; more; {
+		select {
+		case d, ok := <-data:
+			if more = ok; ok {
+				lines = append(lines, string(d.Data))
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for sensor process, got lines %v", lines)
+		}
+	}
+
+	want := []string{line1, line2, line3, line1}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("lines = %v, want %v", lines, want)
+	}
+	nextErr := func() error {
+		t.Helper()
+		select {
+		case err := <-errs:
+			return err
+		case <-timeout:
+			t.Fatalf("timed out waiting for sensor error")
+		}
+
+		return nil
+	}
+	if err := nextErr(); !errors.Is(err, ErrSensorExited) || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("exit error = %v, want ErrSensorExited with exit status 3", err)
+	}
+	if err := nextErr(); !errors.Is(err, ErrCrashLoop) {
+		t.Errorf("second error = %v, want ErrCrashLoop", err)
+	}
+}
+
+func TestAtmosphericSensor_Close(t *testing.T) {
+	a := newHelperSensor(t, "forever", DefaultRestartPolicy)
+	data, _ := a.Data()
+	select {
+	case <-data:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for sensor process")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeTimeout + 5*time.Second):
+		t.Fatalf("Close() did not return")
+	}
+	if a.sensorProc.Running() {
+		t.Errorf("process still running after Close()")
+	}
+}
+
+func TestDecodeAtmospheric(t *testing.T) {
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{line: "1660369274,25.2,43.1,1009.1,70.4,0"},
+		{line: "1660369274,25.2,43.1", wantErr: true},
+		{line: "0,25.2,43.1,1009.1,70.4,0", wantErr: true},
+		{line: "yesterday,25.2,43.1,1009.1,70.4,0", wantErr: true},
+		{line: "-5,25.2,43.1,1009.1,70.4,0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			ts, ms, err := decodeAtmospheric([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeAtmospheric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (ts.Unix() != 1660369274 || len(ms) != 5) {
+				t.Errorf("decodeAtmospheric() = %v, %v", ts, ms)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrCRC is reported when a probe's reading fails its CRC check, usually because of a long or noisy bus
+	ErrCRC = errors.New("DS18B20 CRC check failed")
+	// ErrPowerOnReset is reported when a probe returns 85C, the value it holds before its first conversion
+	ErrPowerOnReset = errors.New("DS18B20 returned power-on reset value")
+)
+
+const (
+	// ds18b20Family is the 1-Wire family code of DS18B20 probes, the prefix of their device directories
+	ds18b20Family = "28-"
+	// ds18b20PowerOnReset is the raw millidegree reading a probe holds until its first conversion
+	ds18b20PowerOnReset = 85000
+
+	defaultDS18B20PollInterval = 15 * time.Second
+	defaultSysfsRoot           = "/sys"
+)
+
+// DS18B20Sensor reads every DS18B20 probe on the w1-gpio bus through sysfs.
+// Each probe reports its own series, named <probe ID>.temperature.
+type DS18B20Sensor struct {
+	name string
+	// root is the sysfs mount point, which tests replace with a fixture directory
+	root         string
+	pollInterval time.Duration
+	// probes limits reading to these probe IDs. Empty reads every probe found.
+	probes []string
+
+	stop chan struct{}
+}
+
+func init() {
+	RegisterFactory(NameByType(TypeDS18B20), newDS18B20FromConfig)
+}
+
+// newDS18B20FromConfig is the Factory for DS18B20 sensors. The sysfsRoot option overrides /sys, and the
+// probes option is a comma separated list of probe IDs to read.
+func newDS18B20FromConfig(cfg Config) (Sensor, error) {
+	var probes []string
+	for _, p := range strings.Split(cfg.StringOr("probes", ""), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			probes = append(probes, p)
+		}
+	}
+
+	return NewDS18B20(cfg.Name, cfg.StringOr("sysfsRoot", defaultSysfsRoot), cfg.PollInterval(defaultDS18B20PollInterval), probes), nil
+}
+
+func NewDS18B20(name, sysfsRoot string, pollInterval time.Duration, probes []string) *DS18B20Sensor {
+	return &DS18B20Sensor{
+		name:         name,
+		root:         sysfsRoot,
+		pollInterval: pollInterval,
+		probes:       probes,
+		stop:         make(chan struct{}),
+	}
+}
+
+func (d *DS18B20Sensor) Type() uint8 {
+	return TypeDS18B20
+}
+
+func (d *DS18B20Sensor) TypeStr() string {
+	return NameByType(int(d.Type()))
+}
+
+func (d *DS18B20Sensor) Name() string {
+	return d.name
+}
+
+func (d *DS18B20Sensor) devicesDir() string {
+	return filepath.Join(d.root, "bus", "w1", "devices")
+}
+
+// Init checks the 1-Wire bus is available, which needs the w1-gpio overlay enabled
+func (d *DS18B20Sensor) Init() error {
+	if _, err := os.Stat(d.devicesDir()); err != nil {
+		return fmt.Errorf("sensor %s: 1-Wire bus not found, is the w1-gpio overlay enabled: %w", d.name, err)
+	}
+
+	return nil
+}
+
+// Ping fails if the bus has gone, and is degraded if no probes are connected
+func (d *DS18B20Sensor) Ping() error {
+	if _, err := os.Stat(d.devicesDir()); err != nil {
+		return fmt.Errorf("%w: 1-Wire bus not found", ErrSensorFailed)
+	}
+	probes, err := d.discover()
+	if err != nil {
+		return err
+	}
+	if len(probes) == 0 {
+		return errors.New("no DS18B20 probes found")
+	}
+
+	return nil
+}
+
+// Data reads every probe each poll interval, sending the successful readings together.
+// Probes which cannot be read are reported on the error channel, so one bad probe does not hide the others.
+func (d *DS18B20Sensor) Data() (chan Data, chan error) {
+	return poll(d.name, d.Type(), d.pollInterval, d.stop, d.read)
+}
+
+// read takes a reading from every probe
+func (d *DS18B20Sensor) read() ([]Measurement, []error) {
+	probes, err := d.discover()
+	if err != nil {
+		return nil, []error{err}
+	}
+	if len(probes) == 0 {
+		return nil, []error{fmt.Errorf("sensor %s: no DS18B20 probes found", d.name)}
+	}
+
+	var (
+		ms   []Measurement
+		errs []error
+	)
+	for _, id := range probes {
+		c, err := d.readProbe(id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("probe %s: %w", id, err))
+			continue
+		}
+		ms = append(ms, Measurement{Metric: id + "." + MetricTemperature, Value: c})
+	}
+
+	return ms, errs
+}
+
+// discover lists the IDs of connected probes, or of the configured probes if any are set
+func (d *DS18B20Sensor) discover() ([]string, error) {
+	if len(d.probes) > 0 {
+		return d.probes, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(d.devicesDir(), ds18b20Family+"*"))
+	if err != nil {
+		return nil, err
+	}
+	probes := make([]string, len(paths))
+	for i, p := range paths {
+		probes[i] = filepath.Base(p)
+	}
+	sort.Strings(probes)
+
+	return probes, nil
+}
+
+func (d *DS18B20Sensor) readProbe(id string) (float64, error) {
+	b, err := os.ReadFile(filepath.Join(d.devicesDir(), id, "w1_slave"))
+	if err != nil {
+		return 0, err
+	}
+
+	return ParseW1Slave(string(b))
+}
+
+// ParseW1Slave parses the w1_slave output of a DS18B20 into degrees Celsius, such as
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func ParseW1Slave(out string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		return 0, fmt.Errorf("unexpected w1_slave output %q", out)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, ErrCRC
+	}
+
+	i := strings.LastIndex(lines[1], "t=")
+	if i < 0 {
+		return 0, fmt.Errorf("no temperature in w1_slave output %q", lines[1])
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][i+2:]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid temperature in w1_slave output: %w", err)
+	}
+	if milli == ds18b20PowerOnReset {
+		return 0, ErrPowerOnReset
+	}
+
+	return float64(milli) / 1000, nil
+}
+
+func (d *DS18B20Sensor) Close() {
+	log.Info().Str("name", d.name).Msg("close DS18B20 sensor")
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+}
@@ -0,0 +1,122 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	w1SlaveOK      = "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	w1SlaveBelow0  = "5e ff 4b 46 7f ff 0c 10 1c : crc=1c YES\n5e ff 4b 46 7f ff 0c 10 1c t=-10125\n"
+	w1SlaveBadCRC  = "72 01 4b 46 7f ff 0e 10 57 : crc=12 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	w1SlaveReset   = "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n"
+	w1SlaveNoTemp  = "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57\n"
+	w1SlaveOneLine = "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n"
+)
+
+func TestParseW1Slave(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    float64
+		wantErr string
+	}{
+		{name: "ok", out: w1SlaveOK, want: 23.125},
+		{name: "below zero", out: w1SlaveBelow0, want: -10.125},
+		{name: "bad crc", out: w1SlaveBadCRC, wantErr: ErrCRC.Error()},
+		{name: "power on reset", out: w1SlaveReset, wantErr: ErrPowerOnReset.Error()},
+		{name: "no temperature", out: w1SlaveNoTemp, wantErr: "no temperature"},
+		{name: "truncated", out: w1SlaveOneLine, wantErr: "unexpected w1_slave output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseW1Slave(tt.out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseW1Slave() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseW1Slave() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseW1Slave() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// w1Fixture creates a sysfs tree with a w1_slave file for each probe
+func w1Fixture(t *testing.T, probes map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	devices := filepath.Join(root, "bus", "w1", "devices")
+	if err := os.MkdirAll(filepath.Join(devices, "w1_bus_master1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for id, out := range probes {
+		if err := os.MkdirAll(filepath.Join(devices, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(devices, id, "w1_slave"), []byte(out), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func TestDS18B20Sensor_Data(t *testing.T) {
+	root := w1Fixture(t, map[string]string{
+		"28-0316a2795eff": w1SlaveOK,
+		"28-0416b1e2a3ff": w1SlaveBadCRC,
+		"28-0516c4d5e6ff": w1SlaveBelow0,
+	})
+	d := NewDS18B20("ds18b20", root, time.Hour, nil)
+	if err := d.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	if err := d.Ping(); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	data, errs := d.Data()
+	defer d.Close()
+
+	got := <-data
+	want := []Measurement{
+		{Metric: "28-0316a2795eff.temperature", Value: 23.125},
+		{Metric: "28-0516c4d5e6ff.temperature", Value: -10.125},
+	}
+	if fmt.Sprint(got.Measurements) != fmt.Sprint(want) {
+		t.Errorf("Measurements = %v, want %v", got.Measurements, want)
+	}
+	if err := <-errs; !errors.Is(err, ErrCRC) {
+		t.Errorf("error = %v, want ErrCRC", err)
+	}
+}
+
+func TestDS18B20Sensor_noBus(t *testing.T) {
+	d := NewDS18B20("ds18b20", t.TempDir(), time.Hour, nil)
+	if err := d.Init(); err == nil {
+		t.Errorf("Init() error = nil without a 1-Wire bus")
+	}
+	if err := d.Ping(); !errors.Is(err, ErrSensorFailed) {
+		t.Errorf("Ping() error = %v, want ErrSensorFailed", err)
+	}
+}
+
+func TestDS18B20Sensor_noProbes(t *testing.T) {
+	d := NewDS18B20("ds18b20", w1Fixture(t, nil), time.Hour, nil)
+	if err := d.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	if err := d.Ping(); err == nil || errors.Is(err, ErrSensorFailed) {
+		t.Errorf("Ping() error = %v, want degraded", err)
+	}
+}
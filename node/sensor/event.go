@@ -0,0 +1,35 @@
+package sensor
+
+import "time"
+
+const (
+	EventKindMotion  = "motion"
+	EventKindContact = "contact"
+
+	// StateStart and StateStop are the states of motion events
+	StateStart = "start"
+	StateStop  = "stop"
+	// StateOpen and StateClosed are the states of contact events
+	StateOpen   = "open"
+	StateClosed = "closed"
+)
+
+// Event is a discrete change of state, such as a door opening, as opposed to a periodic sample.
+// It is the payload of an event packet.
+type Event struct {
+	Typ uint8
+	// Sensor is the name of the sensor instance which saw the event
+	Sensor    string
+	Kind      string
+	State     string
+	Timestamp time.Time
+	// Attributes holds any further detail about the event
+	Attributes map[string]string
+}
+
+// EventSource is implemented by sensors which report events. Event driven sensors may never send Data,
+// and are not expected to report on any schedule.
+type EventSource interface {
+	// Events returns the event channel, which is closed when the sensor is closed
+	Events() chan Event
+}
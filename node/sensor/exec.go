@@ -0,0 +1,258 @@
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cast"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrMalformedLine is reported by the exec sensor for output lines which do not follow the JSON lines protocol
+var ErrMalformedLine = errors.New("malformed sensor output")
+
+// execPollIntervalEnv tells the executable how often to take readings
+const execPollIntervalEnv = "QUILLSECURE_POLL_INTERVAL_SECS"
+
+// ExecSensor runs any executable which prints one JSON object per reading, such as
+//
+//	{"timestamp": 1660369274, "values": {"co2": 415, "pm25": 3.5}}
+//
+// The timestamp is unix seconds or RFC3339, and defaults to the time the line was read. Every metric in values
+// must be declared in the node config. Lines which do not start with { are treated as debug output and ignored.
+type ExecSensor struct {
+	name           string
+	executablePath string
+	pollInterval   time.Duration
+	restartPolicy  RestartPolicy
+	// metrics is keyed by metric name
+	metrics    map[string]Metric
+	sensorProc *Supervisor
+}
+
+type execLine struct {
+	Timestamp interface{}        `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// defaultExecPollInterval is passed to the executable when the config has no poll interval
+const defaultExecPollInterval = 15 * time.Second
+
+func init() {
+	RegisterFactory(NameByType(TypeExec), newExecFromConfig)
+}
+
+// newExecFromConfig is the Factory for exec sensors. The executable option is the command line to run,
+// and the metrics option is a list of metrics, each with a name and an optional unit.
+func newExecFromConfig(cfg Config) (Sensor, error) {
+	executable, err := cfg.String("executable")
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := parseMetricsOption(cfg.Options["metrics"])
+	if err != nil {
+		return nil, fmt.Errorf("sensor %s: option \"metrics\": %w", cfg.Name, err)
+	}
+
+	return NewExec(cfg.Name, executable, cfg.PollInterval(defaultExecPollInterval), metrics, cfg.RestartPolicy)
+}
+
+// parseMetricsOption reads a list of {name, unit} maps from node config
+func parseMetricsOption(v interface{}) ([]Metric, error) {
+	items, err := cast.ToSliceE(v)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]Metric, 0, len(items))
+	for _, item := range items {
+		m, err := cast.ToStringMapStringE(item)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, Metric{Name: m["name"], Unit: m["unit"]})
+	}
+
+	return metrics, nil
+}
+
+// NewExec creates an exec sensor reporting the declared metrics
+func NewExec(name, executable string, pollInterval time.Duration, metrics []Metric, restartPolicy RestartPolicy) (*ExecSensor, error) {
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("sensor %s: no metrics declared", name)
+	}
+
+	byName := make(map[string]Metric, len(metrics))
+	for _, m := range metrics {
+		if m.Name == "" || strings.ContainsAny(m.Name, ". ") {
+			return nil, fmt.Errorf("sensor %s: invalid metric name %q", name, m.Name)
+		}
+		if _, ok := byName[m.Name]; ok {
+			return nil, fmt.Errorf("sensor %s: metric %q declared twice", name, m.Name)
+		}
+		m.SensorType = TypeExec
+		byName[m.Name] = m
+	}
+
+	return &ExecSensor{
+		name:           name,
+		executablePath: executable,
+		pollInterval:   pollInterval,
+		restartPolicy:  restartPolicy,
+		metrics:        byName,
+	}, nil
+}
+
+func (e *ExecSensor) Type() uint8 {
+	return TypeExec
+}
+
+func (e *ExecSensor) TypeStr() string {
+	return NameByType(int(e.Type()))
+}
+
+func (e *ExecSensor) Name() string {
+	return e.name
+}
+
+// DeclaredMetrics returns the metrics from the node config, sorted by name
+func (e *ExecSensor) DeclaredMetrics() []Metric {
+	out := make([]Metric, 0, len(e.metrics))
+	for _, m := range e.metrics {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
+// Ping fails once the process is crash looping, and is degraded while it is waiting to be restarted
+func (e *ExecSensor) Ping() error {
+	select {
+	case <-e.sensorProc.Done():
+		return fmt.Errorf("%w: process is not being restarted after %d restarts", ErrSensorFailed, e.Restarts())
+	default:
+	}
+	if !e.sensorProc.Running() {
+		return errors.New("process is not running")
+	}
+
+	return nil
+}
+
+func (e *ExecSensor) Init() error {
+	args := strings.Fields(e.executablePath)
+	if len(args) == 0 {
+		return fmt.Errorf("sensor %s: blank executable", e.name)
+	}
+	log.Debug().Str("name", e.name).Str("path", e.executablePath).Msg("Exec sensor executable path")
+	e.sensorProc = NewSupervisor(e.name, args, e.restartPolicy)
+	e.sensorProc.Env = []string{execPollIntervalEnv + "=" + strconv.Itoa(int(e.pollInterval.Seconds()))}
+
+	return e.sensorProc.Start()
+}
+
+// Restarts returns the number of times the process has been restarted
+func (e *ExecSensor) Restarts() int {
+	return e.sensorProc.Restarts()
+}
+
+// Restart restarts the process
+func (e *ExecSensor) Restart() error {
+	return e.sensorProc.Restart()
+}
+
+// Data sends each reading printed by the process as measurements. Malformed lines are reported as
+// ErrMalformedLine on the error channel, along with process exits as for the atmospheric sensor.
+func (e *ExecSensor) Data() (chan Data, chan error) {
+	dataCh := make(chan Data)
+
+	go func() {
+		defer close(dataCh)
+		for line := range e.sensorProc.Lines() {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "{") {
+				if line != "" {
+					log.Debug().Str("sensor", e.name).Str("line", line).Msg("exec sensor output")
+				}
+				continue
+			}
+
+			d, err := e.parseLine(line, time.Now())
+			if err != nil {
+				e.sensorProc.report(err)
+				continue
+			}
+			select {
+			case dataCh <- d:
+			case <-e.sensorProc.Stopped():
+				return
+			}
+		}
+	}()
+
+	return dataCh, e.sensorProc.Errors()
+}
+
+// parseLine decodes a single JSON line, timestamping it with now if it has no timestamp
+func (e *ExecSensor) parseLine(line string, now time.Time) (Data, error) {
+	var l execLine
+	if err := json.Unmarshal([]byte(line), &l); err != nil {
+		return Data{}, fmt.Errorf("%w: %v", ErrMalformedLine, err)
+	}
+	if len(l.Values) == 0 {
+		return Data{}, fmt.Errorf("%w: no values", ErrMalformedLine)
+	}
+
+	ts, err := parseExecTimestamp(l.Timestamp, now)
+	if err != nil {
+		return Data{}, fmt.Errorf("%w: %v", ErrMalformedLine, err)
+	}
+
+	ms := make([]Measurement, 0, len(l.Values))
+	for name, v := range l.Values {
+		if _, ok := e.metrics[name]; !ok {
+			return Data{}, fmt.Errorf("%w: undeclared metric %q", ErrMalformedLine, name)
+		}
+		ms = append(ms, Measurement{Metric: name, Value: v})
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Metric < ms[j].Metric
+	})
+
+	return Data{
+		Typ:          e.Type(),
+		Timestamp:    ts,
+		Measurements: ms,
+	}, nil
+}
+
+// parseExecTimestamp accepts unix seconds or an RFC3339 string, defaulting to now
+func parseExecTimestamp(v interface{}, now time.Time) (time.Time, error) {
+	switch ts := v.(type) {
+	case nil:
+		return now, nil
+	case float64:
+		sec := int64(ts)
+		return time.Unix(sec, int64((ts-float64(sec))*float64(time.Second))), nil
+	case string:
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		return t, nil
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp %v", v)
+	}
+}
+
+func (e *ExecSensor) Close() {
+	log.Info().Str("name", e.name).Msg("close exec sensor process")
+	e.sensorProc.Stop()
+}
@@ -0,0 +1,156 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testExecMetrics = []Metric{{Name: "co2", Unit: "ppm"}, {Name: "pm25", Unit: "ug/m3"}}
+
+func TestExecSensor_parseLine(t *testing.T) {
+	now := time.Unix(1660369300, 0)
+	e, err := NewExec("air", "driver", time.Second, testExecMetrics, RestartPolicy{})
+	if err != nil {
+		t.Fatalf("NewExec() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		line    string
+		wantTS  time.Time
+		wantMs  []Measurement
+		wantErr string
+	}{
+		{
+			name:   "unix timestamp",
+			line:   `{"timestamp": 1660369274, "values": {"pm25": 3.5, "co2": 415}}`,
+			wantTS: time.Unix(1660369274, 0),
+			wantMs: []Measurement{{Metric: "co2", Value: 415}, {Metric: "pm25", Value: 3.5}},
+		},
+		{
+			name:   "RFC3339 timestamp",
+			line:   `{"timestamp": "2022-08-13T05:41:29Z", "values": {"co2": 420}}`,
+			wantTS: time.Unix(1660369289, 0),
+			wantMs: []Measurement{{Metric: "co2", Value: 420}},
+		},
+		{
+			name:   "missing timestamp",
+			line:   `{"values": {"co2": 420}}`,
+			wantTS: now,
+			wantMs: []Measurement{{Metric: "co2", Value: 420}},
+		},
+		{
+			name:    "undeclared metric",
+			line:    `{"values": {"co3": 420}}`,
+			wantErr: `undeclared metric "co3"`,
+		},
+		{
+			name:    "non numeric value",
+			line:    `{"values": {"co2": "high"}}`,
+			wantErr: "cannot unmarshal string",
+		},
+		{
+			name:    "no values",
+			line:    `{"timestamp": 1660369274}`,
+			wantErr: "no values",
+		},
+		{
+			name:    "invalid timestamp",
+			line:    `{"timestamp": "yesterday", "values": {"co2": 420}}`,
+			wantErr: "invalid timestamp",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := e.parseLine(tt.line, now)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrMalformedLine) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseLine() error = %v, want ErrMalformedLine with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLine() error = %v", err)
+			}
+			if !d.Timestamp.Equal(tt.wantTS) {
+				t.Errorf("Timestamp = %v, want %v", d.Timestamp, tt.wantTS)
+			}
+			if fmt.Sprint(d.Measurements) != fmt.Sprint(tt.wantMs) {
+				t.Errorf("Measurements = %v, want %v", d.Measurements, tt.wantMs)
+			}
+		})
+	}
+}
+
+func TestNewExec_invalidMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []Metric
+	}{
+		{name: "none"},
+		{name: "blank name", metrics: []Metric{{Unit: "ppm"}}},
+		{name: "dotted name", metrics: []Metric{{Name: "air.co2"}}},
+		{name: "duplicate", metrics: []Metric{{Name: "co2"}, {Name: "co2"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewExec("air", "driver", time.Second, tt.metrics, RestartPolicy{}); err == nil {
+				t.Errorf("NewExec() error = nil")
+			}
+		})
+	}
+}
+
+func TestExecSensor_Data(t *testing.T) {
+	e, err := NewExec("air", strings.Join(helperArgs(t, "jsonlines"), " "), 7*time.Second, testExecMetrics, RestartPolicy{})
+	if err != nil {
+		t.Fatalf("NewExec() error = %v", err)
+	}
+	if err := e.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	data, errs := e.Data()
+
+	var got []Data
+	timeout := time.After(5 * time.Second)
+	for more := true; more; {
+		select {
+		case d, ok := <-data:
+			if more = ok; ok {
+				got = append(got, d)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for sensor process")
+		}
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d readings, want 3: %v", len(got), got)
+	}
+	if got[0].Typ != TypeExec || len(got[0].Measurements) != 2 {
+		t.Errorf("first reading = %+v", got[0])
+	}
+	if v := got[2].Measurements[0].Value; v != 7 {
+		t.Errorf("poll interval seen by process = %v, want 7", v)
+	}
+	nextErr := func() error {
+		t.Helper()
+		select {
+		case err := <-errs:
+			return err
+		case <-timeout:
+			t.Fatalf("timed out waiting for sensor error")
+		}
+
+		return nil
+	}
+	if err := nextErr(); !errors.Is(err, ErrMalformedLine) {
+		t.Errorf("first error = %v, want ErrMalformedLine", err)
+	}
+	if err := nextErr(); !errors.Is(err, ErrSensorExited) {
+		t.Errorf("second error = %v, want ErrSensorExited", err)
+	}
+}
@@ -5,8 +5,25 @@ import (
 	"time"
 )
 
+// defaultFakeInterval is how often a fake sensor sends Buf when no poll interval is configured
+const defaultFakeInterval = 5 * time.Second
+
 type FakeSensor struct {
 	Buf string
+	// SensorName defaults to the type name
+	SensorName string
+	// Interval defaults to defaultFakeInterval
+	Interval time.Duration
+}
+
+func init() {
+	RegisterFactory(NameByType(TypeFake), func(cfg Config) (Sensor, error) {
+		return &FakeSensor{
+			Buf:        cfg.StringOr("buf", "fake data"),
+			SensorName: cfg.Name,
+			Interval:   cfg.PollInterval(defaultFakeInterval),
+		}, nil
+	})
 }
 
 func (f *FakeSensor) Type() uint8 {
@@ -21,6 +38,14 @@ func (f *FakeSensor) TypeStr() string {
 	return NameByType(int(f.Type()))
 }
 
+func (f *FakeSensor) Name() string {
+	if f.SensorName == "" {
+		return f.TypeStr()
+	}
+
+	return f.SensorName
+}
+
 func (f *FakeSensor) Ping() error {
 	return nil
 }
@@ -29,7 +54,11 @@ func (f *FakeSensor) Data() (chan Data, chan error) {
 	errCh := make(chan error)
 	dataCh := make(chan Data)
 
-	t := time.NewTicker(5 * time.Second)
+	interval := f.Interval
+	if interval <= 0 {
+		interval = defaultFakeInterval
+	}
+	t := time.NewTicker(interval)
 	go func() {
 		for {
 			<-t.C
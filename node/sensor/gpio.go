@@ -0,0 +1,337 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGPIOChip     = "gpiochip0"
+	defaultGPIODebounce = 50 * time.Millisecond
+)
+
+// Bias selects the pull resistor of a GPIO line
+type Bias string
+
+const (
+	BiasAsIs     Bias = ""
+	BiasPullUp   Bias = "pull-up"
+	BiasPullDown Bias = "pull-down"
+	BiasDisabled Bias = "disabled"
+)
+
+// GPIOEdge is a change in the physical level of a line
+type GPIOEdge struct {
+	High bool
+	Time time.Time
+}
+
+// GPIOLine is an input line requested for edge detection
+type GPIOLine interface {
+	// High reads the current physical level of the line
+	High() (bool, error)
+	// Edges returns each level change until the line is closed, when the channel is closed
+	Edges() chan GPIOEdge
+	Close() error
+}
+
+// GPIOBackend requests lines from a GPIO chip
+type GPIOBackend interface {
+	RequestLine(chip string, offset int, bias Bias, consumer string) (GPIOLine, error)
+}
+
+func init() {
+	RegisterFactory(NameByType(TypeMotion), newGPIOFromConfig(TypeMotion))
+	RegisterFactory(NameByType(TypeContact), newGPIOFromConfig(TypeContact))
+}
+
+// GPIOSensor watches a single GPIO line for a PIR motion sensor or a door or window contact.
+// Rather than sampling, it sends an event with the line's state once at startup and then on every
+// debounced change. A line is active while it is high, or while it is low if activeLow is set.
+// An active motion sensor has detected motion, and an active contact is open.
+type GPIOSensor struct {
+	name      string
+	typ       uint8
+	backend   GPIOBackend
+	chip      string
+	offset    int
+	activeLow bool
+	bias      Bias
+	debounce  time.Duration
+
+	line   GPIOLine
+	data   chan Data
+	events chan Event
+	errs   chan error
+	start  sync.Once
+	// stop is closed by Close, so watch returns even when nothing reads its events
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newGPIOFromConfig returns the Factory for motion or contact sensors. Options are line (the line offset),
+// chip (default gpiochip0), activeLow, bias (pull-up, pull-down or disabled), debounceMs (default 50),
+// and backend, which may be fake to run without GPIO hardware.
+func newGPIOFromConfig(typ uint8) Factory {
+	return func(cfg Config) (Sensor, error) {
+		offset, err := cfg.Int("line", -1)
+		if err != nil {
+			return nil, err
+		}
+		if offset < 0 {
+			return nil, fmt.Errorf("sensor %s: missing option \"line\"", cfg.Name)
+		}
+		activeLow, err := cfg.Bool("activeLow", false)
+		if err != nil {
+			return nil, err
+		}
+		debounceMs, err := cfg.Int("debounceMs", int(defaultGPIODebounce/time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		bias := Bias(cfg.StringOr("bias", ""))
+		switch bias {
+		case BiasAsIs, BiasPullUp, BiasPullDown, BiasDisabled:
+		default:
+			return nil, fmt.Errorf("sensor %s: invalid bias %q", cfg.Name, bias)
+		}
+
+		var backend GPIOBackend
+		switch b := cfg.StringOr("backend", "chardev"); b {
+		case "chardev":
+			backend = CharDevGPIO{}
+		case "fake":
+			backend = NewFakeGPIO()
+		default:
+			return nil, fmt.Errorf("sensor %s: invalid GPIO backend %q", cfg.Name, b)
+		}
+
+		return NewGPIO(cfg.Name, typ, backend, cfg.StringOr("chip", defaultGPIOChip), offset, activeLow, bias,
+			time.Duration(debounceMs)*time.Millisecond), nil
+	}
+}
+
+// NewGPIO creates a motion or contact sensor on line offset of chip
+func NewGPIO(name string, typ uint8, backend GPIOBackend, chip string, offset int, activeLow bool, bias Bias, debounce time.Duration) *GPIOSensor {
+	return &GPIOSensor{
+		name:      name,
+		typ:       typ,
+		backend:   backend,
+		chip:      chip,
+		offset:    offset,
+		activeLow: activeLow,
+		bias:      bias,
+		debounce:  debounce,
+	}
+}
+
+func (g *GPIOSensor) Type() uint8 {
+	return g.typ
+}
+
+func (g *GPIOSensor) TypeStr() string {
+	return NameByType(int(g.Type()))
+}
+
+func (g *GPIOSensor) Name() string {
+	return g.name
+}
+
+// Init requests the line for edge detection
+func (g *GPIOSensor) Init() error {
+	line, err := g.backend.RequestLine(g.chip, g.offset, g.bias, "quillsecure-"+g.name)
+	if err != nil {
+		return fmt.Errorf("sensor %s: failed to request %s line %d: %w", g.name, g.chip, g.offset, err)
+	}
+	g.line = line
+	g.data = make(chan Data)
+	g.events = make(chan Event)
+	g.errs = make(chan error, errorBufferSize)
+	g.stop = make(chan struct{})
+
+	return nil
+}
+
+// Ping fails if the line can no longer be read
+func (g *GPIOSensor) Ping() error {
+	if _, err := g.line.High(); err != nil {
+		return fmt.Errorf("%w: %v", ErrSensorFailed, err)
+	}
+
+	return nil
+}
+
+// isActive applies activeLow to a physical level
+func (g *GPIOSensor) isActive(high bool) bool {
+	return high != g.activeLow
+}
+
+func (g *GPIOSensor) kind() string {
+	if g.typ == TypeMotion {
+		return EventKindMotion
+	}
+
+	return EventKindContact
+}
+
+// EventState names the state of an active or inactive line, such as open or stop
+func (g *GPIOSensor) EventState(active bool) string {
+	switch {
+	case g.typ == TypeMotion && active:
+		return StateStart
+	case g.typ == TypeMotion:
+		return StateStop
+	case active:
+		return StateOpen
+	default:
+		return StateClosed
+	}
+}
+
+func (g *GPIOSensor) event(active bool, ts time.Time) Event {
+	return Event{
+		Typ:       g.Type(),
+		Sensor:    g.name,
+		Kind:      g.kind(),
+		State:     g.EventState(active),
+		Timestamp: ts,
+		Attributes: map[string]string{
+			"chip": g.chip,
+			"line": strconv.Itoa(g.offset),
+		},
+	}
+}
+
+// Data never sends readings, since the sensor only reports events. Its channel is closed when the sensor is closed.
+func (g *GPIOSensor) Data() (chan Data, chan error) {
+	g.start.Do(func() { go g.watch() })
+
+	return g.data, g.errs
+}
+
+// Events sends the state of the line at startup, then each change which lasts at least the debounce period
+func (g *GPIOSensor) Events() chan Event {
+	g.start.Do(func() { go g.watch() })
+
+	return g.events
+}
+
+// watch sends events until the line or the sensor is closed, then closes the line
+func (g *GPIOSensor) watch() {
+	defer close(g.data)
+	defer close(g.events)
+	defer g.closeLine()
+
+	high, err := g.line.High()
+	if err != nil {
+		select {
+		case g.errs <- err:
+		case <-g.stop:
+		}
+		return
+	}
+	active := g.isActive(high)
+	initial := g.event(active, time.Now())
+	initial.Attributes["initial"] = "true"
+	select {
+	case g.events <- initial:
+	case <-g.stop:
+		return
+	}
+
+	for change := range debounce(g.line.Edges(), g.debounce, g.stop) {
+		if g.isActive(change.High) == active {
+			continue
+		}
+		active = !active
+
+		log.Debug().Str("sensor", g.name).Str("state", g.EventState(active)).Msg("GPIO sensor event")
+		select {
+		case g.events <- g.event(active, change.Time):
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// debounce forwards the level of edges once it has held for period, timestamped with the first edge to reach it.
+// Bounces shorter than period are dropped. The returned channel is closed once edges is closed.
+// Once stop is closed, edges are discarded until edges is closed, so the line never blocks sending them.
+func debounce(edges chan GPIOEdge, period time.Duration, stop chan struct{}) chan GPIOEdge {
+	out := make(chan GPIOEdge)
+	if period <= 0 {
+		go func() {
+			defer close(out)
+			for e := range edges {
+				select {
+				case out <- e:
+				case <-stop:
+					drainEdges(edges)
+					return
+				}
+			}
+		}()
+		return out
+	}
+
+	go func() {
+		defer close(out)
+		var (
+			pending *GPIOEdge
+			timer   = time.NewTimer(period)
+		)
+		timer.Stop()
+		for {
+			select {
+			case e, more := <-edges:
+				if !more {
+					timer.Stop()
+					return
+				}
+				// keep the time of the first edge to the new level, so bounces do not delay the event
+				if pending == nil || pending.High != e.High {
+					edge := e
+					pending = &edge
+				}
+				timer.Reset(period)
+			case <-timer.C:
+				if pending != nil {
+					select {
+					case out <- *pending:
+					case <-stop:
+						drainEdges(edges)
+						return
+					}
+					pending = nil
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+func drainEdges(edges chan GPIOEdge) {
+	for range edges {
+	}
+}
+
+func (g *GPIOSensor) Close() {
+	log.Info().Str("name", g.name).Msg("close GPIO sensor")
+	if g.line == nil {
+		return
+	}
+	g.stopOnce.Do(func() { close(g.stop) })
+	g.closeLine()
+}
+
+// closeLine releases the line, which the sensor and watch may both do
+func (g *GPIOSensor) closeLine() {
+	if err := g.line.Close(); err != nil && !errors.Is(err, ErrLineClosed) {
+		log.Err(err).Str("name", g.name).Msg("error closing GPIO line")
+	}
+}
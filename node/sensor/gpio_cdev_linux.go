@@ -0,0 +1,167 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Line request flags, ioctls and structs of the GPIO character device uAPI v2, from linux/gpio.h
+const (
+	gpioV2LineFlagInput        = 1 << 2
+	gpioV2LineFlagEdgeRising   = 1 << 4
+	gpioV2LineFlagEdgeFalling  = 1 << 5
+	gpioV2LineFlagBiasPullUp   = 1 << 8
+	gpioV2LineFlagBiasPullDown = 1 << 9
+	gpioV2LineFlagBiasDisabled = 1 << 10
+
+	gpioV2LineEventRisingEdge = 1
+
+	// _IOWR(0xB4, 0x07, struct gpio_v2_line_request)
+	gpioV2GetLineIoctl = 0xC250B407
+	// _IOWR(0xB4, 0x0E, struct gpio_v2_line_values)
+	gpioV2LineGetValuesIoctl = 0xC010B40E
+)
+
+type gpioV2LineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64
+}
+
+type gpioV2LineConfigAttribute struct {
+	Attr gpioV2LineAttribute
+	Mask uint64
+}
+
+type gpioV2LineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [10]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	Offsets         [64]uint32
+	Consumer        [32]byte
+	Config          gpioV2LineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+type gpioV2LineEvent struct {
+	TimestampNs uint64
+	ID          uint32
+	Offset      uint32
+	Seqno       uint32
+	LineSeqno   uint32
+	Padding     [6]uint32
+}
+
+// CharDevGPIO requests lines through /dev/gpiochipN, the GPIO character device
+type CharDevGPIO struct{}
+
+type charDevLine struct {
+	f     *os.File
+	edges chan GPIOEdge
+
+	closeOnce sync.Once
+}
+
+func (CharDevGPIO) RequestLine(chip string, offset int, bias Bias, consumer string) (GPIOLine, error) {
+	chipFile, err := os.Open(filepath.Join("/dev", chip))
+	if err != nil {
+		return nil, err
+	}
+	defer chipFile.Close()
+
+	req := gpioV2LineRequest{NumLines: 1}
+	req.Offsets[0] = uint32(offset)
+	copy(req.Consumer[:len(req.Consumer)-1], consumer)
+	req.Config.Flags = gpioV2LineFlagInput | gpioV2LineFlagEdgeRising | gpioV2LineFlagEdgeFalling
+	switch bias {
+	case BiasPullUp:
+		req.Config.Flags |= gpioV2LineFlagBiasPullUp
+	case BiasPullDown:
+		req.Config.Flags |= gpioV2LineFlagBiasPullDown
+	case BiasDisabled:
+		req.Config.Flags |= gpioV2LineFlagBiasDisabled
+	}
+	if err := ioctl(chipFile.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("line request: %w", err)
+	}
+
+	// a nonblocking fd lets Close interrupt a pending read
+	if err := syscall.SetNonblock(int(req.Fd), true); err != nil {
+		syscall.Close(int(req.Fd))
+		return nil, err
+	}
+	l := &charDevLine{
+		f:     os.NewFile(uintptr(req.Fd), fmt.Sprintf("%s line %d", chip, offset)),
+		edges: make(chan GPIOEdge),
+	}
+	go l.readEvents()
+
+	return l, nil
+}
+
+func (l *charDevLine) High() (bool, error) {
+	values := gpioV2LineValues{Mask: 1}
+	if err := ioctl(l.f.Fd(), gpioV2LineGetValuesIoctl, unsafe.Pointer(&values)); err != nil {
+		return false, err
+	}
+
+	return values.Bits&1 == 1, nil
+}
+
+func (l *charDevLine) Edges() chan GPIOEdge {
+	return l.edges
+}
+
+// readEvents forwards edge events until the line is closed. Kernel timestamps are on the monotonic clock,
+// so events are timestamped when read, which is within microseconds for an idle node.
+func (l *charDevLine) readEvents() {
+	defer close(l.edges)
+	var ev gpioV2LineEvent
+	buf := make([]byte, unsafe.Sizeof(ev))
+	for {
+		if _, err := io.ReadFull(l.f, buf); err != nil {
+			return
+		}
+		ev = *(*gpioV2LineEvent)(unsafe.Pointer(&buf[0]))
+		l.edges <- GPIOEdge{High: ev.ID == gpioV2LineEventRisingEdge, Time: time.Now()}
+	}
+}
+
+func (l *charDevLine) Close() error {
+	err := ErrLineClosed
+	l.closeOnce.Do(func() {
+		err = l.f.Close()
+	})
+	if errors.Is(err, os.ErrClosed) {
+		return ErrLineClosed
+	}
+
+	return err
+}
+
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
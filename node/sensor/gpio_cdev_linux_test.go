@@ -0,0 +1,29 @@
+package sensor
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// the uAPI structs must match the kernel's layout exactly on every architecture, including 32 bit ARM
+func TestGPIOV2StructLayout(t *testing.T) {
+	var req gpioV2LineRequest
+	tests := []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"sizeof line request", unsafe.Sizeof(req), 592},
+		{"offsetof config", unsafe.Offsetof(req.Config), 288},
+		{"offsetof config attrs", unsafe.Offsetof(req.Config.Attrs), 32},
+		{"offsetof num lines", unsafe.Offsetof(req.NumLines), 560},
+		{"offsetof fd", unsafe.Offsetof(req.Fd), 588},
+		{"sizeof line values", unsafe.Sizeof(gpioV2LineValues{}), 16},
+		{"sizeof line event", unsafe.Sizeof(gpioV2LineEvent{}), 48},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
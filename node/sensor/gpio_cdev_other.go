@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sensor
+
+import "errors"
+
+// CharDevGPIO requests lines through /dev/gpiochipN, which only exists on Linux
+type CharDevGPIO struct{}
+
+func (CharDevGPIO) RequestLine(chip string, offset int, bias Bias, consumer string) (GPIOLine, error) {
+	return nil, errors.New("the GPIO character device is only available on Linux")
+}
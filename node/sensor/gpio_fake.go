@@ -0,0 +1,96 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLineClosed is returned when using a GPIO line after it has been closed
+var ErrLineClosed = errors.New("GPIO line closed")
+
+// FakeGPIO is a GPIO backend without hardware. Tests drive line levels with Set.
+type FakeGPIO struct {
+	lock  sync.Mutex
+	lines map[string]*fakeLine
+}
+
+func NewFakeGPIO() *FakeGPIO {
+	return &FakeGPIO{lines: make(map[string]*fakeLine)}
+}
+
+type fakeLine struct {
+	lock   sync.Mutex
+	high   bool
+	closed bool
+	edges  chan GPIOEdge
+}
+
+func fakeLineKey(chip string, offset int) string {
+	return fmt.Sprintf("%s/%d", chip, offset)
+}
+
+// RequestLine returns a line which starts low, as if pulled down
+func (f *FakeGPIO) RequestLine(chip string, offset int, bias Bias, consumer string) (GPIOLine, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := fakeLineKey(chip, offset)
+	if l, ok := f.lines[key]; ok && !l.closed {
+		return nil, fmt.Errorf("line %s is busy", key)
+	}
+
+	l := &fakeLine{high: bias == BiasPullUp, edges: make(chan GPIOEdge, 64)}
+	f.lines[key] = l
+
+	return l, nil
+}
+
+// Set changes the level of a requested line, sending an edge if it changed
+func (f *FakeGPIO) Set(chip string, offset int, high bool) error {
+	f.lock.Lock()
+	l, ok := f.lines[fakeLineKey(chip, offset)]
+	f.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("line %s/%d has not been requested", chip, offset)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrLineClosed
+	}
+	if l.high == high {
+		return nil
+	}
+	l.high = high
+	l.edges <- GPIOEdge{High: high, Time: time.Now()}
+
+	return nil
+}
+
+func (l *fakeLine) High() (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return false, ErrLineClosed
+	}
+
+	return l.high, nil
+}
+
+func (l *fakeLine) Edges() chan GPIOEdge {
+	return l.edges
+}
+
+func (l *fakeLine) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrLineClosed
+	}
+	l.closed = true
+	close(l.edges)
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package sensor
+
+import (
+	"testing"
+	"time"
+)
+
+const testDebounce = 30 * time.Millisecond
+
+func newFakeGPIOSensor(t *testing.T, typ uint8, activeLow bool) (*GPIOSensor, *FakeGPIO) {
+	t.Helper()
+	fake := NewFakeGPIO()
+	g := NewGPIO("test", typ, fake, "gpiochip0", 17, activeLow, BiasAsIs, testDebounce)
+	if err := g.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	t.Cleanup(g.Close)
+
+	return g, fake
+}
+
+// nextState waits for the next event and returns its state
+func nextState(t *testing.T, events chan Event) string {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e.State
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+
+	return ""
+}
+
+func expectNoState(t *testing.T, events chan Event) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(3 * testDebounce):
+	}
+}
+
+func TestGPIOSensor_contact(t *testing.T) {
+	g, fake := newFakeGPIOSensor(t, TypeContact, false)
+	events := g.Events()
+
+	select {
+	case e := <-events:
+		if e.Kind != EventKindContact || e.State != StateClosed || e.Attributes["initial"] != "true" || e.Attributes["line"] != "17" {
+			t.Errorf("initial event = %+v, want initial contact closed on line 17", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for initial event")
+	}
+
+	// a bouncing switch settles open
+	for _, high := range []bool{true, false, true, false, true} {
+		fake.Set("gpiochip0", 17, high)
+	}
+	if state := nextState(t, events); state != StateOpen {
+		t.Errorf("state = %q, want open", state)
+	}
+
+	// a glitch shorter than the debounce period is ignored
+	fake.Set("gpiochip0", 17, false)
+	fake.Set("gpiochip0", 17, true)
+	expectNoState(t, events)
+
+	fake.Set("gpiochip0", 17, false)
+	if state := nextState(t, events); state != StateClosed {
+		t.Errorf("state = %q, want closed", state)
+	}
+}
+
+func TestGPIOSensor_motionActiveLow(t *testing.T) {
+	g, fake := newFakeGPIOSensor(t, TypeMotion, true)
+	events := g.Events()
+
+	// the line starts low, which is active
+	if state := nextState(t, events); state != StateStart {
+		t.Errorf("initial state = %q, want start", state)
+	}
+	fake.Set("gpiochip0", 17, true)
+	if state := nextState(t, events); state != StateStop {
+		t.Errorf("state = %q, want stop", state)
+	}
+}
+
+func TestGPIOSensor_Close(t *testing.T) {
+	g, _ := newFakeGPIOSensor(t, TypeContact, false)
+	data, _ := g.Data()
+	events := g.Events()
+	nextState(t, events)
+
+	g.Close()
+	for _, closed := range []func() bool{
+		func() bool { _, more := <-data; return !more },
+		func() bool { _, more := <-events; return !more },
+	} {
+		done := make(chan bool)
+		go func() { done <- closed() }()
+		select {
+		case ok := <-done:
+			if !ok {
+				t.Errorf("unexpected value after Close()")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("channel not closed after Close()")
+		}
+	}
+	if err := g.Ping(); err == nil {
+		t.Errorf("Ping() error = nil after Close()")
+	}
+}
+
+// TestGPIOSensor_closePendingEdge closes the sensor while it is blocked sending an event nobody reads
+func TestGPIOSensor_closePendingEdge(t *testing.T) {
+	g, fake := newFakeGPIOSensor(t, TypeContact, false)
+	data, _ := g.Data()
+	nextState(t, g.Events())
+
+	fake.Set("gpiochip0", 17, true)
+	time.Sleep(3 * testDebounce)
+
+	// the watcher closes data when it returns, without the pending event being read
+	g.Close()
+	select {
+	case <-data:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("watcher still running after Close()")
+	}
+	if err := fake.Set("gpiochip0", 17, false); err != ErrLineClosed {
+		t.Errorf("Set() error = %v, want line closed", err)
+	}
+}
+
+func TestNew_gpioConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		wantErr bool
+	}{
+		{name: "fake backend", options: map[string]interface{}{"line": 17, "backend": "fake", "activeLow": "true"}},
+		{name: "missing line", options: map[string]interface{}{"backend": "fake"}, wantErr: true},
+		{name: "invalid bias", options: map[string]interface{}{"line": 17, "bias": "sideways"}, wantErr: true},
+		{name: "invalid backend", options: map[string]interface{}{"line": 17, "backend": "spi"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(Config{Type: "contact", Name: "front_door", Options: tt.options})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
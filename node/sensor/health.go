@@ -0,0 +1,36 @@
+package sensor
+
+import "errors"
+
+// ErrSensorFailed is returned, possibly wrapped, by Ping when a sensor has failed and will not recover on its own
+var ErrSensorFailed = errors.New("sensor failed")
+
+// Health summarizes whether a sensor is producing good data
+type Health uint8
+
+const (
+	HealthUnknown Health = iota
+	HealthHealthy
+	HealthDegraded
+	HealthFailed
+)
+
+var healthNames = map[Health]string{
+	HealthUnknown:  "unknown",
+	HealthHealthy:  "healthy",
+	HealthDegraded: "degraded",
+	HealthFailed:   "failed",
+}
+
+func (h Health) String() string {
+	if n, ok := healthNames[h]; ok {
+		return n
+	}
+
+	return "invalid health"
+}
+
+// MarshalText lets health appear by name in JSON
+func (h Health) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
@@ -0,0 +1,117 @@
+package sensor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric describes a named series reported by a sensor type
+type Metric struct {
+	Name       string `json:"name"`
+	Unit       string `json:"unit"`
+	SensorType uint8  `json:"sensorType"`
+}
+
+// Measurement is a single value of a named metric
+type Measurement struct {
+	Metric string
+	Value  float64
+}
+
+// QualifyMetric names the series of metric reported by a sensor instance. The default instance of a type,
+// named after the type, reports plain metric names so that single sensor nodes keep their series.
+// Any other instance prefixes its metrics with its name, such as attic.temperature.
+func QualifyMetric(instance, typ, metric string) string {
+	if instance == "" || instance == typ {
+		return metric
+	}
+
+	return instance + "." + metric
+}
+
+// BaseMetric strips the instance prefix added by QualifyMetric
+func BaseMetric(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+
+	return name
+}
+
+// DecodeFunc turns the raw payload of a sensor type into measurements
+type DecodeFunc func(raw []byte) (time.Time, []Measurement, error)
+
+var (
+	registryLock sync.RWMutex
+	metrics      = make(map[string]Metric)
+	decoders     = make(map[uint8]DecodeFunc)
+)
+
+// RegisterMetric adds m to the metric registry, replacing any metric of the same name
+func RegisterMetric(m Metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	metrics[m.Name] = m
+}
+
+// MetricByName looks up a registered metric
+func MetricByName(name string) (Metric, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	m, ok := metrics[name]
+
+	return m, ok
+}
+
+// Metrics returns every registered metric, sorted by name
+func Metrics() []Metric {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	out := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
+// RegisterDecoder sets the decoder for raw payloads of sensor type typ
+func RegisterDecoder(typ uint8, fn DecodeFunc) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	decoders[typ] = fn
+}
+
+// Decode returns the measurements carried by d, with metric names qualified by the sending sensor instance.
+// Measurements sent directly by the node are used as-is, otherwise the raw payload is decoded by
+// the decoder registered for d.Typ.
+func (d Data) Decode() (time.Time, []Measurement, error) {
+	ts, ms := d.Timestamp, d.Measurements
+	if len(ms) == 0 {
+		registryLock.RLock()
+		fn, ok := decoders[d.Typ]
+		registryLock.RUnlock()
+		if !ok {
+			return time.Time{}, nil, fmt.Errorf("no decoder for sensor type %s", NameByType(int(d.Typ)))
+		}
+
+		var err error
+		if ts, ms, err = fn(d.Data); err != nil {
+			return time.Time{}, nil, err
+		}
+	}
+
+	typ := NameByType(int(d.Typ))
+	out := make([]Measurement, len(ms))
+	for i, m := range ms {
+		out[i] = Measurement{Metric: QualifyMetric(d.Sensor, typ, m.Metric), Value: m.Value}
+	}
+
+	return ts, out, nil
+}
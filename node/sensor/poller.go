@@ -0,0 +1,48 @@
+package sensor
+
+import (
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// readFunc takes one reading for a polled sensor, returning whatever could be read along with any errors
+type readFunc func() ([]Measurement, []error)
+
+// poll calls read immediately and then every interval until stop is closed, for sensors which are read
+// in process rather than by a driver. Readings are sent on the data channel, which is closed on stop,
+// and errors on the error channel, which drops errors if nobody is reading them.
+func poll(name string, typ uint8, interval time.Duration, stop chan struct{}, read readFunc) (chan Data, chan error) {
+	dataCh := make(chan Data)
+	errCh := make(chan error, errorBufferSize)
+
+	go func() {
+		defer close(dataCh)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			ms, errs := read()
+			for _, err := range errs {
+				select {
+				case errCh <- err:
+				default:
+					log.Warn().Err(err).Str("sensor", name).Msg("Sensor error buffer full, dropping error")
+				}
+			}
+			if len(ms) > 0 {
+				select {
+				case dataCh <- Data{Typ: typ, Timestamp: time.Now(), Measurements: ms}:
+				case <-stop:
+					return
+				}
+			}
+
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return dataCh, errCh
+}
@@ -0,0 +1,128 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cast"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config describes one sensor instance from the node config
+type Config struct {
+	// Type selects the factory which creates the sensor
+	Type string `mapstructure:"type"`
+	// Name identifies the instance, defaulting to Type. Names must be unique on a node.
+	Name             string `mapstructure:"name"`
+	PollIntervalSecs int    `mapstructure:"pollIntervalSecs"`
+	// Options holds type specific settings
+	Options map[string]interface{} `mapstructure:"options"`
+	// RestartPolicy applies to sensors backed by a process
+	RestartPolicy RestartPolicy `mapstructure:"-"`
+}
+
+// PollInterval returns the configured poll interval, or def if none is set
+func (c Config) PollInterval(def time.Duration) time.Duration {
+	if c.PollIntervalSecs <= 0 {
+		return def
+	}
+
+	return time.Duration(c.PollIntervalSecs) * time.Second
+}
+
+// String returns the string option key, or an error if it is missing or blank
+func (c Config) String(key string) (string, error) {
+	s := strings.TrimSpace(cast.ToString(c.Options[key]))
+	if s == "" {
+		return "", fmt.Errorf("sensor %s: missing option %q", c.Name, key)
+	}
+
+	return s, nil
+}
+
+// StringOr returns the string option key, or def if it is not set
+func (c Config) StringOr(key, def string) string {
+	if s, err := c.String(key); err == nil {
+		return s
+	}
+
+	return def
+}
+
+// Int returns the integer option key, or def if it is not set
+func (c Config) Int(key string, def int) (int, error) {
+	v, ok := c.Options[key]
+	if !ok {
+		return def, nil
+	}
+	i, err := cast.ToIntE(v)
+	if err != nil {
+		return 0, fmt.Errorf("sensor %s: option %q: %w", c.Name, key, err)
+	}
+
+	return i, nil
+}
+
+// Bool returns the boolean option key, or def if it is not set
+func (c Config) Bool(key string, def bool) (bool, error) {
+	v, ok := c.Options[key]
+	if !ok {
+		return def, nil
+	}
+	b, err := cast.ToBoolE(v)
+	if err != nil {
+		return false, fmt.Errorf("sensor %s: option %q: %w", c.Name, key, err)
+	}
+
+	return b, nil
+}
+
+// Factory creates an uninitialized sensor from its config
+type Factory func(cfg Config) (Sensor, error)
+
+var factories = make(map[string]Factory)
+
+// RegisterFactory makes sensors of type typ available to node config
+func RegisterFactory(typ string, f Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	factories[typ] = f
+}
+
+// Types returns the sensor types which can be configured, sorted by name
+func Types() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	out := make([]string, 0, len(factories))
+	for typ := range factories {
+		out = append(out, typ)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// New creates a sensor from cfg using the factory registered for its type.
+// The sensor still needs to be initialized with Init.
+func New(cfg Config) (Sensor, error) {
+	if cfg.Type == "" {
+		return nil, errors.New("sensor config is missing a type")
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.Type
+	}
+	// the leader splits qualified metric names such as attic.temperature at the last dot
+	if strings.Contains(cfg.Name, ".") {
+		return nil, fmt.Errorf("sensor %s: name cannot contain a dot", cfg.Name)
+	}
+
+	registryLock.RLock()
+	f, ok := factories[cfg.Type]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("sensor %s: unknown type %q, must be one of %s", cfg.Name, cfg.Type, strings.Join(Types(), ", "))
+	}
+
+	return f(cfg)
+}
@@ -0,0 +1,93 @@
+package sensor
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		wantName string
+		wantErr  string
+	}{
+		{
+			name:     "name defaults to type",
+			cfg:      Config{Type: "fake"},
+			wantName: "fake",
+		},
+		{
+			name:     "named instance",
+			cfg:      Config{Type: "atmospheric", Name: "attic", Options: map[string]interface{}{"executable": "driver.py"}},
+			wantName: "attic",
+		},
+		{
+			name:    "missing type",
+			cfg:     Config{Name: "attic"},
+			wantErr: "missing a type",
+		},
+		{
+			name:    "unknown type",
+			cfg:     Config{Type: "lidar"},
+			wantErr: `unknown type "lidar"`,
+		},
+		{
+			name:    "dot in name",
+			cfg:     Config{Type: "fake", Name: "attic.north"},
+			wantErr: "cannot contain a dot",
+		},
+		{
+			name:    "missing option",
+			cfg:     Config{Type: "atmospheric"},
+			wantErr: `missing option "executable"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sn, err := New(tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("New() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if sn.Name() != tt.wantName {
+				t.Errorf("Name() = %q, want %q", sn.Name(), tt.wantName)
+			}
+		})
+	}
+}
+
+func TestData_Decode_qualifiesNamedInstances(t *testing.T) {
+	ts := time.Unix(1660369274, 0)
+	ms := []Measurement{{Metric: MetricTemperature, Value: 21.5}}
+
+	tests := []struct {
+		sensor string
+		want   string
+	}{
+		{sensor: "", want: "temperature"},
+		{sensor: "atmospheric", want: "temperature"},
+		{sensor: "attic", want: "attic.temperature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sensor, func(t *testing.T) {
+			_, got, err := Data{Typ: TypeAtmospheric, Sensor: tt.sensor, Timestamp: ts, Measurements: ms}.Decode()
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint([]Measurement{{Metric: tt.want, Value: 21.5}}) {
+				t.Errorf("Decode() = %v, want metric %s", got, tt.want)
+			}
+			if base := BaseMetric(got[0].Metric); base != MetricTemperature {
+				t.Errorf("BaseMetric() = %q", base)
+			}
+		})
+	}
+}
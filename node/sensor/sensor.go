@@ -1,13 +1,25 @@
 package sensor
 
+import "time"
+
 const (
 	TypeFake = iota + 1
 	TypeAtmospheric
+	TypeExec
+	TypeDS18B20
+	TypeSystem
+	TypeMotion
+	TypeContact
 )
 
 var sensorByType = map[int]string{
 	TypeFake:        "fake",
 	TypeAtmospheric: "atmospheric",
+	TypeExec:        "exec",
+	TypeDS18B20:     "ds18b20",
+	TypeSystem:      "system",
+	TypeMotion:      "motion",
+	TypeContact:     "contact",
 }
 
 type Sensor interface {
@@ -15,8 +27,12 @@ type Sensor interface {
 	// If type is 0, it corresponds to a non-data message (ping, etc)
 	Type() uint8
 	TypeStr() string
+	// Name identifies this instance of the sensor on its node
+	Name() string
 	// Init starts or initializes the connection with the sensor
 	Init() error
+	// Ping checks the sensor is alive. A nil error means healthy, an error wrapping ErrSensorFailed means
+	// the sensor has failed for good, and any other error means it is degraded.
 	Ping() error
 	// Data returns error and data channels from the sensor.
 	// The channels do not have to be buffered
@@ -24,10 +40,17 @@ type Sensor interface {
 	Close()
 }
 
-// Data is the wire format for sensor readings
+// Data is the wire format for sensor readings.
+// Sensors either send a raw payload in Data, which the leader decodes by Typ,
+// or send already decoded Measurements taken at Timestamp.
 type Data struct {
 	Typ  uint8
 	Data []byte
+	// Sensor is the name of the sensor instance which took the reading
+	Sensor string
+
+	Timestamp    time.Time
+	Measurements []Measurement
 }
 
 // NameByType maps human readable names to sensor types
@@ -38,3 +61,66 @@ func NameByType(typ int) string {
 		return "invalid type"
 	}
 }
+
+// Status is the state of a single sensor, reported to the leader with each announce
+type Status struct {
+	Typ  uint8
+	Name string
+	// Restarts is the number of times a process backed sensor has been restarted
+	Restarts int
+
+	Health Health
+	// HealthReason explains why the sensor is not healthy
+	HealthReason string
+	LastDataAt   time.Time
+	// RecentErrors is the number of errors within the node's health error window
+	RecentErrors int
+	// Metrics declares the metrics of sensors whose schema comes from node config, so the leader can register them
+	Metrics []Metric
+}
+
+// NodeStatus is the payload of an announce packet
+type NodeStatus struct {
+	Sensors []Status
+}
+
+// ErrorReport is the payload of a sensor error packet, describing one error reported by a sensor on a node
+type ErrorReport struct {
+	Typ       uint8
+	Name      string
+	Timestamp time.Time
+	Message   string
+	// Restarted is set when the node restarted the sensor because it reported too many errors
+	Restarted bool
+}
+
+// Restarter is implemented by sensors which can be restarted without being reinitialized
+type Restarter interface {
+	Restart() error
+}
+
+// restartCounter is implemented by sensors backed by a supervised process
+type restartCounter interface {
+	Restarts() int
+}
+
+// metricDeclarer is implemented by sensors whose metrics are not known to the leader in advance
+type metricDeclarer interface {
+	DeclaredMetrics() []Metric
+}
+
+// StatusOf returns the current status of sn
+func StatusOf(sn Sensor) Status {
+	st := Status{
+		Typ:  sn.Type(),
+		Name: sn.Name(),
+	}
+	if rc, ok := sn.(restartCounter); ok {
+		st.Restarts = rc.Restarts()
+	}
+	if md, ok := sn.(metricDeclarer); ok {
+		st.Metrics = md.DeclaredMetrics()
+	}
+
+	return st
+}
@@ -0,0 +1,326 @@
+package sensor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrSensorExited is sent on the error channel when a sensor's process exits and its output ends
+	ErrSensorExited = errors.New("sensor process exited")
+	// ErrCrashLoop is sent on the error channel when a supervised process has exited too often, and will not be restarted
+	ErrCrashLoop = errors.New("sensor process is crash looping")
+)
+
+const (
+	// closeTimeout is how long Stop waits for the process to exit after SIGINT before killing it
+	closeTimeout = 5 * time.Second
+	// errorBufferSize is how many errors a supervisor holds for a slow consumer before dropping them
+	errorBufferSize = 16
+)
+
+// RestartPolicy controls how a Supervisor restarts a process which exits
+type RestartPolicy struct {
+	// InitialBackoff is the delay before the first restart, doubling on each consecutive restart up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// StableAfter is how long a process must run before its backoff is reset to InitialBackoff
+	StableAfter time.Duration
+	// MaxRestarts is the number of restarts allowed within CrashLoopWindow before giving up.
+	// Zero never restarts.
+	MaxRestarts     int
+	CrashLoopWindow time.Duration
+}
+
+// DefaultRestartPolicy is used for sensor processes unless the node config overrides it
+var DefaultRestartPolicy = RestartPolicy{
+	InitialBackoff:  time.Second,
+	MaxBackoff:      time.Minute,
+	StableAfter:     time.Minute,
+	MaxRestarts:     5,
+	CrashLoopWindow: 10 * time.Minute,
+}
+
+// Supervisor runs a sensor driver process, forwarding its stdout line by line and its stderr to the node log.
+// When the process exits it is restarted with exponential backoff, until it exits too often and is
+// considered to be crash looping.
+type Supervisor struct {
+	// Env is added to the environment of the process. It must be set before Start.
+	Env []string
+
+	name   string
+	args   []string
+	policy RestartPolicy
+
+	lines chan string
+	errs  chan error
+	// stop is closed by Stop, done is closed once the supervisor loop has exited
+	stop chan struct{}
+	done chan struct{}
+
+	lock     sync.Mutex
+	cmd      *exec.Cmd
+	stdout   io.Reader
+	stderr   io.Reader
+	running  bool
+	restarts int64
+}
+
+// NewSupervisor creates a supervisor for the command args. name identifies the process in logs.
+func NewSupervisor(name string, args []string, policy RestartPolicy) *Supervisor {
+	return &Supervisor{
+		name:   name,
+		args:   args,
+		policy: policy,
+		lines:  make(chan string),
+		errs:   make(chan error, errorBufferSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start starts the process, returning an error if it cannot be started at all.
+// Later failures are reported on Errors.
+func (s *Supervisor) Start() error {
+	if err := s.startProcess(); err != nil {
+		return err
+	}
+	go s.run()
+
+	return nil
+}
+
+// Lines returns stdout of the process, one line at a time without the trailing newline.
+// It is closed once the supervisor is stopped or gives up restarting.
+func (s *Supervisor) Lines() chan string {
+	return s.lines
+}
+
+// Errors reports each process exit as an ErrSensorExited, and ErrCrashLoop when the supervisor gives up.
+func (s *Supervisor) Errors() chan error {
+	return s.errs
+}
+
+// Done is closed once the supervisor has stopped for good
+func (s *Supervisor) Done() chan struct{} {
+	return s.done
+}
+
+// Stopped is closed as soon as Stop is called
+func (s *Supervisor) Stopped() chan struct{} {
+	return s.stop
+}
+
+// Restarts returns the number of times the process has been restarted
+func (s *Supervisor) Restarts() int {
+	return int(atomic.LoadInt64(&s.restarts))
+}
+
+// Running reports whether the process is currently alive
+func (s *Supervisor) Running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.running
+}
+
+// Restart terminates the running process so that it is restarted, subject to the usual backoff and crash loop limits.
+func (s *Supervisor) Restart() error {
+	if s.stopping() {
+		return errors.New("supervisor is stopped")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.running {
+		return errors.New("process is not running")
+	}
+	log.Info().Str("sensor", s.name).Msg("Restarting sensor process on request")
+
+	return s.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// Stop interrupts the process and stops restarting it, killing it if it does not exit within closeTimeout
+func (s *Supervisor) Stop() {
+	select {
+	case <-s.stop:
+		return
+	default:
+		close(s.stop)
+	}
+	s.signal(syscall.SIGINT)
+
+	select {
+	case <-s.done:
+	case <-time.After(closeTimeout):
+		log.Warn().Str("sensor", s.name).Msg("Sensor process did not exit, killing it")
+		s.signal(syscall.SIGKILL)
+		<-s.done
+	}
+}
+
+func (s *Supervisor) signal(sig syscall.Signal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running {
+		s.cmd.Process.Signal(sig)
+	}
+}
+
+func (s *Supervisor) startProcess() error {
+	log.Debug().Str("sensor", s.name).Strs("args", s.args).Msg("Starting sensor process")
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	if len(s.Env) > 0 {
+		cmd.Env = append(os.Environ(), s.Env...)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.cmd = cmd
+	s.stdout = stdout
+	s.stderr = stderr
+	s.running = true
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *Supervisor) run() {
+	defer close(s.done)
+	defer close(s.lines)
+
+	var (
+		backoff  = s.policy.InitialBackoff
+		restarts []time.Time
+		started  = time.Now()
+		exitErr  = s.drain()
+	)
+	for {
+		if s.stopping() {
+			return
+		}
+		s.report(exitErr)
+
+		now := time.Now()
+		if now.Sub(started) >= s.policy.StableAfter {
+			backoff = s.policy.InitialBackoff
+		}
+		restarts = within(restarts, now.Add(-s.policy.CrashLoopWindow))
+		if len(restarts) >= s.policy.MaxRestarts {
+			log.Error().Str("sensor", s.name).Int("restarts", len(restarts)).Msg("Sensor process is crash looping, giving up")
+			s.report(fmt.Errorf("%w: %d restarts within %s", ErrCrashLoop, len(restarts), s.policy.CrashLoopWindow))
+			return
+		}
+
+		log.Warn().Str("sensor", s.name).Dur("backoff", backoff).Msg("Restarting sensor process")
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			return
+		}
+		backoff *= 2
+		if backoff > s.policy.MaxBackoff {
+			backoff = s.policy.MaxBackoff
+		}
+
+		restarts = append(restarts, time.Now())
+		atomic.AddInt64(&s.restarts, 1)
+		started = time.Now()
+		if err := s.startProcess(); err != nil {
+			exitErr = fmt.Errorf("%w: failed to restart: %v", ErrSensorExited, err)
+			continue
+		}
+		exitErr = s.drain()
+	}
+}
+
+// drain forwards output of the current process until it ends, then reaps the process and returns why it exited
+func (s *Supervisor) drain() error {
+	s.lock.Lock()
+	cmd, stdout, stderr := s.cmd, s.stdout, s.stderr
+	s.lock.Unlock()
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Warn().Str("sensor", s.name).Str("stderr", scanner.Text()).Msg("Sensor process stderr")
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		select {
+		case s.lines <- scanner.Text():
+		case <-s.stop:
+			// keep reading so the process is not blocked writing while it shuts down
+		}
+	}
+	<-stderrDone
+
+	// output only ends once the process has exited or closed it, so the process can be reaped now
+	err := exitError(scanner.Err(), cmd.Wait())
+	s.lock.Lock()
+	s.running = false
+	s.lock.Unlock()
+
+	return err
+}
+
+// report sends err without blocking the supervisor if nobody is reading errors
+func (s *Supervisor) report(err error) {
+	select {
+	case s.errs <- err:
+	default:
+		log.Warn().Err(err).Str("sensor", s.name).Msg("Sensor error buffer full, dropping error")
+	}
+}
+
+func (s *Supervisor) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// exitError describes why a sensor process's output ended
+func exitError(readErr, waitErr error) error {
+	if readErr != nil {
+		return fmt.Errorf("%w: error reading output: %v", ErrSensorExited, readErr)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("%w: %v", ErrSensorExited, waitErr)
+	}
+
+	return fmt.Errorf("%w: exit status 0", ErrSensorExited)
+}
+
+// within drops times before cutoff
+func within(times []time.Time, cutoff time.Time) []time.Time {
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+
+	return times
+}
@@ -0,0 +1,203 @@
+package sensor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	line1 = "1660369274,25.2296875,43.159619678029735,1009.1293692371094,70.40053920398444,0"
+	line2 = "1660369289,25.5,43.2,1009.2,70.5,12"
+	line3 = "1660369304,25.7,43.3,1009.3,70.6,15"
+)
+
+// TestHelperProcess is not a real test. It is run as a fake sensor driver subprocess by other tests,
+// writing output described by FAKE_SENSOR_MODE.
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("FAKE_SENSOR_MODE")
+	if mode == "" {
+		return
+	}
+
+	write := func(s string) {
+		os.Stdout.WriteString(s)
+		os.Stdout.Sync()
+		time.Sleep(20 * time.Millisecond)
+	}
+	switch mode {
+	case "framing":
+		// one reading split across writes
+		write(line1[:20])
+		write(line1[20:] + "\n")
+		// two readings in one write, with debug output mixed in
+		write(line2 + "\nTemperature: 25.5 C\n" + line3 + "\n")
+		// a partial line at exit is still delivered
+		write(line1)
+		os.Exit(3)
+	case "forever":
+		for {
+			write(line1 + "\n")
+		}
+	case "exit-on-demand":
+		// exits once each time FAKE_SENSOR_EXIT_FILE is created
+		exitFile := os.Getenv("FAKE_SENSOR_EXIT_FILE")
+		os.Stderr.WriteString("fake sensor starting\n")
+		for {
+			if err := os.Remove(exitFile); err == nil {
+				os.Exit(2)
+			}
+			write(line1 + "\n")
+		}
+	case "jsonlines":
+		write("starting\n")
+		write(`{"timestamp": 1660369274, "values": {"co2": 415, "pm25": 3.5}}` + "\n")
+		write(`{"values": {"co2": "high"}}` + "\n")
+		write(`{"timestamp": "2022-08-13T05:41:29Z", "values": {"co2": 420}}` + "\n")
+		// the poll interval is passed in the environment
+		write(`{"values": {"pm25": ` + os.Getenv("QUILLSECURE_POLL_INTERVAL_SECS") + "}}\n")
+		os.Exit(0)
+	case "crash":
+		os.Stderr.WriteString("i2c bus error\n")
+		os.Exit(1)
+	}
+}
+
+// helperArgs returns a command line which runs TestHelperProcess in mode
+func helperArgs(t *testing.T, mode string) []string {
+	t.Helper()
+	t.Setenv("FAKE_SENSOR_MODE", mode)
+
+	return []string{os.Args[0], "-test.run=TestHelperProcess", "--"}
+}
+
+var testRestartPolicy = RestartPolicy{
+	InitialBackoff:  time.Millisecond,
+	MaxBackoff:      10 * time.Millisecond,
+	StableAfter:     time.Minute,
+	MaxRestarts:     2,
+	CrashLoopWindow: time.Minute,
+}
+
+func TestSupervisor_restartsOnExit(t *testing.T) {
+	exitFile := filepath.Join(t.TempDir(), "exit")
+	t.Setenv("FAKE_SENSOR_EXIT_FILE", exitFile)
+	s := NewSupervisor("test", helperArgs(t, "exit-on-demand"), testRestartPolicy)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	if line := <-s.Lines(); line != line1 {
+		t.Fatalf("first line = %q", line)
+	}
+	if err := os.WriteFile(exitFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-s.Errors():
+		if !errors.Is(err, ErrSensorExited) || !strings.Contains(err.Error(), "exit status 2") {
+			t.Errorf("error = %v, want ErrSensorExited with exit status 2", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for exit")
+	}
+
+	// the restarted process keeps producing lines
+	deadline := time.After(5 * time.Second)
+	for s.Restarts() != 1 {
+		select {
+		case <-s.Lines():
+		case <-deadline:
+			t.Fatalf("Restarts() = %d, want 1", s.Restarts())
+		}
+	}
+	if line := <-s.Lines(); line != line1 {
+		t.Errorf("line after restart = %q", line)
+	}
+	if !s.Running() {
+		t.Errorf("Running() = false after restart")
+	}
+}
+
+func TestSupervisor_Restart(t *testing.T) {
+	s := NewSupervisor("test", helperArgs(t, "forever"), testRestartPolicy)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	<-s.Lines()
+	if err := s.Restart(); err != nil {
+		t.Fatalf("Restart() error = %v", err)
+	}
+
+	select {
+	case err := <-s.Errors():
+		if !errors.Is(err, ErrSensorExited) {
+			t.Errorf("error = %v, want ErrSensorExited", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for exit")
+	}
+	deadline := time.After(5 * time.Second)
+	for s.Restarts() != 1 {
+		select {
+		case <-s.Lines():
+		case <-deadline:
+			t.Fatalf("Restarts() = %d, want 1", s.Restarts())
+		}
+	}
+}
+
+func TestSupervisor_crashLoop(t *testing.T) {
+	s := NewSupervisor("test", helperArgs(t, "crash"), testRestartPolicy)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	var errs []error
+	for err := range collect(t, s.Errors(), s.Done()) {
+		errs = append(errs, err)
+	}
+	// initial run plus two restarts, then giving up
+	if len(errs) != 4 {
+		t.Fatalf("got %d errors, want 4: %v", len(errs), errs)
+	}
+	for _, err := range errs[:3] {
+		if !errors.Is(err, ErrSensorExited) {
+			t.Errorf("error = %v, want ErrSensorExited", err)
+		}
+	}
+	if !errors.Is(errs[3], ErrCrashLoop) {
+		t.Errorf("last error = %v, want ErrCrashLoop", errs[3])
+	}
+	if s.Restarts() != 2 {
+		t.Errorf("Restarts() = %d, want 2", s.Restarts())
+	}
+	if _, more := <-s.Lines(); more {
+		t.Errorf("Lines() not closed after giving up")
+	}
+}
+
+// collect returns every error sent before done is closed
+func collect(t *testing.T, errs chan error, done chan struct{}) chan error {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for supervisor to give up")
+	}
+
+	out := make(chan error, len(errs))
+	for len(errs) > 0 {
+		out <- <-errs
+	}
+	close(out)
+
+	return out
+}
@@ -0,0 +1,353 @@
+package sensor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	MetricLoad1             = "load1"
+	MetricLoad5             = "load5"
+	MetricLoad15            = "load15"
+	MetricMemoryTotal       = "memory_total"
+	MetricMemoryAvailable   = "memory_available"
+	MetricMemoryUsedPercent = "memory_used_percent"
+	MetricDiskFree          = "disk_free"
+	MetricDiskUsedPercent   = "disk_used_percent"
+	// MetricThrottled is the Raspberry Pi firmware's throttling bitmask, as printed by vcgencmd get_throttled
+	MetricThrottled = "throttled"
+
+	defaultSystemPollInterval = 30 * time.Second
+	// throttledPath is where Raspberry Pi firmware exposes throttling state on recent kernels
+	throttledPath = "sys/devices/platform/soc/soc:firmware/get_throttled"
+)
+
+func init() {
+	RegisterMetric(Metric{Name: MetricLoad1, Unit: "", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricLoad5, Unit: "", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricLoad15, Unit: "", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricMemoryTotal, Unit: "B", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricMemoryAvailable, Unit: "B", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricMemoryUsedPercent, Unit: "%", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricDiskFree, Unit: "B", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricDiskUsedPercent, Unit: "%", SensorType: TypeSystem})
+	RegisterMetric(Metric{Name: MetricThrottled, Unit: "", SensorType: TypeSystem})
+	RegisterFactory(NameByType(TypeSystem), newSystemFromConfig)
+}
+
+// SystemSensor reports the health of the node itself: thermal zone and hwmon temperatures, firmware throttling,
+// load average, memory and filesystem usage. Temperatures are named <zone or chip>.temperature and filesystem
+// metrics <mount>.disk_free, with / named root.
+type SystemSensor struct {
+	name string
+	// root is prefixed to every path read, which tests replace with a fixture directory
+	root         string
+	pollInterval time.Duration
+	filesystems  []string
+
+	stop chan struct{}
+}
+
+// newSystemFromConfig is the Factory for system sensors. The root option overrides /, and the filesystems
+// option is a comma separated list of mount points, defaulting to /.
+func newSystemFromConfig(cfg Config) (Sensor, error) {
+	var filesystems []string
+	for _, fs := range strings.Split(cfg.StringOr("filesystems", "/"), ",") {
+		if fs = strings.TrimSpace(fs); fs != "" {
+			filesystems = append(filesystems, fs)
+		}
+	}
+
+	return NewSystem(cfg.Name, cfg.StringOr("root", "/"), cfg.PollInterval(defaultSystemPollInterval), filesystems), nil
+}
+
+func NewSystem(name, root string, pollInterval time.Duration, filesystems []string) *SystemSensor {
+	return &SystemSensor{
+		name:         name,
+		root:         root,
+		pollInterval: pollInterval,
+		filesystems:  filesystems,
+		stop:         make(chan struct{}),
+	}
+}
+
+func (s *SystemSensor) Type() uint8 {
+	return TypeSystem
+}
+
+func (s *SystemSensor) TypeStr() string {
+	return NameByType(int(s.Type()))
+}
+
+func (s *SystemSensor) Name() string {
+	return s.name
+}
+
+func (s *SystemSensor) path(p string) string {
+	return filepath.Join(s.root, p)
+}
+
+// Init checks procfs is readable
+func (s *SystemSensor) Init() error {
+	if _, err := os.Stat(s.path("proc/loadavg")); err != nil {
+		return fmt.Errorf("sensor %s: %w", s.name, err)
+	}
+
+	return nil
+}
+
+func (s *SystemSensor) Ping() error {
+	if _, err := os.Stat(s.path("proc/loadavg")); err != nil {
+		return fmt.Errorf("%w: %v", ErrSensorFailed, err)
+	}
+
+	return nil
+}
+
+// Data reads every source each poll interval. Sources which cannot be read are reported on the error channel
+// without holding back the rest. Thermal zones, hwmon chips and throttling are optional, and skipped if absent.
+func (s *SystemSensor) Data() (chan Data, chan error) {
+	return poll(s.name, s.Type(), s.pollInterval, s.stop, s.read)
+}
+
+func (s *SystemSensor) read() ([]Measurement, []error) {
+	var (
+		ms   []Measurement
+		errs []error
+	)
+	for _, read := range []func() ([]Measurement, error){
+		s.readThermalZones,
+		s.readHwmon,
+		s.readThrottled,
+		s.readLoadAvg,
+		s.readMemInfo,
+		s.readFilesystems,
+	} {
+		m, err := read()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		ms = append(ms, m...)
+	}
+
+	return ms, errs
+}
+
+// readThermalZones reads /sys/class/thermal/thermal_zone*/temp, named by each zone's type
+func (s *SystemSensor) readThermalZones() ([]Measurement, error) {
+	zones, err := filepath.Glob(s.path("sys/class/thermal/thermal_zone*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []Measurement
+	for _, zone := range zones {
+		name := readTrimmed(filepath.Join(zone, "type"))
+		if name == "" {
+			name = filepath.Base(zone)
+		}
+		c, err := readMilli(filepath.Join(zone, "temp"))
+		if err != nil {
+			return ms, fmt.Errorf("thermal zone %s: %w", name, err)
+		}
+		ms = append(ms, Measurement{Metric: metricPrefix(name) + "." + MetricTemperature, Value: c})
+	}
+
+	return ms, nil
+}
+
+// readHwmon reads every temp*_input of /sys/class/hwmon/hwmon*, named by chip and sensor label
+func (s *SystemSensor) readHwmon() ([]Measurement, error) {
+	chips, err := filepath.Glob(s.path("sys/class/hwmon/hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []Measurement
+	for _, chip := range chips {
+		chipName := readTrimmed(filepath.Join(chip, "name"))
+		if chipName == "" {
+			chipName = filepath.Base(chip)
+		}
+		inputs, err := filepath.Glob(filepath.Join(chip, "temp*_input"))
+		if err != nil {
+			return ms, err
+		}
+		for _, input := range inputs {
+			sensorName := strings.TrimSuffix(filepath.Base(input), "_input")
+			if label := readTrimmed(strings.TrimSuffix(input, "_input") + "_label"); label != "" {
+				sensorName = label
+			}
+			c, err := readMilli(input)
+			if err != nil {
+				return ms, fmt.Errorf("hwmon %s: %w", chipName, err)
+			}
+			ms = append(ms, Measurement{Metric: metricPrefix(chipName+"_"+sensorName) + "." + MetricTemperature, Value: c})
+		}
+	}
+
+	return ms, nil
+}
+
+// readThrottled reads the firmware throttling bitmask, which only Raspberry Pis have
+func (s *SystemSensor) readThrottled() ([]Measurement, error) {
+	b, err := os.ReadFile(s.path(throttledPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(b)), "0x"), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("throttled: %w", err)
+	}
+
+	return []Measurement{{Metric: MetricThrottled, Value: float64(v)}}, nil
+}
+
+// readLoadAvg reads the 1, 5 and 15 minute load averages from /proc/loadavg
+func (s *SystemSensor) readLoadAvg() ([]Measurement, error) {
+	b, err := os.ReadFile(s.path("proc/loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected loadavg %q", string(b))
+	}
+
+	ms := make([]Measurement, 3)
+	for i, metric := range []string{MetricLoad1, MetricLoad5, MetricLoad15} {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("loadavg: %w", err)
+		}
+		ms[i] = Measurement{Metric: metric, Value: v}
+	}
+
+	return ms, nil
+}
+
+// readMemInfo reads total and available memory from /proc/meminfo
+func (s *SystemSensor) readMemInfo() ([]Measurement, error) {
+	f, err := os.Open(s.path("proc/meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kb := make(map[string]float64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:        3885396 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			kb[strings.TrimSuffix(fields[0], ":")] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	total, available := kb["MemTotal"], kb["MemAvailable"]
+	if total == 0 {
+		return nil, errors.New("meminfo has no MemTotal")
+	}
+
+	return []Measurement{
+		{Metric: MetricMemoryTotal, Value: total * 1024},
+		{Metric: MetricMemoryAvailable, Value: available * 1024},
+		{Metric: MetricMemoryUsedPercent, Value: round2((total - available) / total * 100)},
+	}, nil
+}
+
+// readFilesystems reports free space and usage of each configured mount point
+func (s *SystemSensor) readFilesystems() ([]Measurement, error) {
+	var ms []Measurement
+	for _, mount := range s.filesystems {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(s.path(mount), &st); err != nil {
+			return ms, fmt.Errorf("filesystem %s: %w", mount, err)
+		}
+		// used percent is as df reports it, of the space available to unprivileged users
+		free := float64(st.Bavail) * float64(st.Bsize)
+		used := float64(st.Blocks-st.Bfree) * float64(st.Bsize)
+		usedPercent := 0.0
+		if used+free > 0 {
+			usedPercent = round2(used / (used + free) * 100)
+		}
+
+		prefix := mountName(mount)
+		ms = append(ms,
+			Measurement{Metric: prefix + "." + MetricDiskFree, Value: free},
+			Measurement{Metric: prefix + "." + MetricDiskUsedPercent, Value: usedPercent},
+		)
+	}
+
+	return ms, nil
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// metricPrefix makes a zone or chip name safe to use as a metric prefix
+func metricPrefix(name string) string {
+	return strings.Trim(invalidMetricChars.ReplaceAllString(name, "_"), "_")
+}
+
+// mountName names the metrics of a mount point, / as root and /mnt/data as mnt_data
+func mountName(mount string) string {
+	if p := metricPrefix(mount); p != "" {
+		return p
+	}
+
+	return "root"
+}
+
+// readMilli reads a sysfs file holding thousandths of a unit
+func readMilli(path string) (float64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(v) / 1000, nil
+}
+
+// readTrimmed returns the trimmed contents of a sysfs file, or blank if it cannot be read
+func readTrimmed(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+func round2(v float64) float64 {
+	return float64(int64(v*100+0.5)) / 100
+}
+
+func (s *SystemSensor) Close() {
+	log.Info().Str("name", s.name).Msg("close system sensor")
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
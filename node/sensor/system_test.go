@@ -0,0 +1,119 @@
+package sensor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFixture writes each file under root, creating directories as needed
+func writeFixture(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSystemSensor_read(t *testing.T) {
+	root := t.TempDir()
+	writeFixture(t, root, map[string]string{
+		"proc/loadavg":                                        "0.52 0.58 0.59 1/391 12345\n",
+		"proc/meminfo":                                        "MemTotal:        4000000 kB\nMemFree:          500000 kB\nMemAvailable:    1000000 kB\n",
+		"sys/class/thermal/thermal_zone0/type":                "cpu-thermal\n",
+		"sys/class/thermal/thermal_zone0/temp":                "48686\n",
+		"sys/class/hwmon/hwmon0/name":                         "rpi_volt\n",
+		"sys/class/hwmon/hwmon1/name":                         "nvme\n",
+		"sys/class/hwmon/hwmon1/temp1_input":                  "35850\n",
+		"sys/class/hwmon/hwmon1/temp1_label":                  "Composite\n",
+		"sys/class/hwmon/hwmon1/temp2_input":                  "-1500\n",
+		"sys/devices/platform/soc/soc:firmware/get_throttled": "0x50005\n",
+	})
+
+	s := NewSystem("system", root, time.Hour, []string{"/"})
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	ms, errs := s.read()
+	if len(errs) > 0 {
+		t.Fatalf("read() errors = %v", errs)
+	}
+
+	got := make(map[string]float64)
+	for _, m := range ms {
+		got[m.Metric] = m.Value
+	}
+	want := map[string]float64{
+		"cpu-thermal.temperature":    48.686,
+		"nvme_Composite.temperature": 35.85,
+		"nvme_temp2.temperature":     -1.5,
+		MetricThrottled:              0x50005,
+		MetricLoad1:                  0.52,
+		MetricLoad5:                  0.58,
+		MetricLoad15:                 0.59,
+		MetricMemoryTotal:            4000000 * 1024,
+		MetricMemoryAvailable:        1000000 * 1024,
+		MetricMemoryUsedPercent:      75,
+	}
+	for metric, v := range want {
+		if got[metric] != v {
+			t.Errorf("%s = %v, want %v", metric, got[metric], v)
+		}
+	}
+	if used, ok := got["root.disk_used_percent"]; !ok || used < 0 || used > 100 {
+		t.Errorf("root.disk_used_percent = %v, %v", used, ok)
+	}
+	if _, ok := got["root.disk_free"]; !ok {
+		t.Errorf("root.disk_free missing")
+	}
+	if len(got) != len(want)+2 {
+		t.Errorf("got %d metrics, want %d: %v", len(got), len(want)+2, got)
+	}
+}
+
+func TestSystemSensor_read_partialFailure(t *testing.T) {
+	root := t.TempDir()
+	writeFixture(t, root, map[string]string{
+		"proc/loadavg":                         "0.52 0.58 0.59 1/391 12345\n",
+		"proc/meminfo":                         "MemFree: 500000 kB\n",
+		"sys/class/thermal/thermal_zone0/type": "cpu-thermal\n",
+		"sys/class/thermal/thermal_zone0/temp": "garbage\n",
+	})
+
+	s := NewSystem("system", root, time.Hour, []string{"/missing"})
+	ms, errs := s.read()
+	if len(errs) != 3 {
+		t.Errorf("read() errors = %v, want thermal, meminfo and filesystem errors", errs)
+	}
+	for _, want := range []string{"thermal zone cpu-thermal", "MemTotal", "filesystem /missing"} {
+		if !strings.Contains(fmt.Sprint(errs), want) {
+			t.Errorf("read() errors = %v, missing %q", errs, want)
+		}
+	}
+	// load average is still reported
+	if len(ms) != 3 {
+		t.Errorf("read() = %v, want load averages", ms)
+	}
+}
+
+func TestMountName(t *testing.T) {
+	tests := map[string]string{
+		"/":          "root",
+		"/mnt/data":  "mnt_data",
+		"/boot/":     "boot",
+		"/media/usb": "media_usb",
+	}
+	for mount, want := range tests {
+		if got := mountName(mount); got != want {
+			t.Errorf("mountName(%q) = %q, want %q", mount, got, want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+# Example sensor for the node's exec sensor type.
+# Prints one JSON object per reading. Every metric in values must be declared in the node config.
+import json
+import os
+import random
+import sys
+import time
+
+poll_interval = int(os.environ.get("QUILLSECURE_POLL_INTERVAL_SECS", "15"))
+
+while True:
+    reading = {
+        "timestamp": int(time.time()),
+        "values": {
+            "co2": 400 + random.randint(0, 50),
+        },
+    }
+    # anything not starting with { is ignored, so debug output can go to stdout or stderr
+    sys.stdout.write(json.dumps(reading) + "\n")
+    sys.stdout.flush()
+    time.sleep(poll_interval)
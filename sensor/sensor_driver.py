@@ -18,7 +18,8 @@ class SensorDriver:
         self.poll_freq = poll_freq
         self.debug_print = debug_print
 
-        # change this to match the location's pressure (hPa) at sea level
+        # the leader recomputes altitude from pressure against its own reference, see atmosphere in
+        # quillsecure_leader.yaml, so this only affects the altitude printed while debugging
         self.bme280.sea_level_pressure = 1017.60  # Arlington, VA
 
     def poll(self):
@@ -44,9 +45,8 @@ class SensorDriver:
 
             ts = int(time.time())
             if do_print:
-                sys.stdout.write(f"{ts},{temperature},{relative_humidity},{pressure},{altitude},{voc_index}")
+                sys.stdout.write(f"{ts},{temperature},{relative_humidity},{pressure},{altitude},{voc_index}\n")
                 sys.stdout.flush()
-                print()
             print_count += 1
             time.sleep(1)
 